@@ -28,8 +28,8 @@ func main() {
 
 Where command is one of:
 
-	gen
-		- generate a new key pair
+	gen [ecdsa|ed25519]
+		- generate a new key pair, ECDSA unless specified
 
 	sign <privkeyfile> <datafile>
 		- sign a file
@@ -44,7 +44,7 @@ Where command is one of:
 
 	switch flag.Arg(0) {
 	case "gen":
-		gen()
+		gen(flag.Arg(1))
 	case "sign":
 		sign(flag.Arg(1), flag.Arg(2))
 	case "verify":
@@ -56,8 +56,17 @@ Where command is one of:
 	}
 }
 
-func gen() {
-	priv, pub, err := signature.GenerateKeys()
+func gen(keyType string) {
+	var priv, pub []byte
+	var err error
+	switch keyType {
+	case "", "ecdsa":
+		priv, pub, err = signature.GenerateKeys()
+	case "ed25519":
+		priv, pub, err = signature.GenerateEd25519Keys()
+	default:
+		log.Fatalf("unknown key type %q", keyType)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,130 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/osutil"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/tlsutil"
+)
+
+var errAlreadyRotated = errors.New("the certificate has already been replaced; restart to start using it")
+
+// rotateCertificate replaces the certificate and key of the device with
+// newly generated ones, keeping the old ones with an ".old" suffix. The
+// transition from the old device ID to the new one is signed with the old
+// key, saved to transitionFile and returned. The new key is of the same
+// type as the old one, and the new certificate is used from the next start.
+// The old key also certifies the new one in an extension of the new
+// certificate, so that peers accept connections with it even before they
+// have seen the transition.
+func rotateCertificate(id protocol.DeviceID, certFile, keyFile, transitionFile string) (protocol.DeviceIDTransition, error) {
+	oldCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return protocol.DeviceIDTransition{}, err
+	}
+	if protocol.NewDeviceID(oldCert.Certificate[0]) != id {
+		return protocol.DeviceIDTransition{}, errAlreadyRotated
+	}
+
+	keyType := tlsutil.KeyType(oldCert.PrivateKey)
+	if keyType == "" {
+		keyType = bepKeyType
+	}
+	newCert, err := tlsutil.NewCertificateWithExtensions(certFile+".new", keyFile+".new", tlsDefaultCommonName, keyType, func(pub crypto.PublicKey) ([]pkix.Extension, error) {
+		ext, err := protocol.CertificateTransitionExtension(oldCert, pub)
+		return []pkix.Extension{ext}, err
+	})
+	if err != nil {
+		return protocol.DeviceIDTransition{}, err
+	}
+	defer os.Remove(certFile + ".new")
+	defer os.Remove(keyFile + ".new")
+
+	t, err := protocol.NewDeviceIDTransition(oldCert, newCert)
+	if err != nil {
+		return protocol.DeviceIDTransition{}, err
+	}
+	if err := saveDeviceIDTransition(transitionFile, t); err != nil {
+		return protocol.DeviceIDTransition{}, err
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := osutil.Rename(file, file+".old"); err != nil {
+			return protocol.DeviceIDTransition{}, err
+		}
+		if err := osutil.Rename(file+".new", file); err != nil {
+			return protocol.DeviceIDTransition{}, err
+		}
+	}
+
+	return t, nil
+}
+
+func saveDeviceIDTransition(path string, t protocol.DeviceIDTransition) error {
+	fd, err := osutil.CreateAtomic(path, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write([]byte(t.String() + "\n")); err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+func loadDeviceIDTransition(path string) (protocol.DeviceIDTransition, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return protocol.DeviceIDTransition{}, err
+	}
+	return protocol.ParseDeviceIDTransition(strings.TrimSpace(string(bs)))
+}
+
+// applyDeviceIDTransition checks for a device ID transition left by a
+// certificate rotation. If we are now running with the new certificate, our
+// own configuration is moved over to the new device ID. In either case the
+// transition is returned so that it may be announced to peers; it carries
+// the old certificate, so peers that were offline during the rotation can
+// still verify it after the restart. The transition file is kept until the
+// next rotation replaces it.
+func applyDeviceIDTransition(cfg *config.Wrapper, path string) (protocol.DeviceIDTransition, bool) {
+	t, err := loadDeviceIDTransition(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			l.Warnln("Loading device ID transition:", err)
+		}
+		return protocol.DeviceIDTransition{}, false
+	}
+
+	switch myID {
+	case t.To:
+		if _, ok := cfg.ReplaceDeviceID(t.From, t.To); ok {
+			l.Infof("Device ID changed from %v to %v", t.From, t.To)
+			if err := cfg.Save(); err != nil {
+				l.Warnln("Saving config:", err)
+			}
+		}
+		return t, true
+
+	case t.From:
+		return t, true
+
+	default:
+		l.Infoln("Removing device ID transition for unrelated device", t.From)
+		os.Remove(path)
+		return protocol.DeviceIDTransition{}, false
+	}
+}
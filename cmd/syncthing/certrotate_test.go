@@ -0,0 +1,100 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/tlsutil"
+)
+
+func TestRotateCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	transitionFile := filepath.Join(dir, "device-id-transition.txt")
+
+	oldCert, err := tlsutil.NewCertificateWithKeyType(certFile, keyFile, tlsDefaultCommonName, tlsutil.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID := protocol.NewDeviceID(oldCert.Certificate[0])
+
+	tr, err := rotateCertificate(oldID, certFile, keyFile, transitionFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotateCertificate(oldID, certFile, keyFile, transitionFile); err != errAlreadyRotated {
+		t.Errorf("Unexpected error for a second rotation: %v", err)
+	}
+
+	// The new certificate is in place, the old one is kept, and the
+	// transition between them verifies against the old certificate.
+
+	newCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID := protocol.NewDeviceID(newCert.Certificate[0])
+	if kt := tlsutil.KeyType(newCert.PrivateKey); kt != tlsutil.KeyTypeEd25519 {
+		t.Errorf("New key should be of the same type, not %q", kt)
+	}
+	if tr.From != oldID || tr.To != newID {
+		t.Errorf("Incorrect transition %v -> %v", tr.From, tr.To)
+	}
+	if _, err := tls.LoadX509KeyPair(certFile+".old", keyFile+".old"); err != nil {
+		t.Error("Old certificate not kept:", err)
+	}
+	if err := tr.Verify(); err != nil {
+		t.Error("Transition does not verify:", err)
+	}
+	newX509, err := x509.ParseCertificate(newCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from, ok, err := protocol.CertificateTransitionFrom(newX509); !ok || err != nil || from != oldID {
+		t.Errorf("New certificate not certified by the old key: %v %v %v", from, ok, err)
+	}
+
+	// On the next start, our own configuration moves to the new device ID
+	// and the transition is still announced, for the peers that haven't
+	// seen it yet.
+
+	defer func(id protocol.DeviceID) { myID = id }(myID)
+	myID = newID
+
+	raw := config.New(oldID)
+	raw.Folders = []config.FolderConfiguration{
+		{ID: "default", Devices: []config.FolderDeviceConfiguration{{DeviceID: oldID}}},
+	}
+	cfg := config.Wrap(filepath.Join(dir, "config.xml"), raw)
+
+	if announced, announce := applyDeviceIDTransition(cfg, transitionFile); !announce || announced.String() != tr.String() {
+		t.Error("Transition should still be announced with the new certificate")
+	}
+	if _, ok := cfg.Devices()[newID]; !ok {
+		t.Error("Own device not moved to the new device ID")
+	}
+	if devs := cfg.Folders()["default"].Devices; len(devs) != 1 || devs[0].DeviceID != newID {
+		t.Errorf("Incorrect folder devices %v", devs)
+	}
+	if _, err := os.Stat(transitionFile); err != nil {
+		t.Error("Transition file should have been kept:", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/osutil"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/scanner"
+	"github.com/syncthing/syncthing/lib/symlinks"
+)
+
+// exportDB writes the contents of the database to the given file, or to
+// stdout if the file name is "-".
+func exportDB(file string) error {
+	ldb, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer ldb.Close()
+
+	out := os.Stdout
+	if file != "-" {
+		out, err = os.Create(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(out)
+	if err := ldb.Export(bw); err != nil {
+		out.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	if file != "-" {
+		if err := out.Close(); err != nil {
+			return err
+		}
+		l.Infoln("Exported database to", file)
+	}
+	return nil
+}
+
+// importDB reads a database export from the given file, or from stdin if
+// the file name is "-". Only folders present in the configuration are
+// imported, and only local files that are unchanged on disk.
+func importDB(file string) error {
+	cert, err := tls.LoadX509KeyPair(locations[locCertFile], locations[locKeyFile])
+	if err != nil {
+		return fmt.Errorf("load certificate: %v", err)
+	}
+	myID = protocol.NewDeviceID(cert.Certificate[0])
+
+	cfg, err := config.Load(locations[locConfigFile], myID)
+	if err != nil {
+		return fmt.Errorf("load config: %v", err)
+	}
+
+	in := os.Stdin
+	if file != "-" {
+		in, err = os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	ldb, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer ldb.Close()
+
+	res, err := ldb.Import(bufio.NewReader(in), importVerifier{cfg.Folders()})
+	if err != nil {
+		return err
+	}
+
+	l.Infof("Imported %d files and %d other values for folders %s", res.Files, res.Values, strings.Join(res.Folders, ", "))
+	if res.Rejected > 0 {
+		l.Infof("%d files have changed on disk and will be rescanned", res.Rejected)
+	}
+	if len(res.Skipped) > 0 {
+		l.Warnf("Folders not imported: %s", strings.Join(res.Skipped, ", "))
+	}
+	return nil
+}
+
+// An importVerifier only trusts folders that are configured and exist, and
+// files that are on disk exactly as in the imported index.
+type importVerifier struct {
+	folders map[string]config.FolderConfiguration
+}
+
+func (v importVerifier) VerifyFolder(folder string) error {
+	cfg, ok := v.folders[folder]
+	if !ok {
+		return errors.New("folder is not configured")
+	}
+	if info, err := os.Stat(cfg.Path()); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return errors.New("folder path is not a directory")
+	}
+	return nil
+}
+
+func (v importVerifier) VerifyFile(folder string, f protocol.FileInfo) bool {
+	path := filepath.Join(v.folders[folder].Path(), osutil.NativeFilename(f.Name))
+	info, err := osutil.Lstat(path)
+
+	switch {
+	case f.IsDeleted():
+		return os.IsNotExist(err)
+	case err != nil:
+		return false
+	case f.IsDirectory():
+		return info.IsDir()
+	case f.IsSymlink():
+		target, _, err := symlinks.Read(path)
+		if err != nil {
+			return false
+		}
+		return scanner.Verify(strings.NewReader(target), protocol.BlockSize, f.Blocks) == nil
+	}
+
+	if !info.Mode().IsRegular() || info.Size() != f.Size() {
+		return false
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	return scanner.Verify(fd, protocol.BlockSize, f.Blocks) == nil
+}
@@ -31,6 +31,7 @@ import (
 	"github.com/syncthing/syncthing/lib/db"
 	"github.com/syncthing/syncthing/lib/discover"
 	"github.com/syncthing/syncthing/lib/events"
+	"github.com/syncthing/syncthing/lib/ignore"
 	"github.com/syncthing/syncthing/lib/logger"
 	"github.com/syncthing/syncthing/lib/model"
 	"github.com/syncthing/syncthing/lib/osutil"
@@ -58,13 +59,17 @@ type apiService struct {
 	themes             []string
 	model              modelIntf
 	eventSub           events.BufferedSubscription
+	maskedEventSubs    map[events.EventType]events.BufferedSubscription // created on demand, at most maxMaskedEventSubs
+	maskedEventSubsMut sync.Mutex
 	discoverer         discover.CachingMux
 	connectionsService connectionsIntf
+	webhooks           webhooksIntf
 	fss                *folderSummaryService
-	systemConfigMut    sync.Mutex    // serializes posts to /rest/system/config
-	stop               chan struct{} // signals intentional stop
-	configChanged      chan struct{} // signals intentional listener close due to config change
-	started            chan struct{} // signals startup complete, for testing only
+	systemConfigMut    sync.Mutex        // serializes configuration changes over the REST API
+	totpPending        map[string]string // GUI account -> secret awaiting confirmation, protected by systemConfigMut
+	stop               chan struct{}     // signals intentional stop
+	configChanged      chan struct{}     // signals intentional listener close due to config change
+	started            chan struct{}     // signals startup complete, for testing only
 
 	listener    net.Listener
 	listenerMut sync.Mutex
@@ -82,11 +87,17 @@ type modelIntf interface {
 	ConnectionStats() map[string]interface{}
 	DeviceStatistics() map[string]stats.DeviceStatistics
 	FolderStatistics() map[string]stats.FolderStatistics
+	StatisticsHistory(device, folder string, from, to time.Time) stats.HistoryResult
 	CurrentFolderFile(folder string, file string) (protocol.FileInfo, bool)
 	CurrentGlobalFile(folder string, file string) (protocol.FileInfo, bool)
 	ResetFolder(folder string)
 	Availability(folder, file string, version protocol.Vector, block protocol.BlockInfo) []model.Availability
 	GetIgnores(folder string) ([]string, []string, error)
+	IgnoreLines(folder string) ([]ignore.Line, error)
+	ExplainIgnore(folder, file string) (model.IgnoreExplanation, error)
+	IgnoreDryRun(folder string, content []string) ([]string, []ignore.Line, error)
+	FetchFile(folder, file string) error
+	CheckDatabase(folder string) (db.CheckResult, error)
 	SetIgnores(folder string, content []string) error
 	PauseDevice(device protocol.DeviceID)
 	ResumeDevice(device protocol.DeviceID)
@@ -117,9 +128,14 @@ type configIntf interface {
 
 type connectionsIntf interface {
 	Status() map[string]interface{}
+	RateLimits() (send, recv int)
 }
 
-func newAPIService(id protocol.DeviceID, cfg configIntf, httpsCertFile, httpsKeyFile, assetDir string, m modelIntf, eventSub events.BufferedSubscription, discoverer discover.CachingMux, connectionsService connectionsIntf, errors, systemLog logger.Recorder) (*apiService, error) {
+type webhooksIntf interface {
+	Test(id string) error
+}
+
+func newAPIService(id protocol.DeviceID, cfg configIntf, httpsCertFile, httpsKeyFile, assetDir string, m modelIntf, eventSub events.BufferedSubscription, discoverer discover.CachingMux, connectionsService connectionsIntf, webhooks webhooksIntf, errors, systemLog logger.Recorder) (*apiService, error) {
 	service := &apiService{
 		id:                 id,
 		cfg:                cfg,
@@ -128,9 +144,13 @@ func newAPIService(id protocol.DeviceID, cfg configIntf, httpsCertFile, httpsKey
 		assetDir:           assetDir,
 		model:              m,
 		eventSub:           eventSub,
+		maskedEventSubs:    make(map[events.EventType]events.BufferedSubscription),
+		maskedEventSubsMut: sync.NewMutex(),
 		discoverer:         discoverer,
 		connectionsService: connectionsService,
+		webhooks:           webhooks,
 		systemConfigMut:    sync.NewMutex(),
+		totpPending:        make(map[string]string),
 		stop:               make(chan struct{}),
 		configChanged:      make(chan struct{}),
 		listenerMut:        sync.NewMutex(),
@@ -241,12 +261,15 @@ func (s *apiService) Serve() {
 	getRestMux.HandleFunc("/rest/db/completion", s.getDBCompletion)              // device folder
 	getRestMux.HandleFunc("/rest/db/file", s.getDBFile)                          // folder file
 	getRestMux.HandleFunc("/rest/db/ignores", s.getDBIgnores)                    // folder
+	getRestMux.HandleFunc("/rest/db/ignores/test", s.getDBIgnoresTest)           // folder file
 	getRestMux.HandleFunc("/rest/db/need", s.getDBNeed)                          // folder [perpage] [page]
 	getRestMux.HandleFunc("/rest/db/status", s.getDBStatus)                      // folder
 	getRestMux.HandleFunc("/rest/db/browse", s.getDBBrowse)                      // folder [prefix] [dirsonly] [levels]
-	getRestMux.HandleFunc("/rest/events", s.getEvents)                           // since [limit]
+	getRestMux.HandleFunc("/rest/events", s.getEvents)                           // since [limit] [events]
+	getRestMux.HandleFunc("/rest/events/stream", s.getEventStream)               // since [events]
 	getRestMux.HandleFunc("/rest/stats/device", s.getDeviceStats)                // -
 	getRestMux.HandleFunc("/rest/stats/folder", s.getFolderStats)                // -
+	getRestMux.HandleFunc("/rest/stats/history", s.getStatsHistory)              // [device] [folder] [from] [to]
 	getRestMux.HandleFunc("/rest/svc/deviceid", s.getDeviceID)                   // id
 	getRestMux.HandleFunc("/rest/svc/lang", s.getLang)                           // -
 	getRestMux.HandleFunc("/rest/svc/report", s.getReport)                       // -
@@ -263,15 +286,20 @@ func (s *apiService) Serve() {
 	getRestMux.HandleFunc("/rest/system/debug", s.getSystemDebug)                // -
 	getRestMux.HandleFunc("/rest/system/log", s.getSystemLog)                    // [since]
 	getRestMux.HandleFunc("/rest/system/log.txt", s.getSystemLogTxt)             // [since]
+	getRestMux.HandleFunc("/rest/system/totp", s.getTOTP)                        // -
 
 	// The POST handlers
 	postRestMux := http.NewServeMux()
+	postRestMux.HandleFunc("/rest/db/check", s.postDBCheck)                    // [folder]
 	postRestMux.HandleFunc("/rest/db/prio", s.postDBPrio)                      // folder file [perpage] [page]
+	postRestMux.HandleFunc("/rest/db/fetch", s.postDBFetch)                    // folder file
 	postRestMux.HandleFunc("/rest/db/ignores", s.postDBIgnores)                // folder
+	postRestMux.HandleFunc("/rest/db/ignores/dryrun", s.postDBIgnoresDryRun)   // folder
 	postRestMux.HandleFunc("/rest/db/override", s.postDBOverride)              // folder
 	postRestMux.HandleFunc("/rest/db/scan", s.postDBScan)                      // folder [sub...] [delay]
 	postRestMux.HandleFunc("/rest/system/config", s.postSystemConfig)          // <body>
 	postRestMux.HandleFunc("/rest/system/error", s.postSystemError)            // <body>
+	postRestMux.HandleFunc("/rest/system/webhook/test", s.postWebhookTest)     // id
 	postRestMux.HandleFunc("/rest/system/error/clear", s.postSystemErrorClear) // -
 	postRestMux.HandleFunc("/rest/system/ping", s.restPing)                    // -
 	postRestMux.HandleFunc("/rest/system/reset", s.postSystemReset)            // [folder]
@@ -280,7 +308,11 @@ func (s *apiService) Serve() {
 	postRestMux.HandleFunc("/rest/system/upgrade", s.postSystemUpgrade)        // -
 	postRestMux.HandleFunc("/rest/system/pause", s.postSystemPause)            // device
 	postRestMux.HandleFunc("/rest/system/resume", s.postSystemResume)          // device
-	postRestMux.HandleFunc("/rest/system/debug", s.postSystemDebug)            // [enable] [disable]
+	postRestMux.HandleFunc("/rest/system/debug", s.postSystemDebug)            // [enable] [disable] [level]
+	postRestMux.HandleFunc("/rest/system/totp/enroll", s.postTOTPEnroll)       // -
+	postRestMux.HandleFunc("/rest/system/totp/confirm", s.postTOTPConfirm)     // code
+	postRestMux.HandleFunc("/rest/system/totp/disable", s.postTOTPDisable)     // code
+	postRestMux.HandleFunc("/rest/system/cert/rotate", s.postCertRotate)       // -
 
 	// Debug endpoints, not for general use
 	getRestMux.HandleFunc("/rest/debug/peerCompletion", s.getPeerCompletion)
@@ -288,11 +320,12 @@ func (s *apiService) Serve() {
 
 	// A handler that splits requests between the two above and disables
 	// caching
-	restMux := noCacheMiddleware(metricsMiddleware(getPostHandler(getRestMux, postRestMux)))
+	restMux := noCacheMiddleware(metricsMiddleware(getPostHandler(s.cfg, getRestMux, postRestMux)))
 
 	// The main routing handler
 	mux := http.NewServeMux()
 	mux.Handle("/rest/", restMux)
+	mux.Handle("/rest/config/", noCacheMiddleware(http.HandlerFunc(s.serveConfig))) // GET, PUT, PATCH, DELETE
 	mux.HandleFunc("/qr/", s.getQR)
 
 	// Serve compiled in assets unless an asset directory was set (for development)
@@ -317,8 +350,8 @@ func (s *apiService) Serve() {
 	handler = withDetailsMiddleware(s.id, handler)
 
 	// Wrap everything in basic auth, if user/password is set.
-	if len(guiCfg.User) > 0 && len(guiCfg.Password) > 0 {
-		handler = basicAuthAndSessionMiddleware("sessionid-"+s.id.String()[:5], guiCfg, handler)
+	if guiCfg.IsAuthenticationEnabled() {
+		handler = basicAuthAndSessionMiddleware("sessionid-"+s.id.String()[:5], s.cfg, handler)
 	}
 
 	// Redirect to HTTPS if we are supposed to
@@ -382,7 +415,7 @@ func (s *apiService) VerifyConfiguration(from, to config.Configuration) error {
 }
 
 func (s *apiService) CommitConfiguration(from, to config.Configuration) bool {
-	if to.GUI == from.GUI {
+	if reflect.DeepEqual(to.GUI, from.GUI) {
 		return true
 	}
 
@@ -412,8 +445,12 @@ func (s *apiService) CommitConfiguration(from, to config.Configuration) bool {
 	return true
 }
 
-func getPostHandler(get, post http.Handler) http.Handler {
+func getPostHandler(cfg configIntf, get, post http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requestAllowsScope(cfg.GUI(), w, r, scopeNeededFor(r)) {
+			return
+		}
+
 		switch r.Method {
 		case "GET":
 			get.ServeHTTP(w, r)
@@ -467,10 +504,11 @@ func corsMiddleware(next http.Handler) http.Handler {
 
 		// Process OPTIONS requests
 		if r.Method == "OPTIONS" {
-			// Only GET/POST Methods are supported
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
-			// Only this custom header can be set
-			w.Header().Set("Access-Control-Allow-Headers", "X-API-Key")
+			// Only GET/POST Methods are supported, and PUT/PATCH/DELETE
+			// for the configuration
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+			// Only these custom headers can be set
+			w.Header().Set("Access-Control-Allow-Headers", "X-API-Key, If-Match, If-None-Match")
 			// The request is meant to be cached 10 minutes
 			w.Header().Set("Access-Control-Max-Age", "600")
 
@@ -543,9 +581,14 @@ func (s *apiService) getSystemDebug(w http.ResponseWriter, r *http.Request) {
 	names := l.Facilities()
 	enabled := l.FacilityDebugging()
 	sort.Strings(enabled)
+	levels := make(map[string]logger.LogLevel, len(names))
+	for name := range names {
+		levels[name] = l.Level(name)
+	}
 	sendJSON(w, map[string]interface{}{
 		"facilities": names,
 		"enabled":    enabled,
+		"levels":     levels,
 	})
 }
 
@@ -566,10 +609,34 @@ func (s *apiService) postSystemDebug(w http.ResponseWriter, r *http.Request) {
 		l.SetDebug(f, false)
 		l.Infof("Disabled debug data for %q", f)
 	}
+	levels := make(map[string]logger.LogLevel)
+	for _, fl := range strings.Split(q.Get("level"), ",") {
+		// facility:level, e.g. model:warning
+		parts := strings.SplitN(fl, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var level logger.LogLevel
+		if err := level.UnmarshalText([]byte(parts[1])); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		levels[parts[0]] = level
+	}
+	for f, level := range levels {
+		if l.Level(f) == level {
+			continue
+		}
+		l.SetLevel(f, level)
+		l.Infof("Set log level for %q to %v", f, level)
+	}
 }
 
 func (s *apiService) getDBBrowse(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
 	folder := qs.Get("folder")
 	prefix := qs.Get("prefix")
 	dirsonly := qs.Get("dirsonly") != ""
@@ -584,6 +651,9 @@ func (s *apiService) getDBBrowse(w http.ResponseWriter, r *http.Request) {
 
 func (s *apiService) getDBCompletion(w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
 	var folder = qs.Get("folder")
 	var deviceStr = qs.Get("device")
 
@@ -600,6 +670,9 @@ func (s *apiService) getDBCompletion(w http.ResponseWriter, r *http.Request) {
 
 func (s *apiService) getDBStatus(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
 	folder := qs.Get("folder")
 	sendJSON(w, folderSummary(s.cfg, s.model, folder))
 }
@@ -608,6 +681,7 @@ func folderSummary(cfg configIntf, m modelIntf, folder string) map[string]interf
 	var res = make(map[string]interface{})
 
 	res["invalid"] = cfg.Folders()[folder].Invalid
+	res["schedule"] = cfg.Folders()[folder].Schedule.StateAt(time.Now())
 
 	globalFiles, globalDeleted, globalBytes := m.GlobalSize(folder)
 	res["globalFiles"], res["globalDeleted"], res["globalBytes"] = globalFiles, globalDeleted, globalBytes
@@ -645,12 +719,18 @@ func folderSummary(cfg configIntf, m modelIntf, folder string) map[string]interf
 
 func (s *apiService) postDBOverride(w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
 	var folder = qs.Get("folder")
 	go s.model.Override(folder)
 }
 
 func (s *apiService) getDBNeed(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
 
 	folder := qs.Get("folder")
 
@@ -677,7 +757,13 @@ func (s *apiService) getDBNeed(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *apiService) getSystemConnections(w http.ResponseWriter, r *http.Request) {
-	sendJSON(w, s.model.ConnectionStats())
+	res := s.model.ConnectionStats()
+	send, recv := s.connectionsService.RateLimits()
+	res["rateLimits"] = map[string]int{
+		"maxSendKbps": send,
+		"maxRecvKbps": recv,
+	}
+	sendJSON(w, res)
 }
 
 func (s *apiService) getDeviceStats(w http.ResponseWriter, r *http.Request) {
@@ -688,8 +774,45 @@ func (s *apiService) getFolderStats(w http.ResponseWriter, r *http.Request) {
 	sendJSON(w, s.model.FolderStatistics())
 }
 
+func (s *apiService) getStatsHistory(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	var device string
+	if deviceStr := qs.Get("device"); deviceStr != "" {
+		id, err := protocol.DeviceIDFromString(deviceStr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		device = id.String()
+	}
+
+	// The default is the last day.
+	to := time.Now()
+	if toStr := qs.Get("to"); toStr != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, toStr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if fromStr := qs.Get("from"); fromStr != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, fromStr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sendJSON(w, s.model.StatisticsHistory(device, qs.Get("folder"), from, to))
+}
+
 func (s *apiService) getDBFile(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
 	folder := qs.Get("folder")
 	file := qs.Get("file")
 	gf, gfOk := s.model.CurrentGlobalFile(folder, file)
@@ -710,13 +833,24 @@ func (s *apiService) getDBFile(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *apiService) getSystemConfig(w http.ResponseWriter, r *http.Request) {
-	sendJSON(w, s.cfg.Raw())
+	cfg := s.cfg.Raw()
+	if requesterOf(s.cfg.GUI(), r).scope < config.APIKeyScopeAdmin {
+		cfg = redactedConfig(cfg)
+	}
+	w.Header().Set("ETag", configETag(cfg))
+	sendJSON(w, cfg)
 }
 
 func (s *apiService) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 	s.systemConfigMut.Lock()
 	defer s.systemConfigMut.Unlock()
 
+	from := s.cfg.Raw()
+	if !configPreconditionsHold(r, configETag(from)) {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+
 	to, err := config.ReadJSON(r.Body, myID)
 	if err != nil {
 		l.Warnln("decoding posted config:", err)
@@ -724,22 +858,52 @@ func (s *apiService) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if to.GUI.Password != s.cfg.GUI().Password {
+	if err := s.prepareConfig(from, &to); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Activate and save
+
+	resp := s.cfg.Replace(to)
+	configInSync = !resp.RequiresRestart
+	s.cfg.Save()
+}
+
+// prepareConfig hashes a changed GUI password and applies changes to the
+// usage reporting settings, in a configuration about to replace from.
+func (s *apiService) prepareConfig(from config.Configuration, to *config.Configuration) error {
+	if to.GUI.Password != from.GUI.Password {
 		if to.GUI.Password != "" {
 			hash, err := bcrypt.GenerateFromPassword([]byte(to.GUI.Password), 0)
 			if err != nil {
 				l.Warnln("bcrypting password:", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return err
 			}
 
 			to.GUI.Password = string(hash)
 		}
 	}
 
+	oldPasswords := make(map[string]string, len(from.GUI.Accounts))
+	for _, account := range from.GUI.Accounts {
+		oldPasswords[account.Name] = account.Password
+	}
+	for i, account := range to.GUI.Accounts {
+		if account.Password == "" || account.Password == oldPasswords[account.Name] {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(account.Password), 0)
+		if err != nil {
+			l.Warnln("bcrypting password:", err)
+			return err
+		}
+		to.GUI.Accounts[i].Password = string(hash)
+	}
+
 	// Fixup usage reporting settings
 
-	if curAcc := s.cfg.Options().URAccepted; to.Options.URAccepted > curAcc {
+	if curAcc := from.Options.URAccepted; to.Options.URAccepted > curAcc {
 		// UR was enabled
 		to.Options.URAccepted = usageReportVersion
 		to.Options.URUniqueID = util.RandomString(8)
@@ -749,11 +913,7 @@ func (s *apiService) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 		to.Options.URUniqueID = ""
 	}
 
-	// Activate and save
-
-	resp := s.cfg.Replace(to)
-	configInSync = !resp.RequiresRestart
-	s.cfg.Save()
+	return nil
 }
 
 func (s *apiService) getSystemConfigInsync(w http.ResponseWriter, r *http.Request) {
@@ -765,6 +925,25 @@ func (s *apiService) postSystemRestart(w http.ResponseWriter, r *http.Request) {
 	go restart()
 }
 
+func (s *apiService) postCertRotate(w http.ResponseWriter, r *http.Request) {
+	t, err := rotateCertificate(myID, locations[locCertFile], locations[locKeyFile], locations[locDeviceIDTransition])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// We restart straight away to start using the new certificate, as
+	// peers that have seen the transition no longer accept the old one. On
+	// startup the transition is announced to the peers that connect.
+	bs, _ := json.Marshal(map[string]string{
+		"from": t.From.String(),
+		"to":   t.To.String(),
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	s.flushResponse(string(bs), w)
+	go restart()
+}
+
 func (s *apiService) postSystemReset(w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	folder := qs.Get("folder")
@@ -924,6 +1103,9 @@ func (s *apiService) getReport(w http.ResponseWriter, r *http.Request) {
 
 func (s *apiService) getDBIgnores(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
 
 	ignores, patterns, err := s.model.GetIgnores(qs.Get("folder"))
 	if err != nil {
@@ -931,14 +1113,72 @@ func (s *apiService) getDBIgnores(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sendJSON(w, map[string][]string{
+	lines, err := s.model.IgnoreLines(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
 		"ignore":   ignores,
 		"expanded": patterns,
+		"lines":    lines,
+	})
+}
+
+func (s *apiService) getDBIgnoresTest(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
+
+	file := qs.Get("file")
+	if file == "" {
+		http.Error(w, "missing file", http.StatusBadRequest)
+		return
+	}
+
+	exp, err := s.model.ExplainIgnore(qs.Get("folder"), file)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	sendJSON(w, exp)
+}
+
+func (s *apiService) postDBIgnoresDryRun(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
+
+	var data map[string][]string
+	err := json.NewDecoder(r.Body).Decode(&data)
+	r.Body.Close()
+
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	files, lines, err := s.model.IgnoreDryRun(qs.Get("folder"), data["ignore"])
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"files": files,
+		"lines": lines,
 	})
 }
 
 func (s *apiService) postDBIgnores(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
 
 	var data map[string][]string
 	err := json.NewDecoder(r.Body).Decode(&data)
@@ -965,6 +1205,12 @@ func (s *apiService) getEvents(w http.ResponseWriter, r *http.Request) {
 	since, _ := strconv.Atoi(sinceStr)
 	limit, _ := strconv.Atoi(limitStr)
 
+	mask, err := eventMask(qs.Get("events"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	s.fss.gotEventRequest()
 
 	// Flush before blocking, to indicate that we've received the request and
@@ -974,7 +1220,10 @@ func (s *apiService) getEvents(w http.ResponseWriter, r *http.Request) {
 	f := w.(http.Flusher)
 	f.Flush()
 
-	evs := s.eventSub.Since(since, nil)
+	gone, release := s.clientGone(w)
+	defer release()
+
+	evs := s.eventsSince(since, mask, gone)
 	if 0 < limit && limit < len(evs) {
 		evs = evs[len(evs)-limit:]
 	}
@@ -982,6 +1231,177 @@ func (s *apiService) getEvents(w http.ResponseWriter, r *http.Request) {
 	sendJSON(w, evs)
 }
 
+// getEventStream sends events as they happen, as Server-Sent Events. The
+// stream resumes after the event given by the Last-Event-ID header, as
+// sent by reconnecting clients, or the since parameter.
+func (s *apiService) getEventStream(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	sinceStr := qs.Get("since")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		sinceStr = id
+	}
+	since, _ := strconv.Atoi(sinceStr)
+
+	mask, err := eventMask(qs.Get("events"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	gone, release := s.clientGone(w)
+	defer release()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	f.Flush()
+
+	// Waiting for events blocks, so it's done in a separate routine. It
+	// exits when the client goes away or the service stops.
+	evChan := make(chan []events.Event)
+	go func() {
+		since := since
+		for {
+			evs := s.eventsSince(since, mask, gone)
+			if len(evs) == 0 {
+				return
+			}
+			select {
+			case evChan <- evs:
+			case <-gone:
+				return
+			}
+			since = evs[len(evs)-1].ID
+		}
+	}()
+
+	keepalive := time.NewTicker(pingEventInterval)
+	defer keepalive.Stop()
+
+	s.fss.gotEventRequest()
+	for {
+		select {
+		case evs := <-evChan:
+			for _, ev := range evs {
+				bs, err := json.Marshal(ev)
+				if err != nil {
+					l.Warnln("Marshalling event:", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, bs); err != nil {
+					return
+				}
+			}
+		case <-keepalive.C:
+			// A comment, to keep the connection from timing out.
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+		f.Flush()
+		s.fss.gotEventRequest()
+	}
+}
+
+// eventsSince returns the events of the types in mask after the given
+// event ID, waiting until there are any. It returns nil if cancel is closed
+// first.
+func (s *apiService) eventsSince(since int, mask events.EventType, cancel <-chan struct{}) []events.Event {
+	if mask == events.AllEvents {
+		return s.eventSub.SinceCancel(since, nil, cancel)
+	}
+	if sub, ok := s.maskedEventSub(mask); ok {
+		return sub.SinceCancel(since, nil, cancel)
+	}
+
+	// Out of buffers; filter the shared one, where frequent events of other
+	// types may push out those of interest.
+	for {
+		evs := s.eventSub.SinceCancel(since, nil, cancel)
+		if len(evs) == 0 {
+			return evs
+		}
+		since = evs[len(evs)-1].ID
+
+		filtered := evs[:0]
+		for _, ev := range evs {
+			if ev.Type&mask != 0 {
+				filtered = append(filtered, ev)
+			}
+		}
+		if len(filtered) > 0 {
+			return filtered
+		}
+	}
+}
+
+// maskedEventSub returns the buffered subscription to the events in mask,
+// creating it on first use. Each keeps a buffer of its own, so that the
+// events of interest aren't pushed out by others. As clients choose the
+// masks, the number of buffers is bounded; false is returned when there are
+// too many already. Events are buffered from the first request on.
+func (s *apiService) maskedEventSub(mask events.EventType) (events.BufferedSubscription, bool) {
+	s.maskedEventSubsMut.Lock()
+	defer s.maskedEventSubsMut.Unlock()
+
+	sub, ok := s.maskedEventSubs[mask]
+	if ok {
+		return sub, true
+	}
+	if len(s.maskedEventSubs) >= maxMaskedEventSubs {
+		return nil, false
+	}
+	sub = events.NewBufferedSubscription(events.Default.Subscribe(mask), eventSubBufferSize)
+	s.maskedEventSubs[mask] = sub
+	return sub, true
+}
+
+// clientGone returns a channel that is closed when the client of the
+// request disconnects or the service stops, and a function to call when the
+// request is done.
+func (s *apiService) clientGone(w http.ResponseWriter) (<-chan struct{}, func()) {
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-closed:
+		case <-s.stop:
+		case <-done:
+		}
+		close(gone)
+	}()
+	return gone, func() { close(done) }
+}
+
+// eventMask parses a comma separated list of event type names into a mask.
+// The empty list means all events.
+func eventMask(names string) (events.EventType, error) {
+	if names == "" {
+		return events.AllEvents, nil
+	}
+
+	var mask events.EventType
+	for _, name := range strings.Split(names, ",") {
+		t := events.UnmarshalEventType(strings.TrimSpace(name))
+		if t == 0 {
+			return 0, fmt.Errorf("unknown event type %q", name)
+		}
+		mask |= t
+	}
+	return mask, nil
+}
+
 func (s *apiService) getSystemUpgrade(w http.ResponseWriter, r *http.Request) {
 	if noUpgrade {
 		http.Error(w, upgrade.ErrUpgradeUnsupported.Error(), 500)
@@ -1077,6 +1497,9 @@ func (s *apiService) postSystemResume(w http.ResponseWriter, r *http.Request) {
 
 func (s *apiService) postDBScan(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
 	folder := qs.Get("folder")
 	if folder != "" {
 		nextStr := qs.Get("next")
@@ -1101,14 +1524,68 @@ func (s *apiService) postDBScan(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *apiService) postDBCheck(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
+	folder := qs.Get("folder")
+
+	var folders []string
+	if len(folder) > 0 {
+		folders = []string{folder}
+	} else {
+		// Check all folders.
+		for folder := range s.cfg.Folders() {
+			folders = append(folders, folder)
+		}
+		sort.Strings(folders)
+	}
+
+	results := make([]db.CheckResult, 0, len(folders))
+	for _, folder := range folders {
+		res, err := s.model.CheckDatabase(folder)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		results = append(results, res)
+	}
+	sendJSON(w, results)
+}
+
 func (s *apiService) postDBPrio(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
 	folder := qs.Get("folder")
 	file := qs.Get("file")
 	s.model.BringToFront(folder, file)
 	s.getDBNeed(w, r)
 }
 
+func (s *apiService) postDBFetch(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	if !s.apiKeyAllowsFolder(w, r, qs.Get("folder")) {
+		return
+	}
+	folder := qs.Get("folder")
+	file := qs.Get("file")
+	if err := s.model.FetchFile(folder, file); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (s *apiService) postWebhookTest(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	if err := s.webhooks.Test(qs.Get("id")); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
 func (s *apiService) getQR(w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var text = qs.Get("text")
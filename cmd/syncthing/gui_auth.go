@@ -9,33 +9,198 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"html/template"
 	"math/rand"
+	"net"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/syncthing/syncthing/lib/config"
 	"github.com/syncthing/syncthing/lib/events"
+	"github.com/syncthing/syncthing/lib/ldap"
 	"github.com/syncthing/syncthing/lib/sync"
+	"github.com/syncthing/syncthing/lib/totp"
 	"github.com/syncthing/syncthing/lib/util"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	sessions    = make(map[string]bool)
+	sessions    = make(map[string]login) // session ID -> who logged in
 	sessionsMut = sync.NewMutex()
 )
 
-func emitLoginAttempt(success bool, username string) {
+// A login is who logged in, and how.
+type login struct {
+	username string
+	ldap     bool // checked against the LDAP directory rather than an account
+}
+
+// account returns the account of the login, or false if it has since been
+// removed from the configuration. Users from the directory all get the role
+// configured for LDAP.
+func (l login) account(cfg config.GUIConfiguration) (config.GUIAccountConfiguration, bool) {
+	if l.ldap {
+		return config.GUIAccountConfiguration{Name: l.username, Role: cfg.LDAP.Role}, cfg.LDAP.IsEnabled()
+	}
+	return cfg.Account(l.username)
+}
+
+func emitLoginAttempt(success bool, username string, role string, r *http.Request) {
 	events.Default.Log(events.LoginAttempt, map[string]interface{}{
 		"success":  success,
 		"username": username,
+		"role":     role,
+		"sourceIP": sourceIP(r),
 	})
 }
 
-func basicAuthAndSessionMiddleware(cookieName string, cfg config.GUIConfiguration, next http.Handler) http.Handler {
+func emitAPIRequestDenied(req requester, r *http.Request, reason string) {
+	data := map[string]interface{}{
+		"method":   r.Method,
+		"path":     r.URL.Path,
+		"reason":   reason,
+		"sourceIP": sourceIP(r),
+	}
+	if req.apiKey != "" {
+		data["apiKey"] = req.apiKey
+	} else {
+		data["username"] = req.username
+	}
+	events.Default.Log(events.APIRequestDenied, data)
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// adminPostPaths are the POST endpoints that need the admin scope, as they
+// change the configuration or affect the running process.
+var adminPostPaths = map[string]bool{
+	"/rest/system/cert/rotate": true,
+	"/rest/system/config":      true,
+	"/rest/system/debug":       true,
+	"/rest/system/reset":       true,
+	"/rest/system/restart":     true,
+	"/rest/system/shutdown":    true,
+	"/rest/system/upgrade":     true,
+}
+
+// scopeNeededFor returns the scope needed for the request.
+func scopeNeededFor(r *http.Request) config.APIKeyScope {
+	switch {
+	case r.Method == "GET" || strings.HasPrefix(r.URL.Path, "/rest/system/totp/"):
+		// Anyone may set up two-factor authentication for their own
+		// account.
+		return config.APIKeyScopeReadOnly
+	case adminPostPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/rest/config/"):
+		return config.APIKeyScopeAdmin
+	default:
+		return config.APIKeyScopeControl
+	}
+}
+
+// A requester is who made a request, as far as the scope is concerned.
+// Requests made with a named API key, or in the session of a GUI account,
+// have a limited scope. Others, made with the main API key or when
+// authentication is disabled, are not limited.
+type requester struct {
+	apiKey   string // name of the named API key, if any
+	username string // account of the session, if any
+	scope    config.APIKeyScope
+}
+
+func requesterOf(cfg config.GUIConfiguration, r *http.Request) requester {
+	apiKey := r.Header.Get("X-API-Key")
+	if key, ok := cfg.NamedAPIKey(apiKey); ok {
+		return requester{apiKey: key.Name, scope: key.Scope}
+	}
+	if !cfg.IsAuthenticationEnabled() || cfg.IsValidAPIKey(apiKey) {
+		return requester{scope: config.APIKeyScopeAdmin}
+	}
+	if login, ok := sessionLogin(r); ok {
+		account, _ := login.account(cfg)
+		return requester{username: login.username, scope: account.Role.Scope()}
+	}
+	return requester{scope: config.APIKeyScopeAdmin}
+}
+
+// sessionLogin returns who logged in to the session the request was made in,
+// if anyone. Any session cookie will do, as the session IDs are unique.
+func sessionLogin(r *http.Request) (login, bool) {
+	sessionsMut.Lock()
+	defer sessionsMut.Unlock()
+	for _, cookie := range r.Cookies() {
+		if !strings.HasPrefix(cookie.Name, "sessionid-") {
+			continue
+		}
+		if login, ok := sessions[cookie.Value]; ok {
+			return login, true
+		}
+	}
+	return login{}, false
+}
+
+// requestAllowsScope returns true if the request may proceed. Requests made
+// by someone without the given scope are denied, and get a 403 response.
+func requestAllowsScope(cfg config.GUIConfiguration, w http.ResponseWriter, r *http.Request, scope config.APIKeyScope) bool {
+	req := requesterOf(cfg, r)
+	if req.scope >= scope {
+		return true
+	}
+	emitAPIRequestDenied(req, r, "scope "+req.scope.String()+" does not include "+scope.String())
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// apiKeyAllowsFolder returns true if the request may access the folder.
+// Requests made with a named API key restricted to other folders are denied,
+// and get a 403 response. An empty folder means all folders.
+func (s *apiService) apiKeyAllowsFolder(w http.ResponseWriter, r *http.Request, folder string) bool {
+	key, ok := s.cfg.GUI().NamedAPIKey(r.Header.Get("X-API-Key"))
+	if !ok || key.AllowsFolder(folder) {
+		return true
+	}
+	req := requester{apiKey: key.Name, scope: key.Scope}
+	if folder == "" {
+		emitAPIRequestDenied(req, r, "all folders requested")
+	} else {
+		emitAPIRequestDenied(req, r, "folder "+folder+" not allowed")
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// redactedConfig returns a copy of the configuration without the passwords,
+// API keys and secrets, for those not allowed to change it.
+func redactedConfig(cfg config.Configuration) config.Configuration {
+	cfg = cfg.Copy()
+	cfg.GUI.Password = ""
+	cfg.GUI.TOTPSecret = ""
+	cfg.GUI.RecoveryCodes = []string{}
+	cfg.GUI.APIKey = ""
+	for i := range cfg.GUI.Accounts {
+		cfg.GUI.Accounts[i].Password = ""
+		cfg.GUI.Accounts[i].TOTPSecret = ""
+		cfg.GUI.Accounts[i].RecoveryCodes = []string{}
+	}
+	for i := range cfg.GUI.APIKeys {
+		cfg.GUI.APIKeys[i].Key = ""
+	}
+	for i := range cfg.Webhooks {
+		cfg.Webhooks[i].Secret = ""
+	}
+	return cfg
+}
+
+func basicAuthAndSessionMiddleware(cookieName string, cfg configIntf, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if cfg.IsValidAPIKey(r.Header.Get("X-API-Key")) {
+		guiCfg := cfg.GUI()
+		if guiCfg.IsValidAPIKey(r.Header.Get("X-API-Key")) {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -43,20 +208,24 @@ func basicAuthAndSessionMiddleware(cookieName string, cfg config.GUIConfiguratio
 		cookie, err := r.Cookie(cookieName)
 		if err == nil && cookie != nil {
 			sessionsMut.Lock()
-			_, ok := sessions[cookie.Value]
+			login, ok := sessions[cookie.Value]
 			sessionsMut.Unlock()
-			if ok {
+			if _, exists := login.account(guiCfg); ok && exists {
 				next.ServeHTTP(w, r)
 				return
 			}
 		}
 
+		if r.URL.Path == "/login" && r.Method == "POST" {
+			formLogin(cookieName, cfg, w, r)
+			return
+		}
+
 		httpl.Debugln("Sessionless HTTP request with authentication; this is expensive.")
 
 		error := func() {
 			time.Sleep(time.Duration(rand.Intn(100)+100) * time.Millisecond)
-			w.Header().Set("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
-			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+			notAuthorized(w, r, "")
 		}
 
 		hdr := r.Header.Get("Authorization")
@@ -78,57 +247,294 @@ func basicAuthAndSessionMiddleware(cookieName string, cfg config.GUIConfiguratio
 			return
 		}
 
-		// Check if the username is correct, assuming it was sent as UTF-8
-		username := string(fields[0])
-		if username == cfg.User {
-			goto usernameOK
+		ip := sourceIP(r)
+		if loginLockedOut(string(fields[0]), ip) {
+			http.Error(w, "Too many failed login attempts", 429)
+			return
 		}
 
-		// ... check it again, converting it from assumed ISO-8859-1 to UTF-8
-		username = string(iso88591ToUTF8(fields[0]))
-		if username == cfg.User {
-			goto usernameOK
+		login, account, ok := authenticate(guiCfg, fields[0], fields[1])
+		if !ok {
+			registerLoginFailure(string(fields[0]), ip)
+			emitLoginAttempt(false, login.username, accountRole(account), r)
+			error()
+			return
+		}
+
+		if account.TOTPSecret != "" {
+			// There is no way to give the code with basic authentication,
+			// so the login form must be used.
+			notAuthorized(w, r, "Two-factor authentication is required.")
+			return
 		}
 
-		// Neither of the possible interpretations match the configured username
-		emitLoginAttempt(false, username)
-		error()
+		registerLoginSuccess(string(fields[0]), ip)
+		startSession(w, r, cookieName, login)
+		emitLoginAttempt(true, login.username, accountRole(account), r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// formLogin handles the login form, which unlike basic authentication can
+// take a one time password or recovery code as a second factor.
+func formLogin(cookieName string, cfg configIntf, w http.ResponseWriter, r *http.Request) {
+	user := r.FormValue("user")
+	code := r.FormValue("code")
+	ip := sourceIP(r)
+
+	fail := func(status int, message string) {
+		time.Sleep(time.Duration(rand.Intn(100)+100) * time.Millisecond)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		loginTemplate.Execute(w, message)
+	}
+
+	if loginLockedOut(user, ip) {
+		fail(429, "Too many failed login attempts. Try again later.")
+		return
+	}
+
+	login, account, ok := authenticate(cfg.GUI(), []byte(user), []byte(r.FormValue("password")))
+	if ok && account.TOTPSecret != "" {
+		ok = totp.Validate(account.TOTPSecret, code, time.Now()) || useRecoveryCode(cfg, account, code)
+	}
+	if !ok {
+		registerLoginFailure(user, ip)
+		emitLoginAttempt(false, login.username, accountRole(account), r)
+		fail(http.StatusUnauthorized, "Incorrect user, password or authentication code.")
+		return
+	}
+
+	registerLoginSuccess(user, ip)
+	startSession(w, r, cookieName, login)
+	emitLoginAttempt(true, login.username, accountRole(account), r)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// notAuthorized responds to a request that requires logging in. Pages get
+// the login form, while the REST API gets a plain 401.
+func notAuthorized(w http.ResponseWriter, r *http.Request, message string) {
+	if r.Method == "GET" && !strings.HasPrefix(r.URL.Path, "/rest/") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		loginTemplate.Execute(w, message)
 		return
+	}
+	if message == "" {
+		message = "Not Authorized"
+	}
+	http.Error(w, message, http.StatusUnauthorized)
+}
 
-	usernameOK:
-		// Check password as given (assumes UTF-8 encoding)
-		password := fields[1]
-		if err := bcrypt.CompareHashAndPassword([]byte(cfg.Password), password); err == nil {
-			goto passwordOK
+// authenticate checks the username and password against the LDAP directory,
+// if there is one, or the accounts in the configuration. The accounts are
+// also checked when the directory can't be reached, if so configured.
+func authenticate(cfg config.GUIConfiguration, user, password []byte) (login, config.GUIAccountConfiguration, bool) {
+	if cfg.LDAP.IsEnabled() {
+		username := string(user)
+		err := ldap.Authenticate(cfg.LDAP, username, string(password))
+		if err == nil {
+			return login{username: username, ldap: true}, config.GUIAccountConfiguration{Name: username, Role: cfg.LDAP.Role}, true
 		}
+		if !ldap.IsUnreachable(err) {
+			httpl.Debugln("LDAP login:", err)
+			return login{username: username, ldap: true}, config.GUIAccountConfiguration{}, false
+		}
+		if !cfg.LDAP.LocalFallback {
+			l.Infoln("Checking login with LDAP server:", err)
+			return login{username: username, ldap: true}, config.GUIAccountConfiguration{}, false
+		}
+		l.Infoln("Checking login with LDAP server:", err, "(using local password instead)")
+	}
+
+	username, account, ok := checkPassword(cfg, user, password)
+	return login{username: username}, account, ok
+}
 
+// checkPassword returns the account with the given username and password.
+// Both are tried as UTF-8 and as ISO-8859-1, as browsers differ in what they
+// send for basic authentication.
+func checkPassword(cfg config.GUIConfiguration, user, password []byte) (string, config.GUIAccountConfiguration, bool) {
+	// Check if the username is correct, assuming it was sent as UTF-8
+	username := string(user)
+	account, ok := cfg.Account(username)
+	if !ok {
 		// ... check it again, converting it from assumed ISO-8859-1 to UTF-8
-		password = iso88591ToUTF8(password)
-		if err := bcrypt.CompareHashAndPassword([]byte(cfg.Password), password); err == nil {
-			goto passwordOK
-		}
+		username = string(iso88591ToUTF8(user))
+		account, ok = cfg.Account(username)
+	}
+	if !ok {
+		// Neither of the possible interpretations match a configured username
+		return username, account, false
+	}
 
-		// Neither of the attempts to verify the password checked out
-		emitLoginAttempt(false, username)
-		error()
-		return
+	// Check password as given (assumes UTF-8 encoding)
+	if err := bcrypt.CompareHashAndPassword([]byte(account.Password), password); err == nil {
+		return username, account, true
+	}
 
-	passwordOK:
-		sessionid := util.RandomString(32)
-		sessionsMut.Lock()
-		sessions[sessionid] = true
-		sessionsMut.Unlock()
-		http.SetCookie(w, &http.Cookie{
-			Name:   cookieName,
-			Value:  sessionid,
-			MaxAge: 0,
-		})
-
-		emitLoginAttempt(true, username)
-		next.ServeHTTP(w, r)
+	// ... check it again, converting it from assumed ISO-8859-1 to UTF-8
+	if err := bcrypt.CompareHashAndPassword([]byte(account.Password), iso88591ToUTF8(password)); err == nil {
+		return username, account, true
+	}
+
+	return username, account, false
+}
+
+// accountRole returns the role of the account for the LoginAttempt event,
+// or an empty string for an unknown user.
+func accountRole(account config.GUIAccountConfiguration) string {
+	if account.Name == "" {
+		return ""
+	}
+	return account.Role.String()
+}
+
+func startSession(w http.ResponseWriter, r *http.Request, cookieName string, login login) {
+	sessionid := util.RandomString(32)
+	sessionsMut.Lock()
+	sessions[sessionid] = login
+	sessionsMut.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieName,
+		Value:  sessionid,
+		MaxAge: 0,
 	})
+
+	// The handlers find the account of this request by the session, as
+	// for the requests that follow.
+	r.AddCookie(&http.Cookie{Name: cookieName, Value: sessionid})
+}
+
+// useRecoveryCode returns true if the code is one of the unused recovery
+// codes of the account, and removes it so that it can't be used again.
+func useRecoveryCode(cfg configIntf, account config.GUIAccountConfiguration, code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if code == "" {
+		return false
+	}
+
+	for i, hash := range account.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) != nil {
+			continue
+		}
+
+		account = account.Copy()
+		account.RecoveryCodes = append(account.RecoveryCodes[:i], account.RecoveryCodes[i+1:]...)
+		newCfg := cfg.Raw().Copy()
+		newCfg.GUI.SetAccount(account)
+		if resp := cfg.Replace(newCfg); resp.ValidationError != nil {
+			l.Warnln("Removing used recovery code:", resp.ValidationError)
+			return false
+		}
+		cfg.Save()
+		return true
+	}
+	return false
+}
+
+const (
+	loginMaxFailures = 5               // consecutive failures before a lockout
+	loginLockoutTime = 5 * time.Minute // duration of a lockout
+)
+
+// loginFailures counts the consecutive failed logins per username and per
+// source address. When either reaches loginMaxFailures, it is locked out for
+// loginLockoutTime.
+var (
+	loginFailures    = make(map[string]*loginFailure)
+	loginFailuresMut = sync.NewMutex()
+)
+
+type loginFailure struct {
+	count       int
+	lockedUntil time.Time
+}
+
+func loginFailureKeys(username, ip string) []string {
+	return []string{"user " + username, "ip " + ip}
 }
 
+func loginLockedOut(username, ip string) bool {
+	now := time.Now()
+	loginFailuresMut.Lock()
+	defer loginFailuresMut.Unlock()
+	for _, key := range loginFailureKeys(username, ip) {
+		if f, ok := loginFailures[key]; ok && now.Before(f.lockedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+func registerLoginFailure(username, ip string) {
+	now := time.Now()
+	loginFailuresMut.Lock()
+	defer loginFailuresMut.Unlock()
+
+	if len(loginFailures) > 10000 {
+		// Someone is trying lots of usernames or addresses. Forget about
+		// those not currently locked out.
+		for key, f := range loginFailures {
+			if !now.Before(f.lockedUntil) {
+				delete(loginFailures, key)
+			}
+		}
+	}
+
+	for _, key := range loginFailureKeys(username, ip) {
+		f, ok := loginFailures[key]
+		if !ok {
+			f = &loginFailure{}
+			loginFailures[key] = f
+		}
+		f.count++
+		if f.count >= loginMaxFailures {
+			l.Infof("Locking out %s for %v after %d failed logins", key, loginLockoutTime, f.count)
+			f.count = 0
+			f.lockedUntil = now.Add(loginLockoutTime)
+		}
+	}
+}
+
+func registerLoginSuccess(username, ip string) {
+	loginFailuresMut.Lock()
+	defer loginFailuresMut.Unlock()
+	for _, key := range loginFailureKeys(username, ip) {
+		delete(loginFailures, key)
+	}
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Syncthing</title>
+<style>
+body { font-family: sans-serif; background: #f5f5f5; }
+form { max-width: 20em; margin: 5em auto; padding: 1.5em; background: #fff; border: 1px solid #ddd; border-radius: 4px; }
+label, input { display: block; width: 100%; box-sizing: border-box; }
+input { margin: 0.25em 0 1em; padding: 0.4em; }
+.error { color: #a94442; }
+</style>
+</head>
+<body>
+<form method="post" action="/login">
+<h2>Syncthing</h2>
+{{if .}}<p class="error">{{.}}</p>{{end}}
+<label for="user">User</label>
+<input id="user" name="user" autofocus>
+<label for="password">Password</label>
+<input id="password" name="password" type="password">
+<label for="code">Authentication code, if enabled</label>
+<input id="code" name="code" autocomplete="off">
+<input type="submit" value="Log In">
+</form>
+</body>
+</html>
+`))
+
 // Convert an ISO-8859-1 encoded byte string to UTF-8. Works by the
 // principle that ISO-8859-1 bytes are equivalent to unicode code points,
 // that a rune slice is a list of code points, and that stringifying a slice
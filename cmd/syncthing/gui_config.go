@@ -0,0 +1,381 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/util"
+)
+
+// The endpoints under /rest/config/ each read and modify one part of the
+// configuration, so that a client changing a folder doesn't need to post
+// back the whole configuration. Every part has an entity tag derived from
+// its contents. Modifications carrying an If-Match header that doesn't match
+// the current entity tag are rejected, so that a client doesn't overwrite
+// changes made by someone else since it read the configuration.
+
+var (
+	errConfigNotFound     = errors.New("not found")
+	errConfigNotDeletable = errors.New("cannot be deleted")
+)
+
+// A configResource is a part of the configuration.
+type configResource interface {
+	// get returns the resource in the configuration, and whether it exists.
+	get(cfg config.Configuration) (interface{}, bool)
+	// put sets the resource in the configuration to the JSON value in data.
+	// For a patch, data is applied on top of the current value and only
+	// changes the attributes it contains.
+	put(cfg *config.Configuration, data []byte, patch bool) error
+	// remove removes the resource from the configuration.
+	remove(cfg *config.Configuration) error
+}
+
+type folderResource string
+
+func (id folderResource) get(cfg config.Configuration) (interface{}, bool) {
+	for _, fld := range cfg.Folders {
+		if fld.ID == string(id) {
+			return fld, true
+		}
+	}
+	return nil, false
+}
+
+func (id folderResource) put(cfg *config.Configuration, data []byte, patch bool) error {
+	var fld config.FolderConfiguration
+	idx := -1
+	for i := range cfg.Folders {
+		if cfg.Folders[i].ID == string(id) {
+			idx = i
+			break
+		}
+	}
+	if patch {
+		if idx < 0 {
+			return errConfigNotFound
+		}
+		fld = cfg.Folders[idx]
+	}
+
+	if err := json.Unmarshal(data, &fld); err != nil {
+		return err
+	}
+	if fld.ID == "" {
+		fld.ID = string(id)
+	} else if fld.ID != string(id) {
+		return fmt.Errorf("folder ID %q does not match %q", fld.ID, id)
+	}
+
+	if idx < 0 {
+		cfg.Folders = append(cfg.Folders, fld)
+	} else {
+		cfg.Folders[idx] = fld
+	}
+	return nil
+}
+
+func (id folderResource) remove(cfg *config.Configuration) error {
+	for i := range cfg.Folders {
+		if cfg.Folders[i].ID == string(id) {
+			cfg.Folders = append(cfg.Folders[:i], cfg.Folders[i+1:]...)
+			return nil
+		}
+	}
+	return errConfigNotFound
+}
+
+type deviceResource protocol.DeviceID
+
+func (id deviceResource) get(cfg config.Configuration) (interface{}, bool) {
+	for _, dev := range cfg.Devices {
+		if dev.DeviceID == protocol.DeviceID(id) {
+			return dev, true
+		}
+	}
+	return nil, false
+}
+
+func (id deviceResource) put(cfg *config.Configuration, data []byte, patch bool) error {
+	var dev config.DeviceConfiguration
+	idx := -1
+	for i := range cfg.Devices {
+		if cfg.Devices[i].DeviceID == protocol.DeviceID(id) {
+			idx = i
+			break
+		}
+	}
+	if patch {
+		if idx < 0 {
+			return errConfigNotFound
+		}
+		dev = cfg.Devices[idx]
+	}
+
+	if err := json.Unmarshal(data, &dev); err != nil {
+		return err
+	}
+	if dev.DeviceID == (protocol.DeviceID{}) {
+		dev.DeviceID = protocol.DeviceID(id)
+	} else if dev.DeviceID != protocol.DeviceID(id) {
+		return fmt.Errorf("device ID %v does not match %v", dev.DeviceID, protocol.DeviceID(id))
+	}
+
+	if idx < 0 {
+		cfg.Devices = append(cfg.Devices, dev)
+	} else {
+		cfg.Devices[idx] = dev
+	}
+	return nil
+}
+
+func (id deviceResource) remove(cfg *config.Configuration) error {
+	if protocol.DeviceID(id) == myID {
+		return errors.New("cannot remove the local device")
+	}
+	for i := range cfg.Devices {
+		if cfg.Devices[i].DeviceID == protocol.DeviceID(id) {
+			// Removing the device from the folders sharing it is taken care
+			// of when the configuration is prepared.
+			cfg.Devices = append(cfg.Devices[:i], cfg.Devices[i+1:]...)
+			return nil
+		}
+	}
+	return errConfigNotFound
+}
+
+type optionsResource struct{}
+
+func (optionsResource) get(cfg config.Configuration) (interface{}, bool) {
+	return cfg.Options, true
+}
+
+func (optionsResource) put(cfg *config.Configuration, data []byte, patch bool) error {
+	var opts config.OptionsConfiguration
+	if patch {
+		opts = cfg.Options
+	} else {
+		util.SetDefaults(&opts)
+	}
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return err
+	}
+	cfg.Options = opts
+	return nil
+}
+
+func (optionsResource) remove(cfg *config.Configuration) error {
+	return errConfigNotDeletable
+}
+
+type guiResource struct{}
+
+func (guiResource) get(cfg config.Configuration) (interface{}, bool) {
+	return cfg.GUI, true
+}
+
+func (guiResource) put(cfg *config.Configuration, data []byte, patch bool) error {
+	var gui config.GUIConfiguration
+	if patch {
+		gui = cfg.GUI
+	} else {
+		util.SetDefaults(&gui)
+		util.SetDefaults(&gui.LDAP)
+	}
+	if err := json.Unmarshal(data, &gui); err != nil {
+		return err
+	}
+	cfg.GUI = gui
+	return nil
+}
+
+func (guiResource) remove(cfg *config.Configuration) error {
+	return errConfigNotDeletable
+}
+
+// configResourceFor returns the resource for a path under /rest/config/, or
+// an error if there is no such resource.
+func configResourceFor(path string) (configResource, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/rest/config/"), "/", 2)
+	switch {
+	case parts[0] == "folders" && len(parts) == 2 && parts[1] != "":
+		return folderResource(parts[1]), nil
+	case parts[0] == "devices" && len(parts) == 2 && parts[1] != "":
+		id, err := protocol.DeviceIDFromString(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		return deviceResource(id), nil
+	case parts[0] == "options" && len(parts) == 1:
+		return optionsResource{}, nil
+	case parts[0] == "gui" && len(parts) == 1:
+		return guiResource{}, nil
+	}
+	return nil, errConfigNotFound
+}
+
+func (s *apiService) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if !requestAllowsScope(s.cfg.GUI(), w, r, scopeNeededFor(r)) {
+		return
+	}
+
+	res, err := configResourceFor(r.URL.Path)
+	if err == errConfigNotFound {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		s.getConfigResource(w, r, res)
+	case "PUT", "PATCH", "DELETE":
+		s.modifyConfigResource(w, r, res)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *apiService) getConfigResource(w http.ResponseWriter, r *http.Request, res configResource) {
+	cfg := s.cfg.Raw()
+	if requesterOf(s.cfg.GUI(), r).scope < config.APIKeyScopeAdmin {
+		cfg = redactedConfig(cfg)
+	}
+
+	v, ok := res.get(cfg)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	etag := configETag(v)
+	w.Header().Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	sendJSON(w, v)
+}
+
+func (s *apiService) modifyConfigResource(w http.ResponseWriter, r *http.Request, res configResource) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.systemConfigMut.Lock()
+	defer s.systemConfigMut.Unlock()
+
+	from := s.cfg.Raw()
+	var etag string
+	if v, ok := res.get(from); ok {
+		etag = configETag(v)
+	}
+	if !configPreconditionsHold(r, etag) {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	to := from.Copy()
+	if r.Method == "DELETE" {
+		err = res.remove(&to)
+	} else {
+		err = res.put(&to, data, r.Method == "PATCH")
+	}
+	switch err {
+	case nil:
+	case errConfigNotFound:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	case errConfigNotDeletable:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Pass the result through the same preparation as a configuration
+	// posted in full, so that defaults are filled in and references to
+	// removed devices are cleaned up.
+	bs, err := json.Marshal(to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	to, err = config.ReadJSON(bytes.NewReader(bs), myID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.prepareConfig(from, &to); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := s.cfg.Replace(to)
+	if resp.ValidationError != nil {
+		http.Error(w, resp.ValidationError.Error(), http.StatusBadRequest)
+		return
+	}
+	configInSync = !resp.RequiresRestart
+	s.cfg.Save()
+
+	if v, ok := res.get(s.cfg.Raw()); ok {
+		w.Header().Set("ETag", configETag(v))
+		sendJSON(w, v)
+	}
+}
+
+// configETag returns the entity tag for a part of the configuration.
+func configETag(v interface{}) string {
+	bs, _ := json.Marshal(v)
+	hash := sha256.Sum256(bs)
+	return fmt.Sprintf(`"%x"`, hash[:16])
+}
+
+// etagMatches returns true if the value of an If-Match or If-None-Match
+// header matches the given entity tag, which is empty if the resource does
+// not exist.
+func etagMatches(header, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// configPreconditionsHold returns false if the If-Match or If-None-Match
+// headers of a modifying request rule out the current value of the resource.
+func configPreconditionsHold(r *http.Request, etag string) bool {
+	if match := r.Header.Get("If-Match"); match != "" && !etagMatches(match, etag) {
+		return false
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		return false
+	}
+	return true
+}
@@ -9,20 +9,26 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/d4l3k/messagediff"
 	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/events"
 	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syncthing/syncthing/lib/sync"
+	"github.com/syncthing/syncthing/lib/totp"
 	"github.com/thejerf/suture"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestCSRFToken(t *testing.T) {
@@ -67,7 +73,7 @@ func TestStopAfterBrokenConfig(t *testing.T) {
 	}
 	w := config.Wrap("/dev/null", cfg)
 
-	srv, err := newAPIService(protocol.LocalDeviceID, w, "../../test/h1/https-cert.pem", "../../test/h1/https-key.pem", "", nil, nil, nil, nil, nil, nil)
+	srv, err := newAPIService(protocol.LocalDeviceID, w, "../../test/h1/https-cert.pem", "../../test/h1/https-key.pem", "", nil, nil, nil, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -180,6 +186,68 @@ func TestDirNames(t *testing.T) {
 	}
 }
 
+func TestEventMask(t *testing.T) {
+	cases := []struct {
+		names string
+		mask  events.EventType
+		err   bool
+	}{
+		{"", events.AllEvents, false},
+		{"Ping", events.Ping, false},
+		{"ItemFinished,StateChanged", events.ItemFinished | events.StateChanged, false},
+		{"ItemFinished, FolderSummary", events.ItemFinished | events.FolderSummary, false},
+		{"ItemFinished,NoSuchEvent", 0, true},
+	}
+
+	for _, tc := range cases {
+		mask, err := eventMask(tc.names)
+		if (err != nil) != tc.err {
+			t.Errorf("Unexpected error state for %q: %v", tc.names, err)
+		}
+		if mask != tc.mask {
+			t.Errorf("Incorrect mask for %q; %v != %v", tc.names, mask, tc.mask)
+		}
+	}
+}
+
+func TestMaskedEventSubs(t *testing.T) {
+	s := &apiService{
+		eventSub:           new(mockedEventSub),
+		maskedEventSubs:    make(map[events.EventType]events.BufferedSubscription),
+		maskedEventSubsMut: sync.NewMutex(),
+	}
+
+	// Events of other types don't push out those of interest.
+
+	mask := events.DeviceConnected | events.DeviceDisconnected
+	if _, ok := s.maskedEventSub(mask); !ok {
+		t.Fatal("No subscription for the first mask")
+	}
+	for i := 0; i < 2*eventSubBufferSize; i++ {
+		events.Default.Log(events.Ping, nil)
+	}
+	events.Default.Log(events.DeviceConnected, nil)
+
+	evs := s.eventsSince(0, mask, nil)
+	if len(evs) != 1 || evs[0].Type != events.DeviceConnected {
+		t.Errorf("Unexpected events %v", evs)
+	}
+
+	// The subscriptions are reused, and there is a limit to them.
+
+	for i := uint(0); len(s.maskedEventSubs) < maxMaskedEventSubs; i++ {
+		if _, ok := s.maskedEventSub(events.Ping | events.EventType(1)<<(i+1)); !ok {
+			t.Fatal("No subscription below the limit")
+		}
+	}
+	if _, ok := s.maskedEventSub(mask); !ok {
+		t.Error("Existing subscription not reused at the limit")
+	}
+	if _, ok := s.maskedEventSub(events.Ping | events.StateChanged | events.ItemFinished); ok {
+		t.Error("Unexpected new subscription above the limit")
+	}
+}
+
 type httpTestCase struct {
 	URL     string        // URL to check
 	Code    int           // Expected result code
@@ -290,7 +358,7 @@ func TestAPIServiceRequests(t *testing.T) {
 			URL:    "/rest/system/connections",
 			Code:   200,
 			Type:   "application/json",
-			Prefix: "null",
+			Prefix: "{",
 		},
 		{
 			URL:    "/rest/system/discovery",
@@ -455,6 +523,486 @@ func TestHTTPLogin(t *testing.T) {
 
 }
 
+func TestConfigEndpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := config.Wrap(filepath.Join(dir, "config.xml"), config.New(myID))
+	svc := &apiService{
+		cfg:             w,
+		systemConfigMut: sync.NewMutex(),
+	}
+
+	request := func(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+path, strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		svc.serveConfig(rec, req)
+		return rec
+	}
+
+	// Create a folder, then read it back.
+
+	rec := request("PUT", "/rest/config/folders/abc", `{"label": "ABC", "path": "/tmp/abc"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected result %d for put: %s", rec.Code, rec.Body)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Missing ETag")
+	}
+	if fld := w.Folders()["abc"]; fld.Label != "ABC" || fld.RawPath == "" {
+		t.Fatalf("Folder not stored: %+v", fld)
+	}
+
+	rec = request("GET", "/rest/config/folders/abc", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != etag || !strings.Contains(rec.Body.String(), `"label":"ABC"`) {
+		t.Fatalf("Unexpected get result %d %q: %s", rec.Code, rec.Header().Get("ETag"), rec.Body)
+	}
+	if rec = request("GET", "/rest/config/folders/abc", "", "If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("Unexpected result %d for unmodified get", rec.Code)
+	}
+
+	// Patching changes only the given attributes, and a stale ETag is
+	// rejected.
+
+	rec = request("PATCH", "/rest/config/folders/abc", `{"rescanIntervalS": 123}`, "If-Match", etag)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected result %d for patch: %s", rec.Code, rec.Body)
+	}
+	if fld := w.Folders()["abc"]; fld.Label != "ABC" || fld.RescanIntervalS != 123 {
+		t.Fatalf("Folder not patched: %+v", fld)
+	}
+	if rec.Header().Get("ETag") == etag {
+		t.Error("ETag did not change")
+	}
+	if rec = request("PATCH", "/rest/config/folders/abc", `{"label": "Stale"}`, "If-Match", etag); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Unexpected result %d for stale patch", rec.Code)
+	}
+	if rec = request("PUT", "/rest/config/folders/abc", `{"path": "/tmp/abc"}`, "If-None-Match", "*"); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Unexpected result %d for put of existing folder", rec.Code)
+	}
+	if rec = request("PUT", "/rest/config/folders/abc", `{"id": "other"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected result %d for mismatched ID", rec.Code)
+	}
+
+	// Devices, which are also removed from the folders when deleted.
+
+	dev := protocol.DeviceID{1, 2, 3}
+	if rec = request("PUT", "/rest/config/devices/"+dev.String(), `{"name": "other"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected result %d for device put: %s", rec.Code, rec.Body)
+	}
+	if rec = request("PATCH", "/rest/config/folders/abc", `{"devices": [{"deviceID": "`+dev.String()+`"}]}`); rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected result %d for folder patch: %s", rec.Code, rec.Body)
+	}
+	if devs := w.Folders()["abc"].Devices; len(devs) != 2 {
+		t.Fatalf("Incorrect folder devices %v", devs)
+	}
+	if rec = request("DELETE", "/rest/config/devices/"+dev.String(), ""); rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected result %d for device delete: %s", rec.Code, rec.Body)
+	}
+	if _, ok := w.Devices()[dev]; ok {
+		t.Error("Device not deleted")
+	}
+	if devs := w.Folders()["abc"].Devices; len(devs) != 1 || devs[0].DeviceID != myID {
+		t.Errorf("Incorrect folder devices after delete %v", devs)
+	}
+	if rec = request("DELETE", "/rest/config/devices/"+myID.String(), ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected result %d for deleting the local device", rec.Code)
+	}
+	if rec = request("GET", "/rest/config/devices/invalid", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected result %d for invalid device ID", rec.Code)
+	}
+
+	// Options and GUI can be changed but not deleted.
+
+	if rec = request("PATCH", "/rest/config/options", `{"maxSendKbps": 42}`); rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected result %d for options patch: %s", rec.Code, rec.Body)
+	}
+	if opts := w.Options(); opts.MaxSendKbps != 42 || opts.ReconnectIntervalS != 60 {
+		t.Errorf("Options not patched: %+v", opts)
+	}
+	if rec = request("DELETE", "/rest/config/gui", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected result %d for gui delete", rec.Code)
+	}
+	if rec = request("PATCH", "/rest/config/gui", `{"password": "secret"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected result %d for gui patch: %s", rec.Code, rec.Body)
+	}
+	if pw := w.GUI().Password; pw == "" || pw == "secret" {
+		t.Errorf("Password not hashed: %q", pw)
+	}
+
+	// Deleting the folder, twice.
+
+	if rec = request("DELETE", "/rest/config/folders/abc", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected result %d for folder delete: %s", rec.Code, rec.Body)
+	}
+	if _, ok := w.Folders()["abc"]; ok {
+		t.Error("Folder not deleted")
+	}
+	if rec = request("DELETE", "/rest/config/folders/abc", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Unexpected result %d for deleting a missing folder", rec.Code)
+	}
+	if rec = request("GET", "/rest/config/something", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Unexpected result %d for unknown resource", rec.Code)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	cfg := &mockedConfig{gui: config.GUIConfiguration{
+		APIKey: "main",
+		APIKeys: []config.APIKeyConfiguration{
+			{Name: "monitoring", Key: "readonly", Scope: config.APIKeyScopeReadOnly},
+			{Name: "scanner", Key: "control", Scope: config.APIKeyScopeControl, Folders: []string{"default"}},
+			{Name: "admin", Key: "admin", Scope: config.APIKeyScopeAdmin},
+		},
+	}}
+	svc := &apiService{cfg: cfg, model: new(mockedModel)}
+
+	getRestMux := http.NewServeMux()
+	getRestMux.HandleFunc("/rest/db/status", svc.getDBStatus)
+	getRestMux.HandleFunc("/rest/system/config", func(w http.ResponseWriter, r *http.Request) {})
+	postRestMux := http.NewServeMux()
+	postRestMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	handler := getPostHandler(cfg, getRestMux, postRestMux)
+
+	sub := events.Default.Subscribe(events.APIRequestDenied)
+	defer events.Default.Unsubscribe(sub)
+
+	cases := []struct {
+		key    string
+		method string
+		url    string
+		code   int
+	}{
+		{"readonly", "GET", "/rest/db/status?folder=other", 200},
+		{"readonly", "POST", "/rest/db/scan?folder=other", 403},
+		{"readonly", "GET", "/rest/system/config", 200}, // redacted
+		{"readonly", "POST", "/rest/system/config", 403},
+		{"control", "GET", "/rest/db/status?folder=default", 200},
+		{"control", "GET", "/rest/db/status?folder=other", 403},
+		{"control", "POST", "/rest/db/scan?folder=default", 200},
+		{"control", "POST", "/rest/system/shutdown", 403},
+		{"admin", "GET", "/rest/system/config", 200},
+		{"admin", "POST", "/rest/system/shutdown", 200},
+		{"main", "POST", "/rest/system/shutdown", 200},
+		{"", "POST", "/rest/system/shutdown", 200}, // authenticated otherwise, by session
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, "http://localhost"+tc.url, nil)
+		req.Header.Set("X-API-Key", tc.key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("Unexpected result %d != %d for %s %s with key %q", rec.Code, tc.code, tc.method, tc.url, tc.key)
+		}
+	}
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := ev.Data.(map[string]interface{}); data["apiKey"] != "monitoring" || data["path"] != "/rest/db/scan" {
+		t.Errorf("Unexpected event data %v", data)
+	}
+}
+
+func TestGUIAccountRoles(t *testing.T) {
+	hash := func(password string) string {
+		bs, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(bs)
+	}
+
+	cfg := &mockedConfig{gui: config.GUIConfiguration{
+		User:     "admin",
+		Password: hash("adminpw"),
+		APIKey:   "main",
+		Accounts: []config.GUIAccountConfiguration{
+			{Name: "noc", Password: hash("nocpw"), Role: config.GUIUserRoleViewer},
+			{Name: "helpdesk", Password: hash("helpdeskpw"), Role: config.GUIUserRoleOperator},
+		},
+	}}
+	svc := &apiService{cfg: cfg, model: new(mockedModel)}
+
+	getRestMux := http.NewServeMux()
+	getRestMux.HandleFunc("/rest/system/config", svc.getSystemConfig)
+	postRestMux := http.NewServeMux()
+	postRestMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	handler := basicAuthAndSessionMiddleware("sessionid-test", cfg, getPostHandler(cfg, getRestMux, postRestMux))
+
+	sub := events.Default.Subscribe(events.LoginAttempt)
+	defer events.Default.Unsubscribe(sub)
+
+	cases := []struct {
+		user     string
+		password string
+		method   string
+		url      string
+		code     int
+	}{
+		{"noc", "wrong", "GET", "/rest/system/config", 401},
+		{"noc", "nocpw", "GET", "/rest/system/config", 200},
+		{"noc", "nocpw", "POST", "/rest/db/scan", 403},
+		{"helpdesk", "helpdeskpw", "POST", "/rest/db/scan", 200},
+		{"helpdesk", "helpdeskpw", "POST", "/rest/system/config", 403},
+		{"admin", "adminpw", "POST", "/rest/system/config", 200},
+	}
+
+	for _, tc := range cases {
+		// Log in with basic authentication, then make the request again in
+		// the session.
+		req, _ := http.NewRequest(tc.method, "http://localhost"+tc.url, nil)
+		req.RemoteAddr = "192.0.2.42:1234"
+		req.SetBasicAuth(tc.user, tc.password)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("Unexpected result %d != %d for %s %s as %q", rec.Code, tc.code, tc.method, tc.url, tc.user)
+		}
+		if rec.Code == http.StatusUnauthorized {
+			continue
+		}
+
+		cookie := rec.Header().Get("Set-Cookie")
+		req, _ = http.NewRequest(tc.method, "http://localhost"+tc.url, nil)
+		req.Header.Set("Cookie", cookie)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("Unexpected result %d != %d for %s %s in the session of %q", rec.Code, tc.code, tc.method, tc.url, tc.user)
+		}
+		if tc.user == "noc" && tc.method == "GET" && strings.Contains(rec.Body.String(), "$2a$") {
+			t.Error("Password hashes shown to a viewer")
+		}
+	}
+
+	// The main API key is not limited by a session.
+	req, _ := http.NewRequest("POST", "http://localhost/rest/system/config", nil)
+	req.SetBasicAuth("noc", "nocpw")
+	req.Header.Set("X-API-Key", "main")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Unexpected result %d for main API key", rec.Code)
+	}
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ev.Data.(map[string]interface{})
+	if data["success"] != false || data["username"] != "noc" || data["role"] != "viewer" || data["sourceIP"] != "192.0.2.42" {
+		t.Errorf("Unexpected login event data %v", data)
+	}
+	ev, err = sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := ev.Data.(map[string]interface{}); data["success"] != true || data["role"] != "viewer" {
+		t.Errorf("Unexpected login event data %v", data)
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	password, err := bcrypt.GenerateFromPassword([]byte("opspw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCfg := config.New(myID)
+	newCfg.GUI.Accounts = []config.GUIAccountConfiguration{
+		{Name: "ops", Password: string(password), Role: config.GUIUserRoleOperator},
+	}
+	w := config.Wrap(filepath.Join(dir, "config.xml"), newCfg)
+	svc := &apiService{
+		cfg:             w,
+		systemConfigMut: sync.NewMutex(),
+		totpPending:     make(map[string]string),
+	}
+
+	getRestMux := http.NewServeMux()
+	getRestMux.HandleFunc("/rest/system/totp", svc.getTOTP)
+	postRestMux := http.NewServeMux()
+	postRestMux.HandleFunc("/rest/system/totp/enroll", svc.postTOTPEnroll)
+	postRestMux.HandleFunc("/rest/system/totp/confirm", svc.postTOTPConfirm)
+	handler := basicAuthAndSessionMiddleware("sessionid-test", w, getPostHandler(w, getRestMux, postRestMux))
+
+	loginFailuresMut.Lock()
+	loginFailures = make(map[string]*loginFailure)
+	loginFailuresMut.Unlock()
+
+	login := func(password, code string) *httptest.ResponseRecorder {
+		form := "user=ops&password=" + password + "&code=" + code
+		req, _ := http.NewRequest("POST", "http://localhost/login", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "192.0.2.42:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	inSession := func(rec *httptest.ResponseRecorder, method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+path, nil)
+		req.Header.Set("Cookie", rec.Header().Get("Set-Cookie"))
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Enrol from a session started without a code.
+
+	session := login("opspw", "")
+	if session.Code != http.StatusSeeOther {
+		t.Fatalf("Unexpected result %d for login", session.Code)
+	}
+	rec := inSession(session, "POST", "/rest/system/totp/enroll")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected result %d for enroll: %s", rec.Code, rec.Body)
+	}
+	var secret string
+	code := func() string {
+		code, err := totp.Code(secret, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	var enroll map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &enroll); err != nil {
+		t.Fatal(err)
+	}
+	secret = enroll["secret"]
+	if secret == "" || !strings.HasPrefix(enroll["uri"], "otpauth://totp/") {
+		t.Fatalf("Unexpected enrolment %v", enroll)
+	}
+
+	rec = inSession(session, "POST", "/rest/system/totp/confirm?code=000000x")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected result %d for confirm with a bad code", rec.Code)
+	}
+	rec = inSession(session, "POST", "/rest/system/totp/confirm?code="+code())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected result %d for confirm: %s", rec.Code, rec.Body)
+	}
+	var confirm map[string][]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &confirm); err != nil {
+		t.Fatal(err)
+	}
+	if len(confirm["recoveryCodes"]) != totpRecoveryCodes {
+		t.Fatalf("Unexpected recovery codes %v", confirm)
+	}
+	if account, _ := w.GUI().Account("ops"); account.TOTPSecret != secret || len(account.RecoveryCodes) != totpRecoveryCodes {
+		t.Fatalf("TOTP not stored: %+v", account)
+	}
+
+	// The password is no longer enough, neither in the form nor with basic
+	// authentication.
+
+	if rec := login("opspw", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected result %d for login without a code", rec.Code)
+	}
+	req, _ := http.NewRequest("GET", "http://localhost/rest/system/totp", nil)
+	req.SetBasicAuth("ops", "opspw")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected result %d for basic authentication", rec.Code)
+	}
+
+	if rec := login("opspw", code()); rec.Code != http.StatusSeeOther {
+		t.Errorf("Unexpected result %d for login with a code", rec.Code)
+	}
+
+	// A recovery code works once.
+
+	recovery := confirm["recoveryCodes"][0]
+	if rec := login("opspw", recovery); rec.Code != http.StatusSeeOther {
+		t.Errorf("Unexpected result %d for login with a recovery code", rec.Code)
+	}
+	if rec := login("opspw", recovery); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected result %d for login with a used recovery code", rec.Code)
+	}
+	rec = inSession(session, "GET", "/rest/system/totp")
+	if !strings.Contains(rec.Body.String(), fmt.Sprintf(`"recoveryCodes":%d`, totpRecoveryCodes-1)) {
+		t.Errorf("Unexpected status %s", rec.Body)
+	}
+
+	// Repeated failures lock the user out, even with the right password and
+	// code.
+
+	for i := 0; i < loginMaxFailures; i++ {
+		login("wrong", "")
+	}
+	if rec := login("opspw", code()); rec.Code != 429 {
+		t.Errorf("Unexpected result %d after repeated failures", rec.Code)
+	}
+
+	loginFailuresMut.Lock()
+	loginFailures = make(map[string]*loginFailure)
+	loginFailuresMut.Unlock()
+}
+
+func TestLDAPLocalFallback(t *testing.T) {
+	// An address where nothing is listening.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	password, err := bcrypt.GenerateFromPassword([]byte("adminpw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &mockedConfig{gui: config.GUIConfiguration{
+		User:     "admin",
+		Password: string(password),
+		LDAP: config.LDAPConfiguration{
+			Address:       addr,
+			BindDN:        "uid=%s,dc=example,dc=com",
+			TimeoutS:      1,
+			LocalFallback: true,
+		},
+	}}
+	handler := basicAuthAndSessionMiddleware("sessionid-test", cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func() int {
+		req, _ := http.NewRequest("GET", "http://localhost/rest/system/status", nil)
+		req.SetBasicAuth("admin", "adminpw")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := request(); code != http.StatusOK {
+		t.Errorf("Unexpected result %d with local fallback", code)
+	}
+
+	cfg.gui.LDAP.LocalFallback = false
+	if code := request(); code != http.StatusUnauthorized {
+		t.Errorf("Unexpected result %d without local fallback", code)
+	}
+
+	loginFailuresMut.Lock()
+	loginFailures = make(map[string]*loginFailure)
+	loginFailuresMut.Unlock()
+}
+
 func startHTTP(cfg *mockedConfig) (string, error) {
 	model := new(mockedModel)
 	httpsCertFile := "../../test/h1/https-cert.pem"
@@ -463,12 +1011,13 @@ func startHTTP(cfg *mockedConfig) (string, error) {
 	eventSub := new(mockedEventSub)
 	discoverer := new(mockedCachingMux)
 	connections := new(mockedConnections)
+	webhooks := new(mockedWebhooks)
 	errorLog := new(mockedLoggerRecorder)
 	systemLog := new(mockedLoggerRecorder)
 
 	// Instantiate the API service
 	svc, err := newAPIService(protocol.LocalDeviceID, cfg, httpsCertFile, httpsKeyFile, assetDir, model,
-		eventSub, discoverer, connections, errorLog, systemLog)
+		eventSub, discoverer, connections, webhooks, errorLog, systemLog)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,174 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/totp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// GUI accounts enable two-factor authentication for themselves. Enrolling
+// generates a secret to add to an authenticator app, through the QR code.
+// Confirming with a code from the app stores the secret in the configuration,
+// along with a set of single use recovery codes for when the app is lost.
+
+const totpRecoveryCodes = 10
+
+// totpAccount returns the GUI account the request was made by, or responds
+// with an error if there is none.
+func (s *apiService) totpAccount(w http.ResponseWriter, r *http.Request) (config.GUIAccountConfiguration, bool) {
+	login, ok := sessionLogin(r)
+	account, exists := login.account(s.cfg.GUI())
+	if !ok || !exists || login.ldap {
+		http.Error(w, "Two-factor authentication is set up when logged in to a GUI account", http.StatusBadRequest)
+		return config.GUIAccountConfiguration{}, false
+	}
+	return account, true
+}
+
+func (s *apiService) getTOTP(w http.ResponseWriter, r *http.Request) {
+	account, ok := s.totpAccount(w, r)
+	if !ok {
+		return
+	}
+	sendJSON(w, map[string]interface{}{
+		"enabled":       account.TOTPSecret != "",
+		"recoveryCodes": len(account.RecoveryCodes),
+	})
+}
+
+func (s *apiService) postTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	account, ok := s.totpAccount(w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.systemConfigMut.Lock()
+	s.totpPending[account.Name] = secret
+	s.systemConfigMut.Unlock()
+
+	uri := totp.URI(secret, "Syncthing", account.Name+"@"+s.id.Short().String())
+	sendJSON(w, map[string]string{
+		"secret": secret,
+		"uri":    uri,
+		"qr":     "/qr/?text=" + url.QueryEscape(uri),
+	})
+}
+
+func (s *apiService) postTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	account, ok := s.totpAccount(w, r)
+	if !ok {
+		return
+	}
+
+	s.systemConfigMut.Lock()
+	defer s.systemConfigMut.Unlock()
+
+	secret, ok := s.totpPending[account.Name]
+	if !ok {
+		http.Error(w, "No enrolment in progress", http.StatusBadRequest)
+		return
+	}
+	if !totp.Validate(secret, r.URL.Query().Get("code"), time.Now()) {
+		http.Error(w, "Incorrect code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	account = account.Copy()
+	account.TOTPSecret = secret
+	account.RecoveryCodes = hashes
+	if err := s.setAccount(account); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	delete(s.totpPending, account.Name)
+
+	// This is the only time the recovery codes are shown.
+	sendJSON(w, map[string][]string{
+		"recoveryCodes": codes,
+	})
+}
+
+func (s *apiService) postTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	account, ok := s.totpAccount(w, r)
+	if !ok {
+		return
+	}
+	if account.TOTPSecret == "" {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if !totp.Validate(account.TOTPSecret, r.URL.Query().Get("code"), time.Now()) {
+		http.Error(w, "Incorrect code", http.StatusBadRequest)
+		return
+	}
+
+	s.systemConfigMut.Lock()
+	defer s.systemConfigMut.Unlock()
+
+	account = account.Copy()
+	account.TOTPSecret = ""
+	account.RecoveryCodes = []string{}
+	if err := s.setAccount(account); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// setAccount replaces the account in the configuration. The caller must hold
+// systemConfigMut.
+func (s *apiService) setAccount(account config.GUIAccountConfiguration) error {
+	to := s.cfg.Raw().Copy()
+	if !to.GUI.SetAccount(account) {
+		return errors.New("account has been removed")
+	}
+	resp := s.cfg.Replace(to)
+	if resp.ValidationError != nil {
+		return resp.ValidationError
+	}
+	configInSync = !resp.RequiresRestart
+	return s.cfg.Save()
+}
+
+// newRecoveryCodes returns a set of recovery codes, and their bcrypt hashes
+// to store in the configuration.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < totpRecoveryCodes; i++ {
+		bs := make([]byte, 5)
+		if _, err := rand.Read(bs); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(bs))
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, string(hash))
+	}
+	return codes, hashes, nil
+}
@@ -21,18 +21,19 @@ type locationEnum string
 // Use strings as keys to make printout and serialization of the locations map
 // more meaningful.
 const (
-	locConfigFile    locationEnum = "config"
-	locCertFile                   = "certFile"
-	locKeyFile                    = "keyFile"
-	locHTTPSCertFile              = "httpsCertFile"
-	locHTTPSKeyFile               = "httpsKeyFile"
-	locDatabase                   = "database"
-	locLogFile                    = "logFile"
-	locCsrfTokens                 = "csrfTokens"
-	locPanicLog                   = "panicLog"
-	locAuditLog                   = "auditLog"
-	locGUIAssets                  = "GUIAssets"
-	locDefFolder                  = "defFolder"
+	locConfigFile         locationEnum = "config"
+	locCertFile                        = "certFile"
+	locKeyFile                         = "keyFile"
+	locHTTPSCertFile                   = "httpsCertFile"
+	locHTTPSKeyFile                    = "httpsKeyFile"
+	locDatabase                        = "database"
+	locLogFile                         = "logFile"
+	locCsrfTokens                      = "csrfTokens"
+	locPanicLog                        = "panicLog"
+	locAuditLog                        = "auditLog"
+	locGUIAssets                       = "GUIAssets"
+	locDefFolder                       = "defFolder"
+	locDeviceIDTransition              = "deviceIDTransition"
 )
 
 // Platform dependent directories
@@ -43,18 +44,19 @@ var baseDirs = map[string]string{
 
 // Use the variables from baseDirs here
 var locations = map[locationEnum]string{
-	locConfigFile:    "${config}/config.xml",
-	locCertFile:      "${config}/cert.pem",
-	locKeyFile:       "${config}/key.pem",
-	locHTTPSCertFile: "${config}/https-cert.pem",
-	locHTTPSKeyFile:  "${config}/https-key.pem",
-	locDatabase:      "${config}/index-v0.13.0.db",
-	locLogFile:       "${config}/syncthing.log", // -logfile on Windows
-	locCsrfTokens:    "${config}/csrftokens.txt",
-	locPanicLog:      "${config}/panic-${timestamp}.log",
-	locAuditLog:      "${config}/audit-${timestamp}.log",
-	locGUIAssets:     "${config}/gui",
-	locDefFolder:     "${home}/Sync",
+	locConfigFile:         "${config}/config.xml",
+	locCertFile:           "${config}/cert.pem",
+	locKeyFile:            "${config}/key.pem",
+	locHTTPSCertFile:      "${config}/https-cert.pem",
+	locHTTPSKeyFile:       "${config}/https-key.pem",
+	locDatabase:           "${config}/index-v0.13.0.db",
+	locLogFile:            "${config}/syncthing.log", // -logfile on Windows
+	locCsrfTokens:         "${config}/csrftokens.txt",
+	locPanicLog:           "${config}/panic-${timestamp}.log",
+	locAuditLog:           "${config}/audit-${timestamp}.log",
+	locGUIAssets:          "${config}/gui",
+	locDefFolder:          "${home}/Sync",
+	locDeviceIDTransition: "${config}/device-id-transition.txt",
 }
 
 // expandLocations replaces the variables in the location map with actual
@@ -43,6 +43,7 @@ import (
 	"github.com/syncthing/syncthing/lib/tlsutil"
 	"github.com/syncthing/syncthing/lib/upgrade"
 	"github.com/syncthing/syncthing/lib/util"
+	"github.com/syncthing/syncthing/lib/webhook"
 
 	"github.com/thejerf/suture"
 )
@@ -72,11 +73,13 @@ const (
 	bepProtocolName      = "bep/1.0"
 	tlsDefaultCommonName = "syncthing"
 	httpsRSABits         = 2048
-	bepRSABits           = 0 // 384 bit ECDSA used instead
+	bepKeyType           = tlsutil.KeyTypeECDSAP384 // unless -generate-key-type is given
 	pingEventInterval    = time.Minute
 	maxSystemErrors      = 5
 	initialSystemLog     = 10
 	maxSystemLog         = 250
+	eventSubBufferSize   = 1000
+	maxMaskedEventSubs   = 8
 )
 
 // The discovery results are sorted by their source priority.
@@ -132,6 +135,21 @@ I.e. to prefix each log line with date and time, set -logflags=3 (1 + 2 from
 above). The value 0 is used to disable all of the above. The default is to
 show time only (2).
 
+With -logformat=json each log line is instead a JSON object with the time,
+level, facility and message, plus the folder or device concerned when there
+is one. The -logflags value does not apply.
+
+The log file given by -logfile, and the audit file, are rotated when they
+reach -log-max-size or -log-max-age. The old file is compressed and the
+newest -log-max-old-files of those are kept. For external log rotation
+instead, move the log file away and send SIGUSR1; Syncthing then logs to a
+new file without restarting. (SIGHUP restarts Syncthing.)
+
+The device key, created by -generate or on the first start, is a 384 bit
+ECDSA key unless -generate-key-type says otherwise. The "ecdsa-p256" and
+"ed25519" key types make connection handshakes considerably cheaper on slow
+devices. The device ID of an existing key does not change.
+
 
 Development Settings
 --------------------
@@ -165,6 +183,12 @@ are mostly useful for developers. Use with care.
 
  STNOUPGRADE       Disable automatic upgrades.
 
+ STDBBACKEND       The database backend to use, "leveldb" (the default) or
+                   "btree". Each backend keeps its database in a separate
+                   location. The "btree" backend is experimental and keeps
+                   the entire database in memory, so it's only suitable
+                   where the database is small compared to available RAM.
+
  GOMAXPROCS        Set the maximum number of CPU cores to use. Defaults to all
                    available CPU cores.
 
@@ -186,11 +210,15 @@ var (
 	noUpgrade       = os.Getenv("STNOUPGRADE") != ""
 	innerProcess    = os.Getenv("STNORESTART") != "" || os.Getenv("STMONITORED") != ""
 	noDefaultFolder = os.Getenv("STNODEFAULTFOLDER") != ""
+	dbBackend       = os.Getenv("STDBBACKEND")
 )
 
 type RuntimeOptions struct {
 	confDir        string
 	reset          bool
+	checkDB        bool
+	exportDB       string
+	importDB       string
 	showVersion    bool
 	showPaths      bool
 	doUpgrade      bool
@@ -206,22 +234,39 @@ type RuntimeOptions struct {
 	guiAddress     string
 	guiAPIKey      string
 	generateDir    string
+	keyType        string
 	noRestart      bool
 	profiler       string
 	assetDir       string
 	cpuProfile     bool
 	stRestarting   bool
 	logFlags       int
+	logFormat      string
+	logMaxSize     int // MiB
+	logMaxAge      time.Duration
+	logMaxOldFiles int
+}
+
+// logRotation returns how the log and audit files are rotated.
+func (o RuntimeOptions) logRotation() logRotation {
+	return logRotation{
+		maxSize:     int64(o.logMaxSize) << 20,
+		maxAge:      o.logMaxAge,
+		maxArchives: o.logMaxOldFiles,
+	}
 }
 
 func defaultRuntimeOptions() RuntimeOptions {
 	options := RuntimeOptions{
-		noRestart:    os.Getenv("STNORESTART") != "",
-		profiler:     os.Getenv("STPROFILER"),
-		assetDir:     os.Getenv("STGUIASSETS"),
-		cpuProfile:   os.Getenv("STCPUPROFILE") != "",
-		stRestarting: os.Getenv("STRESTART") != "",
-		logFlags:     log.Ltime,
+		noRestart:      os.Getenv("STNORESTART") != "",
+		profiler:       os.Getenv("STPROFILER"),
+		assetDir:       os.Getenv("STGUIASSETS"),
+		cpuProfile:     os.Getenv("STCPUPROFILE") != "",
+		stRestarting:   os.Getenv("STRESTART") != "",
+		logFlags:       log.Ltime,
+		logFormat:      "text",
+		keyType:        bepKeyType,
+		logMaxOldFiles: 3,
 	}
 
 	if os.Getenv("STTRACE") != "" {
@@ -243,14 +288,19 @@ func parseCommandLineOptions() RuntimeOptions {
 	options := defaultRuntimeOptions()
 
 	flag.StringVar(&options.generateDir, "generate", "", "Generate key and config in specified dir, then exit")
+	flag.StringVar(&options.keyType, "generate-key-type", options.keyType, "Type of newly generated device keys (\""+strings.Join(tlsutil.KeyTypes, "\", \"")+"\")")
 	flag.StringVar(&options.guiAddress, "gui-address", options.guiAddress, "Override GUI address (e.g. \"http://192.0.2.42:8443\")")
 	flag.StringVar(&options.guiAPIKey, "gui-apikey", options.guiAPIKey, "Override GUI API key")
 	flag.StringVar(&options.confDir, "home", "", "Set configuration directory")
 	flag.IntVar(&options.logFlags, "logflags", options.logFlags, "Select information in log line prefix (see below)")
+	flag.StringVar(&options.logFormat, "logformat", options.logFormat, "Log line format (\"text\" or \"json\")")
 	flag.BoolVar(&options.noBrowser, "no-browser", false, "Do not start browser")
 	flag.BoolVar(&options.browserOnly, "browser-only", false, "Open GUI in browser")
 	flag.BoolVar(&options.noRestart, "no-restart", options.noRestart, "Do not restart; just exit")
 	flag.BoolVar(&options.reset, "reset", false, "Reset the database")
+	flag.BoolVar(&options.checkDB, "check-db", false, "Check and repair the database at startup")
+	flag.StringVar(&options.exportDB, "export-db", "", "Export the database to the given file (\"-\" for stdout), then exit")
+	flag.StringVar(&options.importDB, "import-db", "", "Import the database from the given file (\"-\" for stdin), then exit")
 	flag.BoolVar(&options.doUpgrade, "upgrade", false, "Perform upgrade")
 	flag.BoolVar(&options.doUpgradeCheck, "upgrade-check", false, "Check for available upgrade")
 	flag.BoolVar(&options.showVersion, "version", false, "Show version")
@@ -260,6 +310,9 @@ func parseCommandLineOptions() RuntimeOptions {
 	flag.BoolVar(&options.verbose, "verbose", false, "Print verbose log output")
 	flag.BoolVar(&options.paused, "paused", false, "Start with all devices paused")
 	flag.StringVar(&options.logFile, "logfile", options.logFile, "Log file name (use \"-\" for stdout)")
+	flag.IntVar(&options.logMaxSize, "log-max-size", options.logMaxSize, "Rotate the log and audit files when they reach this size in MiB (0 to disable)")
+	flag.DurationVar(&options.logMaxAge, "log-max-age", options.logMaxAge, "Rotate the log and audit files when they get older than this, e.g. \"24h\" (0 to disable)")
+	flag.IntVar(&options.logMaxOldFiles, "log-max-old-files", options.logMaxOldFiles, "Number of compressed rotated log and audit files to keep")
 	if runtime.GOOS == "windows" {
 		// Allow user to hide the console window
 		flag.BoolVar(&options.hideConsole, "no-console", false, "Hide console window")
@@ -275,6 +328,16 @@ func parseCommandLineOptions() RuntimeOptions {
 func main() {
 	options := parseCommandLineOptions()
 	l.SetFlags(options.logFlags)
+	switch options.logFormat {
+	case "text":
+	case "json":
+		l.SetFormat(logger.FormatJSON)
+	default:
+		l.Fatalf("Unknown log format %q; expected \"text\" or \"json\"", options.logFormat)
+	}
+	if !validKeyType(options.keyType) {
+		l.Fatalf("Unknown key type %q; expected one of %s", options.keyType, strings.Join(tlsutil.KeyTypes, ", "))
+	}
 
 	if options.guiAddress != "" {
 		// The config picks this up from the environment.
@@ -326,7 +389,7 @@ func main() {
 	}
 
 	if options.generateDir != "" {
-		generate(options.generateDir)
+		generate(options.generateDir, options.keyType)
 		return
 	}
 
@@ -358,6 +421,20 @@ func main() {
 		return
 	}
 
+	if options.exportDB != "" {
+		if err := exportDB(options.exportDB); err != nil {
+			l.Fatalln("Export database:", err)
+		}
+		return
+	}
+
+	if options.importDB != "" {
+		if err := importDB(options.importDB); err != nil {
+			l.Fatalln("Import database:", err)
+		}
+		return
+	}
+
 	if options.noRestart {
 		syncthingMain(options)
 	} else {
@@ -374,7 +451,7 @@ func openGUI() {
 	}
 }
 
-func generate(generateDir string) {
+func generate(generateDir, keyType string) {
 	dir, err := osutil.ExpandTilde(generateDir)
 	if err != nil {
 		l.Fatalln("generate:", err)
@@ -387,7 +464,7 @@ func generate(generateDir string) {
 		l.Warnln("Key exists; will not overwrite.")
 		l.Infoln("Device ID:", protocol.NewDeviceID(cert.Certificate[0]))
 	} else {
-		cert, err = tlsutil.NewCertificate(certFile, keyFile, tlsDefaultCommonName, bepRSABits)
+		cert, err = tlsutil.NewCertificateWithKeyType(certFile, keyFile, tlsDefaultCommonName, keyType)
 		if err != nil {
 			l.Fatalln("Create certificate:", err)
 		}
@@ -414,6 +491,15 @@ func generate(generateDir string) {
 	}
 }
 
+func validKeyType(keyType string) bool {
+	for _, kt := range tlsutil.KeyTypes {
+		if kt == keyType {
+			return true
+		}
+	}
+	return false
+}
+
 func debugFacilities() string {
 	facilities := l.Facilities()
 
@@ -455,8 +541,8 @@ func checkUpgrade() upgrade.Release {
 }
 
 func performUpgrade(release upgrade.Release) {
-	// Use leveldb database locks to protect against concurrent upgrades
-	_, err := db.Open(locations[locDatabase])
+	// Use the database lock to protect against concurrent upgrades
+	_, err := openDatabase()
 	if err == nil {
 		err = upgrade.To(release)
 		if err != nil {
@@ -522,7 +608,7 @@ func syncthingMain(runtimeOptions RuntimeOptions) {
 	l.SetPrefix("[start] ")
 
 	if runtimeOptions.auditEnabled {
-		startAuditing(mainService)
+		startAuditing(mainService, runtimeOptions.logRotation())
 	}
 
 	if runtimeOptions.verbose {
@@ -533,7 +619,7 @@ func syncthingMain(runtimeOptions RuntimeOptions) {
 	systemLog := logger.NewRecorder(l, logger.LevelDebug, maxSystemLog, initialSystemLog)
 
 	// Event subscription for the API; must start early to catch the early events.
-	apiSub := events.NewBufferedSubscription(events.Default.Subscribe(events.AllEvents), 1000)
+	apiSub := events.NewBufferedSubscription(events.Default.Subscribe(events.AllEvents), eventSubBufferSize)
 
 	if len(os.Getenv("GOMAXPROCS")) == 0 {
 		runtime.GOMAXPROCS(runtime.NumCPU())
@@ -547,8 +633,8 @@ func syncthingMain(runtimeOptions RuntimeOptions) {
 	// Ensure that that we have a certificate and key.
 	cert, err := tls.LoadX509KeyPair(locations[locCertFile], locations[locKeyFile])
 	if err != nil {
-		l.Infof("Generating ECDSA key and certificate for %s...", tlsDefaultCommonName)
-		cert, err = tlsutil.NewCertificate(locations[locCertFile], locations[locKeyFile], tlsDefaultCommonName, bepRSABits)
+		l.Infof("Generating %s key and certificate for %s...", runtimeOptions.keyType, tlsDefaultCommonName)
+		cert, err = tlsutil.NewCertificateWithKeyType(locations[locCertFile], locations[locKeyFile], tlsDefaultCommonName, runtimeOptions.keyType)
 		if err != nil {
 			l.Fatalln(err)
 		}
@@ -570,6 +656,9 @@ func syncthingMain(runtimeOptions RuntimeOptions) {
 
 	cfg := loadOrCreateConfig()
 
+	// Finish or continue a certificate rotation.
+	transition, announceTransition := applyDeviceIDTransition(cfg, locations[locDeviceIDTransition])
+
 	if err := checkShortIDs(cfg); err != nil {
 		l.Fatalln("Short device IDs are in conflict. Unlucky!\n  Regenerate the device ID of one of the following:\n  ", err)
 	}
@@ -614,7 +703,9 @@ func syncthingMain(runtimeOptions RuntimeOptions) {
 		symlinks.Supported = false
 	}
 
-	if (opts.MaxRecvKbps > 0 || opts.MaxSendKbps > 0) && !opts.LimitBandwidthInLan {
+	// The rate limits may be set later on, or by the bandwidth schedule, so
+	// we need to know the local networks regardless.
+	if !opts.LimitBandwidthInLan {
 		lans, _ = osutil.GetLans()
 		for _, lan := range opts.AlwaysLocalNets {
 			_, ipnet, err := net.ParseCIDR(lan)
@@ -629,18 +720,23 @@ func syncthingMain(runtimeOptions RuntimeOptions) {
 		for i, lan := range lans {
 			networks[i] = lan.String()
 		}
-		l.Infoln("Local networks:", strings.Join(networks, ", "))
+		if opts.HasRateLimits() {
+			l.Infoln("Local networks:", strings.Join(networks, ", "))
+		}
 	}
 
-	dbFile := locations[locDatabase]
-	ldb, err := db.Open(dbFile)
+	if dbBackend == db.BackendBTree {
+		l.Warnln("Using the experimental btree database backend; the entire database is kept in memory")
+	}
+
+	ldb, err := openDatabase()
 
 	if err != nil {
 		l.Fatalln("Cannot open database:", err, "- Is another copy of Syncthing already running?")
 	}
 
 	protectedFiles := []string{
-		locations[locDatabase],
+		databaseFile(),
 		locations[locConfigFile],
 		locations[locCertFile],
 		locations[locKeyFile],
@@ -658,6 +754,10 @@ func syncthingMain(runtimeOptions RuntimeOptions) {
 	m := model.NewModel(cfg, myID, myDeviceName(cfg), "syncthing", Version, ldb, protectedFiles)
 	cfg.Subscribe(m)
 
+	if announceTransition {
+		m.AnnounceDeviceIDTransition(transition)
+	}
+
 	if t := os.Getenv("STDEADLOCKTIMEOUT"); len(t) > 0 {
 		it, err := strconv.Atoi(t)
 		if err == nil {
@@ -684,6 +784,9 @@ func syncthingMain(runtimeOptions RuntimeOptions) {
 			}
 			m.Index(device, folderCfg.ID, nil, 0, nil)
 		}
+		if runtimeOptions.checkDB || ldb.Recovered() {
+			m.CheckDatabase(folderCfg.ID)
+		}
 		m.StartFolder(folderCfg.ID)
 	}
 
@@ -699,6 +802,12 @@ func syncthingMain(runtimeOptions RuntimeOptions) {
 	connectionsService := connections.NewService(cfg, myID, m, tlsCfg, cachedDiscovery, bepProtocolName, tlsDefaultCommonName, lans)
 	mainService.Add(connectionsService)
 
+	// Start webhook delivery
+
+	webhooks := webhook.NewService(cfg, ldb)
+	cfg.Subscribe(webhooks)
+	mainService.Add(webhooks)
+
 	if cfg.Options().GlobalAnnEnabled {
 		for _, srv := range cfg.GlobalDiscoveryServers() {
 			l.Infoln("Using discovery server", srv)
@@ -734,7 +843,7 @@ func syncthingMain(runtimeOptions RuntimeOptions) {
 
 	// GUI
 
-	setupGUI(mainService, cfg, m, apiSub, cachedDiscovery, connectionsService, errors, systemLog, runtimeOptions)
+	setupGUI(mainService, cfg, m, apiSub, cachedDiscovery, connectionsService, webhooks, errors, systemLog, runtimeOptions)
 
 	if runtimeOptions.cpuProfile {
 		f, err := os.Create(fmt.Sprintf("cpu-%d.pprof", os.Getpid()))
@@ -825,6 +934,11 @@ func setupSignalHandling() {
 		stop <- exitRestarting
 	}()
 
+	// Reopening the log file is up to the monitor process; don't die
+	// should we get the signal as well.
+
+	ignoreReopen()
+
 	// Exit with "success" code (no restart) on INT/TERM
 
 	stopSign := make(chan os.Signal, 1)
@@ -899,14 +1013,15 @@ func archiveAndSaveConfig(cfg *config.Wrapper) error {
 	return cfg.Save()
 }
 
-func startAuditing(mainService *suture.Supervisor) {
+func startAuditing(mainService *suture.Supervisor, rotation logRotation) {
 	auditFile := timestampedLoc(locAuditLog)
 	fd, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		l.Fatalln("Audit:", err)
 	}
+	fd.Close()
 
-	auditService := newAuditService(fd)
+	auditService := newAuditService(newAutoclosedFile(auditFile, logFileAutoCloseDelay, logFileMaxOpenTime, rotation))
 	mainService.Add(auditService)
 
 	// We wait for the audit service to fully start before we return, to
@@ -916,7 +1031,7 @@ func startAuditing(mainService *suture.Supervisor) {
 	l.Infoln("Audit log in", auditFile)
 }
 
-func setupGUI(mainService *suture.Supervisor, cfg *config.Wrapper, m *model.Model, apiSub events.BufferedSubscription, discoverer discover.CachingMux, connectionsService *connections.Service, errors, systemLog logger.Recorder, runtimeOptions RuntimeOptions) {
+func setupGUI(mainService *suture.Supervisor, cfg *config.Wrapper, m *model.Model, apiSub events.BufferedSubscription, discoverer discover.CachingMux, connectionsService *connections.Service, webhooks *webhook.Service, errors, systemLog logger.Recorder, runtimeOptions RuntimeOptions) {
 	guiCfg := cfg.GUI()
 
 	if !guiCfg.Enabled {
@@ -927,7 +1042,7 @@ func setupGUI(mainService *suture.Supervisor, cfg *config.Wrapper, m *model.Mode
 		l.Warnln("Insecure admin access is enabled.")
 	}
 
-	api, err := newAPIService(myID, cfg, locations[locHTTPSCertFile], locations[locHTTPSKeyFile], runtimeOptions.assetDir, m, apiSub, discoverer, connectionsService, errors, systemLog)
+	api, err := newAPIService(myID, cfg, locations[locHTTPSCertFile], locations[locHTTPSKeyFile], runtimeOptions.assetDir, m, apiSub, discoverer, connectionsService, webhooks, errors, systemLog)
 	if err != nil {
 		l.Fatalln("Cannot start GUI:", err)
 	}
@@ -996,7 +1111,20 @@ func generatePingEvents() {
 }
 
 func resetDB() error {
-	return os.RemoveAll(locations[locDatabase])
+	return os.RemoveAll(databaseFile())
+}
+
+// databaseFile returns the location of the database. Backends other than the
+// default have their own location, as the on disk formats differ.
+func databaseFile() string {
+	if dbBackend == "" || dbBackend == db.BackendLevelDB {
+		return locations[locDatabase]
+	}
+	return locations[locDatabase] + "." + dbBackend
+}
+
+func openDatabase() (*db.Instance, error) {
+	return db.OpenBackend(dbBackend, databaseFile())
 }
 
 func restart() {
@@ -1125,6 +1253,7 @@ func cleanConfigDirectory() {
 	patterns := map[string]time.Duration{
 		"panic-*.log":      7 * 24 * time.Hour,  // keep panic logs for a week
 		"audit-*.log":      7 * 24 * time.Hour,  // keep audit logs for a week
+		"audit-*.log.*.gz": 7 * 24 * time.Hour,  // and their rotated parts
 		"index":            14 * 24 * time.Hour, // keep old index format for two weeks
 		"index*.converted": 14 * 24 * time.Hour, // keep old converted indexes for two weeks
 		"config.xml.v*":    30 * 24 * time.Hour, // old config versions for a month
@@ -1175,7 +1304,7 @@ func checkShortIDs(cfg *config.Wrapper) error {
 
 func showPaths() {
 	fmt.Printf("Configuration file:\n\t%s\n\n", locations[locConfigFile])
-	fmt.Printf("Database directory:\n\t%s\n\n", locations[locDatabase])
+	fmt.Printf("Database directory:\n\t%s\n\n", databaseFile())
 	fmt.Printf("Device private key & certificate files:\n\t%s\n\t%s\n\n", locations[locKeyFile], locations[locCertFile])
 	fmt.Printf("HTTPS private key & certificate files:\n\t%s\n\t%s\n\n", locations[locHTTPSKeyFile], locations[locHTTPSCertFile])
 	fmt.Printf("Log file:\n\t%s\n\n", locations[locLogFile])
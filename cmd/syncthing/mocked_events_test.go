@@ -13,3 +13,8 @@ type mockedEventSub struct{}
 func (s *mockedEventSub) Since(id int, into []events.Event) []events.Event {
 	select {}
 }
+
+func (s *mockedEventSub) SinceCancel(id int, into []events.Event, cancel <-chan struct{}) []events.Event {
+	<-cancel
+	return into
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/ignore"
 	"github.com/syncthing/syncthing/lib/model"
 	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syncthing/syncthing/lib/stats"
@@ -36,13 +37,17 @@ func (m *mockedModel) NeedSize(folder string) (nfiles int, bytes int64) {
 }
 
 func (m *mockedModel) ConnectionStats() map[string]interface{} {
-	return nil
+	return map[string]interface{}{}
 }
 
 func (m *mockedModel) DeviceStatistics() map[string]stats.DeviceStatistics {
 	return nil
 }
 
+func (m *mockedModel) StatisticsHistory(device, folder string, from, to time.Time) stats.HistoryResult {
+	return stats.HistoryResult{}
+}
+
 func (m *mockedModel) FolderStatistics() map[string]stats.FolderStatistics {
 	return nil
 }
@@ -66,6 +71,26 @@ func (m *mockedModel) GetIgnores(folder string) ([]string, []string, error) {
 	return nil, nil, nil
 }
 
+func (m *mockedModel) IgnoreLines(folder string) ([]ignore.Line, error) {
+	return nil, nil
+}
+
+func (m *mockedModel) ExplainIgnore(folder, file string) (model.IgnoreExplanation, error) {
+	return model.IgnoreExplanation{}, nil
+}
+
+func (m *mockedModel) IgnoreDryRun(folder string, content []string) ([]string, []ignore.Line, error) {
+	return nil, nil, nil
+}
+
+func (m *mockedModel) FetchFile(folder, file string) error {
+	return nil
+}
+
+func (m *mockedModel) CheckDatabase(folder string) (db.CheckResult, error) {
+	return db.CheckResult{}, nil
+}
+
 func (m *mockedModel) SetIgnores(folder string, content []string) error {
 	return nil
 }
@@ -8,6 +8,8 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
@@ -32,6 +34,7 @@ const (
 	loopThreshold         = 60 * time.Second
 	logFileAutoCloseDelay = 5 * time.Second
 	logFileMaxOpenTime    = time.Minute
+	logRotateRetryDelay   = time.Minute
 )
 
 func monitorMain(runtimeOptions RuntimeOptions) {
@@ -41,9 +44,11 @@ func monitorMain(runtimeOptions RuntimeOptions) {
 
 	var dst io.Writer = os.Stdout
 
+	var logFd *autoclosedFile
 	logFile := runtimeOptions.logFile
 	if logFile != "-" {
-		var fileDst io.Writer = newAutoclosedFile(logFile, logFileAutoCloseDelay, logFileMaxOpenTime)
+		logFd = newAutoclosedFile(logFile, logFileAutoCloseDelay, logFileMaxOpenTime, runtimeOptions.logRotation())
+		var fileDst io.Writer = logFd
 
 		if runtime.GOOS == "windows" {
 			// Translate line breaks to Windows standard
@@ -70,6 +75,19 @@ func monitorMain(runtimeOptions RuntimeOptions) {
 	sigHup := syscall.Signal(1)
 	signal.Notify(restartSign, sigHup)
 
+	// Reopen the log file on request, without disturbing Syncthing itself,
+	// for external log rotation.
+	reopenSign := make(chan os.Signal, 1)
+	notifyReopen(reopenSign)
+	go func() {
+		for s := range reopenSign {
+			if logFd != nil {
+				l.Infof("Signal %d received; reopening log file", s)
+				logFd.Reopen()
+			}
+		}
+	}()
+
 	for {
 		if t := time.Since(restarts[0]); t < loopThreshold {
 			l.Warnf("%d restarts in %v; not retrying further", countRestarts, t)
@@ -268,29 +286,51 @@ func restartMonitorWindows(args []string) error {
 	return cmd.Start()
 }
 
+// A logRotation says when a log file is rotated. The old file is then
+// compressed, as name.1.gz, with older ones shifted to name.2.gz and so on up
+// to maxArchives. Rotation is disabled when neither maxSize nor maxAge is
+// set.
+type logRotation struct {
+	maxSize     int64         // rotate before the file grows larger than this
+	maxAge      time.Duration // rotate when the file is older than this
+	maxArchives int           // compressed old files to keep
+}
+
+func (r logRotation) enabled() bool {
+	return r.maxSize > 0 || r.maxAge > 0
+}
+
 // An autoclosedFile is an io.WriteCloser that opens itself for appending on
 // Write() and closes itself after an interval of no writes (closeDelay) or
 // when the file has been open for too long (maxOpenTime). A call to Write()
 // will return any error that happens on the resulting Open() call too. Errors
-// on automatic Close() calls are silently swallowed...
+// on automatic Close() calls are silently swallowed, and a failed rotation is
+// logged and then retried later while we keep appending to the current file.
 type autoclosedFile struct {
 	name        string        // path to write to
 	closeDelay  time.Duration // close after this long inactivity
 	maxOpenTime time.Duration // or this long after opening
+	rotation    logRotation
 
-	fd         io.WriteCloser // underlying WriteCloser
-	opened     time.Time      // timestamp when the file was last opened
-	closed     chan struct{}  // closed on Close(), stops the closerLoop
-	closeTimer *time.Timer    // fires closeDelay after a write
+	fd             io.WriteCloser // underlying WriteCloser
+	opened         time.Time      // timestamp when the file was last opened
+	started        time.Time      // timestamp when the file was created, for rotation
+	size           int64          // current size of the file, for rotation
+	perm           os.FileMode    // permissions of the file, kept when rotating
+	rotateFailedAt time.Time      // timestamp when rotation last failed, zero if it didn't
+	closed         chan struct{}  // closed on Close(), stops the closerLoop
+	closeTimer     *time.Timer    // fires closeDelay after a write
 
 	mut sync.Mutex
 }
 
-func newAutoclosedFile(name string, closeDelay, maxOpenTime time.Duration) *autoclosedFile {
+func newAutoclosedFile(name string, closeDelay, maxOpenTime time.Duration, rotation logRotation) *autoclosedFile {
 	f := &autoclosedFile{
 		name:        name,
 		closeDelay:  closeDelay,
 		maxOpenTime: maxOpenTime,
+		rotation:    rotation,
+		perm:        0644,
 		mut:         sync.NewMutex(),
 		closed:      make(chan struct{}),
 		closeTimer:  time.NewTimer(time.Minute),
@@ -308,13 +348,33 @@ func (f *autoclosedFile) Write(bs []byte) (int, error) {
 		return 0, err
 	}
 
+	if f.shouldRotate(len(bs)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
 	// If we haven't run into the maxOpenTime, postpone close for another
 	// closeDelay
 	if time.Since(f.opened) < f.maxOpenTime {
 		f.closeTimer.Reset(f.closeDelay)
 	}
 
-	return f.fd.Write(bs)
+	n, err := f.fd.Write(bs)
+	f.size += int64(n)
+	return n, err
+}
+
+// Reopen closes the file, so that the next write opens it again. Should it
+// have been moved away, for example by an external log rotation, a new file
+// is created.
+func (f *autoclosedFile) Reopen() {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.fd != nil {
+		f.fd.Close()
+		f.fd = nil
+	}
 }
 
 func (f *autoclosedFile) Close() error {
@@ -344,23 +404,138 @@ func (f *autoclosedFile) ensureOpen() error {
 	flags := os.O_WRONLY | os.O_CREATE
 	if f.opened.IsZero() {
 		// This is the first time we are opening the file. We should truncate
-		// it to better emulate an os.Create() call.
+		// it to better emulate an os.Create() call, after keeping what it
+		// contains from last time if we are rotating.
 		flags |= os.O_TRUNC
+		if info, err := os.Stat(f.name); err == nil {
+			f.perm = info.Mode().Perm()
+			if f.rotation.enabled() && info.Size() > 0 {
+				if err := archiveLogFile(f.name, f.rotation.maxArchives); err != nil {
+					// Rather append to what's there than lose it.
+					f.rotateFailed(err)
+					flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+				}
+			}
+		}
 	} else {
 		// The file was already opened once, so we should append to it.
 		flags |= os.O_APPEND
 	}
 
-	fd, err := os.OpenFile(f.name, flags, 0644)
+	fd, err := os.OpenFile(f.name, flags, f.perm)
 	if err != nil {
 		return err
 	}
 
 	f.fd = fd
 	f.opened = time.Now()
+	f.size = 0
+	if info, err := fd.Stat(); err == nil {
+		f.size = info.Size()
+		f.perm = info.Mode().Perm()
+	}
+	if f.size == 0 {
+		// A new file, or one that someone else has emptied or moved away
+		// since we last had it open.
+		f.started = f.opened
+	}
 	return nil
 }
 
+// Must be called with f.mut held!
+func (f *autoclosedFile) shouldRotate(size int) bool {
+	if f.size == 0 {
+		// Nothing to rotate away, even if this write is too large by
+		// itself.
+		return false
+	}
+	if !f.rotateFailedAt.IsZero() && time.Since(f.rotateFailedAt) < logRotateRetryDelay {
+		// Don't try again on every write.
+		return false
+	}
+	if f.rotation.maxSize > 0 && f.size+int64(size) > f.rotation.maxSize {
+		return true
+	}
+	return f.rotation.maxAge > 0 && time.Since(f.started) > f.rotation.maxAge
+}
+
+// Must be called with f.mut held!
+func (f *autoclosedFile) rotate() error {
+	f.fd.Close()
+	f.fd = nil
+	if err := archiveLogFile(f.name, f.rotation.maxArchives); err != nil {
+		// The file is still there, so we keep appending to it.
+		f.rotateFailed(err)
+	} else {
+		f.rotateFailedAt = time.Time{}
+	}
+	// Reopening after the first time appends, to a new file if we rotated.
+	return f.ensureOpen()
+}
+
+// rotateFailed logs a rotation failure, unless the previous attempt failed
+// as well, and delays the next attempt. Must be called with f.mut held!
+func (f *autoclosedFile) rotateFailed(err error) {
+	if f.rotateFailedAt.IsZero() {
+		l.Warnln("Rotating log file:", err)
+	}
+	f.rotateFailedAt = time.Now()
+}
+
+// archiveLogFile moves the log file to name.1.gz, compressing it, after
+// shifting the older archives up by one. Those beyond maxArchives are
+// removed, as is the log file itself if maxArchives is zero.
+func archiveLogFile(name string, maxArchives int) error {
+	archive := func(i int) string {
+		return fmt.Sprintf("%s.%d.gz", name, i)
+	}
+
+	if maxArchives <= 0 {
+		return os.Remove(name)
+	}
+
+	os.Remove(archive(maxArchives))
+	for i := maxArchives - 1; i > 0; i-- {
+		if err := osutil.Rename(archive(i), archive(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := archive(1) + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	gw := gzip.NewWriter(dst)
+	_, err = io.Copy(gw, src)
+	if err == nil {
+		err = gw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	src.Close()
+	if err := osutil.Rename(tmp, archive(1)); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
 func (f *autoclosedFile) closerLoop() {
 	for {
 		select {
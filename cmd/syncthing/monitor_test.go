@@ -0,0 +1,169 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readGzipped(t *testing.T, name string) string {
+	fd, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	gr, err := gzip.NewReader(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+func TestAutoclosedFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "syncthing.log")
+
+	// Whatever was logged last time is kept.
+	if err := ioutil.WriteFile(name, []byte("previous\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newAutoclosedFile(name, time.Minute, time.Hour, logRotation{maxSize: 20, maxArchives: 2})
+	defer f.Close()
+
+	for _, line := range []string{"aaaaaaaaa\n", "bbbbbbbbb\n", "ccccccccc\n", "ddddddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "previous" went to .1, then .2, and fell off the end when a and b
+	// were rotated away.
+	if s := readGzipped(t, name+".2.gz"); s != "previous\n" {
+		t.Errorf("Unexpected contents of .2.gz: %q", s)
+	}
+	if _, err := os.Stat(name + ".3.gz"); !os.IsNotExist(err) {
+		t.Error("Too many archives kept")
+	}
+	if s := readGzipped(t, name+".1.gz"); s != "aaaaaaaaa\nbbbbbbbbb\n" {
+		t.Errorf("Unexpected contents of .1.gz: %q", s)
+	}
+	f.Reopen() // flush
+	if bs, _ := ioutil.ReadFile(name); string(bs) != "ccccccccc\nddddddddd\n" {
+		t.Errorf("Unexpected contents of log: %q", bs)
+	}
+	if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Permissions not kept: %v, %v", info.Mode(), err)
+	}
+}
+
+func TestAutoclosedFileRotationFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "syncthing.log")
+
+	// The archive can't be written while a directory is in the way.
+	if err := os.Mkdir(name+".1.gz.tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newAutoclosedFile(name, time.Minute, time.Hour, logRotation{maxSize: 20, maxArchives: 1})
+	defer f.Close()
+
+	for _, line := range []string{"aaaaaaaaa\n", "bbbbbbbbb\n", "ccccccccc\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Reopen() // flush
+	if bs, _ := ioutil.ReadFile(name); string(bs) != "aaaaaaaaa\nbbbbbbbbb\nccccccccc\n" {
+		t.Errorf("Unexpected contents of log: %q", bs)
+	}
+
+	// Rotation is retried after a while.
+
+	if err := os.Remove(name + ".1.gz.tmp"); err != nil {
+		t.Fatal(err)
+	}
+	f.rotateFailedAt = time.Now().Add(-logRotateRetryDelay)
+	if _, err := f.Write([]byte("ddddddddd\n")); err != nil {
+		t.Fatal(err)
+	}
+	if s := readGzipped(t, name+".1.gz"); s != "aaaaaaaaa\nbbbbbbbbb\nccccccccc\n" {
+		t.Errorf("Unexpected contents of .1.gz: %q", s)
+	}
+	f.Reopen() // flush
+	if bs, _ := ioutil.ReadFile(name); string(bs) != "ddddddddd\n" {
+		t.Errorf("Unexpected contents of log: %q", bs)
+	}
+}
+
+func TestAutoclosedFileAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "syncthing.log")
+
+	f := newAutoclosedFile(name, time.Minute, time.Hour, logRotation{maxAge: 50 * time.Millisecond, maxArchives: 1})
+	defer f.Close()
+
+	f.Write([]byte("old\n"))
+	time.Sleep(100 * time.Millisecond)
+	f.Write([]byte("new\n"))
+
+	if s := readGzipped(t, name+".1.gz"); s != "old\n" {
+		t.Errorf("Unexpected contents of .1.gz: %q", s)
+	}
+}
+
+func TestAutoclosedFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "syncthing.log")
+
+	f := newAutoclosedFile(name, time.Minute, time.Hour, logRotation{})
+	defer f.Close()
+
+	f.Write([]byte("before\n"))
+
+	// An external log rotation moves the file away, then tells us.
+	if err := os.Rename(name, name+".0"); err != nil {
+		t.Fatal(err)
+	}
+	f.Reopen()
+	f.Write([]byte("after\n"))
+	f.Reopen()
+
+	if bs, _ := ioutil.ReadFile(name + ".0"); !bytes.Equal(bs, []byte("before\n")) {
+		t.Errorf("Unexpected contents of moved log: %q", bs)
+	}
+	if bs, _ := ioutil.ReadFile(name); !bytes.Equal(bs, []byte("after\n")) {
+		t.Errorf("Unexpected contents of new log: %q", bs)
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package main
+
+import "os"
+
+// There is no signal to reopen the log file on Windows.
+
+func notifyReopen(c chan<- os.Signal) {}
+
+func ignoreReopen() {}
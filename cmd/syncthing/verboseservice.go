@@ -162,6 +162,18 @@ func (s *verboseService) formatEvent(ev events.Event) string {
 			success = "failed"
 		}
 		return fmt.Sprintf("Login %s for username %s.", success, username)
+	case events.APIRequestDenied:
+		data := ev.Data.(map[string]interface{})
+		if apiKey, ok := data["apiKey"]; ok {
+			return fmt.Sprintf("Denied %s %s for API key %s: %s", data["method"], data["path"], apiKey, data["reason"])
+		}
+		return fmt.Sprintf("Denied %s %s for username %s: %s", data["method"], data["path"], data["username"], data["reason"])
+	case events.DeviceIDChanged:
+		data := ev.Data.(map[string]string)
+		return fmt.Sprintf("Device %s changed its device ID to %s", data["from"], data["to"])
+	case events.DeviceRevoked:
+		data := ev.Data.(map[string]string)
+		return fmt.Sprintf("Device %s was revoked", data["device"])
 
 	}
 
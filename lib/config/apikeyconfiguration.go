@@ -0,0 +1,89 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+// An APIKeyConfiguration is an additional, named, API key that is restricted
+// to a scope and optionally to some folders. The main API key in the GUI
+// configuration is not restricted.
+type APIKeyConfiguration struct {
+	Name    string      `xml:"name,attr" json:"name"`
+	Key     string      `xml:"key,attr" json:"key"`
+	Scope   APIKeyScope `xml:"scope,attr" json:"scope"`
+	Folders []string    `xml:"folder" json:"folders"` // If set, only these folders can be accessed through /rest/db
+}
+
+func (orig APIKeyConfiguration) Copy() APIKeyConfiguration {
+	c := orig
+	c.Folders = make([]string, len(orig.Folders))
+	copy(c.Folders, orig.Folders)
+	return c
+}
+
+// Allows returns true if the key's scope includes the given scope.
+func (k APIKeyConfiguration) Allows(scope APIKeyScope) bool {
+	return k.Scope >= scope
+}
+
+// AllowsFolder returns true if the key may access the given folder.
+func (k APIKeyConfiguration) AllowsFolder(folder string) bool {
+	if len(k.Folders) == 0 {
+		return true
+	}
+	for _, f := range k.Folders {
+		if f == folder {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKeyConfiguration) prepare() {
+	if k.Folders == nil {
+		k.Folders = []string{}
+	}
+}
+
+// An APIKeyScope is what an API key may be used for. Each scope includes the
+// ones before it.
+type APIKeyScope int
+
+const (
+	APIKeyScopeReadOnly APIKeyScope = iota // default is readonly; GET requests
+	APIKeyScopeControl                     // POST requests, such as scans and pausing devices
+	APIKeyScopeAdmin                       // reading and changing the configuration, restarts and upgrades
+)
+
+func (s APIKeyScope) String() string {
+	switch s {
+	case APIKeyScopeReadOnly:
+		return "readonly"
+	case APIKeyScopeControl:
+		return "control"
+	case APIKeyScopeAdmin:
+		return "admin"
+	default:
+		return "unknown"
+	}
+}
+
+func (s APIKeyScope) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *APIKeyScope) UnmarshalText(bs []byte) error {
+	switch string(bs) {
+	case "readonly":
+		*s = APIKeyScopeReadOnly
+	case "control":
+		*s = APIKeyScopeControl
+	case "admin":
+		*s = APIKeyScopeAdmin
+	default:
+		*s = APIKeyScopeReadOnly
+	}
+	return nil
+}
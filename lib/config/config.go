@@ -10,6 +10,7 @@ package config
 import (
 	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"io"
 	"net/url"
 	"os"
@@ -65,6 +66,7 @@ func New(myID protocol.DeviceID) Configuration {
 	util.SetDefaults(&cfg)
 	util.SetDefaults(&cfg.Options)
 	util.SetDefaults(&cfg.GUI)
+	util.SetDefaults(&cfg.GUI.LDAP)
 
 	cfg.prepare(myID)
 
@@ -77,6 +79,7 @@ func ReadXML(r io.Reader, myID protocol.DeviceID) (Configuration, error) {
 	util.SetDefaults(&cfg)
 	util.SetDefaults(&cfg.Options)
 	util.SetDefaults(&cfg.GUI)
+	util.SetDefaults(&cfg.GUI.LDAP)
 
 	err := xml.NewDecoder(r).Decode(&cfg)
 	cfg.OriginalVersion = cfg.Version
@@ -91,6 +94,7 @@ func ReadJSON(r io.Reader, myID protocol.DeviceID) (Configuration, error) {
 	util.SetDefaults(&cfg)
 	util.SetDefaults(&cfg.Options)
 	util.SetDefaults(&cfg.GUI)
+	util.SetDefaults(&cfg.GUI.LDAP)
 
 	err := json.NewDecoder(r).Decode(&cfg)
 	cfg.OriginalVersion = cfg.Version
@@ -100,13 +104,15 @@ func ReadJSON(r io.Reader, myID protocol.DeviceID) (Configuration, error) {
 }
 
 type Configuration struct {
-	Version        int                   `xml:"version,attr" json:"version"`
-	Folders        []FolderConfiguration `xml:"folder" json:"folders"`
-	Devices        []DeviceConfiguration `xml:"device" json:"devices"`
-	GUI            GUIConfiguration      `xml:"gui" json:"gui"`
-	Options        OptionsConfiguration  `xml:"options" json:"options"`
-	IgnoredDevices []protocol.DeviceID   `xml:"ignoredDevice" json:"ignoredDevices"`
-	XMLName        xml.Name              `xml:"configuration" json:"-"`
+	Version        int                    `xml:"version,attr" json:"version"`
+	Folders        []FolderConfiguration  `xml:"folder" json:"folders"`
+	Devices        []DeviceConfiguration  `xml:"device" json:"devices"`
+	GUI            GUIConfiguration       `xml:"gui" json:"gui"`
+	Options        OptionsConfiguration   `xml:"options" json:"options"`
+	IgnoredDevices []protocol.DeviceID    `xml:"ignoredDevice" json:"ignoredDevices"`
+	RevokedDevices []protocol.DeviceID    `xml:"revokedDevice" json:"revokedDevices"`
+	Webhooks       []WebhookConfiguration `xml:"webhook" json:"webhooks"`
+	XMLName        xml.Name               `xml:"configuration" json:"-"`
 
 	OriginalVersion int `xml:"-" json:"-"` // The version we read from disk, before any conversion
 }
@@ -127,10 +133,19 @@ func (cfg Configuration) Copy() Configuration {
 	}
 
 	newCfg.Options = cfg.Options.Copy()
+	newCfg.GUI = cfg.GUI.Copy()
 
 	// DeviceIDs are values
 	newCfg.IgnoredDevices = make([]protocol.DeviceID, len(cfg.IgnoredDevices))
 	copy(newCfg.IgnoredDevices, cfg.IgnoredDevices)
+	newCfg.RevokedDevices = make([]protocol.DeviceID, len(cfg.RevokedDevices))
+	copy(newCfg.RevokedDevices, cfg.RevokedDevices)
+
+	// Deep copy WebhookConfigurations
+	newCfg.Webhooks = make([]WebhookConfiguration, len(cfg.Webhooks))
+	for i := range newCfg.Webhooks {
+		newCfg.Webhooks[i] = cfg.Webhooks[i].Copy()
+	}
 
 	return newCfg
 }
@@ -156,9 +171,60 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 	if cfg.IgnoredDevices == nil {
 		cfg.IgnoredDevices = []protocol.DeviceID{}
 	}
+	if cfg.RevokedDevices == nil {
+		cfg.RevokedDevices = []protocol.DeviceID{}
+	}
+
+	if cfg.Webhooks == nil {
+		cfg.Webhooks = []WebhookConfiguration{}
+	}
+	// Webhook IDs name the queues of the webhooks in the database, so they
+	// must be unique and must not be a prefix of one another.
+	seenWebhooks := make(map[string]bool, len(cfg.Webhooks))
+	webhooks := cfg.Webhooks[:0]
+	for _, hook := range cfg.Webhooks {
+		switch {
+		case hook.ID == "":
+			l.Warnln("Dropping webhook without ID")
+			continue
+		case strings.Contains(hook.ID, "/"):
+			l.Warnf("Dropping webhook %q; the ID must not contain %q", hook.ID, "/")
+			continue
+		case seenWebhooks[hook.ID]:
+			l.Warnf("Dropping webhook with duplicate ID %q", hook.ID)
+			continue
+		}
+		seenWebhooks[hook.ID] = true
+		hook.prepare()
+		webhooks = append(webhooks, hook)
+	}
+	cfg.Webhooks = webhooks
+	if cfg.GUI.RecoveryCodes == nil {
+		cfg.GUI.RecoveryCodes = []string{}
+	}
+	if cfg.GUI.Accounts == nil {
+		cfg.GUI.Accounts = []GUIAccountConfiguration{}
+	}
+	for i := range cfg.GUI.Accounts {
+		cfg.GUI.Accounts[i].prepare()
+	}
+	if cfg.GUI.APIKeys == nil {
+		cfg.GUI.APIKeys = []APIKeyConfiguration{}
+	}
+	for i := range cfg.GUI.APIKeys {
+		cfg.GUI.APIKeys[i].prepare()
+	}
 	if cfg.Options.AlwaysLocalNets == nil {
 		cfg.Options.AlwaysLocalNets = []string{}
 	}
+	if cfg.Options.BandwidthSchedule == nil {
+		cfg.Options.BandwidthSchedule = []BandwidthWindow{}
+	}
+	for i, w := range cfg.Options.BandwidthSchedule {
+		if _, err := parseScheduleSpan(w.Days, w.Start, w.End); err != nil {
+			l.Warnf("Ignoring bandwidth window %d: %v", i, err)
+		}
+	}
 
 	// Check for missing, bad or duplicate folder ID:s
 	var seenFolders = map[string]*FolderConfiguration{}
@@ -193,6 +259,14 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		convertV12V13(cfg)
 	}
 
+	// Revoked devices are not shared with; the folder device lists are
+	// cleaned up below.
+	for _, id := range cfg.RevokedDevices {
+		if id != myID {
+			cfg.removeDevice(id)
+		}
+	}
+
 	// Build a list of available devices
 	existingDevices := make(map[protocol.DeviceID]bool)
 	for _, device := range cfg.Devices {
@@ -233,6 +307,7 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		if len(n.Addresses) == 0 || len(n.Addresses) == 1 && n.Addresses[0] == "" {
 			n.Addresses = []string{"dynamic"}
 		}
+		n.Schedule.prepare(fmt.Sprintf("device %v", n.DeviceID))
 	}
 
 	// Very short reconnection intervals are annoying
@@ -356,6 +431,79 @@ func convertV10V11(cfg *Configuration) {
 	cfg.Version = 11
 }
 
+// removeDevice removes the device from the device list and from the device
+// lists of all folders.
+func (cfg *Configuration) removeDevice(id protocol.DeviceID) {
+	devices := cfg.Devices[:0]
+	for _, dev := range cfg.Devices {
+		if dev.DeviceID != id {
+			devices = append(devices, dev)
+		}
+	}
+	cfg.Devices = devices
+
+	for i := range cfg.Folders {
+		fdevs := cfg.Folders[i].Devices[:0]
+		for _, dev := range cfg.Folders[i].Devices {
+			if dev.DeviceID != id {
+				fdevs = append(fdevs, dev)
+			}
+		}
+		cfg.Folders[i].Devices = fdevs
+	}
+}
+
+// replaceDeviceID changes the device ID of the device from, and of its entries
+// in the folder device lists, to the device ID to. Any existing configuration
+// for the device to is replaced, so the caller must make sure that to is not
+// another device.
+func (cfg *Configuration) replaceDeviceID(from, to protocol.DeviceID) bool {
+	idx := -1
+	for i, dev := range cfg.Devices {
+		if dev.DeviceID == from {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return false
+	}
+
+	dev := cfg.Devices[idx]
+	dev.DeviceID = to
+	devices := make([]DeviceConfiguration, 0, len(cfg.Devices))
+	for i, d := range cfg.Devices {
+		switch {
+		case i == idx:
+			devices = append(devices, dev)
+		case d.DeviceID != to:
+			devices = append(devices, d)
+		}
+	}
+	cfg.Devices = devices
+
+	for i := range cfg.Devices {
+		if cfg.Devices[i].IsIntroducedBy(from) {
+			cfg.Devices[i].IntroducedBy = &to
+		}
+	}
+
+	for i := range cfg.Folders {
+		fdevs := cfg.Folders[i].Devices
+		for j := range fdevs {
+			if fdevs[j].DeviceID == from {
+				fdevs[j].DeviceID = to
+			}
+			if fdevs[j].IsIntroducedBy(from) {
+				fdevs[j].IntroducedBy = &to
+			}
+		}
+		cfg.Folders[i].Devices = ensureNoDuplicateFolderDevices(fdevs)
+	}
+
+	return true
+}
+
 func ensureDevicePresent(devices []FolderDeviceConfiguration, myID protocol.DeviceID) []FolderDeviceConfiguration {
 	for _, device := range devices {
 		if device.DeviceID.Equals(myID) {
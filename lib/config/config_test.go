@@ -15,6 +15,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/d4l3k/messagediff"
 	"github.com/syncthing/syncthing/lib/protocol"
@@ -59,6 +60,7 @@ func TestDefaultValues(t *testing.T) {
 		URPostInsecurely:        false,
 		ReleasesURL:             "https://api.github.com/repos/syncthing/syncthing/releases?per_page=30",
 		AlwaysLocalNets:         []string{},
+		BandwidthSchedule:       []BandwidthWindow{},
 		OverwriteNames:          false,
 		TempIndexMinBlocks:      10,
 	}
@@ -188,6 +190,7 @@ func TestOverriddenValues(t *testing.T) {
 		URPostInsecurely:        true,
 		ReleasesURL:             "https://localhost/releases",
 		AlwaysLocalNets:         []string{},
+		BandwidthSchedule:       []BandwidthWindow{},
 		OverwriteNames:          true,
 		TempIndexMinBlocks:      100,
 	}
@@ -616,3 +619,350 @@ func TestRemoveDuplicateDevicesFolders(t *testing.T) {
 		t.Errorf("Incorrect number of folder devices, %d != 2", l)
 	}
 }
+
+func TestAPIKeys(t *testing.T) {
+	wrapper, err := Load("testdata/apikeys.xml", device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gui := wrapper.GUI()
+
+	if len(gui.APIKeys) != 4 {
+		t.Fatalf("Incorrect number of API keys, %d != 4", len(gui.APIKeys))
+	}
+	for _, key := range []string{"mainkey", "key1", "key2", "key3", "key4"} {
+		if !gui.IsValidAPIKey(key) {
+			t.Errorf("API key %q should be valid", key)
+		}
+	}
+	if gui.IsValidAPIKey("key5") || gui.IsValidAPIKey("") {
+		t.Error("Unknown API key should not be valid")
+	}
+	if _, ok := gui.NamedAPIKey("mainkey"); ok {
+		t.Error("The main API key is not a named one")
+	}
+
+	expected := []struct {
+		key     string
+		scope   APIKeyScope
+		folders int
+	}{
+		{"key1", APIKeyScopeReadOnly, 0},
+		{"key2", APIKeyScopeControl, 2},
+		{"key3", APIKeyScopeAdmin, 0},
+		{"key4", APIKeyScopeReadOnly, 0}, // unknown value, default
+	}
+	for _, tc := range expected {
+		k, ok := gui.NamedAPIKey(tc.key)
+		if !ok {
+			t.Errorf("Missing API key %q", tc.key)
+			continue
+		}
+		if k.Scope != tc.scope || len(k.Folders) != tc.folders {
+			t.Errorf("Incorrect API key %q: %+v", tc.key, k)
+		}
+	}
+
+	k, _ := gui.NamedAPIKey("key2")
+	if !k.Allows(APIKeyScopeReadOnly) || !k.Allows(APIKeyScopeControl) || k.Allows(APIKeyScopeAdmin) {
+		t.Error("Incorrect scopes for control key")
+	}
+	if !k.AllowsFolder("f2") || k.AllowsFolder("f3") || k.AllowsFolder("") {
+		t.Error("Incorrect folders for control key")
+	}
+	if k, _ := gui.NamedAPIKey("key1"); !k.AllowsFolder("f3") {
+		t.Error("A key without folders should allow all")
+	}
+}
+
+func TestGUIAccounts(t *testing.T) {
+	wrapper, err := Load("testdata/guiaccounts.xml", device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gui := wrapper.GUI()
+
+	if !gui.IsAuthenticationEnabled() {
+		t.Error("Authentication should be enabled")
+	}
+
+	expected := []struct {
+		name     string
+		password string
+		role     GUIUserRole
+	}{
+		{"root", "$2a$10$IdIZTxTg/dCNuNEGlmLynOjqg4B1FvDKuIV5e0BB3pnWVHNb8.GSq", GUIUserRoleAdmin},
+		{"noc", "hash1", GUIUserRoleViewer},
+		{"helpdesk", "hash2", GUIUserRoleOperator},
+		{"jb", "hash3", GUIUserRoleAdmin},
+		{"other", "hash4", GUIUserRoleViewer}, // unknown value, default
+	}
+	for _, tc := range expected {
+		a, ok := gui.Account(tc.name)
+		if !ok {
+			t.Errorf("Missing account %q", tc.name)
+			continue
+		}
+		if a.Password != tc.password || a.Role != tc.role {
+			t.Errorf("Incorrect account %q: %+v", tc.name, a)
+		}
+	}
+	if _, ok := gui.Account("nobody"); ok {
+		t.Error("Unexpected account")
+	}
+
+	if GUIUserRoleOperator.Scope() != APIKeyScopeControl {
+		t.Error("Incorrect scope for operator")
+	}
+
+	// Without the user/password and accounts, there is no authentication.
+	gui.Password = ""
+	if _, ok := gui.Account("root"); ok {
+		t.Error("Unexpected account without password")
+	}
+	gui.Accounts = nil
+	if gui.IsAuthenticationEnabled() {
+		t.Error("Authentication should not be enabled")
+	}
+}
+
+func TestLDAPConfig(t *testing.T) {
+	wrapper, err := Load("testdata/ldap.xml", device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldap := wrapper.GUI().LDAP
+
+	expected := LDAPConfiguration{
+		Address:        "ldap.example.com:636",
+		Transport:      LDAPTransportTLS,
+		BindDN:         "uid=%s,ou=people,dc=example,dc=com",
+		GroupDN:        "cn=syncthing,ou=groups,dc=example,dc=com",
+		GroupAttribute: "member",
+		Role:           GUIUserRoleOperator,
+		TimeoutS:       10,
+		LocalFallback:  true,
+	}
+	if diff, equal := messagediff.PrettyDiff(expected, ldap); !equal {
+		t.Errorf("LDAP configuration differs. Diff:\n%s", diff)
+	}
+	if !wrapper.GUI().IsAuthenticationEnabled() {
+		t.Error("Authentication should be enabled")
+	}
+
+	cfg := New(device1)
+	if cfg.GUI.LDAP.IsEnabled() || cfg.GUI.IsAuthenticationEnabled() {
+		t.Error("LDAP should be disabled by default")
+	}
+}
+
+func TestReplaceDeviceID(t *testing.T) {
+	cfg := New(device1)
+	cfg.Devices = append(cfg.Devices, DeviceConfiguration{DeviceID: device2, Name: "two", Introducer: true})
+	cfg.Folders = []FolderConfiguration{
+		{ID: "f1", Devices: []FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}}},
+		{ID: "f2", Devices: []FolderDeviceConfiguration{{DeviceID: device2}, {DeviceID: device3}}},
+	}
+	wrapper := Wrap("/tmp/test", cfg)
+
+	if _, ok := wrapper.ReplaceDeviceID(device4, device3); ok {
+		t.Error("Unexpected replace of unknown device")
+	}
+	if _, ok := wrapper.ReplaceDeviceID(device2, device3); !ok {
+		t.Fatal("Unexpected failure to replace device")
+	}
+
+	devs := wrapper.Devices()
+	if _, ok := devs[device2]; ok {
+		t.Error("Old device ID should be gone")
+	}
+	if dev := devs[device3]; dev.Name != "two" || !dev.Introducer {
+		t.Errorf("Device settings were not kept: %+v", dev)
+	}
+
+	folders := wrapper.Folders()
+	if devs := folders["f1"].Devices; len(devs) != 2 || devs[1].DeviceID != device3 {
+		t.Errorf("Incorrect devices for f1: %v", devs)
+	}
+	if devs := folders["f2"].Devices; len(devs) != 1 || devs[0].DeviceID != device3 {
+		t.Errorf("Incorrect devices for f2: %v", devs)
+	}
+}
+
+func TestRevokedDevices(t *testing.T) {
+	cfg := New(device1)
+	cfg.Devices = append(cfg.Devices,
+		DeviceConfiguration{DeviceID: device2, IntroducedBy: &device1},
+		DeviceConfiguration{DeviceID: device3},
+	)
+	cfg.Folders = []FolderConfiguration{
+		{ID: "f1", Devices: []FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2, IntroducedBy: &device1}, {DeviceID: device3}}},
+	}
+	cfg.RevokedDevices = []protocol.DeviceID{device3}
+
+	// Revoked devices are dropped when the config is read, and the
+	// introducer survives the round trip.
+
+	buf := new(bytes.Buffer)
+	if err := cfg.WriteXML(buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(buf.String(), "introducedBy=") != 2 {
+		t.Errorf("Only introduced devices should have an introducer:\n%s", buf.String())
+	}
+	read, err := ReadXML(buf, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapper := Wrap("/tmp/test", read)
+
+	if _, ok := wrapper.Devices()[device3]; ok {
+		t.Error("Revoked device should have been removed")
+	}
+	if !wrapper.Devices()[device2].IsIntroducedBy(device1) {
+		t.Error("Introducer was lost")
+	}
+	if devs := wrapper.Folders()["f1"].Devices; len(devs) != 2 {
+		t.Errorf("Incorrect folder devices %v", devs)
+	}
+
+	// Revoking another device does the same.
+
+	wrapper.RevokeDevice(device2)
+	if !wrapper.RevokedDevice(device2) || !wrapper.RevokedDevice(device3) {
+		t.Error("Devices should be revoked")
+	}
+	if _, ok := wrapper.Devices()[device2]; ok {
+		t.Error("Revoked device should have been removed")
+	}
+	if devs := wrapper.Folders()["f1"].Devices; len(devs) != 1 {
+		t.Errorf("Incorrect folder devices %v", devs)
+	}
+}
+
+func TestScheduleState(t *testing.T) {
+	sched := ScheduleConfiguration{
+		Windows: []ScheduleWindow{
+			{Days: "mon-fri", Start: "08:00", End: "18:00", Allow: "scan,serve", MaxSendKbps: 100},
+			{Days: "fri-sun", Start: "22:00", End: "06:00", Allow: "scan, pull, serve"},
+			{Days: "6", Allow: ""},
+			{Days: "someday", Allow: "pull"},
+		},
+	}
+
+	// 2016-08-01 is a Monday.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2016, 8, day, hour, min, 0, 0, time.Local)
+	}
+	cases := []struct {
+		t      time.Time
+		window int
+		ops    []string
+	}{
+		{at(1, 7, 59), -1, []string{ScheduleScan, SchedulePull, ScheduleServe}},
+		{at(1, 8, 0), 0, []string{ScheduleScan, ScheduleServe}},
+		{at(5, 17, 59), 0, []string{ScheduleScan, ScheduleServe}},
+		{at(5, 18, 0), -1, []string{ScheduleScan, SchedulePull, ScheduleServe}},
+		{at(5, 23, 0), 1, []string{ScheduleScan, SchedulePull, ScheduleServe}},
+		{at(6, 5, 59), 1, []string{ScheduleScan, SchedulePull, ScheduleServe}},
+		{at(6, 6, 0), 2, nil},
+		{at(8, 5, 0), 1, []string{ScheduleScan, SchedulePull, ScheduleServe}},
+		{at(9, 5, 0), -1, []string{ScheduleScan, SchedulePull, ScheduleServe}},
+	}
+
+	for _, tc := range cases {
+		state := sched.StateAt(tc.t)
+		if state.Window != tc.window {
+			t.Errorf("%v: window %d != expected %d", tc.t, state.Window, tc.window)
+			continue
+		}
+		allowed := map[string]bool{}
+		for _, op := range tc.ops {
+			allowed[op] = true
+		}
+		for _, op := range []string{ScheduleScan, SchedulePull, ScheduleServe} {
+			if state.Allows(op) != allowed[op] {
+				t.Errorf("%v: %s allowed is %v, expected %v", tc.t, op, state.Allows(op), allowed[op])
+			}
+		}
+	}
+
+	if state := sched.StateAt(at(1, 12, 0)); state.MaxSendKbps != 100 || state.MaxRecvKbps != 0 {
+		t.Errorf("Incorrect bandwidth caps %+v", state)
+	}
+}
+
+func TestScheduleDays(t *testing.T) {
+	cases := []struct {
+		days string
+		want [7]bool
+	}{
+		{"0-7", [7]bool{true, true, true, true, true, true, true}},
+		{"1-7", [7]bool{true, true, true, true, true, true, true}},
+		{"5-7", [7]bool{true, false, false, false, false, true, true}},
+		{"7", [7]bool{true, false, false, false, false, false, false}},
+		{"7-2", [7]bool{true, true, true, false, false, false, false}},
+		{"fri-mon", [7]bool{true, true, false, false, false, true, true}},
+	}
+	for _, tc := range cases {
+		days, err := parseScheduleDays(tc.days)
+		if err != nil {
+			t.Errorf("%q: %v", tc.days, err)
+			continue
+		}
+		if days != tc.want {
+			t.Errorf("%q: %v != expected %v", tc.days, days, tc.want)
+		}
+	}
+}
+
+func TestRateLimitsAt(t *testing.T) {
+	opts := OptionsConfiguration{
+		MaxSendKbps: 1000,
+		MaxRecvKbps: 2000,
+		BandwidthSchedule: []BandwidthWindow{
+			{Days: "mon-fri", Start: "08:00", End: "18:00", MaxSendKbps: 100, MaxRecvKbps: 200},
+			{Days: "sat,sun"},
+			{Days: "mon", Start: "25:00", End: "26:00", MaxSendKbps: 1},
+		},
+	}
+	if !opts.HasRateLimits() {
+		t.Error("Should have rate limits")
+	}
+
+	// 2016-08-01 is a Monday.
+	cases := []struct {
+		t          time.Time
+		send, recv int
+	}{
+		{time.Date(2016, 8, 1, 7, 0, 0, 0, time.Local), 1000, 2000},
+		{time.Date(2016, 8, 1, 12, 0, 0, 0, time.Local), 100, 200},
+		{time.Date(2016, 8, 6, 12, 0, 0, 0, time.Local), 0, 0},
+	}
+	for _, tc := range cases {
+		send, recv := opts.RateLimitsAt(tc.t)
+		if send != tc.send || recv != tc.recv {
+			t.Errorf("%v: limits %d/%d != expected %d/%d", tc.t, send, recv, tc.send, tc.recv)
+		}
+	}
+
+	if (OptionsConfiguration{BandwidthSchedule: []BandwidthWindow{{}}}).HasRateLimits() {
+		t.Error("Should not have rate limits")
+	}
+}
+
+func TestWebhookIDs(t *testing.T) {
+	cfg := New(device1)
+	cfg.Webhooks = []WebhookConfiguration{
+		{ID: "a", URL: "http://one/"},
+		{ID: "", URL: "http://two/"},
+		{ID: "a/b", URL: "http://three/"},
+		{ID: "a", URL: "http://four/"},
+		{ID: "b", URL: "http://five/"},
+	}
+	cfg.prepare(device1)
+
+	if len(cfg.Webhooks) != 2 || cfg.Webhooks[0].URL != "http://one/" || cfg.Webhooks[1].URL != "http://five/" {
+		t.Errorf("Webhooks with invalid IDs should have been dropped: %+v", cfg.Webhooks)
+	}
+}
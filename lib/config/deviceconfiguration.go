@@ -15,6 +15,10 @@ type DeviceConfiguration struct {
 	Compression protocol.Compression `xml:"compression,attr" json:"compression"`
 	CertName    string               `xml:"certName,attr,omitempty" json:"certName"`
 	Introducer  bool                 `xml:"introducer,attr" json:"introducer"`
+	// The introducer that added the device, if any.
+	IntroducedBy *protocol.DeviceID `xml:"introducedBy,attr,omitempty" json:"introducedBy,omitempty"`
+	// When pulling from and serving requests to the device is allowed.
+	Schedule ScheduleConfiguration `xml:"schedule" json:"schedule"`
 }
 
 func NewDeviceConfiguration(id protocol.DeviceID, name string) DeviceConfiguration {
@@ -28,9 +32,19 @@ func (orig DeviceConfiguration) Copy() DeviceConfiguration {
 	c := orig
 	c.Addresses = make([]string, len(orig.Addresses))
 	copy(c.Addresses, orig.Addresses)
+	if orig.IntroducedBy != nil {
+		id := *orig.IntroducedBy
+		c.IntroducedBy = &id
+	}
+	c.Schedule = orig.Schedule.Copy()
 	return c
 }
 
+// IsIntroducedBy returns whether the device was added by the introducer.
+func (orig DeviceConfiguration) IsIntroducedBy(introducer protocol.DeviceID) bool {
+	return orig.IntroducedBy != nil && *orig.IntroducedBy == introducer
+}
+
 type DeviceConfigurationList []DeviceConfiguration
 
 func (l DeviceConfigurationList) Less(a, b int) bool {
@@ -7,6 +7,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -38,6 +39,10 @@ type FolderConfiguration struct {
 	MaxConflicts          int                         `xml:"maxConflicts" json:"maxConflicts"`
 	DisableSparseFiles    bool                        `xml:"disableSparseFiles" json:"disableSparseFiles"`
 	DisableTempIndexes    bool                        `xml:"disableTempIndexes" json:"disableTempIndexes"`
+	SharedIgnores         bool                        `xml:"sharedIgnores" json:"sharedIgnores"` // Sync the .stignore file to other devices; .stignore.local remains device local.
+	SelectiveSync         bool                        `xml:"selectiveSync" json:"selectiveSync"` // Pull only the selected paths and files in the folder root.
+	SelectedPaths         []string                    `xml:"selectedPath" json:"selectedPaths"`
+	Schedule              ScheduleConfiguration       `xml:"schedule" json:"schedule"` // When scanning, pulling and serving requests is allowed.
 
 	Invalid    string `xml:"-" json:"invalid"` // Set at runtime when there is an error, not saved
 	cachedPath string
@@ -47,6 +52,14 @@ type FolderConfiguration struct {
 
 type FolderDeviceConfiguration struct {
 	DeviceID protocol.DeviceID `xml:"id,attr" json:"deviceID"`
+	// The introducer that shared the folder with the device, if any.
+	IntroducedBy *protocol.DeviceID `xml:"introducedBy,attr,omitempty" json:"introducedBy,omitempty"`
+}
+
+// IsIntroducedBy returns whether the folder was shared with the device by
+// the introducer.
+func (f FolderDeviceConfiguration) IsIntroducedBy(introducer protocol.DeviceID) bool {
+	return f.IntroducedBy != nil && *f.IntroducedBy == introducer
 }
 
 func NewFolderConfiguration(id, path string) FolderConfiguration {
@@ -63,6 +76,8 @@ func (f FolderConfiguration) Copy() FolderConfiguration {
 	c.Devices = make([]FolderDeviceConfiguration, len(f.Devices))
 	copy(c.Devices, f.Devices)
 	c.Versioning = f.Versioning.Copy()
+	c.SelectedPaths = append([]string(nil), f.SelectedPaths...)
+	c.Schedule = f.Schedule.Copy()
 	return c
 }
 
@@ -138,6 +153,8 @@ func (f *FolderConfiguration) prepare() {
 	} else if f.RescanIntervalS < 0 {
 		f.RescanIntervalS = 0
 	}
+
+	f.Schedule.prepare(fmt.Sprintf("folder %q", f.ID))
 }
 
 func (f *FolderConfiguration) cleanedPath() string {
@@ -0,0 +1,83 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+// A GUIAccountConfiguration is a user that can log in to the GUI, in
+// addition to the one given by the User and Password of the GUI
+// configuration, which is always an admin.
+type GUIAccountConfiguration struct {
+	Name          string      `xml:"name,attr" json:"name"`
+	Password      string      `xml:"password" json:"password"` // bcrypt hash
+	Role          GUIUserRole `xml:"role,attr" json:"role"`
+	TOTPSecret    string      `xml:"totpSecret,omitempty" json:"totpSecret"` // If set, a one time password is required to log in
+	RecoveryCodes []string    `xml:"recoveryCode" json:"recoveryCodes"`      // bcrypt hashes of the unused recovery codes
+}
+
+func (orig GUIAccountConfiguration) Copy() GUIAccountConfiguration {
+	c := orig
+	c.RecoveryCodes = make([]string, len(orig.RecoveryCodes))
+	copy(c.RecoveryCodes, orig.RecoveryCodes)
+	return c
+}
+
+func (a *GUIAccountConfiguration) prepare() {
+	if a.RecoveryCodes == nil {
+		a.RecoveryCodes = []string{}
+	}
+}
+
+// A GUIUserRole is what a GUI user may do.
+type GUIUserRole int
+
+const (
+	GUIUserRoleViewer   GUIUserRole = iota // default is viewer; looking but not touching
+	GUIUserRoleOperator                    // scanning, pausing, overriding and so on
+	GUIUserRoleAdmin                       // changing the configuration, restarts and upgrades
+)
+
+// Scope returns the API key scope that allows the same requests as the role.
+func (r GUIUserRole) Scope() APIKeyScope {
+	switch r {
+	case GUIUserRoleOperator:
+		return APIKeyScopeControl
+	case GUIUserRoleAdmin:
+		return APIKeyScopeAdmin
+	default:
+		return APIKeyScopeReadOnly
+	}
+}
+
+func (r GUIUserRole) String() string {
+	switch r {
+	case GUIUserRoleViewer:
+		return "viewer"
+	case GUIUserRoleOperator:
+		return "operator"
+	case GUIUserRoleAdmin:
+		return "admin"
+	default:
+		return "unknown"
+	}
+}
+
+func (r GUIUserRole) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *GUIUserRole) UnmarshalText(bs []byte) error {
+	switch string(bs) {
+	case "viewer":
+		*r = GUIUserRoleViewer
+	case "operator":
+		*r = GUIUserRoleOperator
+	case "admin":
+		*r = GUIUserRoleAdmin
+	default:
+		*r = GUIUserRoleViewer
+	}
+	return nil
+}
@@ -13,14 +13,34 @@ import (
 )
 
 type GUIConfiguration struct {
-	Enabled             bool   `xml:"enabled,attr" json:"enabled" default:"true"`
-	RawAddress          string `xml:"address" json:"address" default:"127.0.0.1:8384"`
-	User                string `xml:"user,omitempty" json:"user"`
-	Password            string `xml:"password,omitempty" json:"password"`
-	RawUseTLS           bool   `xml:"tls,attr" json:"useTLS"`
-	APIKey              string `xml:"apikey,omitempty" json:"apiKey"`
-	InsecureAdminAccess bool   `xml:"insecureAdminAccess,omitempty" json:"insecureAdminAccess"`
-	Theme               string `xml:"theme" json:"theme" default:"default"`
+	Enabled             bool                      `xml:"enabled,attr" json:"enabled" default:"true"`
+	RawAddress          string                    `xml:"address" json:"address" default:"127.0.0.1:8384"`
+	User                string                    `xml:"user,omitempty" json:"user"`
+	Password            string                    `xml:"password,omitempty" json:"password"`
+	TOTPSecret          string                    `xml:"totpSecret,omitempty" json:"totpSecret"`
+	RecoveryCodes       []string                  `xml:"recoveryCode" json:"recoveryCodes"`
+	Accounts            []GUIAccountConfiguration `xml:"account" json:"accounts"`
+	LDAP                LDAPConfiguration         `xml:"ldap" json:"ldap"`
+	RawUseTLS           bool                      `xml:"tls,attr" json:"useTLS"`
+	APIKey              string                    `xml:"apikey,omitempty" json:"apiKey"`
+	APIKeys             []APIKeyConfiguration     `xml:"namedApikey" json:"apiKeys"`
+	InsecureAdminAccess bool                      `xml:"insecureAdminAccess,omitempty" json:"insecureAdminAccess"`
+	Theme               string                    `xml:"theme" json:"theme" default:"default"`
+}
+
+func (orig GUIConfiguration) Copy() GUIConfiguration {
+	c := orig
+	c.RecoveryCodes = make([]string, len(orig.RecoveryCodes))
+	copy(c.RecoveryCodes, orig.RecoveryCodes)
+	c.Accounts = make([]GUIAccountConfiguration, len(orig.Accounts))
+	for i := range orig.Accounts {
+		c.Accounts[i] = orig.Accounts[i].Copy()
+	}
+	c.APIKeys = make([]APIKeyConfiguration, len(orig.APIKeys))
+	for i := range orig.APIKeys {
+		c.APIKeys[i] = orig.APIKeys[i].Copy()
+	}
+	return c
 }
 
 func (c GUIConfiguration) Address() string {
@@ -76,8 +96,58 @@ func (c GUIConfiguration) URL() string {
 	return u.String()
 }
 
+// IsAuthenticationEnabled returns true if logging in to the GUI is required.
+func (c GUIConfiguration) IsAuthenticationEnabled() bool {
+	return c.User != "" && c.Password != "" || len(c.Accounts) > 0 || c.LDAP.IsEnabled()
+}
+
+// Account returns the account with the given name, if there is one. The user
+// and password set directly in the GUI configuration is an admin account.
+func (c GUIConfiguration) Account(name string) (GUIAccountConfiguration, bool) {
+	if name == "" {
+		return GUIAccountConfiguration{}, false
+	}
+	if name == c.User && c.Password != "" {
+		return GUIAccountConfiguration{
+			Name:          c.User,
+			Password:      c.Password,
+			Role:          GUIUserRoleAdmin,
+			TOTPSecret:    c.TOTPSecret,
+			RecoveryCodes: c.RecoveryCodes,
+		}, true
+	}
+	for _, a := range c.Accounts {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return GUIAccountConfiguration{}, false
+}
+
+// SetAccount replaces the account with the same name, returning false if
+// there is none. For the user set directly in the GUI configuration, all but
+// the role is updated.
+func (c *GUIConfiguration) SetAccount(account GUIAccountConfiguration) bool {
+	if account.Name == "" {
+		return false
+	}
+	if account.Name == c.User && c.Password != "" {
+		c.Password = account.Password
+		c.TOTPSecret = account.TOTPSecret
+		c.RecoveryCodes = account.RecoveryCodes
+		return true
+	}
+	for i := range c.Accounts {
+		if c.Accounts[i].Name == account.Name {
+			c.Accounts[i] = account
+			return true
+		}
+	}
+	return false
+}
+
 // IsValidAPIKey returns true when the given API key is valid, including both
-// the value in config and any overrides
+// the value in config and any overrides, and the named API keys
 func (c GUIConfiguration) IsValidAPIKey(apiKey string) bool {
 	switch apiKey {
 	case "":
@@ -87,6 +157,20 @@ func (c GUIConfiguration) IsValidAPIKey(apiKey string) bool {
 		return true
 
 	default:
-		return false
+		_, ok := c.NamedAPIKey(apiKey)
+		return ok
+	}
+}
+
+// NamedAPIKey returns the named API key with the given value, if there is one.
+func (c GUIConfiguration) NamedAPIKey(apiKey string) (APIKeyConfiguration, bool) {
+	if apiKey == "" {
+		return APIKeyConfiguration{}, false
+	}
+	for _, k := range c.APIKeys {
+		if k.Key == apiKey {
+			return k, true
+		}
 	}
+	return APIKeyConfiguration{}, false
 }
@@ -0,0 +1,74 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import "time"
+
+// An LDAPConfiguration describes a directory that GUI logins are checked
+// against, by binding as the user with the given password.
+type LDAPConfiguration struct {
+	Address            string        `xml:"address" json:"address"`                       // host:port of the server; empty disables LDAP
+	Transport          LDAPTransport `xml:"transport" json:"transport"`                   // plain, tls or starttls
+	InsecureSkipVerify bool          `xml:"insecureSkipVerify" json:"insecureSkipVerify"` // don't verify the server certificate
+	BindDN             string        `xml:"bindDN" json:"bindDN"`                         // the DN to bind as, with %s for the escaped username
+	GroupDN            string        `xml:"groupDN" json:"groupDN"`                       // If set, users must be a member of this group
+	GroupAttribute     string        `xml:"groupAttribute" json:"groupAttribute" default:"member"`
+	Role               GUIUserRole   `xml:"role" json:"role"` // of the users logging in through the directory
+	TimeoutS           int           `xml:"timeoutS" json:"timeoutS" default:"10"`
+	LocalFallback      bool          `xml:"localFallback" json:"localFallback" default:"true"` // check the local password when the server can't be reached
+}
+
+// IsEnabled returns true if logins are checked against the directory.
+func (c LDAPConfiguration) IsEnabled() bool {
+	return c.Address != "" && c.BindDN != ""
+}
+
+func (c LDAPConfiguration) Timeout() time.Duration {
+	if c.TimeoutS <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.TimeoutS) * time.Second
+}
+
+type LDAPTransport int
+
+const (
+	LDAPTransportPlain    LDAPTransport = iota // default is plain
+	LDAPTransportTLS                           // LDAPS; TLS from the start
+	LDAPTransportStartTLS                      // plain, upgraded to TLS before binding
+)
+
+func (t LDAPTransport) String() string {
+	switch t {
+	case LDAPTransportPlain:
+		return "plain"
+	case LDAPTransportTLS:
+		return "tls"
+	case LDAPTransportStartTLS:
+		return "starttls"
+	default:
+		return "unknown"
+	}
+}
+
+func (t LDAPTransport) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *LDAPTransport) UnmarshalText(bs []byte) error {
+	switch string(bs) {
+	case "plain":
+		*t = LDAPTransportPlain
+	case "tls":
+		*t = LDAPTransportTLS
+	case "starttls":
+		*t = LDAPTransportStartTLS
+	default:
+		*t = LDAPTransportPlain
+	}
+	return nil
+}
@@ -6,6 +6,8 @@
 
 package config
 
+import "time"
+
 type OptionsConfiguration struct {
 	ListenAddresses         []string `xml:"listenAddress" json:"listenAddresses" default:"default"`
 	GlobalAnnServers        []string `xml:"globalAnnounceServer" json:"globalAnnounceServers" json:"globalAnnounceServer" default:"default"`
@@ -40,6 +42,9 @@ type OptionsConfiguration struct {
 	OverwriteNames          bool     `xml:"overwriteNames" json:"overwriteNames" default:"false"`
 	TempIndexMinBlocks      int      `xml:"tempIndexMinBlocks" json:"tempIndexMinBlocks" default:"10"`
 
+	// Overrides MaxSendKbps and MaxRecvKbps during the first matching window.
+	BandwidthSchedule []BandwidthWindow `xml:"bandwidthWindow" json:"bandwidthSchedule"`
+
 	DeprecatedUPnPEnabled   bool     `xml:"upnpEnabled" json:"-"`
 	DeprecatedUPnPLeaseM    int      `xml:"upnpLeaseMinutes" json:"-"`
 	DeprecatedUPnPRenewalM  int      `xml:"upnpRenewalMinutes" json:"-"`
@@ -56,5 +61,31 @@ func (orig OptionsConfiguration) Copy() OptionsConfiguration {
 	copy(c.GlobalAnnServers, orig.GlobalAnnServers)
 	c.AlwaysLocalNets = make([]string, len(orig.AlwaysLocalNets))
 	copy(c.AlwaysLocalNets, orig.AlwaysLocalNets)
+	c.BandwidthSchedule = make([]BandwidthWindow, len(orig.BandwidthSchedule))
+	copy(c.BandwidthSchedule, orig.BandwidthSchedule)
 	return c
 }
+
+// RateLimitsAt returns the send and receive rate limits, in KiB/s, in effect
+// at the given time. Zero means no limit.
+func (orig OptionsConfiguration) RateLimitsAt(t time.Time) (send, recv int) {
+	for _, w := range orig.BandwidthSchedule {
+		if w.contains(t) {
+			return w.MaxSendKbps, w.MaxRecvKbps
+		}
+	}
+	return orig.MaxSendKbps, orig.MaxRecvKbps
+}
+
+// HasRateLimits returns whether rate limits are set at any time.
+func (orig OptionsConfiguration) HasRateLimits() bool {
+	if orig.MaxSendKbps > 0 || orig.MaxRecvKbps > 0 {
+		return true
+	}
+	for _, w := range orig.BandwidthSchedule {
+		if w.MaxSendKbps > 0 || w.MaxRecvKbps > 0 {
+			return true
+		}
+	}
+	return false
+}
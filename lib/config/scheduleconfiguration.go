@@ -0,0 +1,307 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The operations that can be allowed in a schedule window.
+const (
+	ScheduleScan  = "scan"
+	SchedulePull  = "pull"
+	ScheduleServe = "serve"
+)
+
+// A ScheduleConfiguration restricts what a folder, or a device, is allowed
+// to do at certain times. The first window matching the current time
+// decides; outside of all windows everything is allowed without limits.
+type ScheduleConfiguration struct {
+	Windows []ScheduleWindow `xml:"window" json:"windows"`
+}
+
+// A ScheduleWindow is a time span on a set of weekdays. Days uses the cron
+// day of week syntax, i.e. "*", "1-5", "mon-fri" or "sat,sun". Start and
+// End are given as "15:04" in local time; a window where End is before
+// Start continues into the following day, and a window with neither covers
+// the whole day. Allow is a comma separated list of the operations allowed
+// during the window. The bandwidth caps are in KiB/s, zero meaning no cap.
+type ScheduleWindow struct {
+	Days        string `xml:"days,attr" json:"days"`
+	Start       string `xml:"start,attr" json:"start"`
+	End         string `xml:"end,attr" json:"end"`
+	Allow       string `xml:"allow,attr" json:"allow"`
+	MaxSendKbps int    `xml:"maxSendKbps,attr" json:"maxSendKbps"`
+	MaxRecvKbps int    `xml:"maxRecvKbps,attr" json:"maxRecvKbps"`
+}
+
+// ScheduleState is what a schedule allows at a given time. Window is the
+// index of the window in effect, or -1 if none.
+type ScheduleState struct {
+	Window      int  `json:"window"`
+	Scan        bool `json:"scan"`
+	Pull        bool `json:"pull"`
+	Serve       bool `json:"serve"`
+	MaxSendKbps int  `json:"maxSendKbps"`
+	MaxRecvKbps int  `json:"maxRecvKbps"`
+}
+
+// Allows returns whether the given operation is allowed.
+func (s ScheduleState) Allows(op string) bool {
+	switch op {
+	case ScheduleScan:
+		return s.Scan
+	case SchedulePull:
+		return s.Pull
+	case ScheduleServe:
+		return s.Serve
+	default:
+		return false
+	}
+}
+
+func (orig ScheduleConfiguration) Copy() ScheduleConfiguration {
+	c := orig
+	if orig.Windows != nil {
+		c.Windows = make([]ScheduleWindow, len(orig.Windows))
+		copy(c.Windows, orig.Windows)
+	}
+	return c
+}
+
+// StateAt returns what the schedule allows at the given time. Invalid
+// windows never match.
+func (s ScheduleConfiguration) StateAt(t time.Time) ScheduleState {
+	return s.Parse().StateAt(t)
+}
+
+// A ParsedSchedule is a ScheduleConfiguration parsed once, for looking up
+// the state often. The zero value allows everything.
+type ParsedSchedule struct {
+	windows []parsedScheduleWindow
+}
+
+type parsedScheduleWindow struct {
+	parsedWindow
+	index       int
+	maxSendKbps int
+	maxRecvKbps int
+}
+
+// Parse returns the parsed schedule. Invalid windows are left out.
+func (s ScheduleConfiguration) Parse() ParsedSchedule {
+	var ps ParsedSchedule
+	for i, w := range s.Windows {
+		pw, err := w.parse()
+		if err != nil {
+			continue
+		}
+		ps.windows = append(ps.windows, parsedScheduleWindow{
+			parsedWindow: pw,
+			index:        i,
+			maxSendKbps:  w.MaxSendKbps,
+			maxRecvKbps:  w.MaxRecvKbps,
+		})
+	}
+	return ps
+}
+
+// StateAt returns what the schedule allows at the given time.
+func (s ParsedSchedule) StateAt(t time.Time) ScheduleState {
+	for _, w := range s.windows {
+		if !w.contains(t) {
+			continue
+		}
+		return ScheduleState{
+			Window:      w.index,
+			Scan:        w.allow[ScheduleScan],
+			Pull:        w.allow[SchedulePull],
+			Serve:       w.allow[ScheduleServe],
+			MaxSendKbps: w.maxSendKbps,
+			MaxRecvKbps: w.maxRecvKbps,
+		}
+	}
+	return ScheduleState{
+		Window: -1,
+		Scan:   true,
+		Pull:   true,
+		Serve:  true,
+	}
+}
+
+// prepare warns about windows that cannot be parsed, as they are otherwise
+// silently ignored.
+func (s *ScheduleConfiguration) prepare(owner string) {
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		if w.MaxSendKbps < 0 {
+			w.MaxSendKbps = 0
+		}
+		if w.MaxRecvKbps < 0 {
+			w.MaxRecvKbps = 0
+		}
+		if _, err := w.parse(); err != nil {
+			l.Warnf("Ignoring schedule window %d for %s: %v", i, owner, err)
+		}
+	}
+}
+
+// A BandwidthWindow sets the connection rate limits for a time span on a
+// set of weekdays, given the same way as for a ScheduleWindow. The limits
+// are in KiB/s, zero meaning no limit.
+type BandwidthWindow struct {
+	Days        string `xml:"days,attr" json:"days"`
+	Start       string `xml:"start,attr" json:"start"`
+	End         string `xml:"end,attr" json:"end"`
+	MaxSendKbps int    `xml:"maxSendKbps,attr" json:"maxSendKbps"`
+	MaxRecvKbps int    `xml:"maxRecvKbps,attr" json:"maxRecvKbps"`
+}
+
+// contains returns whether the window covers the given time. Invalid
+// windows cover no time at all.
+func (w BandwidthWindow) contains(t time.Time) bool {
+	pw, err := parseScheduleSpan(w.Days, w.Start, w.End)
+	return err == nil && pw.contains(t)
+}
+
+type parsedWindow struct {
+	days       [7]bool
+	start, end int // minutes since midnight
+	allow      map[string]bool
+}
+
+func (w ScheduleWindow) parse() (parsedWindow, error) {
+	pw, err := parseScheduleSpan(w.Days, w.Start, w.End)
+	if err != nil {
+		return pw, err
+	}
+
+	pw.allow = make(map[string]bool)
+	for _, op := range strings.Split(w.Allow, ",") {
+		op = strings.TrimSpace(op)
+		switch op {
+		case "":
+		case ScheduleScan, SchedulePull, ScheduleServe:
+			pw.allow[op] = true
+		default:
+			return pw, fmt.Errorf("unknown operation %q", op)
+		}
+	}
+
+	return pw, nil
+}
+
+func parseScheduleSpan(days, start, end string) (parsedWindow, error) {
+	var pw parsedWindow
+	var err error
+
+	if pw.days, err = parseScheduleDays(days); err != nil {
+		return pw, err
+	}
+	if start != "" || end != "" {
+		if pw.start, err = parseScheduleTime(start); err != nil {
+			return pw, err
+		}
+		if pw.end, err = parseScheduleTime(end); err != nil {
+			return pw, err
+		}
+	}
+	return pw, nil
+}
+
+func (pw parsedWindow) contains(t time.Time) bool {
+	day := int(t.Weekday())
+	mins := t.Hour()*60 + t.Minute()
+
+	if pw.start < pw.end {
+		return pw.days[day] && mins >= pw.start && mins < pw.end
+	}
+	if pw.start == pw.end {
+		return pw.days[day]
+	}
+	// The window starts on one of the days and ends on the next one.
+	return pw.days[day] && mins >= pw.start || pw.days[(day+6)%7] && mins < pw.end
+}
+
+var scheduleDayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseScheduleDays(s string) ([7]bool, error) {
+	var days [7]bool
+	if s == "" || s == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		from, to := part, part
+		if idx := strings.IndexByte(part, '-'); idx >= 0 {
+			from, to = part[:idx], part[idx+1:]
+		}
+		first, err := parseScheduleDay(from)
+		if err != nil {
+			return days, err
+		}
+		last, err := parseScheduleDay(to)
+		if err != nil {
+			return days, err
+		}
+		// Both 0 and 7 are Sunday, as in cron, so "0-7" is the whole week
+		// and "5-7" ends on the Sunday after.
+		if last == 7 {
+			if first == 0 {
+				last = 6
+			} else {
+				last = 0
+			}
+		}
+		first %= 7
+		// Ranges may wrap around the end of the week, as in "fri-mon".
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseScheduleDay(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 || n > 7 {
+			return 0, fmt.Errorf("invalid day %q", s)
+		}
+		// Both 0 and 7 are Sunday; the caller tells them apart in ranges.
+		return n, nil
+	}
+	if len(s) >= 3 {
+		for i, name := range scheduleDayNames {
+			if strings.HasPrefix(s, name) {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
+
+func parseScheduleTime(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
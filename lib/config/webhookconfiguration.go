@@ -0,0 +1,45 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import "github.com/syncthing/syncthing/lib/protocol"
+
+// A WebhookConfiguration describes a URL that batches of events are posted
+// to.
+type WebhookConfiguration struct {
+	ID                 string              `xml:"id,attr" json:"id"`
+	URL                string              `xml:"url" json:"url"`
+	Events             []string            `xml:"event" json:"events"`                          // Names of the event types to send
+	Folders            []string            `xml:"folder" json:"folders"`                        // If set, only events concerning these folders are sent
+	Devices            []protocol.DeviceID `xml:"device" json:"devices"`                        // If set, only events concerning these devices are sent
+	Secret             string              `xml:"secret" json:"secret"`                         // If set, requests are signed with HMAC-SHA256 using this secret
+	DisconnectedDelayS int                 `xml:"disconnectedDelayS" json:"disconnectedDelayS"` // DeviceDisconnected is only sent if the device stays disconnected this long
+	CompletedOnly      bool                `xml:"completedOnly" json:"completedOnly"`           // FolderCompletion is only sent when reaching 100%
+}
+
+func (orig WebhookConfiguration) Copy() WebhookConfiguration {
+	c := orig
+	c.Events = make([]string, len(orig.Events))
+	copy(c.Events, orig.Events)
+	c.Folders = make([]string, len(orig.Folders))
+	copy(c.Folders, orig.Folders)
+	c.Devices = make([]protocol.DeviceID, len(orig.Devices))
+	copy(c.Devices, orig.Devices)
+	return c
+}
+
+func (w *WebhookConfiguration) prepare() {
+	if w.Events == nil {
+		w.Events = []string{}
+	}
+	if w.Folders == nil {
+		w.Folders = []string{}
+	}
+	if w.Devices == nil {
+		w.Devices = []protocol.DeviceID{}
+	}
+}
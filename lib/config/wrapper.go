@@ -202,6 +202,21 @@ func (w *Wrapper) SetDevice(dev DeviceConfiguration) CommitResponse {
 	return w.replaceLocked(newCfg)
 }
 
+// ReplaceDeviceID moves the configuration of a device, including the folders
+// shared with it, from one device ID to another. Any existing configuration
+// for the new device ID is overwritten. It returns false if the old device ID
+// is unknown.
+func (w *Wrapper) ReplaceDeviceID(from, to protocol.DeviceID) (CommitResponse, bool) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	newCfg := w.cfg.Copy()
+	if !newCfg.replaceDeviceID(from, to) {
+		return CommitResponse{}, false
+	}
+	return w.replaceLocked(newCfg), true
+}
+
 // Folders returns a map of folders. Folder structures should not be changed,
 // other than for the purpose of updating via SetFolder().
 func (w *Wrapper) Folders() map[string]FolderConfiguration {
@@ -283,6 +298,41 @@ func (w *Wrapper) IgnoredDevice(id protocol.DeviceID) bool {
 	return false
 }
 
+// RevokedDevice returns whether the device has been revoked, and should
+// never be connected to or shared with.
+func (w *Wrapper) RevokedDevice(id protocol.DeviceID) bool {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	for _, device := range w.cfg.RevokedDevices {
+		if device == id {
+			return true
+		}
+	}
+	return false
+}
+
+// RevokeDevice adds the device to the list of revoked devices, and removes
+// it from the device list and all folders.
+func (w *Wrapper) RevokeDevice(id protocol.DeviceID) CommitResponse {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	newCfg := w.cfg.Copy()
+	revoked := false
+	for _, device := range newCfg.RevokedDevices {
+		if device == id {
+			revoked = true
+			break
+		}
+	}
+	if !revoked {
+		newCfg.RevokedDevices = append(newCfg.RevokedDevices, id)
+	}
+	newCfg.removeDevice(id)
+
+	return w.replaceLocked(newCfg)
+}
+
 // Save writes the configuration to disk, and generates a ConfigSaved event.
 func (w *Wrapper) Save() error {
 	fd, err := osutil.CreateAtomic(w.path, 0600)
@@ -6,18 +6,20 @@
 
 package connections
 
-import (
-	"io"
+import "io"
 
-	"github.com/juju/ratelimit"
-)
+// A waiter blocks until the given number of bytes may be transferred, as
+// implemented by *ratelimit.Bucket.
+type waiter interface {
+	Wait(count int64)
+}
 
 type LimitedReader struct {
 	reader io.Reader
-	bucket *ratelimit.Bucket
+	bucket waiter
 }
 
-func NewReadLimiter(r io.Reader, b *ratelimit.Bucket) *LimitedReader {
+func NewReadLimiter(r io.Reader, b waiter) *LimitedReader {
 	return &LimitedReader{
 		reader: r,
 		bucket: b,
@@ -6,18 +6,14 @@
 
 package connections
 
-import (
-	"io"
-
-	"github.com/juju/ratelimit"
-)
+import "io"
 
 type LimitedWriter struct {
 	writer io.Writer
-	bucket *ratelimit.Bucket
+	bucket waiter
 }
 
-func NewWriteLimiter(w io.Writer, b *ratelimit.Bucket) *LimitedWriter {
+func NewWriteLimiter(w io.Writer, b waiter) *LimitedWriter {
 	return &LimitedWriter{
 		writer: w,
 		bucket: b,
@@ -0,0 +1,67 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package connections
+
+import (
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// A rateLimiter is a rate limit that can be changed while connections are
+// using it.
+type rateLimiter struct {
+	bucket *ratelimit.Bucket // nil when unlimited
+	kbps   int
+	mut    sync.Mutex
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		mut: sync.NewMutex(),
+	}
+}
+
+// setRate sets the limit in KiB/s, zero meaning unlimited. It returns
+// whether the limit changed.
+func (r *rateLimiter) setRate(kbps int) bool {
+	if kbps < 0 {
+		kbps = 0
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if kbps == r.kbps {
+		return false
+	}
+
+	r.kbps = kbps
+	if kbps == 0 {
+		r.bucket = nil
+	} else {
+		// The rate variables are in KiB/s in the UI (despite the camel
+		// casing of the name). We multiply by 1024 here to get B/s.
+		r.bucket = ratelimit.NewBucketWithRate(float64(1024*kbps), int64(5*1024*kbps))
+	}
+	return true
+}
+
+// rate returns the current limit in KiB/s.
+func (r *rateLimiter) rate() int {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.kbps
+}
+
+// Wait blocks until count bytes may be transferred.
+func (r *rateLimiter) Wait(count int64) {
+	r.mut.Lock()
+	bucket := r.bucket
+	r.mut.Unlock()
+	if bucket != nil {
+		bucket.Wait(count)
+	}
+}
@@ -8,6 +8,7 @@ package connections
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -15,7 +16,6 @@ import (
 	"net/url"
 	"time"
 
-	"github.com/juju/ratelimit"
 	"github.com/syncthing/syncthing/lib/config"
 	"github.com/syncthing/syncthing/lib/discover"
 	"github.com/syncthing/syncthing/lib/events"
@@ -49,8 +49,8 @@ type Service struct {
 	bepProtocolName      string
 	tlsDefaultCommonName string
 	lans                 []*net.IPNet
-	writeRateLimit       *ratelimit.Bucket
-	readRateLimit        *ratelimit.Bucket
+	writeRateLimit       *rateLimiter
+	readRateLimit        *rateLimiter
 	natService           *nat.Service
 	natServiceToken      *suture.ServiceToken
 
@@ -75,6 +75,8 @@ func NewService(cfg *config.Wrapper, myID protocol.DeviceID, mdl Model, tlsCfg *
 		tlsDefaultCommonName: tlsDefaultCommonName,
 		lans:                 lans,
 		natService:           nat.NewService(myID, cfg),
+		writeRateLimit:       newRateLimiter(),
+		readRateLimit:        newRateLimiter(),
 
 		mut:               sync.NewRWMutex(),
 		listeners:         make(map[string]genericListener),
@@ -83,14 +85,9 @@ func NewService(cfg *config.Wrapper, myID protocol.DeviceID, mdl Model, tlsCfg *
 	}
 	cfg.Subscribe(service)
 
-	// The rate variables are in KiB/s in the UI (despite the camel casing
-	// of the name). We multiply by 1024 here to get B/s.
-	if service.cfg.Options().MaxSendKbps > 0 {
-		service.writeRateLimit = ratelimit.NewBucketWithRate(float64(1024*service.cfg.Options().MaxSendKbps), int64(5*1024*service.cfg.Options().MaxSendKbps))
-	}
-	if service.cfg.Options().MaxRecvKbps > 0 {
-		service.readRateLimit = ratelimit.NewBucketWithRate(float64(1024*service.cfg.Options().MaxRecvKbps), int64(5*1024*service.cfg.Options().MaxRecvKbps))
-	}
+	send, recv := cfg.Options().RateLimitsAt(time.Now())
+	service.writeRateLimit.setRate(send)
+	service.readRateLimit.setRate(recv)
 
 	// There are several moving parts here; one routine per listening address
 	// (handled in configuration changing) to handle incoming connections,
@@ -100,6 +97,7 @@ func NewService(cfg *config.Wrapper, myID protocol.DeviceID, mdl Model, tlsCfg *
 
 	service.Add(serviceFunc(service.connect))
 	service.Add(serviceFunc(service.handle))
+	service.Add(serviceFunc(service.followBandwidthSchedule))
 
 	raw := cfg.Raw()
 	// Actually starts the listeners and NAT service
@@ -142,6 +140,18 @@ next:
 			continue
 		}
 
+		// Revoked devices are refused before they get to say anything.
+		if s.cfg.RevokedDevice(remoteID) {
+			l.Infof("Connection from revoked device %s (%s) refused", remoteID, c.RemoteAddr())
+			c.Close()
+			continue
+		}
+
+		// A device that has replaced its certificate may connect with the
+		// new one before we have heard of the change. We take its word for
+		// it if the old key has certified the new one.
+		s.checkDeviceIDTransition(remoteID, remoteCert)
+
 		hello, err := exchangeHello(c, s.model.GetHello(remoteID))
 		if err != nil {
 			l.Infof("Failed to exchange Hello messages with %s (%s): %s", remoteID, c.RemoteAddr(), err)
@@ -200,18 +210,20 @@ next:
 					continue next
 				}
 
-				// If rate limiting is set, and based on the address we should
-				// limit the connection, then we wrap it in a limiter.
+				// If based on the address we should limit the connection,
+				// then we wrap it in a limiter. The limits may change
+				// while the connection is up, as the bandwidth schedule
+				// says.
 
 				limit := s.shouldLimit(c.RemoteAddr())
 
 				wr := io.Writer(c)
-				if limit && s.writeRateLimit != nil {
+				if limit {
 					wr = NewWriteLimiter(c, s.writeRateLimit)
 				}
 
 				rd := io.Reader(c)
-				if limit && s.readRateLimit != nil {
+				if limit {
 					rd = NewReadLimiter(c, s.readRateLimit)
 				}
 
@@ -235,6 +247,27 @@ next:
 	}
 }
 
+// checkDeviceIDTransition moves the configuration of a known device over to
+// remoteID, if that is unknown and the certificate carries a valid device ID
+// transition from the known device.
+func (s *Service) checkDeviceIDTransition(remoteID protocol.DeviceID, cert *x509.Certificate) {
+	if _, ok := s.cfg.Devices()[remoteID]; ok {
+		return
+	}
+
+	from, ok, err := protocol.CertificateTransitionFrom(cert)
+	if !ok {
+		return
+	}
+	if err != nil {
+		l.Infof("Certificate of %s carries an invalid device ID transition: %v", remoteID, err)
+		return
+	}
+	if err := s.model.ApplyDeviceIDTransition(from, remoteID); err != nil {
+		l.Debugf("Device ID transition from %s to %s not applied: %v", from, remoteID, err)
+	}
+}
+
 func (s *Service) connect() {
 	nextDial := make(map[string]time.Time)
 	delay := time.Second
@@ -437,9 +470,45 @@ func (s *Service) CommitConfiguration(from, to config.Configuration) bool {
 		s.natServiceToken = nil
 	}
 
+	s.updateRateLimits(to.Options)
+
 	return !restart
 }
 
+// followBandwidthSchedule updates the rate limits when the bandwidth
+// schedule moves from one window to another.
+func (s *Service) followBandwidthSchedule() {
+	for {
+		// Windows start and end on the minute.
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		s.updateRateLimits(s.cfg.Options())
+	}
+}
+
+func (s *Service) updateRateLimits(opts config.OptionsConfiguration) {
+	send, recv := opts.RateLimitsAt(time.Now())
+	if s.writeRateLimit.setRate(send) {
+		l.Infoln("Send rate limit is now", rateString(send))
+	}
+	if s.readRateLimit.setRate(recv) {
+		l.Infoln("Receive rate limit is now", rateString(recv))
+	}
+}
+
+// RateLimits returns the send and receive rate limits currently in effect,
+// in KiB/s. Zero means no limit.
+func (s *Service) RateLimits() (send, recv int) {
+	return s.writeRateLimit.rate(), s.readRateLimit.rate()
+}
+
+func rateString(kbps int) string {
+	if kbps == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d KiB/s", kbps)
+}
+
 func (s *Service) AllAddresses() []string {
 	s.mut.RLock()
 	var addrs []string
@@ -0,0 +1,229 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package connections
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+type fakeModel struct {
+	cfg   *config.Wrapper
+	added chan protocol.DeviceID
+}
+
+func (m *fakeModel) Index(protocol.DeviceID, string, []protocol.FileInfo, uint32, []protocol.Option) {
+}
+
+func (m *fakeModel) IndexUpdate(protocol.DeviceID, string, []protocol.FileInfo, uint32, []protocol.Option) {
+}
+
+func (m *fakeModel) Request(protocol.DeviceID, string, string, int64, []byte, uint32, []protocol.Option, []byte) error {
+	return nil
+}
+
+func (m *fakeModel) ClusterConfig(protocol.DeviceID, protocol.ClusterConfigMessage) {}
+
+func (m *fakeModel) Close(protocol.DeviceID, error) {}
+
+func (m *fakeModel) DownloadProgress(protocol.DeviceID, string, []protocol.FileDownloadProgressUpdate, uint32, []protocol.Option) {
+}
+
+func (m *fakeModel) AddConnection(conn Connection, hello protocol.HelloMessage) {
+	m.added <- conn.ID()
+}
+
+func (m *fakeModel) ConnectedTo(protocol.DeviceID) bool { return false }
+
+func (m *fakeModel) IsPaused(protocol.DeviceID) bool { return false }
+
+func (m *fakeModel) OnHello(protocol.DeviceID, net.Addr, protocol.HelloMessage) {}
+
+func (m *fakeModel) GetHello(protocol.DeviceID) protocol.HelloMessage {
+	return protocol.HelloMessage{ClientName: "syncthing"}
+}
+
+func (m *fakeModel) ApplyDeviceIDTransition(from, to protocol.DeviceID) error {
+	if _, ok := m.cfg.ReplaceDeviceID(from, to); !ok {
+		return errors.New("unknown device")
+	}
+	return nil
+}
+
+func TestHandleDeviceIDTransition(t *testing.T) {
+	// newCert returns a certificate for the default name, certified by
+	// oldCert if that is given.
+	newCert := func(oldCert *tls.Certificate) tls.Certificate {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "syncthing"},
+			DNSNames:     []string{"syncthing"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		if oldCert != nil {
+			ext, err := protocol.CertificateTransitionExtension(*oldCert, pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			template.ExtraExtensions = []pkix.Extension{ext}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &template, &template, pub, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+	}
+
+	myCert := newCert(nil)
+	myID := protocol.NewDeviceID(myCert.Certificate[0])
+	oldCert := newCert(nil)
+	oldID := protocol.NewDeviceID(oldCert.Certificate[0])
+	rotatedCert := newCert(&oldCert)
+	rotatedID := protocol.NewDeviceID(rotatedCert.Certificate[0])
+	strangerCert := newCert(nil)
+	forgedCert := newCert(&strangerCert)
+
+	raw := config.New(myID)
+	raw.Devices = append(raw.Devices, config.DeviceConfiguration{DeviceID: oldID})
+	raw.Folders = []config.FolderConfiguration{
+		{ID: "default", Devices: []config.FolderDeviceConfiguration{{DeviceID: myID}, {DeviceID: oldID}}},
+	}
+	cfg := config.Wrap("/dev/null", raw)
+
+	mdl := &fakeModel{cfg: cfg, added: make(chan protocol.DeviceID, 1)}
+	s := &Service{
+		cfg:                  cfg,
+		myID:                 myID,
+		model:                mdl,
+		conns:                make(chan IntermediateConnection),
+		bepProtocolName:      "bep/1.0",
+		tlsDefaultCommonName: "syncthing",
+		writeRateLimit:       newRateLimiter(),
+		readRateLimit:        newRateLimiter(),
+		mut:                  sync.NewRWMutex(),
+		currentConnection:    make(map[protocol.DeviceID]Connection),
+	}
+	go s.handle()
+	defer close(s.conns)
+
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+
+	// connect connects to the service with the given certificate, and
+	// returns whether the connection was handed to the model and under
+	// which device ID.
+	connect := func(cert tls.Certificate) (protocol.DeviceID, bool) {
+		c0, err := net.Dial("tcp", lst.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c0.Close()
+		c1, err := lst.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := tls.Client(c0, &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			NextProtos:         []string{"bep/1.0"},
+			InsecureSkipVerify: true,
+		})
+		server := tls.Server(c1, &tls.Config{
+			Certificates: []tls.Certificate{myCert},
+			NextProtos:   []string{"bep/1.0"},
+			ClientAuth:   tls.RequireAnyClientCert,
+		})
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- server.Handshake()
+		}()
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		s.conns <- IntermediateConnection{server, "tcp-server", 10}
+		if _, err := exchangeHello(client, protocol.HelloMessage{ClientName: "syncthing"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The connection is then either handed to the model, or closed.
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		client.Read(make([]byte, 1))
+		select {
+		case id := <-mdl.added:
+			return id, true
+		default:
+			return protocol.DeviceID{}, false
+		}
+	}
+
+	// A certificate with no transition, or one certified by an unknown
+	// device, is ignored.
+
+	if _, ok := connect(strangerCert); ok {
+		t.Error("Unexpected connection from an unknown device")
+	}
+	if _, ok := connect(forgedCert); ok {
+		t.Error("Unexpected connection from a device certified by an unknown one")
+	}
+	if _, ok := cfg.Devices()[oldID]; !ok {
+		t.Fatal("Old device ID changed by an unrelated connection")
+	}
+
+	// The rotated certificate is accepted straight away, with the
+	// configuration of the old device moved over to it.
+
+	if id, ok := connect(rotatedCert); !ok || id != rotatedID {
+		t.Fatalf("Rotated certificate not accepted: %v %v", id, ok)
+	}
+	devices := cfg.Devices()
+	if _, ok := devices[oldID]; ok {
+		t.Error("Old device ID still configured")
+	}
+	if _, ok := devices[rotatedID]; !ok {
+		t.Error("New device ID not configured")
+	}
+	shared := false
+	for _, dev := range cfg.Folders()["default"].Devices {
+		if dev.DeviceID == oldID {
+			t.Error("Folder still shared with the old device ID")
+		}
+		shared = shared || dev.DeviceID == rotatedID
+	}
+	if !shared {
+		t.Error("Folder not shared with the new device ID")
+	}
+
+	// The old certificate is no longer accepted.
+
+	if _, ok := connect(oldCert); ok {
+		t.Error("Unexpected connection with the old certificate")
+	}
+}
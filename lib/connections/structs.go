@@ -64,6 +64,7 @@ type Model interface {
 	IsPaused(remoteID protocol.DeviceID) bool
 	OnHello(protocol.DeviceID, net.Addr, protocol.HelloMessage)
 	GetHello(protocol.DeviceID) protocol.HelloMessage
+	ApplyDeviceIDTransition(from, to protocol.DeviceID) error
 }
 
 // serviceFunc wraps a function to create a suture.Service without stop
@@ -0,0 +1,94 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The available database backends.
+const (
+	BackendLevelDB = "leveldb"
+	BackendBTree   = "btree"
+)
+
+// ErrNotFound is returned by Get when the key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// A Backend is the ordered key-value store that the database is kept in.
+type Backend interface {
+	Reader
+	Put(key, val []byte) error
+	Delete(key []byte) error
+	NewBatch() Batch
+	// Write applies the batch atomically.
+	Write(batch Batch) error
+	// NewSnapshot returns a consistent read only view of the current
+	// contents, which must be released after use.
+	NewSnapshot() (Snapshot, error)
+	Close() error
+}
+
+// A Reader does lookups and iterates over keys in order.
+type Reader interface {
+	// Get returns the value for the key, or ErrNotFound.
+	Get(key []byte) ([]byte, error)
+	// NewPrefixIterator returns an iterator over the keys with the given
+	// prefix, in ascending order. A nil prefix iterates over all keys.
+	NewPrefixIterator(prefix []byte) BackendIterator
+}
+
+// A Snapshot is a Reader that isn't affected by later writes.
+type Snapshot interface {
+	Reader
+	Release()
+}
+
+// A Batch collects writes to be applied together. Keys and values are copied,
+// so the caller may reuse the slices.
+type Batch interface {
+	Put(key, val []byte)
+	Delete(key []byte)
+	Len() int
+	Reset()
+}
+
+// A BackendIterator walks over keys in order. The slices returned by Key and
+// Value must not be modified and are only valid until the next call to Next.
+type BackendIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+// OpenBackend opens the database at the given location using the named
+// backend. The locations of different backends should not be shared, as the
+// on disk formats differ.
+func OpenBackend(backend, file string) (*Instance, error) {
+	var b Backend
+	var recovered bool
+	var err error
+
+	switch backend {
+	case BackendLevelDB, "":
+		b, recovered, err = openLevelDBBackend(file)
+	case BackendBTree:
+		b, recovered, err = openBTreeBackend(file)
+	default:
+		return nil, fmt.Errorf("unknown database backend %q", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	i := newDBInstance(b)
+	i.recovered = recovered
+	return i, nil
+}
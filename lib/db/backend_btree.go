@@ -0,0 +1,502 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/syncthing/syncthing/lib/osutil"
+	"github.com/syncthing/syncthing/lib/sync"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// The btreeBackend is experimental. It keeps the entire database in an in
+// memory B-tree, so its memory usage grows with the database, and appends
+// every write to a log file which is replayed on open. When the log has grown
+// to several times the size of the live data it's compacted by writing the
+// current contents to a new log in one sequential pass. This trades memory
+// for compaction that is simple and predictable: it happens at a known point,
+// doesn't block readers, and needs no more than the live data in extra disk
+// space.
+//
+// Writes are not synced to disk, same as for the LevelDB backend; they survive
+// a crash of the process but not necessarily of the operating system. A log
+// with a damaged tail is truncated after the last intact write on open.
+
+const (
+	btreeLogName         = "btree.log"
+	btreeCompactMinSize  = 64 << 20 // Don't compact logs smaller than this
+	btreeCompactFactor   = 2        // Compact when the log is this many times the live data
+	btreeCompactRecord   = 1 << 20  // Size of the records in a compacted log
+	btreeRecordHeaderLen = 8        // Payload length and checksum
+)
+
+// The operations in a batch, each followed by the length prefixed key and,
+// for puts, value.
+const (
+	btreeOpPut    = 1
+	btreeOpDelete = 2
+)
+
+var (
+	errBTreeClosed  = errors.New("database is closed")
+	errBTreeCorrupt = errors.New("corrupt database log record")
+	btreeCRCTable   = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type btreeBackend struct {
+	path string
+	lock storage.Storage // holds the lock on the directory
+
+	wmut    sync.Mutex // serializes writes
+	tree    btree      // the tree being written
+	size    int64      // the size of the keys and values in the tree
+	log     *os.File   // nil if the database is in memory only
+	logSize int64
+	err     error // set if the log can no longer be written
+
+	rmut    sync.RWMutex
+	current btree // the tree as of the last write
+}
+
+func newBTreeMemoryBackend() *btreeBackend {
+	return &btreeBackend{
+		tree: btree{owner: new(btreeOwner)},
+		wmut: sync.NewMutex(),
+		rmut: sync.NewRWMutex(),
+	}
+}
+
+func openBTreeBackend(path string) (Backend, bool, error) {
+	// The storage is only used for its cross platform directory lock.
+	lock, err := storage.OpenFile(path, false)
+	if err != nil {
+		return nil, false, err
+	}
+
+	b := newBTreeMemoryBackend()
+	b.path = path
+	b.lock = lock
+
+	recovered, err := b.replay()
+	if err != nil {
+		lock.Close()
+		return nil, false, err
+	}
+	b.current = b.tree.clone()
+
+	b.wmut.Lock()
+	if err := b.maybeCompact(); err != nil {
+		l.Warnln("Compacting database:", err)
+	}
+	b.wmut.Unlock()
+
+	return b, recovered, nil
+}
+
+// replay reads the log into the tree and opens it for appending. A damaged
+// tail is truncated, in which case recovered is true.
+func (b *btreeBackend) replay() (recovered bool, err error) {
+	name := filepath.Join(b.path, btreeLogName)
+	fd, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return false, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return false, err
+	}
+
+	br := bufio.NewReader(fd)
+	var offset int64
+	var hdr [btreeRecordHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			recovered = true
+			break
+		}
+
+		size := int64(binary.BigEndian.Uint32(hdr[:]))
+		if offset+btreeRecordHeaderLen+size > info.Size() {
+			recovered = true
+			break
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			recovered = true
+			break
+		}
+		if crc32.Checksum(data, btreeCRCTable) != binary.BigEndian.Uint32(hdr[4:]) {
+			recovered = true
+			break
+		}
+		if err := b.apply(data); err != nil {
+			recovered = true
+			break
+		}
+		offset += btreeRecordHeaderLen + size
+	}
+
+	if recovered {
+		l.Infof("Database log %s is damaged after %d of %d bytes; discarding the rest", name, offset, info.Size())
+		if err := fd.Truncate(offset); err != nil {
+			fd.Close()
+			return false, err
+		}
+	}
+
+	b.log = fd
+	b.logSize = offset
+	return recovered, nil
+}
+
+// apply applies the operations of an encoded batch to the tree. Nothing is
+// applied if the batch can't be decoded.
+func (b *btreeBackend) apply(data []byte) error {
+	type op struct {
+		del      bool
+		key, val []byte
+	}
+	var ops []op
+	for len(data) > 0 {
+		var o op
+		var err error
+		switch data[0] {
+		case btreeOpPut:
+			if o.key, data, err = btreeReadBytes(data[1:]); err != nil {
+				return err
+			}
+			if o.val, data, err = btreeReadBytes(data); err != nil {
+				return err
+			}
+		case btreeOpDelete:
+			o.del = true
+			if o.key, data, err = btreeReadBytes(data[1:]); err != nil {
+				return err
+			}
+		default:
+			return errBTreeCorrupt
+		}
+		ops = append(ops, o)
+	}
+
+	for _, o := range ops {
+		if o.del {
+			if old, ok := b.tree.delete(o.key); ok {
+				b.size -= int64(len(old.key) + len(old.val))
+			}
+			continue
+		}
+
+		// The batch buffer is reused by the caller, so the key and value
+		// are copied, into one allocation.
+		buf := make([]byte, len(o.key)+len(o.val))
+		copy(buf, o.key)
+		copy(buf[len(o.key):], o.val)
+		item := btreeItem{key: buf[:len(o.key):len(o.key)], val: buf[len(o.key):]}
+		if old, ok := b.tree.set(item); ok {
+			b.size -= int64(len(old.key) + len(old.val))
+		}
+		b.size += int64(len(buf))
+	}
+	return nil
+}
+
+func (b *btreeBackend) snapshot() btreeSnapshot {
+	b.rmut.RLock()
+	t := b.current
+	b.rmut.RUnlock()
+	return btreeSnapshot{t}
+}
+
+func (b *btreeBackend) Get(key []byte) ([]byte, error) {
+	return b.snapshot().Get(key)
+}
+
+func (b *btreeBackend) NewPrefixIterator(prefix []byte) BackendIterator {
+	return b.snapshot().NewPrefixIterator(prefix)
+}
+
+func (b *btreeBackend) Put(key, val []byte) error {
+	batch := b.NewBatch()
+	batch.Put(key, val)
+	return b.Write(batch)
+}
+
+func (b *btreeBackend) Delete(key []byte) error {
+	batch := b.NewBatch()
+	batch.Delete(key)
+	return b.Write(batch)
+}
+
+func (b *btreeBackend) NewBatch() Batch {
+	return new(btreeBatch)
+}
+
+func (b *btreeBackend) Write(batch Batch) error {
+	bb := batch.(*btreeBatch)
+	if bb.n == 0 {
+		return nil
+	}
+
+	b.wmut.Lock()
+	defer b.wmut.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+
+	if b.log != nil {
+		n, err := btreeWriteRecord(b.log, bb.data)
+		if err != nil {
+			// The log may now end in a partial record, and anything
+			// appended after that would be lost on replay.
+			b.err = err
+			return err
+		}
+		b.logSize += int64(n)
+	}
+
+	if err := b.apply(bb.data); err != nil {
+		return err
+	}
+
+	// Publish the new tree. The writer continues with a new owner, so the
+	// published nodes are never modified.
+	current := b.tree.clone()
+	b.rmut.Lock()
+	b.current = current
+	b.rmut.Unlock()
+
+	if err := b.maybeCompact(); err != nil {
+		l.Warnln("Compacting database:", err)
+	}
+	return nil
+}
+
+func (b *btreeBackend) NewSnapshot() (Snapshot, error) {
+	return b.snapshot(), nil
+}
+
+func (b *btreeBackend) Close() error {
+	b.wmut.Lock()
+	defer b.wmut.Unlock()
+
+	if b.err == errBTreeClosed {
+		return nil
+	}
+	b.err = errBTreeClosed
+	if b.log == nil {
+		return nil
+	}
+
+	err := b.log.Sync()
+	if cerr := b.log.Close(); err == nil {
+		err = cerr
+	}
+	b.lock.Close()
+	return err
+}
+
+// maybeCompact compacts the log if it has grown large compared to the live
+// data. It must be called with wmut held.
+func (b *btreeBackend) maybeCompact() error {
+	if b.log == nil || b.logSize < btreeCompactMinSize || b.logSize < btreeCompactFactor*b.size {
+		return nil
+	}
+	return b.compact()
+}
+
+// compact replaces the log with one holding just the current contents. It
+// must be called with wmut held.
+func (b *btreeBackend) compact() error {
+	l.Debugf("compacting database log of %d bytes with %d bytes of live data", b.logSize, b.size)
+
+	// The current tree is that of the last write, and as writes are
+	// blocked it stays that way.
+	name := filepath.Join(b.path, btreeLogName)
+	tmp := name + ".tmp"
+	size, err := b.writeCompacted(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// The log must be closed before it can be replaced on Windows.
+	if err := b.log.Close(); err != nil {
+		b.err = err
+		return err
+	}
+	renameErr := osutil.Rename(tmp, name)
+	if renameErr != nil {
+		os.Remove(tmp)
+	} else {
+		b.logSize = size
+	}
+
+	// Whether or not it was replaced, the log is reopened for writing.
+	b.log, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		b.err = err
+		return err
+	}
+	return renameErr
+}
+
+func (b *btreeBackend) writeCompacted(name string) (int64, error) {
+	fd, err := os.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	bw := bufio.NewWriter(fd)
+	var size int64
+	var batch btreeBatch
+	it := b.current.seek(nil)
+	for {
+		item, ok := it.next()
+		if ok {
+			batch.Put(item.key, item.val)
+		}
+		if len(batch.data) >= btreeCompactRecord || !ok && batch.n > 0 {
+			n, err := btreeWriteRecord(bw, batch.data)
+			if err != nil {
+				return 0, err
+			}
+			size += int64(n)
+			batch.Reset()
+		}
+		if !ok {
+			break
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	if err := fd.Sync(); err != nil {
+		return 0, err
+	}
+	return size, fd.Close()
+}
+
+func btreeWriteRecord(w io.Writer, data []byte) (int, error) {
+	rec := make([]byte, btreeRecordHeaderLen+len(data))
+	binary.BigEndian.PutUint32(rec, uint32(len(data)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.Checksum(data, btreeCRCTable))
+	copy(rec[btreeRecordHeaderLen:], data)
+	return w.Write(rec)
+}
+
+func btreeAppendBytes(data, bs []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(bs)))
+	data = append(data, buf[:n]...)
+	return append(data, bs...)
+}
+
+func btreeReadBytes(data []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return nil, nil, errBTreeCorrupt
+	}
+	end := n + int(size)
+	return data[n:end], data[end:], nil
+}
+
+// A btreeBatch holds its operations encoded as they are written to the log.
+type btreeBatch struct {
+	data []byte
+	n    int
+}
+
+func (b *btreeBatch) Put(key, val []byte) {
+	b.data = append(b.data, btreeOpPut)
+	b.data = btreeAppendBytes(b.data, key)
+	b.data = btreeAppendBytes(b.data, val)
+	b.n++
+}
+
+func (b *btreeBatch) Delete(key []byte) {
+	b.data = append(b.data, btreeOpDelete)
+	b.data = btreeAppendBytes(b.data, key)
+	b.n++
+}
+
+func (b *btreeBatch) Len() int {
+	return b.n
+}
+
+func (b *btreeBatch) Reset() {
+	b.data = b.data[:0]
+	b.n = 0
+}
+
+type btreeSnapshot struct {
+	tree btree
+}
+
+func (s btreeSnapshot) Get(key []byte) ([]byte, error) {
+	item, ok := s.tree.get(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), item.val...), nil
+}
+
+func (s btreeSnapshot) NewPrefixIterator(prefix []byte) BackendIterator {
+	return &btreePrefixIterator{
+		it:     s.tree.seek(prefix),
+		prefix: prefix,
+	}
+}
+
+func (s btreeSnapshot) Release() {}
+
+type btreePrefixIterator struct {
+	it     *btreeIterator
+	prefix []byte
+	item   btreeItem
+}
+
+func (i *btreePrefixIterator) Next() bool {
+	item, ok := i.it.next()
+	if !ok || !bytes.HasPrefix(item.key, i.prefix) {
+		i.Release()
+		return false
+	}
+	i.item = item
+	return true
+}
+
+func (i *btreePrefixIterator) Key() []byte {
+	return i.item.key
+}
+
+func (i *btreePrefixIterator) Value() []byte {
+	return i.item.val
+}
+
+func (i *btreePrefixIterator) Release() {
+	i.it.stack = nil
+	i.item = btreeItem{}
+}
+
+func (i *btreePrefixIterator) Error() error {
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The leveldbBackend is a Backend on top of goleveldb.
+type leveldbBackend struct {
+	db *leveldb.DB
+}
+
+func openLevelDBBackend(file string) (Backend, bool, error) {
+	opts := &opt.Options{
+		OpenFilesCacheCapacity: 100,
+		WriteBuffer:            4 << 20,
+	}
+
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		// The file we are looking to open does not exist. This may be the
+		// first launch so we should look for an old version and try to
+		// convert it.
+		if err := checkConvertDatabase(file); err != nil {
+			l.Infoln("Converting old database:", err)
+			l.Infoln("Will rescan from scratch.")
+		}
+	}
+
+	db, err := leveldb.OpenFile(file, opts)
+	recovered := false
+	if leveldbIsCorrupted(err) {
+		db, err = leveldb.RecoverFile(file, opts)
+		recovered = true
+	}
+	if leveldbIsCorrupted(err) {
+		// The database is corrupted, and we've tried to recover it but it
+		// didn't work. At this point there isn't much to do beyond dropping
+		// the database and reindexing...
+		l.Infoln("Database corruption detected, unable to recover. Reinitializing...")
+		if err := os.RemoveAll(file); err != nil {
+			return nil, false, err
+		}
+		db, err = leveldb.OpenFile(file, opts)
+		recovered = false
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return leveldbBackend{db}, recovered, nil
+}
+
+func newLevelDBMemoryBackend() Backend {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	return leveldbBackend{db}
+}
+
+func (b leveldbBackend) Get(key []byte) ([]byte, error) {
+	return leveldbGet(b.db.Get(key, nil))
+}
+
+func (b leveldbBackend) NewPrefixIterator(prefix []byte) BackendIterator {
+	return b.db.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+func (b leveldbBackend) Put(key, val []byte) error {
+	return b.db.Put(key, val, nil)
+}
+
+func (b leveldbBackend) Delete(key []byte) error {
+	return b.db.Delete(key, nil)
+}
+
+func (b leveldbBackend) NewBatch() Batch {
+	return new(leveldb.Batch)
+}
+
+func (b leveldbBackend) Write(batch Batch) error {
+	return b.db.Write(batch.(*leveldb.Batch), nil)
+}
+
+func (b leveldbBackend) NewSnapshot() (Snapshot, error) {
+	snap, err := b.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return leveldbSnapshot{snap}, nil
+}
+
+func (b leveldbBackend) Close() error {
+	return b.db.Close()
+}
+
+type leveldbSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+func (s leveldbSnapshot) Get(key []byte) ([]byte, error) {
+	return leveldbGet(s.snap.Get(key, nil))
+}
+
+func (s leveldbSnapshot) NewPrefixIterator(prefix []byte) BackendIterator {
+	return s.snap.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+func (s leveldbSnapshot) Release() {
+	s.snap.Release()
+}
+
+func leveldbGet(val []byte, err error) ([]byte, error) {
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return val, err
+}
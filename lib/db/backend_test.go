@@ -0,0 +1,484 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// The conformance tests that every backend must pass, in memory and on disk.
+
+func TestLevelDBBackend(t *testing.T) {
+	testBackend(t, newLevelDBMemoryBackend)
+}
+
+func TestBTreeBackend(t *testing.T) {
+	testBackend(t, func() Backend { return newBTreeMemoryBackend() })
+}
+
+func TestLevelDBBackendPersistence(t *testing.T) {
+	testBackendPersistence(t, BackendLevelDB)
+}
+
+func TestBTreeBackendPersistence(t *testing.T) {
+	testBackendPersistence(t, BackendBTree)
+}
+
+func testBackend(t *testing.T, open func() Backend) {
+	tests := []func(*testing.T, Backend){
+		testBackendGetPutDelete,
+		testBackendPrefixIterator,
+		testBackendBatch,
+		testBackendSnapshot,
+		testBackendWriteWhileIterating,
+		testBackendRandomOperations,
+		testBackendFileSet,
+	}
+	for _, test := range tests {
+		b := open()
+		test(t, b)
+		b.Close()
+	}
+}
+
+func expectValue(t *testing.T, r Reader, key, val string) {
+	bs, err := r.Get([]byte(key))
+	if val == "" {
+		if err != ErrNotFound {
+			t.Errorf("Get(%q) = %q, %v; expected ErrNotFound", key, bs, err)
+		}
+		return
+	}
+	if err != nil || string(bs) != val {
+		t.Errorf("Get(%q) = %q, %v; expected %q", key, bs, err, val)
+	}
+}
+
+func expectKeys(t *testing.T, r Reader, prefix string, keys ...string) {
+	it := r.NewPrefixIterator([]byte(prefix))
+	defer it.Release()
+
+	var got []string
+	for it.Next() {
+		got = append(got, string(it.Key()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", keys) {
+		t.Errorf("Incorrect keys for prefix %q:\n%q\nexpected:\n%q", prefix, got, keys)
+	}
+}
+
+func testBackendGetPutDelete(t *testing.T, b Backend) {
+	expectValue(t, b, "a", "")
+
+	if err := b.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, b, "a", "1")
+
+	if err := b.Put([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, b, "a", "2")
+
+	// The returned value belongs to the caller.
+	bs, _ := b.Get([]byte("a"))
+	bs[0] = 'x'
+	expectValue(t, b, "a", "2")
+
+	if err := b.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, b, "a", "")
+
+	if err := b.Delete([]byte("a")); err != nil {
+		t.Errorf("Deleting a nonexistent key: %v", err)
+	}
+
+	// Empty values are values.
+	b.Put([]byte("e"), nil)
+	if bs, err := b.Get([]byte("e")); err != nil || len(bs) != 0 {
+		t.Errorf("Get of empty value = %q, %v", bs, err)
+	}
+}
+
+func testBackendPrefixIterator(t *testing.T, b Backend) {
+	for _, k := range []string{"b", "ab", "\xff\xff", "a", "abc", "\xff", "ac", "aa\xff", "c"} {
+		b.Put([]byte(k), []byte("v"+k))
+	}
+
+	expectKeys(t, b, "a", "a", "aa\xff", "ab", "abc", "ac")
+	expectKeys(t, b, "ab", "ab", "abc")
+	expectKeys(t, b, "abcd")
+	expectKeys(t, b, "\xff", "\xff", "\xff\xff")
+	expectKeys(t, b, "", "a", "aa\xff", "ab", "abc", "ac", "b", "c", "\xff", "\xff\xff")
+
+	it := b.NewPrefixIterator([]byte("ab"))
+	for it.Next() {
+		if string(it.Value()) != "v"+string(it.Key()) {
+			t.Errorf("Incorrect value %q for %q", it.Value(), it.Key())
+		}
+	}
+	it.Release()
+}
+
+func testBackendBatch(t *testing.T, b Backend) {
+	b.Put([]byte("a"), []byte("1"))
+	b.Put([]byte("b"), []byte("1"))
+
+	batch := b.NewBatch()
+	key, val := []byte("c"), []byte("1")
+	batch.Put(key, val)
+	// The batch has its own copy.
+	key[0], val[0] = 'x', 'x'
+	batch.Delete([]byte("a"))
+	batch.Put([]byte("b"), []byte("2"))
+	batch.Put([]byte("d"), []byte("1"))
+	batch.Delete([]byte("d"))
+	if batch.Len() != 5 {
+		t.Errorf("Incorrect batch length %d != 5", batch.Len())
+	}
+
+	// Nothing is visible until the batch is written.
+	expectKeys(t, b, "", "a", "b")
+
+	if err := b.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, b, "", "b", "c")
+	expectValue(t, b, "b", "2")
+	expectValue(t, b, "c", "1")
+
+	// A reset batch can be reused.
+	batch.Reset()
+	if batch.Len() != 0 {
+		t.Errorf("Incorrect length %d after reset", batch.Len())
+	}
+	batch.Put([]byte("e"), []byte("1"))
+	if err := b.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, b, "", "b", "c", "e")
+	expectValue(t, b, "c", "1")
+}
+
+func testBackendSnapshot(t *testing.T, b Backend) {
+	b.Put([]byte("a"), []byte("1"))
+	b.Put([]byte("b"), []byte("1"))
+
+	snap, err := b.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	b.Put([]byte("a"), []byte("2"))
+	b.Delete([]byte("b"))
+	b.Put([]byte("c"), []byte("1"))
+
+	expectValue(t, snap, "a", "1")
+	expectValue(t, snap, "b", "1")
+	expectValue(t, snap, "c", "")
+	expectKeys(t, snap, "", "a", "b")
+	expectKeys(t, b, "", "a", "c")
+}
+
+// testBackendWriteWhileIterating follows the pattern of the replace
+// operations: iterate over a snapshot while rewriting and deleting the same
+// keys in flushed batches.
+func testBackendWriteWhileIterating(t *testing.T, b Backend) {
+	for i := 0; i < 1000; i++ {
+		b.Put([]byte(fmt.Sprintf("k%04d", i)), []byte("1"))
+	}
+
+	snap, err := b.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := b.NewBatch()
+	it := snap.NewPrefixIterator([]byte("k"))
+	n := 0
+	for it.Next() {
+		n++
+		if n%2 == 0 {
+			batch.Delete(it.Key())
+		} else {
+			batch.Put(it.Key(), []byte("2"))
+		}
+		if batch.Len() > batchFlushSize {
+			if err := b.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+			batch.Reset()
+		}
+	}
+	it.Release()
+	snap.Release()
+	if err := b.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Errorf("Iterated over %d keys != 1000", n)
+	}
+
+	it = b.NewPrefixIterator([]byte("k"))
+	n = 0
+	for it.Next() {
+		n++
+		if string(it.Value()) != "2" {
+			t.Errorf("Incorrect value %q for %q", it.Value(), it.Key())
+		}
+	}
+	it.Release()
+	if n != 500 {
+		t.Errorf("Incorrect number of keys %d != 500", n)
+	}
+}
+
+// testBackendRandomOperations compares the backend to a map, with enough
+// keys to build up and tear down a tree of some depth.
+func testBackendRandomOperations(t *testing.T, b Backend) {
+	rnd := rand.New(rand.NewSource(42))
+	model := make(map[string]string)
+
+	for round := 0; round < 20; round++ {
+		// Grow the data set in the first rounds and shrink it in the
+		// later, so that everything is deleted in the end.
+		batch := b.NewBatch()
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("%05d", rnd.Intn(5000))
+			if round < 10 && rnd.Intn(4) != 0 {
+				val := fmt.Sprint(round, i)
+				batch.Put([]byte(key), []byte(val))
+				model[key] = val
+			} else {
+				batch.Delete([]byte(key))
+				delete(model, key)
+			}
+		}
+		if round == 19 {
+			for key := range model {
+				batch.Delete([]byte(key))
+				delete(model, key)
+			}
+		}
+		if err := b.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+
+		keys := make([]string, 0, len(model))
+		for key := range model {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		expectKeys(t, b, "", keys...)
+		for _, key := range keys {
+			expectValue(t, b, key, model[key])
+		}
+	}
+}
+
+// testBackendFileSet makes sure the database proper works on the backend.
+func testBackendFileSet(t *testing.T, b Backend) {
+	s := NewFileSet("test", newDBInstance(b))
+
+	remote := protocol.DeviceID{42}
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+	v2 := protocol.Vector{{ID: 1, Value: 2}}
+
+	local := []protocol.FileInfo{f1, f2}
+	local[0].Version, local[1].Version = v1, v1
+	s.Replace(protocol.LocalDeviceID, local)
+	rem := []protocol.FileInfo{f1, f3}
+	rem[0].Version, rem[1].Version = v2, v1
+	s.Replace(remote, rem)
+
+	if g, ok := s.GetGlobal("f1"); !ok || !g.Version.Equal(v2) {
+		t.Errorf("Incorrect global f1 %v", g)
+	}
+	if files, _, _ := s.GlobalSize(); files != 3 {
+		t.Errorf("Incorrect global size %d != 3", files)
+	}
+	var need []string
+	s.WithNeed(protocol.LocalDeviceID, func(fi FileIntf) bool {
+		need = append(need, fi.(protocol.FileInfo).Name)
+		return true
+	})
+	if fmt.Sprint(need) != "[f1 f3]" {
+		t.Errorf("Incorrect need list %v", need)
+	}
+	if res := s.Check(); res.Problems() != 0 {
+		t.Errorf("Unexpected problems %+v", res)
+	}
+}
+
+func testBackendPersistence(t *testing.T, backend string) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func() *Instance {
+		ldb, err := OpenBackend(backend, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ldb
+	}
+
+	ldb := open()
+	ldb.Put([]byte("a"), []byte("1"))
+	ldb.Put([]byte("b"), []byte("1"))
+	batch := ldb.NewBatch()
+	batch.Put([]byte("c"), []byte("1"))
+	batch.Delete([]byte("a"))
+	ldb.Write(batch)
+	if err := ldb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ldb = open()
+	expectKeys(t, ldb, "", "b", "c")
+	expectValue(t, ldb, "c", "1")
+	ldb.Put([]byte("d"), []byte("1"))
+
+	// The database is locked while open.
+	if _, err := OpenBackend(backend, dir); err == nil {
+		t.Error("Unexpected nil error opening a database that is already open")
+	}
+
+	if err := ldb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ldb = open()
+	expectKeys(t, ldb, "", "b", "c", "d")
+	ldb.Close()
+}
+
+func TestBTreeBackendCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend, _, err := openBTreeBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := backend.(*btreeBackend)
+
+	// Rewrite the same keys over and over, so that the log holds mostly
+	// dead data.
+	for round := 0; round < 10; round++ {
+		batch := b.NewBatch()
+		for i := 0; i < 100; i++ {
+			batch.Put([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", round)))
+		}
+		b.Write(batch)
+	}
+	b.Delete([]byte("k000"))
+
+	// A snapshot from before the compaction is not affected by it.
+	snap, _ := b.NewSnapshot()
+	defer snap.Release()
+
+	before := b.logSize
+	b.wmut.Lock()
+	err = b.compact()
+	b.wmut.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.logSize >= before/5 {
+		t.Errorf("Log size %d not reduced enough from %d", b.logSize, before)
+	}
+	if info, err := os.Stat(filepath.Join(dir, btreeLogName)); err != nil || info.Size() != b.logSize {
+		t.Errorf("Log size on disk does not match %d: %v, %v", b.logSize, info, err)
+	}
+	expectValue(t, snap, "k001", "v9")
+
+	// Writes after the compaction are appended to the new log.
+	b.Put([]byte("k001"), []byte("new"))
+	b.Close()
+
+	backend, recovered, err := openBTreeBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	if recovered {
+		t.Error("Compacted log should not need recovery")
+	}
+	expectValue(t, backend, "k000", "")
+	expectValue(t, backend, "k001", "new")
+	expectValue(t, backend, "k099", "v9")
+	if n := backend.(*btreeBackend).size; n != b.size {
+		t.Errorf("Incorrect live size %d != %d after reopen", n, b.size)
+	}
+}
+
+func TestBTreeBackendDamagedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, _, err := openBTreeBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Put([]byte("a"), []byte("1"))
+	b.Put([]byte("b"), []byte("1"))
+	b.Close()
+
+	// Cut off the last write in the middle.
+	name := filepath.Join(dir, btreeLogName)
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(name, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+
+	b, recovered, err := openBTreeBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recovered {
+		t.Error("Damaged log should need recovery")
+	}
+	expectKeys(t, b, "", "a")
+
+	// The damaged tail is gone, so new writes survive.
+	b.Put([]byte("c"), []byte("1"))
+	b.Close()
+
+	b, recovered, err = openBTreeBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if recovered {
+		t.Error("Repaired log should not need recovery")
+	}
+	expectKeys(t, b, "", "a", "c")
+}
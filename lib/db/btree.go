@@ -0,0 +1,348 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"sort"
+)
+
+// The btree is an in memory B-tree of key/value pairs with copy on write
+// nodes. A tree value is cheap to copy and copies share nodes, but a node is
+// only ever modified by the tree that created it. A copy is thus an
+// immutable snapshot as long as the original is given a new owner before the
+// next modification.
+
+const (
+	btreeDegree   = 32
+	btreeMaxItems = 2*btreeDegree - 1
+	btreeMinItems = btreeDegree - 1
+)
+
+type btreeItem struct {
+	key, val []byte
+}
+
+// A btreeOwner marks the nodes that a tree may modify in place. It has a
+// size so that each new owner gets a distinct address.
+type btreeOwner struct {
+	_ int
+}
+
+type btreeNode struct {
+	items    []btreeItem
+	children []*btreeNode
+	owner    *btreeOwner
+}
+
+type btree struct {
+	root  *btreeNode
+	owner *btreeOwner
+}
+
+// clone returns a tree sharing the current nodes. Both trees get new owners,
+// so neither will modify the shared nodes.
+func (t *btree) clone() btree {
+	t.owner = new(btreeOwner)
+	return btree{root: t.root, owner: new(btreeOwner)}
+}
+
+// get returns the item with the given key.
+func (t btree) get(key []byte) (btreeItem, bool) {
+	n := t.root
+	for n != nil {
+		i, found := n.find(key)
+		if found {
+			return n.items[i], true
+		}
+		if len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	return btreeItem{}, false
+}
+
+// set inserts the item, returning the item it replaced if there was one.
+func (t *btree) set(item btreeItem) (btreeItem, bool) {
+	if t.root == nil {
+		t.root = &btreeNode{owner: t.owner}
+		t.root.items = append(t.root.items, item)
+		return btreeItem{}, false
+	}
+
+	t.root = t.root.mutableFor(t.owner)
+	if len(t.root.items) >= btreeMaxItems {
+		median, second := t.root.split(btreeMaxItems / 2)
+		first := t.root
+		t.root = &btreeNode{owner: t.owner}
+		t.root.items = append(t.root.items, median)
+		t.root.children = append(t.root.children, first, second)
+	}
+	return t.root.insert(item)
+}
+
+// delete removes the item with the given key, returning it if it existed.
+func (t *btree) delete(key []byte) (btreeItem, bool) {
+	if t.root == nil || len(t.root.items) == 0 {
+		return btreeItem{}, false
+	}
+
+	t.root = t.root.mutableFor(t.owner)
+	item, ok := t.root.remove(key, false)
+	if len(t.root.items) == 0 {
+		if len(t.root.children) > 0 {
+			t.root = t.root.children[0]
+		} else {
+			t.root = nil
+		}
+	}
+	return item, ok
+}
+
+// find returns the index of the item with the given key, or the index of the
+// child to look for it in.
+func (n *btreeNode) find(key []byte) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return bytes.Compare(key, n.items[i].key) < 0
+	})
+	if i > 0 && bytes.Equal(n.items[i-1].key, key) {
+		return i - 1, true
+	}
+	return i, false
+}
+
+// mutableFor returns the node itself if it belongs to the owner, otherwise a
+// copy of it that does.
+func (n *btreeNode) mutableFor(owner *btreeOwner) *btreeNode {
+	if n.owner == owner {
+		return n
+	}
+	c := &btreeNode{owner: owner}
+	c.items = append(make([]btreeItem, 0, len(n.items)+1), n.items...)
+	if len(n.children) > 0 {
+		c.children = append(make([]*btreeNode, 0, len(n.children)+1), n.children...)
+	}
+	return c
+}
+
+func (n *btreeNode) mutableChild(i int) *btreeNode {
+	c := n.children[i].mutableFor(n.owner)
+	n.children[i] = c
+	return c
+}
+
+// split splits the node at index i, returning the item at i and a new node
+// with everything after it.
+func (n *btreeNode) split(i int) (btreeItem, *btreeNode) {
+	item := n.items[i]
+	next := &btreeNode{owner: n.owner}
+	next.items = append(next.items, n.items[i+1:]...)
+	for j := i; j < len(n.items); j++ {
+		n.items[j] = btreeItem{}
+	}
+	n.items = n.items[:i]
+	if len(n.children) > 0 {
+		next.children = append(next.children, n.children[i+1:]...)
+		for j := i + 1; j < len(n.children); j++ {
+			n.children[j] = nil
+		}
+		n.children = n.children[:i+1]
+	}
+	return item, next
+}
+
+// maybeSplitChild splits child i if it's full, returning true if it did.
+func (n *btreeNode) maybeSplitChild(i int) bool {
+	if len(n.children[i].items) < btreeMaxItems {
+		return false
+	}
+	first := n.mutableChild(i)
+	item, second := first.split(btreeMaxItems / 2)
+	n.insertItemAt(i, item)
+	n.insertChildAt(i+1, second)
+	return true
+}
+
+// insert adds the item to the subtree rooted at the node, which must not be
+// full.
+func (n *btreeNode) insert(item btreeItem) (btreeItem, bool) {
+	i, found := n.find(item.key)
+	if found {
+		old := n.items[i]
+		n.items[i] = item
+		return old, true
+	}
+	if len(n.children) == 0 {
+		n.insertItemAt(i, item)
+		return btreeItem{}, false
+	}
+	if n.maybeSplitChild(i) {
+		switch cmp := bytes.Compare(item.key, n.items[i].key); {
+		case cmp > 0:
+			i++
+		case cmp == 0:
+			old := n.items[i]
+			n.items[i] = item
+			return old, true
+		}
+	}
+	return n.mutableChild(i).insert(item)
+}
+
+// remove removes the item with the given key, or the largest item if max is
+// true, from the subtree rooted at the node. The node must have more than the
+// minimum number of items unless it's the root.
+func (n *btreeNode) remove(key []byte, max bool) (btreeItem, bool) {
+	var i int
+	var found bool
+	if max {
+		if len(n.children) == 0 {
+			return n.removeItemAt(len(n.items) - 1), true
+		}
+		i = len(n.items)
+	} else {
+		i, found = n.find(key)
+		if len(n.children) == 0 {
+			if found {
+				return n.removeItemAt(i), true
+			}
+			return btreeItem{}, false
+		}
+	}
+
+	if len(n.children[i].items) <= btreeMinItems {
+		n.growChild(i)
+		return n.remove(key, max)
+	}
+
+	child := n.mutableChild(i)
+	if found {
+		// The child has more than the minimum number of items, so it can
+		// give up its largest to replace the removed item.
+		item := n.items[i]
+		n.items[i], _ = child.remove(nil, true)
+		return item, true
+	}
+	return child.remove(key, max)
+}
+
+// growChild makes sure child i has more than the minimum number of items, by
+// moving an item from a sibling or by merging it with one.
+func (n *btreeNode) growChild(i int) {
+	switch {
+	case i > 0 && len(n.children[i-1].items) > btreeMinItems:
+		child := n.mutableChild(i)
+		left := n.mutableChild(i - 1)
+		child.insertItemAt(0, n.items[i-1])
+		n.items[i-1] = left.removeItemAt(len(left.items) - 1)
+		if len(left.children) > 0 {
+			child.insertChildAt(0, left.removeChildAt(len(left.children)-1))
+		}
+
+	case i < len(n.items) && len(n.children[i+1].items) > btreeMinItems:
+		child := n.mutableChild(i)
+		right := n.mutableChild(i + 1)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = right.removeItemAt(0)
+		if len(right.children) > 0 {
+			child.children = append(child.children, right.removeChildAt(0))
+		}
+
+	default:
+		if i >= len(n.items) {
+			i--
+		}
+		child := n.mutableChild(i)
+		item := n.removeItemAt(i)
+		right := n.removeChildAt(i + 1)
+		child.items = append(child.items, item)
+		child.items = append(child.items, right.items...)
+		child.children = append(child.children, right.children...)
+	}
+}
+
+func (n *btreeNode) insertItemAt(i int, item btreeItem) {
+	n.items = append(n.items, btreeItem{})
+	copy(n.items[i+1:], n.items[i:])
+	n.items[i] = item
+}
+
+func (n *btreeNode) removeItemAt(i int) btreeItem {
+	item := n.items[i]
+	copy(n.items[i:], n.items[i+1:])
+	n.items[len(n.items)-1] = btreeItem{}
+	n.items = n.items[:len(n.items)-1]
+	return item
+}
+
+func (n *btreeNode) insertChildAt(i int, child *btreeNode) {
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
+
+func (n *btreeNode) removeChildAt(i int) *btreeNode {
+	child := n.children[i]
+	copy(n.children[i:], n.children[i+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+	return child
+}
+
+// A btreeIterator walks the items of a tree in order, starting at a given
+// key. The stack holds the nodes on the path to the next item, and for each
+// the index of the next item to return from it.
+type btreeIterator struct {
+	stack []btreeIteratorFrame
+}
+
+type btreeIteratorFrame struct {
+	node *btreeNode
+	i    int
+}
+
+func (t btree) seek(start []byte) *btreeIterator {
+	it := &btreeIterator{}
+	n := t.root
+	for n != nil {
+		i := sort.Search(len(n.items), func(i int) bool {
+			return bytes.Compare(n.items[i].key, start) >= 0
+		})
+		it.stack = append(it.stack, btreeIteratorFrame{n, i})
+		if len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	return it
+}
+
+func (it *btreeIterator) next() (btreeItem, bool) {
+	for len(it.stack) > 0 {
+		f := &it.stack[len(it.stack)-1]
+		if f.i >= len(f.node.items) {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+
+		item := f.node.items[f.i]
+		f.i++
+		if len(f.node.children) > 0 {
+			// The items in the next child come before the next item in
+			// this node.
+			for n := f.node.children[f.i]; n != nil; n = n.children[0] {
+				it.stack = append(it.stack, btreeIteratorFrame{n, 0})
+				if len(n.children) == 0 {
+					break
+				}
+			}
+		}
+		return item, true
+	}
+	return btreeItem{}, false
+}
@@ -0,0 +1,315 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// A CheckResult describes the inconsistencies found by a database check of a
+// folder. Everything counted here has been repaired; records that can't be
+// decoded are deleted, to be recreated by scanning and index exchange.
+type CheckResult struct {
+	Folder          string        `json:"folder"`
+	Files           int           `json:"files"`           // Number of device file entries checked
+	Globals         int           `json:"globals"`         // Number of global entries checked
+	Blocks          int           `json:"blocks"`          // Number of block map entries checked
+	OrphanGlobals   int           `json:"orphanGlobals"`   // Global versions without a matching device file
+	MissingGlobals  int           `json:"missingGlobals"`  // Device files missing from the global version lists
+	MissingBlocks   int           `json:"missingBlocks"`   // Blocks of local files missing from the block map
+	OrphanBlocks    int           `json:"orphanBlocks"`    // Block map entries without a matching local block
+	Undecodable     int           `json:"undecodable"`     // Device files and global version lists that could not be decoded
+	LocalSizeFixed  bool          `json:"localSizeFixed"`  // The local size totals were off
+	GlobalSizeFixed bool          `json:"globalSizeFixed"` // The global size totals were off
+	Duration        time.Duration `json:"duration"`
+}
+
+// Problems returns the total number of inconsistencies found.
+func (r CheckResult) Problems() int {
+	n := r.OrphanGlobals + r.MissingGlobals + r.MissingBlocks + r.OrphanBlocks + r.Undecodable
+	if r.LocalSizeFixed {
+		n++
+	}
+	if r.GlobalSizeFixed {
+		n++
+	}
+	return n
+}
+
+// checkFolder walks the device files, global version lists and block map of
+// the folder, repairing any inconsistencies between them. The local and
+// global size totals as they should be are returned in localSize and
+// globalSize. This reads the entire folder from the database, so it's slow
+// for large folders and meant as a maintenance operation.
+func (db *Instance) checkFolder(folder []byte, localSize, globalSize *sizeTracker) CheckResult {
+	res := CheckResult{Folder: string(folder)}
+	db.checkFolderGlobals(folder, &res)
+	db.checkFolderFiles(folder, localSize, &res)
+	db.checkFolderBlocks(folder, &res)
+	db.folderGlobalSize(folder, globalSize)
+	return res
+}
+
+// checkFolderGlobals removes the versions from the global version lists that
+// don't correspond to a valid device file, and the lists left empty.
+func (db *Instance) checkFolderGlobals(folder []byte, res *CheckResult) {
+	t := db.newReadWriteTransaction()
+	defer t.close()
+
+	dbi := t.NewPrefixIterator(db.globalKey(folder, nil)[:keyPrefixLen+keyFolderLen])
+	defer dbi.Release()
+
+	var fk []byte
+	for dbi.Next() {
+		res.Globals++
+
+		name := db.globalKeyName(dbi.Key())
+
+		var vl versionList
+		if err := vl.UnmarshalXDR(dbi.Value()); err != nil {
+			// The list is rebuilt from the device files later on.
+			l.Infof("Database check %q: deleting undecodable global %q: %v", folder, name, err)
+			t.Delete(dbi.Key())
+			res.Undecodable++
+			continue
+		}
+
+		var newVL versionList
+		for _, version := range vl.versions {
+			fk = db.deviceKeyInto(fk[:cap(fk)], folder, version.device, name)
+			bs, err := t.Get(fk)
+			if err == ErrNotFound {
+				l.Debugf("check %q: global %q points to nonexistent file for %v", folder, name, protocol.DeviceIDFromBytes(version.device))
+				res.OrphanGlobals++
+				continue
+			}
+			if err != nil {
+				// We can't tell, so leave it be.
+				l.Infof("Database check %q: reading %q for %v: %v", folder, name, protocol.DeviceIDFromBytes(version.device), err)
+				newVL.versions = append(newVL.versions, version)
+				continue
+			}
+
+			var f FileInfoTruncated
+			if err := f.UnmarshalXDR(bs); err != nil {
+				l.Infof("Database check %q: deleting undecodable file %q for %v: %v", folder, name, protocol.DeviceIDFromBytes(version.device), err)
+				t.Delete(fk)
+				res.Undecodable++
+				continue
+			}
+			if f.IsInvalid() || !f.Version.Equal(version.version) {
+				l.Debugf("check %q: global %q has wrong version for %v", folder, name, protocol.DeviceIDFromBytes(version.device))
+				res.OrphanGlobals++
+				continue
+			}
+
+			newVL.versions = append(newVL.versions, version)
+		}
+
+		switch {
+		case len(newVL.versions) == 0:
+			t.Delete(dbi.Key())
+		case len(newVL.versions) != len(vl.versions):
+			t.Put(dbi.Key(), newVL.MustMarshalXDR())
+		}
+		t.checkFlush()
+	}
+}
+
+// checkFolderFiles adds the valid device files missing from the global
+// version lists, and tallies the local size.
+func (db *Instance) checkFolderFiles(folder []byte, localSize *sizeTracker, res *CheckResult) {
+	type deviceFile struct {
+		device []byte
+		name   []byte
+	}
+	var missing []deviceFile
+	var undecodable [][]byte
+
+	t := db.newReadOnlyTransaction()
+	dbi := t.NewPrefixIterator(db.deviceKey(folder, nil, nil)[:keyPrefixLen+keyFolderLen])
+	for dbi.Next() {
+		res.Files++
+
+		var f FileInfoTruncated
+		if err := f.UnmarshalXDR(dbi.Value()); err != nil {
+			l.Infof("Database check %q: deleting undecodable file %q for %v: %v", folder, db.deviceKeyName(dbi.Key()), protocol.DeviceIDFromBytes(db.deviceKeyDevice(dbi.Key())), err)
+			undecodable = append(undecodable, append([]byte(nil), dbi.Key()...))
+			continue
+		}
+
+		device := db.deviceKeyDevice(dbi.Key())
+		if bytes.Equal(device, protocol.LocalDeviceID[:]) {
+			localSize.addFile(f)
+		}
+		if f.IsInvalid() {
+			continue
+		}
+
+		name := db.deviceKeyName(dbi.Key())
+		if !db.globalHasVersion(t, folder, device, name, f.Version) {
+			l.Debugf("check %q: file %q for %v is missing from global", folder, name, protocol.DeviceIDFromBytes(device))
+			missing = append(missing, deviceFile{device, append([]byte(nil), name...)})
+		}
+	}
+	dbi.Release()
+	t.close()
+
+	if len(undecodable) > 0 {
+		t := db.newReadWriteTransaction()
+		for _, key := range undecodable {
+			t.Delete(key)
+			res.Undecodable++
+			t.checkFlush()
+		}
+		t.close()
+	}
+
+	// Each fix is its own transaction, as updating a global version list
+	// depends on seeing the previous updates to it.
+	var discard sizeTracker
+	for _, m := range missing {
+		t := db.newReadWriteTransaction()
+		if f, ok := t.getFile(folder, m.device, m.name); ok {
+			t.updateGlobal(folder, m.device, f, &discard)
+			res.MissingGlobals++
+		}
+		t.close()
+	}
+}
+
+func (db *Instance) globalHasVersion(t readOnlyTransaction, folder, device, name []byte, version protocol.Vector) bool {
+	bs, err := t.Get(db.globalKey(folder, name))
+	if err == ErrNotFound {
+		return false
+	}
+	if err != nil {
+		// We can't tell, so leave it be.
+		l.Infof("Database check %q: reading global %q: %v", folder, name, err)
+		return true
+	}
+
+	var vl versionList
+	if err := vl.UnmarshalXDR(bs); err != nil {
+		// Undecodable lists have been removed by checkFolderGlobals, so
+		// this is new; leave it for the next check.
+		return true
+	}
+	for _, v := range vl.versions {
+		if bytes.Equal(v.device, device) {
+			return v.version.Equal(version)
+		}
+	}
+	return false
+}
+
+// checkFolderBlocks makes sure the block map contains exactly the blocks of
+// the valid local files.
+func (db *Instance) checkFolderBlocks(folder []byte, res *CheckResult) {
+	t := db.newReadWriteTransaction()
+	defer t.close()
+
+	folderID := db.folderIdx.ID(folder)
+	buf := make([]byte, 4)
+	var key []byte
+
+	dbi := t.NewPrefixIterator(db.deviceKey(folder, protocol.LocalDeviceID[:], nil)[:keyPrefixLen+keyFolderLen+keyDeviceLen])
+	for dbi.Next() {
+		var f protocol.FileInfo
+		if err := f.UnmarshalXDR(dbi.Value()); err != nil {
+			// Undecodable files have been removed by checkFolderFiles, so
+			// this is new; leave it for the next check.
+			continue
+		}
+		if f.IsDirectory() || f.IsDeleted() || f.IsInvalid() {
+			continue
+		}
+
+		// A block that occurs several times in the file is mapped to its
+		// last occurrence, same as when the block map is created.
+		indexes := make(map[string]int, len(f.Blocks))
+		for i, block := range f.Blocks {
+			indexes[string(block.Hash)] = i
+		}
+		for hash, i := range indexes {
+			binary.BigEndian.PutUint32(buf, uint32(i))
+			key = blockKeyInto(key, []byte(hash), folderID, f.Name)
+			if bs, err := t.Get(key); err == nil && bytes.Equal(bs, buf) {
+				continue
+			}
+			l.Debugf("check %q: block %d of %q is missing from the block map", folder, i, f.Name)
+			t.Put(key, buf)
+			res.MissingBlocks++
+		}
+		t.checkFlush()
+	}
+	dbi.Release()
+
+	// Block map entries are sorted by hash, so there is no locality in the
+	// files we look up. Remember the last one, as files with several equal
+	// blocks are common enough.
+	var last protocol.FileInfo
+	var lastOk bool
+	dbi = t.NewPrefixIterator(blockKeyInto(nil, nil, folderID, "")[:keyPrefixLen+keyFolderLen])
+	defer dbi.Release()
+	for dbi.Next() {
+		res.Blocks++
+
+		name := blockKeyName(dbi.Key())
+		hash := dbi.Key()[keyPrefixLen+keyFolderLen : keyPrefixLen+keyFolderLen+keyHashLen]
+		index := int(binary.BigEndian.Uint32(dbi.Value()))
+
+		if last.Name != name {
+			last, lastOk = t.getFile(folder, protocol.LocalDeviceID[:], []byte(name))
+			last.Name = name
+		}
+		if lastOk && !last.IsDirectory() && !last.IsDeleted() && !last.IsInvalid() &&
+			index < len(last.Blocks) && bytes.Equal(last.Blocks[index].Hash, hash) {
+			continue
+		}
+
+		l.Debugf("check %q: block map entry %d of %q is stale", folder, index, name)
+		t.Delete(dbi.Key())
+		res.OrphanBlocks++
+		t.checkFlush()
+	}
+}
+
+// folderGlobalSize tallies the size of the global files in the folder.
+func (db *Instance) folderGlobalSize(folder []byte, globalSize *sizeTracker) {
+	t := db.newReadOnlyTransaction()
+	defer t.close()
+
+	dbi := t.NewPrefixIterator(db.globalKey(folder, nil)[:keyPrefixLen+keyFolderLen])
+	defer dbi.Release()
+
+	var fk []byte
+	for dbi.Next() {
+		var vl versionList
+		if err := vl.UnmarshalXDR(dbi.Value()); err != nil {
+			continue
+		}
+		if len(vl.versions) == 0 {
+			continue
+		}
+
+		fk = db.deviceKeyInto(fk[:cap(fk)], folder, vl.versions[0].device, db.globalKeyName(dbi.Key()))
+		bs, err := t.Get(fk)
+		if err != nil {
+			continue
+		}
+		var f FileInfoTruncated
+		if err := f.UnmarshalXDR(bs); err != nil {
+			continue
+		}
+		globalSize.addFile(f)
+	}
+}
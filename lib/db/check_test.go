@@ -0,0 +1,143 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+func TestCheckFolder(t *testing.T) {
+	ldb := OpenMemory()
+	s := NewFileSet("test", ldb)
+
+	remote := protocol.DeviceID{42}
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+	v2 := protocol.Vector{{ID: 1, Value: 2}}
+
+	local := []protocol.FileInfo{f1, f2}
+	local[0].Version, local[1].Version = v1, v1
+	s.Replace(protocol.LocalDeviceID, local)
+
+	rem := []protocol.FileInfo{f1, f3}
+	rem[0].Version, rem[1].Version = v2, v1
+	s.Replace(remote, rem)
+
+	if res := s.Check(); res.Problems() != 0 {
+		t.Fatalf("Unexpected problems in a consistent database: %+v", res)
+	}
+
+	// Break things.
+
+	folder := []byte("test")
+	folderID := ldb.folderIdx.ID(folder)
+
+	// f2 is missing from the global list, and there's a global entry for a
+	// file that doesn't exist.
+	ldb.Delete(ldb.globalKey(folder, []byte("f2")))
+	vl := versionList{versions: []fileVersion{{version: v1, device: remote[:]}}}
+	ldb.Put(ldb.globalKey(folder, []byte("ghost")), vl.MustMarshalXDR())
+
+	// A block of f1 is missing from the block map, and there's a block
+	// entry for a file that doesn't exist.
+	ldb.Delete(blockKeyInto(nil, f1.Blocks[3].Hash, folderID, "f1"))
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, 0)
+	ldb.Put(blockKeyInto(nil, f3.Blocks[0].Hash, folderID, "ghost"), buf)
+
+	// The size totals are off.
+	s.localSize.files += 3
+	s.globalSize.bytes -= 100
+
+	res := s.Check()
+	if res.MissingGlobals != 1 {
+		t.Errorf("Incorrect missing globals %d != 1", res.MissingGlobals)
+	}
+	if res.OrphanGlobals != 1 {
+		t.Errorf("Incorrect orphan globals %d != 1", res.OrphanGlobals)
+	}
+	if res.MissingBlocks != 1 {
+		t.Errorf("Incorrect missing blocks %d != 1", res.MissingBlocks)
+	}
+	if res.OrphanBlocks != 1 {
+		t.Errorf("Incorrect orphan blocks %d != 1", res.OrphanBlocks)
+	}
+	if !res.LocalSizeFixed || !res.GlobalSizeFixed {
+		t.Errorf("Size totals should have been fixed: %+v", res)
+	}
+	if res.Files != 4 {
+		t.Errorf("Incorrect number of files checked %d != 4", res.Files)
+	}
+
+	// Everything is back in order.
+
+	if res := s.Check(); res.Problems() != 0 {
+		t.Errorf("Unexpected problems after repair: %+v", res)
+	}
+	if g, ok := s.GetGlobal("f2"); !ok || !g.Version.Equal(v1) {
+		t.Errorf("f2 should be back in the global list: %v", g)
+	}
+	if _, ok := s.GetGlobal("ghost"); ok {
+		t.Error("ghost should not be in the global list")
+	}
+	if g, ok := s.GetGlobal("f1"); !ok || !g.Version.Equal(v2) {
+		t.Errorf("f1 should be the remote version: %v", g)
+	}
+	if files, _, _ := s.LocalSize(); files != 2 {
+		t.Errorf("Incorrect local size %d != 2", files)
+	}
+	if files, _, _ := s.GlobalSize(); files != 3 {
+		t.Errorf("Incorrect global size %d != 3", files)
+	}
+}
+
+func TestCheckFolderUndecodable(t *testing.T) {
+	ldb := OpenMemory()
+	s := NewFileSet("test", ldb)
+
+	remote := protocol.DeviceID{42}
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+
+	local := []protocol.FileInfo{f1, f2}
+	local[0].Version, local[1].Version = v1, v1
+	s.Replace(protocol.LocalDeviceID, local)
+
+	rem := []protocol.FileInfo{f3}
+	rem[0].Version = v1
+	s.Replace(remote, rem)
+
+	// The global list of f2 and the remote f3 are truncated garbage.
+
+	folder := []byte("test")
+	ldb.Put(ldb.globalKey(folder, []byte("f2")), []byte{0xde, 0xad})
+	ldb.Put(ldb.deviceKey(folder, remote[:], []byte("f3")), []byte{0xde, 0xad})
+
+	res := s.Check()
+	if res.Undecodable != 2 {
+		t.Errorf("Incorrect undecodable records %d != 2", res.Undecodable)
+	}
+	if res.MissingGlobals != 1 {
+		t.Errorf("Incorrect missing globals %d != 1", res.MissingGlobals)
+	}
+
+	// The garbage is gone, and the global list of f2 is rebuilt.
+
+	if res := s.Check(); res.Problems() != 0 {
+		t.Errorf("Unexpected problems after repair: %+v", res)
+	}
+	if g, ok := s.GetGlobal("f2"); !ok || !g.Version.Equal(v1) {
+		t.Errorf("f2 should be back in the global list: %v", g)
+	}
+	if _, ok := s.GetGlobal("f3"); ok {
+		t.Error("f3 should not be in the global list")
+	}
+	if _, ok := s.Get(remote, "f3"); ok {
+		t.Error("The undecodable f3 should have been deleted")
+	}
+}
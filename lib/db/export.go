@@ -0,0 +1,256 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// The export format is a stream of JSON objects: a header followed by one
+// record per file or key/value pair. It contains nothing that depends on
+// the internal layout of the database, so it can be imported by later
+// versions.
+const (
+	exportFormat  = "syncthing-db"
+	exportVersion = 1
+)
+
+// Imported files are added to the database this many at a time.
+const importBatchSize = 1000
+
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+type exportRecord struct {
+	Type      string             `json:"type"` // "file" or "kv"
+	Folder    string             `json:"folder,omitempty"`
+	Device    *protocol.DeviceID `json:"device,omitempty"`
+	File      *protocol.FileInfo `json:"file,omitempty"`
+	Namespace string             `json:"namespace,omitempty"`
+	Key       []byte             `json:"key,omitempty"`
+	Value     []byte             `json:"value,omitempty"`
+}
+
+// The key/value namespaces that are exported. Per folder namespaces have
+// the folder index after the key type.
+var exportNamespaces = []struct {
+	name      string
+	keyType   byte
+	perFolder bool
+}{
+	{"virtualMtime", KeyTypeVirtualMtime, true},
+	{"deviceStatistic", KeyTypeDeviceStatistic, false},
+	{"folderStatistic", KeyTypeFolderStatistic, false},
+	{"statsHistory", KeyTypeStatsHistory, false},
+}
+
+// An ImportVerifier decides which of the imported data to trust.
+type ImportVerifier interface {
+	// VerifyFolder returns an error if the folder should not be imported.
+	VerifyFolder(folder string) error
+	// VerifyFile returns true if the local file matches what's on disk.
+	VerifyFile(folder string, f protocol.FileInfo) bool
+}
+
+// ImportResult summarizes what was imported.
+type ImportResult struct {
+	Folders  []string // The folders imported
+	Skipped  []string // The folders skipped, as they failed verification
+	Files    int      // Number of files imported, local and remote
+	Rejected int      // Number of local files that failed verification
+	Values   int      // Number of other key/value pairs imported
+}
+
+// Export writes the files of all devices and folders, and the statistics
+// and virtual mtimes, to w.
+func (db *Instance) Export(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(exportHeader{exportFormat, exportVersion}); err != nil {
+		return err
+	}
+
+	t := db.newReadOnlyTransaction()
+	defer t.close()
+
+	dbi := t.NewPrefixIterator([]byte{KeyTypeDevice})
+	for dbi.Next() {
+		var f protocol.FileInfo
+		if err := f.UnmarshalXDR(dbi.Value()); err != nil {
+			dbi.Release()
+			return err
+		}
+		device := protocol.DeviceIDFromBytes(db.deviceKeyDevice(dbi.Key()))
+		rec := exportRecord{
+			Type:   "file",
+			Folder: string(db.deviceKeyFolder(dbi.Key())),
+			Device: &device,
+			File:   &f,
+		}
+		if err := enc.Encode(rec); err != nil {
+			dbi.Release()
+			return err
+		}
+	}
+	dbi.Release()
+
+	for _, ns := range exportNamespaces {
+		dbi := t.NewPrefixIterator([]byte{ns.keyType})
+		for dbi.Next() {
+			rec := exportRecord{
+				Type:      "kv",
+				Namespace: ns.name,
+				Key:       dbi.Key()[keyPrefixLen:],
+				Value:     dbi.Value(),
+			}
+			if ns.perFolder {
+				folder, ok := db.folderIdx.Val(binary.BigEndian.Uint32(rec.Key))
+				if !ok {
+					continue
+				}
+				rec.Folder = string(folder)
+				rec.Key = rec.Key[keyFolderLen:]
+			}
+			if err := enc.Encode(rec); err != nil {
+				dbi.Release()
+				return err
+			}
+		}
+		dbi.Release()
+	}
+
+	return nil
+}
+
+// Import reads a stream written by Export. The existing data for every
+// imported folder is dropped first. Folders that fail verification are
+// skipped entirely, as are local files that don't match what's on disk; those
+// will be picked up by the next scan.
+func (db *Instance) Import(r io.Reader, verifier ImportVerifier) (ImportResult, error) {
+	var res ImportResult
+	dec := json.NewDecoder(r)
+
+	var hdr exportHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return res, err
+	}
+	if hdr.Format != exportFormat {
+		return res, errors.New("not a database export")
+	}
+	if hdr.Version > exportVersion {
+		return res, fmt.Errorf("unsupported export version %d", hdr.Version)
+	}
+
+	// Whether the folder passed verification, for the folders seen so far.
+	folders := make(map[string]bool)
+	checkFolder := func(folder string) bool {
+		ok, seen := folders[folder]
+		if seen {
+			return ok
+		}
+		if err := verifier.VerifyFolder(folder); err != nil {
+			l.Infof("Skipping import of folder %q: %v", folder, err)
+			res.Skipped = append(res.Skipped, folder)
+			folders[folder] = false
+			return false
+		}
+		DropFolder(db, folder)
+		res.Folders = append(res.Folders, folder)
+		folders[folder] = true
+		return true
+	}
+
+	// Files are added in batches per folder and device, which are flushed
+	// when full or when the stream moves on to another folder or device.
+	var batch []protocol.FileInfo
+	var batchFolder string
+	var batchDevice protocol.DeviceID
+	sets := make(map[string]*FileSet)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		fs, ok := sets[batchFolder]
+		if !ok {
+			fs = NewFileSet(batchFolder, db)
+			sets[batchFolder] = fs
+		}
+		fs.Update(batchDevice, batch)
+		batch = batch[:0]
+	}
+
+	for {
+		var rec exportRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return res, err
+		}
+
+		switch rec.Type {
+		case "file":
+			if rec.File == nil || rec.Device == nil {
+				return res, errors.New("invalid file record")
+			}
+			if !checkFolder(rec.Folder) {
+				continue
+			}
+			if rec.Folder != batchFolder || *rec.Device != batchDevice || len(batch) == importBatchSize {
+				flush()
+				batchFolder, batchDevice = rec.Folder, *rec.Device
+			}
+			if batchDevice == protocol.LocalDeviceID && !verifier.VerifyFile(rec.Folder, *rec.File) {
+				l.Debugf("import: not trusting %q in %q", rec.File.Name, rec.Folder)
+				res.Rejected++
+				continue
+			}
+			batch = append(batch, *rec.File)
+			res.Files++
+
+		case "kv":
+			var keyType byte
+			var perFolder, known bool
+			for _, ns := range exportNamespaces {
+				if ns.name == rec.Namespace {
+					keyType, perFolder, known = ns.keyType, ns.perFolder, true
+					break
+				}
+			}
+			if !known {
+				l.Debugf("import: skipping unknown namespace %q", rec.Namespace)
+				continue
+			}
+
+			key := []byte{keyType}
+			if perFolder {
+				if !checkFolder(rec.Folder) {
+					continue
+				}
+				key = append(key, make([]byte, keyFolderLen)...)
+				binary.BigEndian.PutUint32(key[keyPrefixLen:], db.folderIdx.ID([]byte(rec.Folder)))
+			}
+			key = append(key, rec.Key...)
+			if err := db.Put(key, rec.Value); err != nil {
+				return res, err
+			}
+			res.Values++
+
+		default:
+			l.Debugf("import: skipping unknown record type %q", rec.Type)
+		}
+	}
+	flush()
+
+	return res, nil
+}
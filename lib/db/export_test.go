@@ -0,0 +1,100 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+type testVerifier struct{}
+
+func (testVerifier) VerifyFolder(folder string) error {
+	if folder == "skipped" {
+		return errors.New("skipped")
+	}
+	return nil
+}
+
+func (testVerifier) VerifyFile(folder string, f protocol.FileInfo) bool {
+	return f.Name != "f2"
+}
+
+func TestExportImport(t *testing.T) {
+	src := OpenMemory()
+
+	remote := protocol.DeviceID{42}
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+
+	local := []protocol.FileInfo{f1, f2}
+	local[0].Version, local[1].Version = v1, v1
+	s := NewFileSet("test", src)
+	s.Replace(protocol.LocalDeviceID, local)
+	rem := []protocol.FileInfo{f3}
+	rem[0].Version = v1
+	s.Replace(remote, rem)
+	NewFileSet("skipped", src).Replace(protocol.LocalDeviceID, local)
+
+	mtime := time.Unix(1234567890, 0)
+	NewVirtualMtimeRepo(src, "test").UpdateMtime("f1", mtime, mtime.Add(time.Hour))
+	NewNamespacedKV(src, string([]byte{KeyTypeDeviceStatistic})+"device").PutInt64("seen", 42)
+
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := OpenMemory()
+	res, err := dst.Import(&buf, testVerifier{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Folders) != 1 || res.Folders[0] != "test" {
+		t.Errorf("Incorrect imported folders %v", res.Folders)
+	}
+	if len(res.Skipped) != 1 || res.Skipped[0] != "skipped" {
+		t.Errorf("Incorrect skipped folders %v", res.Skipped)
+	}
+	if res.Files != 2 || res.Rejected != 1 || res.Values != 2 {
+		t.Errorf("Incorrect import result %+v", res)
+	}
+
+	s = NewFileSet("test", dst)
+	if f, ok := s.Get(protocol.LocalDeviceID, "f1"); !ok || !f.Version.Equal(v1) || len(f.Blocks) != len(f1.Blocks) {
+		t.Errorf("Incorrect local f1 %v", f)
+	}
+	if _, ok := s.Get(protocol.LocalDeviceID, "f2"); ok {
+		t.Error("Unverified f2 should not be imported")
+	}
+	if f, ok := s.Get(remote, "f3"); !ok || !f.Version.Equal(v1) {
+		t.Errorf("Incorrect remote f3 %v", f)
+	}
+	if files, _, _ := s.GlobalSize(); files != 2 {
+		t.Errorf("Incorrect global size %d != 2", files)
+	}
+	if ldb := dst.ListFolders(); len(ldb) != 1 || ldb[0] != "test" {
+		t.Errorf("Incorrect folders %v", ldb)
+	}
+
+	if got := NewVirtualMtimeRepo(dst, "test").GetMtime("f1", mtime); !got.Equal(mtime.Add(time.Hour)) {
+		t.Errorf("Incorrect virtual mtime %v", got)
+	}
+	if v, ok := NewNamespacedKV(dst, string([]byte{KeyTypeDeviceStatistic})+"device").Int64("seen"); !ok || v != 42 {
+		t.Errorf("Incorrect statistic %d", v)
+	}
+
+	// A stream that isn't an export is refused.
+
+	if _, err := OpenMemory().Import(bytes.NewBufferString(`{"format":"something"}`), testVerifier{}); err == nil {
+		t.Error("Unexpected nil error for invalid stream")
+	}
+}
@@ -15,8 +15,6 @@ import (
 
 	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syncthing/syncthing/lib/sync"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
 var (
@@ -44,6 +42,10 @@ const (
 	KeyTypeVirtualMtime
 	KeyTypeFolderIdx
 	KeyTypeDeviceIdx
+	KeyTypeWebhookQueue
+	KeyTypeIndexID
+	KeyTypeStatsHistory
+	KeyTypeTempProgress
 )
 
 type fileVersion struct {
@@ -84,16 +86,12 @@ func (l fileList) Less(a, b int) bool {
 	return l[a].Name < l[b].Name
 }
 
-type dbReader interface {
-	Get([]byte, *opt.ReadOptions) ([]byte, error)
-}
-
 // Flush batches to disk when they contain this many records.
 const batchFlushSize = 64
 
-func getFile(db dbReader, key []byte) (protocol.FileInfo, bool) {
-	bs, err := db.Get(key, nil)
-	if err == leveldb.ErrNotFound {
+func getFile(db Reader, key []byte) (protocol.FileInfo, bool) {
+	bs, err := db.Get(key)
+	if err == ErrNotFound {
 		return protocol.FileInfo{}, false
 	}
 	if err != nil {
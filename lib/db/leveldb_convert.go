@@ -20,7 +20,7 @@ func convertKeyFormat(from, to *leveldb.DB) error {
 	l.Infoln("Converting database key format")
 	blocks, files, globals, unchanged := 0, 0, 0, 0
 
-	dbi := newDBInstance(to)
+	dbi := newDBInstance(leveldbBackend{to})
 	i := from.NewIterator(nil, nil)
 	for i.Next() {
 		key := i.Key()
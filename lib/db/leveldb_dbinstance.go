@@ -19,18 +19,15 @@ import (
 	"github.com/syncthing/syncthing/lib/sync"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
-	"github.com/syndtr/goleveldb/leveldb/opt"
-	"github.com/syndtr/goleveldb/leveldb/storage"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
-type deletionHandler func(t readWriteTransaction, folder, device, name []byte, dbi iterator.Iterator) int64
+type deletionHandler func(t readWriteTransaction, folder, device, name []byte, dbi BackendIterator) int64
 
 type Instance struct {
-	*leveldb.DB
+	Backend
 	folderIdx *smallIndex
 	deviceIdx *smallIndex
+	recovered bool
 }
 
 const (
@@ -40,64 +37,39 @@ const (
 	keyHashLen   = 32
 )
 
+// Open opens the LevelDB database at the given location.
 func Open(file string) (*Instance, error) {
-	opts := &opt.Options{
-		OpenFilesCacheCapacity: 100,
-		WriteBuffer:            4 << 20,
-	}
-
-	if _, err := os.Stat(file); os.IsNotExist(err) {
-		// The file we are looking to open does not exist. This may be the
-		// first launch so we should look for an old version and try to
-		// convert it.
-		if err := checkConvertDatabase(file); err != nil {
-			l.Infoln("Converting old database:", err)
-			l.Infoln("Will rescan from scratch.")
-		}
-	}
-
-	db, err := leveldb.OpenFile(file, opts)
-	if leveldbIsCorrupted(err) {
-		db, err = leveldb.RecoverFile(file, opts)
-	}
-	if leveldbIsCorrupted(err) {
-		// The database is corrupted, and we've tried to recover it but it
-		// didn't work. At this point there isn't much to do beyond dropping
-		// the database and reindexing...
-		l.Infoln("Database corruption detected, unable to recover. Reinitializing...")
-		if err := os.RemoveAll(file); err != nil {
-			return nil, err
-		}
-		db, err = leveldb.OpenFile(file, opts)
-	}
-	if err != nil {
-		return nil, err
-	}
-
-	return newDBInstance(db), nil
+	return OpenBackend(BackendLevelDB, file)
 }
 
+// OpenMemory returns a database kept in memory only, for testing.
 func OpenMemory() *Instance {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	return newDBInstance(db)
+	return newDBInstance(newLevelDBMemoryBackend())
 }
 
-func newDBInstance(db *leveldb.DB) *Instance {
+func newDBInstance(backend Backend) *Instance {
 	i := &Instance{
-		DB: db,
+		Backend: backend,
 	}
 	i.folderIdx = newSmallIndex(i, []byte{KeyTypeFolderIdx})
 	i.deviceIdx = newSmallIndex(i, []byte{KeyTypeDeviceIdx})
 	return i
 }
 
+// Recovered returns true if the database was found to be corrupted when
+// opened and has been recovered. The recovered contents should be checked
+// before use.
+func (db *Instance) Recovered() bool {
+	return db.recovered
+}
+
 func (db *Instance) genericReplace(folder, device []byte, fs []protocol.FileInfo, localSize, globalSize *sizeTracker, deleteFn deletionHandler) int64 {
 	sort.Sort(fileList(fs)) // sort list on name, same as in the database
 
 	t := db.newReadWriteTransaction()
 	defer t.close()
 
-	dbi := t.NewIterator(util.BytesPrefix(db.deviceKey(folder, device, nil)[:keyPrefixLen+keyFolderLen+keyDeviceLen]), nil)
+	dbi := t.NewPrefixIterator(db.deviceKey(folder, device, nil)[:keyPrefixLen+keyFolderLen+keyDeviceLen])
 	defer dbi.Release()
 
 	moreDb := dbi.Next()
@@ -188,7 +160,7 @@ func (db *Instance) genericReplace(folder, device []byte, fs []protocol.FileInfo
 
 func (db *Instance) replace(folder, device []byte, fs []protocol.FileInfo, localSize, globalSize *sizeTracker) int64 {
 	// TODO: Return the remaining maxLocalVer?
-	return db.genericReplace(folder, device, fs, localSize, globalSize, func(t readWriteTransaction, folder, device, name []byte, dbi iterator.Iterator) int64 {
+	return db.genericReplace(folder, device, fs, localSize, globalSize, func(t readWriteTransaction, folder, device, name []byte, dbi BackendIterator) int64 {
 		// Database has a file that we are missing. Remove it.
 		l.Debugf("delete; folder=%q device=%v name=%q", folder, protocol.DeviceIDFromBytes(device), name)
 		t.removeFromGlobal(folder, device, name, globalSize)
@@ -207,8 +179,8 @@ func (db *Instance) updateFiles(folder, device []byte, fs []protocol.FileInfo, l
 	for _, f := range fs {
 		name := []byte(f.Name)
 		fk = db.deviceKeyInto(fk[:cap(fk)], folder, device, name)
-		bs, err := t.Get(fk, nil)
-		if err == leveldb.ErrNotFound {
+		bs, err := t.Get(fk)
+		if err == ErrNotFound {
 			if isLocalDevice {
 				localSize.addFile(f)
 			}
@@ -259,7 +231,7 @@ func (db *Instance) withHave(folder, device, prefix []byte, truncate bool, fn It
 	t := db.newReadOnlyTransaction()
 	defer t.close()
 
-	dbi := t.NewIterator(util.BytesPrefix(db.deviceKey(folder, device, prefix)[:keyPrefixLen+keyFolderLen+keyDeviceLen+len(prefix)]), nil)
+	dbi := t.NewPrefixIterator(db.deviceKey(folder, device, prefix)[:keyPrefixLen+keyFolderLen+keyDeviceLen+len(prefix)])
 	defer dbi.Release()
 
 	for dbi.Next() {
@@ -281,7 +253,7 @@ func (db *Instance) withAllFolderTruncated(folder []byte, fn func(device []byte,
 	t := db.newReadWriteTransaction()
 	defer t.close()
 
-	dbi := t.NewIterator(util.BytesPrefix(db.deviceKey(folder, nil, nil)[:keyPrefixLen+keyFolderLen]), nil)
+	dbi := t.NewPrefixIterator(db.deviceKey(folder, nil, nil)[:keyPrefixLen+keyFolderLen])
 	defer dbi.Release()
 
 	for dbi.Next() {
@@ -321,8 +293,8 @@ func (db *Instance) getGlobal(folder, file []byte, truncate bool) (FileIntf, boo
 	t := db.newReadOnlyTransaction()
 	defer t.close()
 
-	bs, err := t.Get(k, nil)
-	if err == leveldb.ErrNotFound {
+	bs, err := t.Get(k)
+	if err == ErrNotFound {
 		return nil, false
 	}
 	if err != nil {
@@ -340,7 +312,7 @@ func (db *Instance) getGlobal(folder, file []byte, truncate bool) (FileIntf, boo
 	}
 
 	k = db.deviceKey(folder, vl.versions[0].device, file)
-	bs, err = t.Get(k, nil)
+	bs, err = t.Get(k)
 	if err != nil {
 		panic(err)
 	}
@@ -356,7 +328,7 @@ func (db *Instance) withGlobal(folder, prefix []byte, truncate bool, fn Iterator
 	t := db.newReadOnlyTransaction()
 	defer t.close()
 
-	dbi := t.NewIterator(util.BytesPrefix(db.globalKey(folder, prefix)), nil)
+	dbi := t.NewPrefixIterator(db.globalKey(folder, prefix))
 	defer dbi.Release()
 
 	var fk []byte
@@ -372,7 +344,7 @@ func (db *Instance) withGlobal(folder, prefix []byte, truncate bool, fn Iterator
 		}
 		name := db.globalKeyName(dbi.Key())
 		fk = db.deviceKeyInto(fk[:cap(fk)], folder, vl.versions[0].device, name)
-		bs, err := t.Get(fk, nil)
+		bs, err := t.Get(fk)
 		if err != nil {
 			l.Debugf("folder: %q (%x)", folder, folder)
 			l.Debugf("key: %q (%x)", dbi.Key(), dbi.Key())
@@ -400,8 +372,8 @@ func (db *Instance) withGlobal(folder, prefix []byte, truncate bool, fn Iterator
 
 func (db *Instance) availability(folder, file []byte) []protocol.DeviceID {
 	k := db.globalKey(folder, file)
-	bs, err := db.Get(k, nil)
-	if err == leveldb.ErrNotFound {
+	bs, err := db.Get(k)
+	if err == ErrNotFound {
 		return nil
 	}
 	if err != nil {
@@ -430,7 +402,7 @@ func (db *Instance) withNeed(folder, device []byte, truncate bool, fn Iterator)
 	t := db.newReadOnlyTransaction()
 	defer t.close()
 
-	dbi := t.NewIterator(util.BytesPrefix(db.globalKey(folder, nil)[:keyPrefixLen+keyFolderLen]), nil)
+	dbi := t.NewPrefixIterator(db.globalKey(folder, nil)[:keyPrefixLen+keyFolderLen])
 	defer dbi.Release()
 
 	var fk []byte
@@ -472,7 +444,7 @@ nextFile:
 					continue nextFile
 				}
 				fk = db.deviceKeyInto(fk[:cap(fk)], folder, vl.versions[i].device, name)
-				bs, err := t.Get(fk, nil)
+				bs, err := t.Get(fk)
 				if err != nil {
 					var id protocol.DeviceID
 					copy(id[:], device)
@@ -518,7 +490,7 @@ func (db *Instance) ListFolders() []string {
 	t := db.newReadOnlyTransaction()
 	defer t.close()
 
-	dbi := t.NewIterator(util.BytesPrefix([]byte{KeyTypeGlobal}), nil)
+	dbi := t.NewPrefixIterator([]byte{KeyTypeGlobal})
 	defer dbi.Release()
 
 	folderExists := make(map[string]bool)
@@ -543,31 +515,66 @@ func (db *Instance) dropFolder(folder []byte) {
 	defer t.close()
 
 	// Remove all items related to the given folder from the device->file bucket
-	dbi := t.NewIterator(util.BytesPrefix([]byte{KeyTypeDevice}), nil)
+	dbi := t.NewPrefixIterator([]byte{KeyTypeDevice})
 	for dbi.Next() {
 		itemFolder := db.deviceKeyFolder(dbi.Key())
 		if bytes.Equal(folder, itemFolder) {
-			db.Delete(dbi.Key(), nil)
+			db.Delete(dbi.Key())
 		}
 	}
 	dbi.Release()
 
 	// Remove all items related to the given folder from the global bucket
-	dbi = t.NewIterator(util.BytesPrefix([]byte{KeyTypeGlobal}), nil)
+	dbi = t.NewPrefixIterator([]byte{KeyTypeGlobal})
 	for dbi.Next() {
 		itemFolder := db.globalKeyFolder(dbi.Key())
 		if bytes.Equal(folder, itemFolder) {
-			db.Delete(dbi.Key(), nil)
+			db.Delete(dbi.Key())
 		}
 	}
 	dbi.Release()
+
+	// Remove the index IDs of all devices for the given folder
+	dbi = t.NewPrefixIterator(db.indexIDKey(folder, nil)[:keyPrefixLen+keyFolderLen])
+	for dbi.Next() {
+		db.Delete(dbi.Key())
+	}
+	dbi.Release()
+}
+
+// getIndexID returns the index ID and the highest acknowledged local version
+// stored for the given folder and device, or zeroes if there are none.
+func (db *Instance) getIndexID(folder, device []byte) (protocol.IndexID, int64) {
+	bs, err := db.Get(db.indexIDKey(folder, device))
+	if err == ErrNotFound {
+		return 0, 0
+	}
+	if err != nil {
+		panic(err)
+	}
+	if len(bs) != 16 {
+		l.Debugf("Invalid index ID record of length %d for %q", len(bs), folder)
+		return 0, 0
+	}
+	return protocol.IndexID(binary.BigEndian.Uint64(bs)), int64(binary.BigEndian.Uint64(bs[8:]))
+}
+
+func (db *Instance) setIndexID(folder, device []byte, id protocol.IndexID, maxLocalVer int64) {
+	bs := make([]byte, 16)
+	binary.BigEndian.PutUint64(bs, uint64(id))
+	binary.BigEndian.PutUint64(bs[8:], uint64(maxLocalVer))
+	db.Put(db.indexIDKey(folder, device), bs)
+}
+
+func (db *Instance) deleteIndexID(folder, device []byte) {
+	db.Delete(db.indexIDKey(folder, device))
 }
 
 func (db *Instance) checkGlobals(folder []byte, globalSize *sizeTracker) {
 	t := db.newReadWriteTransaction()
 	defer t.close()
 
-	dbi := t.NewIterator(util.BytesPrefix(db.globalKey(folder, nil)[:keyPrefixLen+keyFolderLen]), nil)
+	dbi := t.NewPrefixIterator(db.globalKey(folder, nil)[:keyPrefixLen+keyFolderLen])
 	defer dbi.Release()
 
 	var fk []byte
@@ -589,8 +596,8 @@ func (db *Instance) checkGlobals(folder []byte, globalSize *sizeTracker) {
 		for i, version := range vl.versions {
 			fk = db.deviceKeyInto(fk[:cap(fk)], folder, version.device, name)
 
-			_, err := t.Get(fk, nil)
-			if err == leveldb.ErrNotFound {
+			_, err := t.Get(fk)
+			if err == ErrNotFound {
 				continue
 			}
 			if err != nil {
@@ -671,6 +678,20 @@ func (db *Instance) globalKey(folder, file []byte) []byte {
 	return k
 }
 
+// indexIDKey returns a byte slice encoding the following information:
+//	   keyTypeIndexID (1 byte)
+//	   folder (4 bytes)
+//	   device (4 bytes)
+func (db *Instance) indexIDKey(folder, device []byte) []byte {
+	k := make([]byte, keyPrefixLen+keyFolderLen+keyDeviceLen)
+	k[0] = KeyTypeIndexID
+	binary.BigEndian.PutUint32(k[keyPrefixLen:], db.folderIdx.ID(folder))
+	if device != nil {
+		binary.BigEndian.PutUint32(k[keyPrefixLen+keyFolderLen:], db.deviceIdx.ID(device))
+	}
+	return k
+}
+
 // globalKeyName returns the filename from the key
 func (db *Instance) globalKeyName(key []byte) []byte {
 	return key[keyPrefixLen+keyFolderLen:]
@@ -785,7 +806,7 @@ func newSmallIndex(db *Instance, prefix []byte) *smallIndex {
 // memory maps.
 func (i *smallIndex) load() {
 	tr := i.db.newReadOnlyTransaction()
-	it := tr.NewIterator(util.BytesPrefix(i.prefix), nil)
+	it := tr.NewPrefixIterator(i.prefix)
 	for it.Next() {
 		val := string(it.Value())
 		id := binary.BigEndian.Uint32(it.Key()[len(i.prefix):])
@@ -823,7 +844,7 @@ func (i *smallIndex) ID(val []byte) uint32 {
 	key := make([]byte, len(i.prefix)+8) // prefix plus uint32 id
 	copy(key, i.prefix)
 	binary.BigEndian.PutUint32(key[len(i.prefix):], id)
-	i.db.Put(key, val, nil)
+	i.db.Put(key, val)
 
 	i.mut.Unlock()
 	return id
@@ -10,17 +10,16 @@ import (
 	"bytes"
 
 	"github.com/syncthing/syncthing/lib/protocol"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 // A readOnlyTransaction represents a database snapshot.
 type readOnlyTransaction struct {
-	*leveldb.Snapshot
+	Snapshot
 	db *Instance
 }
 
 func (db *Instance) newReadOnlyTransaction() readOnlyTransaction {
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -43,19 +42,19 @@ func (t readOnlyTransaction) getFile(folder, device, file []byte) (protocol.File
 // batch size.
 type readWriteTransaction struct {
 	readOnlyTransaction
-	*leveldb.Batch
+	Batch
 }
 
 func (db *Instance) newReadWriteTransaction() readWriteTransaction {
 	t := db.newReadOnlyTransaction()
 	return readWriteTransaction{
 		readOnlyTransaction: t,
-		Batch:               new(leveldb.Batch),
+		Batch:               db.NewBatch(),
 	}
 }
 
 func (t readWriteTransaction) close() {
-	if err := t.db.Write(t.Batch, nil); err != nil {
+	if err := t.db.Write(t.Batch); err != nil {
 		panic(err)
 	}
 	t.readOnlyTransaction.close()
@@ -63,7 +62,7 @@ func (t readWriteTransaction) close() {
 
 func (t readWriteTransaction) checkFlush() {
 	if t.Batch.Len() > batchFlushSize {
-		if err := t.db.Write(t.Batch, nil); err != nil {
+		if err := t.db.Write(t.Batch); err != nil {
 			panic(err)
 		}
 		t.Batch.Reset()
@@ -91,8 +90,8 @@ func (t readWriteTransaction) updateGlobal(folder, device []byte, file protocol.
 	l.Debugf("update global; folder=%q device=%v file=%q version=%d", folder, protocol.DeviceIDFromBytes(device), file.Name, file.Version)
 	name := []byte(file.Name)
 	gk := t.db.globalKey(folder, name)
-	svl, err := t.Get(gk, nil)
-	if err != nil && err != leveldb.ErrNotFound {
+	svl, err := t.Get(gk)
+	if err != nil && err != ErrNotFound {
 		panic(err)
 	}
 
@@ -198,7 +197,7 @@ func (t readWriteTransaction) removeFromGlobal(folder, device, file []byte, glob
 	l.Debugf("remove from global; folder=%q device=%v file=%q", folder, protocol.DeviceIDFromBytes(device), file)
 
 	gk := t.db.globalKey(folder, file)
-	svl, err := t.Get(gk, nil)
+	svl, err := t.Get(gk)
 	if err != nil {
 		// We might be called to "remove" a global version that doesn't exist
 		// if the first update for the file is already marked invalid.
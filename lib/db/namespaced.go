@@ -9,13 +9,10 @@ package db
 import (
 	"encoding/binary"
 	"time"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // NamespacedKV is a simple key-value store using a specific namespace within
-// a leveldb.
+// the database.
 type NamespacedKV struct {
 	db     *Instance
 	prefix []byte
@@ -32,20 +29,20 @@ func NewNamespacedKV(db *Instance, prefix string) *NamespacedKV {
 
 // Reset removes all entries in this namespace.
 func (n *NamespacedKV) Reset() {
-	it := n.db.NewIterator(util.BytesPrefix(n.prefix), nil)
+	it := n.db.NewPrefixIterator(n.prefix)
 	defer it.Release()
-	batch := new(leveldb.Batch)
+	batch := n.db.NewBatch()
 	for it.Next() {
 		batch.Delete(it.Key())
 		if batch.Len() > batchFlushSize {
-			if err := n.db.Write(batch, nil); err != nil {
+			if err := n.db.Write(batch); err != nil {
 				panic(err)
 			}
 			batch.Reset()
 		}
 	}
 	if batch.Len() > 0 {
-		if err := n.db.Write(batch, nil); err != nil {
+		if err := n.db.Write(batch); err != nil {
 			panic(err)
 		}
 	}
@@ -57,14 +54,14 @@ func (n *NamespacedKV) PutInt64(key string, val int64) {
 	keyBs := append(n.prefix, []byte(key)...)
 	var valBs [8]byte
 	binary.BigEndian.PutUint64(valBs[:], uint64(val))
-	n.db.Put(keyBs, valBs[:], nil)
+	n.db.Put(keyBs, valBs[:])
 }
 
 // Int64 returns the stored value interpreted as an int64 and a boolean that
 // is false if no value was stored at the key.
 func (n *NamespacedKV) Int64(key string) (int64, bool) {
 	keyBs := append(n.prefix, []byte(key)...)
-	valBs, err := n.db.Get(keyBs, nil)
+	valBs, err := n.db.Get(keyBs)
 	if err != nil {
 		return 0, false
 	}
@@ -77,7 +74,7 @@ func (n *NamespacedKV) Int64(key string) (int64, bool) {
 func (n *NamespacedKV) PutTime(key string, val time.Time) {
 	keyBs := append(n.prefix, []byte(key)...)
 	valBs, _ := val.MarshalBinary() // never returns an error
-	n.db.Put(keyBs, valBs, nil)
+	n.db.Put(keyBs, valBs)
 }
 
 // Time returns the stored value interpreted as a time.Time and a boolean
@@ -85,7 +82,7 @@ func (n *NamespacedKV) PutTime(key string, val time.Time) {
 func (n NamespacedKV) Time(key string) (time.Time, bool) {
 	var t time.Time
 	keyBs := append(n.prefix, []byte(key)...)
-	valBs, err := n.db.Get(keyBs, nil)
+	valBs, err := n.db.Get(keyBs)
 	if err != nil {
 		return t, false
 	}
@@ -97,14 +94,14 @@ func (n NamespacedKV) Time(key string) (time.Time, bool) {
 // is overwritten.
 func (n *NamespacedKV) PutString(key, val string) {
 	keyBs := append(n.prefix, []byte(key)...)
-	n.db.Put(keyBs, []byte(val), nil)
+	n.db.Put(keyBs, []byte(val))
 }
 
 // String returns the stored value interpreted as a string and a boolean that
 // is false if no value was stored at the key.
 func (n NamespacedKV) String(key string) (string, bool) {
 	keyBs := append(n.prefix, []byte(key)...)
-	valBs, err := n.db.Get(keyBs, nil)
+	valBs, err := n.db.Get(keyBs)
 	if err != nil {
 		return "", false
 	}
@@ -115,14 +112,14 @@ func (n NamespacedKV) String(key string) (string, bool) {
 // is overwritten.
 func (n *NamespacedKV) PutBytes(key string, val []byte) {
 	keyBs := append(n.prefix, []byte(key)...)
-	n.db.Put(keyBs, val, nil)
+	n.db.Put(keyBs, val)
 }
 
 // Bytes returns the stored value as a raw byte slice and a boolean that
 // is false if no value was stored at the key.
 func (n NamespacedKV) Bytes(key string) ([]byte, bool) {
 	keyBs := append(n.prefix, []byte(key)...)
-	valBs, err := n.db.Get(keyBs, nil)
+	valBs, err := n.db.Get(keyBs)
 	if err != nil {
 		return nil, false
 	}
@@ -134,9 +131,9 @@ func (n NamespacedKV) Bytes(key string) ([]byte, bool) {
 func (n *NamespacedKV) PutBool(key string, val bool) {
 	keyBs := append(n.prefix, []byte(key)...)
 	if val {
-		n.db.Put(keyBs, []byte{0x0}, nil)
+		n.db.Put(keyBs, []byte{0x0})
 	} else {
-		n.db.Put(keyBs, []byte{0x1}, nil)
+		n.db.Put(keyBs, []byte{0x1})
 	}
 }
 
@@ -144,7 +141,7 @@ func (n *NamespacedKV) PutBool(key string, val bool) {
 // is false if no value was stored at the key.
 func (n NamespacedKV) Bool(key string) (bool, bool) {
 	keyBs := append(n.prefix, []byte(key)...)
-	valBs, err := n.db.Get(keyBs, nil)
+	valBs, err := n.db.Get(keyBs)
 	if err != nil {
 		return false, false
 	}
@@ -155,5 +152,5 @@ func (n NamespacedKV) Bool(key string) (bool, bool) {
 // key.
 func (n NamespacedKV) Delete(key string) {
 	keyBs := append(n.prefix, []byte(key)...)
-	n.db.Delete(keyBs, nil)
+	n.db.Delete(keyBs)
 }
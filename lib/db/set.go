@@ -14,6 +14,7 @@ package db
 
 import (
 	stdsync "sync"
+	"time"
 
 	"github.com/syncthing/syncthing/lib/osutil"
 	"github.com/syncthing/syncthing/lib/protocol"
@@ -86,6 +87,16 @@ func (s *sizeTracker) removeFile(f FileIntf) {
 	s.mut.Unlock()
 }
 
+// set replaces the totals with those of other, returning true if they
+// were different.
+func (s *sizeTracker) set(other *sizeTracker) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	changed := s.files != other.files || s.deleted != other.deleted || s.bytes != other.bytes
+	s.files, s.deleted, s.bytes = other.files, other.deleted, other.bytes
+	return changed
+}
+
 func (s *sizeTracker) Size() (files, deleted int, bytes int64) {
 	s.mut.Lock()
 	defer s.mut.Unlock()
@@ -133,6 +144,9 @@ func (s *FileSet) Replace(device protocol.DeviceID, fs []protocol.FileInfo) {
 	if device == protocol.LocalDeviceID {
 		s.blockmap.Drop()
 		s.blockmap.Add(fs)
+		// Files may have disappeared without a trace, so peers can no
+		// longer catch up using index updates. Start a new index.
+		s.db.deleteIndexID([]byte(s.folder), device[:])
 	}
 }
 
@@ -234,6 +248,64 @@ func (s *FileSet) LocalVersion(device protocol.DeviceID) int64 {
 	return s.localVersion[device]
 }
 
+// Check verifies the database entries for the folder and repairs any
+// inconsistencies, including incorrect size totals. Updates to the folder
+// are blocked while the check runs.
+func (s *FileSet) Check() CheckResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	t0 := time.Now()
+	var localSize, globalSize sizeTracker
+	res := s.db.checkFolder([]byte(s.folder), &localSize, &globalSize)
+	res.LocalSizeFixed = s.localSize.set(&localSize)
+	res.GlobalSizeFixed = s.globalSize.set(&globalSize)
+	res.Duration = time.Since(t0)
+	return res
+}
+
+// IndexID returns the index ID of the given device for this folder, or zero
+// if it is not known. An index ID is created for the local device if it
+// doesn't have one yet.
+func (s *FileSet) IndexID(device protocol.DeviceID) protocol.IndexID {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id, _ := s.db.getIndexID([]byte(s.folder), device[:])
+	if id == 0 && device == protocol.LocalDeviceID {
+		id = protocol.NewIndexID()
+		s.db.setIndexID([]byte(s.folder), device[:], id, 0)
+	}
+	return id
+}
+
+// SetIndexID records the index ID of the given device. The acknowledged
+// local version for the device is reset to zero.
+func (s *FileSet) SetIndexID(device protocol.DeviceID, id protocol.IndexID) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.db.setIndexID([]byte(s.folder), device[:], id, 0)
+}
+
+// MaxLocalVersion returns the highest local version of the given device up
+// to which we are known to have received its complete index. Unlike
+// LocalVersion, this does not move until a full round of updates has been
+// received.
+func (s *FileSet) MaxLocalVersion(device protocol.DeviceID) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ver := s.db.getIndexID([]byte(s.folder), device[:])
+	return ver
+}
+
+// SetMaxLocalVersion records the highest local version of the given device
+// up to which we have received its complete index.
+func (s *FileSet) SetMaxLocalVersion(device protocol.DeviceID, ver int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id, _ := s.db.getIndexID([]byte(s.folder), device[:])
+	s.db.setIndexID([]byte(s.folder), device[:], id, ver)
+}
+
 func (s *FileSet) LocalSize() (files, deleted int, bytes int64) {
 	return s.localSize.Size()
 }
@@ -252,6 +324,7 @@ func DropFolder(db *Instance, folder string) {
 	}
 	bm.Drop()
 	NewVirtualMtimeRepo(db, folder).Drop()
+	NewTempProgressRepo(db, folder).Drop()
 }
 
 func normalizeFilenames(fs []protocol.FileInfo) {
@@ -560,6 +560,55 @@ func TestListDropFolder(t *testing.T) {
 	}
 }
 
+func TestIndexID(t *testing.T) {
+	ldb := db.OpenMemory()
+
+	s := db.NewFileSet("test", ldb)
+
+	// The local index ID is created on demand and then stays the same.
+
+	localID := s.IndexID(protocol.LocalDeviceID)
+	if localID == 0 {
+		t.Fatal("Local index ID should be set")
+	}
+	if id := db.NewFileSet("test", ldb).IndexID(protocol.LocalDeviceID); id != localID {
+		t.Errorf("Local index ID changed %v != %v", id, localID)
+	}
+
+	// Remote index IDs are only what we record, as is the local version
+	// acknowledged for them.
+
+	if id := s.IndexID(remoteDevice0); id != 0 {
+		t.Errorf("Remote index ID should be unset, not %v", id)
+	}
+	s.SetIndexID(remoteDevice0, 42)
+	s.SetMaxLocalVersion(remoteDevice0, 1000)
+	if id := s.IndexID(remoteDevice0); id != 42 {
+		t.Errorf("Incorrect remote index ID %v != 42", id)
+	}
+	if ver := s.MaxLocalVersion(remoteDevice0); ver != 1000 {
+		t.Errorf("Incorrect max local version %d != 1000", ver)
+	}
+	s.SetIndexID(remoteDevice0, 43)
+	if ver := s.MaxLocalVersion(remoteDevice0); ver != 0 {
+		t.Errorf("Max local version should be reset with a new index ID, not %d", ver)
+	}
+
+	// Replacing the local index starts a new one.
+
+	s.Replace(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}}})
+	if id := s.IndexID(protocol.LocalDeviceID); id == localID || id == 0 {
+		t.Errorf("Local index ID should have changed, not %v", id)
+	}
+
+	// Dropping the folder forgets all of them.
+
+	db.DropFolder(ldb, "test")
+	if id := s.IndexID(remoteDevice0); id != 0 {
+		t.Errorf("Remote index ID should be gone, not %v", id)
+	}
+}
+
 func TestGlobalNeedWithInvalid(t *testing.T) {
 	ldb := db.OpenMemory()
 
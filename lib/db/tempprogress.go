@@ -0,0 +1,139 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A TempProgress records which blocks of a temporary file have been written
+// and verified, so that a pull can be resumed without rehashing the file.
+type TempProgress struct {
+	BlocksHash []byte  // Identifies the block list of the file being pulled
+	Size       int64   // Size of the temporary file when recorded
+	Modified   int64   // Modification time of the temporary file when recorded, in nanoseconds
+	Verified   []byte  // Bitmap of the verified block indexes
+	Tail       []int32 // The block indexes verified since the previous record
+}
+
+var errTempProgressCorrupt = errors.New("corrupt temp progress record")
+
+// IsVerified returns whether the block at the given index is verified.
+func (p TempProgress) IsVerified(idx int) bool {
+	return idx >= 0 && idx/8 < len(p.Verified) && p.Verified[idx/8]&(1<<uint(idx%8)) != 0
+}
+
+// SetVerified marks the block at the given index as verified.
+func (p *TempProgress) SetVerified(idx int) {
+	for idx/8 >= len(p.Verified) {
+		p.Verified = append(p.Verified, 0)
+	}
+	p.Verified[idx/8] |= 1 << uint(idx%8)
+}
+
+func (p TempProgress) MarshalBinary() ([]byte, error) {
+	bs := make([]byte, 4+len(p.BlocksHash)+8+8+4+len(p.Verified)+4+4*len(p.Tail))
+	o := 0
+	binary.BigEndian.PutUint32(bs[o:], uint32(len(p.BlocksHash)))
+	o += 4
+	o += copy(bs[o:], p.BlocksHash)
+	binary.BigEndian.PutUint64(bs[o:], uint64(p.Size))
+	o += 8
+	binary.BigEndian.PutUint64(bs[o:], uint64(p.Modified))
+	o += 8
+	binary.BigEndian.PutUint32(bs[o:], uint32(len(p.Verified)))
+	o += 4
+	o += copy(bs[o:], p.Verified)
+	binary.BigEndian.PutUint32(bs[o:], uint32(len(p.Tail)))
+	o += 4
+	for _, idx := range p.Tail {
+		binary.BigEndian.PutUint32(bs[o:], uint32(idx))
+		o += 4
+	}
+	return bs, nil
+}
+
+func (p *TempProgress) UnmarshalBinary(bs []byte) error {
+	readBytes := func() ([]byte, bool) {
+		if len(bs) < 4 {
+			return nil, false
+		}
+		n := int(binary.BigEndian.Uint32(bs))
+		if len(bs)-4 < n {
+			return nil, false
+		}
+		res := append([]byte(nil), bs[4:4+n]...)
+		bs = bs[4+n:]
+		return res, true
+	}
+
+	var ok bool
+	if p.BlocksHash, ok = readBytes(); !ok || len(bs) < 16 {
+		return errTempProgressCorrupt
+	}
+	p.Size = int64(binary.BigEndian.Uint64(bs))
+	p.Modified = int64(binary.BigEndian.Uint64(bs[8:]))
+	bs = bs[16:]
+	if p.Verified, ok = readBytes(); !ok || len(bs) < 4 {
+		return errTempProgressCorrupt
+	}
+	n := int(binary.BigEndian.Uint32(bs))
+	bs = bs[4:]
+	if len(bs) != 4*n {
+		return errTempProgressCorrupt
+	}
+	p.Tail = make([]int32, n)
+	for i := range p.Tail {
+		p.Tail[i] = int32(binary.BigEndian.Uint32(bs[4*i:]))
+	}
+	return nil
+}
+
+// The TempProgressRepo keeps the progress records for the temporary files
+// of a folder.
+type TempProgressRepo struct {
+	ns *NamespacedKV
+}
+
+func NewTempProgressRepo(ldb *Instance, folder string) *TempProgressRepo {
+	var prefix [5]byte // key type + 4 bytes folder idx number
+	prefix[0] = KeyTypeTempProgress
+	binary.BigEndian.PutUint32(prefix[1:], ldb.folderIdx.ID([]byte(folder)))
+
+	return &TempProgressRepo{
+		ns: NewNamespacedKV(ldb, string(prefix[:])),
+	}
+}
+
+// Get returns the progress recorded for the file with the given name.
+// Records that cannot be read are ignored.
+func (r *TempProgressRepo) Get(name string) (TempProgress, bool) {
+	data, ok := r.ns.Bytes(name)
+	if !ok {
+		return TempProgress{}, false
+	}
+	var p TempProgress
+	if err := p.UnmarshalBinary(data); err != nil {
+		l.Debugf("temp progress: %s: %v", name, err)
+		return TempProgress{}, false
+	}
+	return p, true
+}
+
+func (r *TempProgressRepo) Put(name string, p TempProgress) {
+	data, _ := p.MarshalBinary()
+	r.ns.PutBytes(name, data)
+}
+
+func (r *TempProgressRepo) Delete(name string) {
+	r.ns.Delete(name)
+}
+
+func (r *TempProgressRepo) Drop() {
+	r.ns.Reset()
+}
@@ -0,0 +1,63 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestTempProgressRepo(t *testing.T) {
+	ldb := OpenMemory()
+
+	repo1 := NewTempProgressRepo(ldb, "folder1")
+	repo2 := NewTempProgressRepo(ldb, "folder2")
+
+	if _, ok := repo1.Get("file1"); ok {
+		t.Error("Progress should be missing")
+	}
+
+	p := TempProgress{
+		BlocksHash: []byte{1, 2, 3},
+		Size:       1 << 40,
+		Modified:   1234567890123456789,
+		Tail:       []int32{9, 3},
+	}
+	for _, idx := range []int{0, 3, 9} {
+		p.SetVerified(idx)
+	}
+	repo1.Put("file1", p)
+
+	got, ok := repo1.Get("file1")
+	if !ok {
+		t.Fatal("Progress should be present")
+	}
+	if !bytes.Equal(got.BlocksHash, p.BlocksHash) || got.Size != p.Size || got.Modified != p.Modified || !reflect.DeepEqual(got.Tail, p.Tail) {
+		t.Errorf("Incorrect progress %+v != expected %+v", got, p)
+	}
+	for idx := 0; idx < 20; idx++ {
+		if exp := idx == 0 || idx == 3 || idx == 9; got.IsVerified(idx) != exp {
+			t.Errorf("Block %d verified is %v, expected %v", idx, got.IsVerified(idx), exp)
+		}
+	}
+
+	if _, ok := repo2.Get("file1"); ok {
+		t.Error("Progress should be missing from the other folder")
+	}
+
+	repo1.Delete("file1")
+	if _, ok := repo1.Get("file1"); ok {
+		t.Error("Progress should have been deleted")
+	}
+
+	// Corrupt records are ignored.
+	repo1.ns.PutBytes("file2", []byte{0, 0, 0, 42})
+	if _, ok := repo1.Get("file2"); ok {
+		t.Error("Corrupt progress should be ignored")
+	}
+}
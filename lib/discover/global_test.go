@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -218,6 +219,63 @@ func TestGlobalAnnounce(t *testing.T) {
 	}
 }
 
+func TestGlobalAnnounceKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverCert, err := tlsutil.NewCertificateWithKeyType(dir+"/server-cert.pem", dir+"/server-key.pem", "syncthing", tlsutil.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	s := new(fakeDiscoveryServer)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handler)
+	go http.Serve(list, mux)
+
+	// The discovery server identifies us by the certificate we present,
+	// whatever kind of key it has.
+
+	for _, keyType := range []string{tlsutil.KeyTypeECDSAP256, tlsutil.KeyTypeEd25519} {
+		cert, err := tlsutil.NewCertificateWithKeyType(dir+"/"+keyType+"-cert.pem", dir+"/"+keyType+"-key.pem", "syncthing", keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		url := "https://" + list.Addr().String() + "?id=" + protocol.NewDeviceID(serverCert.Certificate[0]).String()
+		disco, err := NewGlobal(url, cert, new(fakeAddressLister))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go disco.Serve()
+		t0 := time.Now()
+		for err := disco.Error(); err != nil; err = disco.Error() {
+			if time.Since(t0) > 10*time.Second {
+				t.Fatalf("%s: announce failed: %v", keyType, err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		disco.Stop()
+
+		if id := protocol.NewDeviceID(cert.Certificate[0]); s.device != id {
+			t.Errorf("%s: announced as %v, not %v", keyType, s.device, id)
+		}
+	}
+}
+
 func testLookup(url string) ([]string, error) {
 	disco, err := NewGlobal(url, tls.Certificate{}, nil)
 	if err != nil {
@@ -231,6 +289,7 @@ func testLookup(url string) ([]string, error) {
 
 type fakeDiscoveryServer struct {
 	announce []byte
+	device   protocol.DeviceID
 }
 
 func (s *fakeDiscoveryServer) handler(w http.ResponseWriter, r *http.Request) {
@@ -241,6 +300,9 @@ func (s *fakeDiscoveryServer) handler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "POST" {
 		s.announce, _ = ioutil.ReadAll(r.Body)
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			s.device = protocol.NewDeviceID(r.TLS.PeerCertificates[0].Raw)
+		}
 		w.WriteHeader(204)
 	} else {
 		w.Header().Set("Content-Type", "application/json")
@@ -41,6 +41,10 @@ const (
 	FolderScanProgress
 	ListenAddressesChanged
 	LoginAttempt
+	FolderIgnoresChanged
+	APIRequestDenied
+	DeviceIDChanged
+	DeviceRevoked
 
 	AllEvents = (1 << iota) - 1
 )
@@ -93,6 +97,14 @@ func (t EventType) String() string {
 		return "ListenAddressesChanged"
 	case LoginAttempt:
 		return "LoginAttempt"
+	case FolderIgnoresChanged:
+		return "FolderIgnoresChanged"
+	case APIRequestDenied:
+		return "APIRequestDenied"
+	case DeviceIDChanged:
+		return "DeviceIDChanged"
+	case DeviceRevoked:
+		return "DeviceRevoked"
 	default:
 		return "Unknown"
 	}
@@ -102,6 +114,17 @@ func (t EventType) MarshalText() ([]byte, error) {
 	return []byte(t.String()), nil
 }
 
+// UnmarshalEventType returns the event type with the given name, or zero if
+// there is no such event type.
+func UnmarshalEventType(s string) EventType {
+	for t := EventType(1); t&AllEvents != 0; t <<= 1 {
+		if t.String() == s {
+			return t
+		}
+	}
+	return 0
+}
+
 const BufferSize = 64
 
 type Logger struct {
@@ -235,6 +258,7 @@ type bufferedSubscription struct {
 
 type BufferedSubscription interface {
 	Since(id int, into []Event) []Event
+	SinceCancel(id int, into []Event, cancel <-chan struct{}) []Event
 }
 
 func NewBufferedSubscription(s *Subscription, size int) BufferedSubscription {
@@ -271,10 +295,36 @@ func (s *bufferedSubscription) pollingLoop() {
 }
 
 func (s *bufferedSubscription) Since(id int, into []Event) []Event {
+	return s.SinceCancel(id, into, nil)
+}
+
+// SinceCancel is like Since, but gives up waiting for new events and returns
+// into unchanged when the cancel channel is closed.
+func (s *bufferedSubscription) SinceCancel(id int, into []Event, cancel <-chan struct{}) []Event {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
+	if cancel != nil && id >= s.cur {
+		// Wake up the waiting below when cancelled.
+		returned := make(chan struct{})
+		defer close(returned)
+		go func() {
+			select {
+			case <-cancel:
+				s.mut.Lock()
+				s.cond.Broadcast()
+				s.mut.Unlock()
+			case <-returned:
+			}
+		}()
+	}
+
 	for id >= s.cur {
+		select {
+		case <-cancel:
+			return into
+		default:
+		}
 		s.cond.Wait()
 	}
 
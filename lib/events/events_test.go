@@ -187,3 +187,43 @@ func TestBufferedSub(t *testing.T) {
 	}
 
 }
+
+func TestBufferedSubCancel(t *testing.T) {
+	l := events.NewLogger()
+
+	s := l.Subscribe(events.AllEvents)
+	defer l.Unsubscribe(s)
+	bs := events.NewBufferedSubscription(s, events.BufferSize)
+
+	cancel := make(chan struct{})
+	res := make(chan []events.Event)
+	go func() {
+		res <- bs.SinceCancel(0, nil, cancel)
+	}()
+
+	close(cancel)
+	select {
+	case evs := <-res:
+		if len(evs) != 0 {
+			t.Errorf("Unexpected events %v", evs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SinceCancel did not return when cancelled")
+	}
+}
+
+func TestUnmarshalEventType(t *testing.T) {
+	for ev := events.EventType(1); ev&events.AllEvents != 0; ev <<= 1 {
+		if ev.String() == "Unknown" {
+			t.Errorf("Event type %d lacks a name", ev)
+			continue
+		}
+		if res := events.UnmarshalEventType(ev.String()); res != ev {
+			t.Errorf("Incorrect event type for %q; %v != %v", ev.String(), res, ev)
+		}
+	}
+
+	if res := events.UnmarshalEventType("NoSuchEvent"); res != 0 {
+		t.Errorf("Unexpected event type %v for unknown name", res)
+	}
+}
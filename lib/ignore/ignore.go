@@ -22,6 +22,11 @@ import (
 	"github.com/syncthing/syncthing/lib/sync"
 )
 
+// LocalSuffix is appended to the name of an ignore file to form the name of
+// its device local override file. The override file is never synced and its
+// patterns take precedence over those of the file it overrides.
+const LocalSuffix = ".local"
+
 const (
 	resultNotMatched Result = 0
 	resultInclude    Result = 1 << iota
@@ -30,9 +35,36 @@ const (
 )
 
 type Pattern struct {
-	pattern string
-	match   glob.Glob
-	result  Result
+	pattern    string
+	match      glob.Glob
+	result     Result
+	predicates []predicate
+	file       string // the ignore file the pattern is from
+	line       int    // the line in that file
+	prefix     string // the literal start of the glob, up to any wildcard
+}
+
+func (p *Pattern) compile(expr string) error {
+	match, err := glob.Compile(expr)
+	if err != nil {
+		return err
+	}
+	p.match = match
+	p.prefix = expr
+	if i := strings.IndexAny(expr, "*?[{\\"); i >= 0 {
+		p.prefix = expr[:i]
+	}
+	return nil
+}
+
+// mayMatchWithin returns true if the pattern may match something within the
+// given directory.
+func (p Pattern) mayMatchWithin(dir string) bool {
+	dir = filepath.ToSlash(dir) + "/"
+	if p.result.IsCaseFolded() {
+		dir = strings.ToLower(dir)
+	}
+	return strings.HasPrefix(dir, p.prefix) || strings.HasPrefix(p.prefix, dir)
 }
 
 func (p Pattern) String() string {
@@ -46,9 +78,52 @@ func (p Pattern) String() string {
 	if p.result&resultDeletable == resultDeletable {
 		ret = "(?d)" + ret
 	}
+	for i := len(p.predicates) - 1; i >= 0; i-- {
+		ret = p.predicates[i].String() + ret
+	}
 	return ret
 }
 
+// Result returns the result of a file matching the pattern.
+func (p Pattern) Result() Result {
+	return p.result
+}
+
+// Source returns the name of the ignore file and the line number the
+// pattern originates from.
+func (p Pattern) Source() (file string, line int) {
+	return p.file, p.line
+}
+
+// allowsInfo returns true if all the pattern's predicates hold for the given
+// file. Without file info only patterns without predicates apply.
+func (p Pattern) allowsInfo(info os.FileInfo, now time.Time) bool {
+	if len(p.predicates) == 0 {
+		return true
+	}
+	if info == nil {
+		return false
+	}
+	for _, pred := range p.predicates {
+		if !pred.match(info, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// A Line is the parsed form of a line in an ignore file, with the patterns
+// it resulted in or the error that made it invalid. A line including another
+// file has the lines of that file as children.
+type Line struct {
+	File     string   `json:"file"`
+	Line     int      `json:"line"`
+	Text     string   `json:"text"`
+	Patterns []string `json:"patterns,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Children []Line   `json:"children,omitempty"`
+}
+
 type Result uint8
 
 func (r Result) IsIgnored() bool {
@@ -64,12 +139,15 @@ func (r Result) IsCaseFolded() bool {
 }
 
 type Matcher struct {
-	patterns  []Pattern
-	withCache bool
-	matches   *cache
-	curHash   string
-	stop      chan struct{}
-	mut       sync.Mutex
+	patterns      []Pattern
+	lines         []Line
+	withCache     bool
+	matches       *cache
+	curHash       string
+	hasPredicates bool
+	negated       []Pattern
+	stop          chan struct{}
+	mut           sync.Mutex
 }
 
 func New(withCache bool) *Matcher {
@@ -84,37 +162,82 @@ func New(withCache bool) *Matcher {
 	return m
 }
 
+// Load loads the patterns from the given file. Patterns from the local
+// override file (the same name with LocalSuffix appended), if it exists, are
+// merged on top of them.
 func (m *Matcher) Load(file string) error {
-	// No locking, Parse() does the locking
+	// No locking, parse() does the locking
 
 	fd, err := os.Open(file)
 	if err != nil {
 		// We do a parse with empty patterns to clear out the hash, cache etc.
-		m.Parse(&bytes.Buffer{}, file)
+		// Any local overrides still apply.
+		m.parse(&bytes.Buffer{}, file, true)
 		return err
 	}
 	defer fd.Close()
 
-	return m.Parse(fd, file)
+	return m.parse(fd, file, true)
 }
 
 func (m *Matcher) Parse(r io.Reader, file string) error {
+	return m.parse(r, file, false)
+}
+
+// ParseWithLocal is like Parse, but applies the local overrides for the
+// given file as Load does.
+func (m *Matcher) ParseWithLocal(r io.Reader, file string) error {
+	return m.parse(r, file, true)
+}
+
+func (m *Matcher) parse(r io.Reader, file string, withLocal bool) error {
 	m.mut.Lock()
 	defer m.mut.Unlock()
 
 	seen := map[string]bool{file: true}
-	patterns, err := parseIgnoreFile(r, file, seen)
+
+	var patterns []Pattern
+	var lines []Line
+	var err error
+	if withLocal {
+		patterns, lines, err = loadIgnoreFile(file+LocalSuffix, seen)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+
+	filePatterns, fileLines, ferr := parseIgnoreFile(r, file, seen)
+	if err == nil {
+		err = ferr
+	}
+	patterns = append(patterns, filePatterns...)
+	lines = append(lines, fileLines...)
 	// Error is saved and returned at the end. We process the patterns
 	// (possibly blank) anyway.
 
+	m.lines = lines
+
 	newHash := hashPatterns(patterns)
 	if newHash == m.curHash {
-		// We've already loaded exactly these patterns.
+		// We've already loaded exactly these patterns, and the cached
+		// results remain valid. The patterns may have moved around in the
+		// files though, so we keep the new ones for their source lines.
+		m.patterns = patterns
 		return err
 	}
 
 	m.curHash = newHash
 	m.patterns = patterns
+	m.hasPredicates = false
+	m.negated = nil
+	for _, pat := range patterns {
+		if len(pat.predicates) > 0 {
+			m.hasPredicates = true
+		}
+		if !pat.result.IsIgnored() {
+			m.negated = append(m.negated, pat)
+		}
+	}
 	if m.withCache {
 		m.matches = newCache(patterns)
 	}
@@ -122,6 +245,9 @@ func (m *Matcher) Parse(r io.Reader, file string) error {
 	return err
 }
 
+// Match returns the result for the given file name. Patterns with
+// attribute predicates are not considered, as there are no attributes to
+// evaluate them against; use MatchInfo for that.
 func (m *Matcher) Match(file string) (result Result) {
 	if m == nil {
 		return resultNotMatched
@@ -147,26 +273,96 @@ func (m *Matcher) Match(file string) (result Result) {
 		}()
 	}
 
+	return m.match(file, nil)
+}
+
+// MatchInfo returns the result for the given file name, evaluating any
+// attribute predicates against the given file info. A nil info is the same
+// as calling Match.
+func (m *Matcher) MatchInfo(file string, info os.FileInfo) Result {
+	if m == nil {
+		return resultNotMatched
+	}
+
+	m.mut.Lock()
+	hasPredicates := m.hasPredicates
+	m.mut.Unlock()
+
+	if info == nil || !hasPredicates {
+		// The result depends only on the name and may be cached.
+		return m.Match(file)
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.match(file, info)
+}
+
+// MatchPattern returns the pattern that decides the result for the given
+// file name, and whether there is such a pattern. The file info is used to
+// evaluate attribute predicates and may be nil. The cache is not used, so
+// this is intended for explaining results rather than for scanning.
+func (m *Matcher) MatchPattern(file string, info os.FileInfo) (Pattern, bool) {
+	if m == nil {
+		return Pattern{}, false
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.matchPattern(file, info)
+}
+
+func (m *Matcher) match(file string, info os.FileInfo) Result {
+	if pattern, ok := m.matchPattern(file, info); ok {
+		return pattern.result
+	}
+
+	// Default to not matching.
+	return resultNotMatched
+}
+
+func (m *Matcher) matchPattern(file string, info os.FileInfo) (Pattern, bool) {
 	// Check all the patterns for a match.
 	file = filepath.ToSlash(file)
+	now := time.Now()
 	var lowercaseFile string
 	for _, pattern := range m.patterns {
+		if !pattern.allowsInfo(info, now) {
+			continue
+		}
 		if pattern.result.IsCaseFolded() {
 			if lowercaseFile == "" {
 				lowercaseFile = strings.ToLower(file)
 			}
 			if pattern.match.Match(lowercaseFile) {
-				return pattern.result
+				return pattern, true
 			}
 		} else {
 			if pattern.match.Match(file) {
-				return pattern.result
+				return pattern, true
 			}
 		}
 	}
 
-	// Default to not matching.
-	return resultNotMatched
+	return Pattern{}, false
+}
+
+// SkipIgnoredDir returns true if the contents of the given ignored directory
+// can be assumed to be ignored as well. That is the case unless there are
+// negated patterns which may match files within the directory.
+func (m *Matcher) SkipIgnoredDir(dir string) bool {
+	if m == nil {
+		return true
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for _, pat := range m.negated {
+		if pat.mayMatchWithin(dir) {
+			return false
+		}
+	}
+	return true
 }
 
 // Patterns return a list of the loaded patterns, as they've been parsed
@@ -185,6 +381,21 @@ func (m *Matcher) Patterns() []string {
 	return patterns
 }
 
+// Lines returns the lines of the loaded ignore files as they've been parsed,
+// including any errors.
+func (m *Matcher) Lines() []Line {
+	if m == nil {
+		return nil
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	lines := make([]Line, len(m.lines))
+	copy(lines, m.lines)
+	return lines
+}
+
 func (m *Matcher) Hash() string {
 	m.mut.Lock()
 	defer m.mut.Unlock()
@@ -221,55 +432,81 @@ func hashPatterns(patterns []Pattern) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func loadIgnoreFile(file string, seen map[string]bool) ([]Pattern, error) {
+func loadIgnoreFile(file string, seen map[string]bool) ([]Pattern, []Line, error) {
 	if seen[file] {
-		return nil, fmt.Errorf("Multiple include of ignore file %q", file)
+		return nil, nil, fmt.Errorf("Multiple include of ignore file %q", file)
 	}
 	seen[file] = true
 
 	fd, err := os.Open(file)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer fd.Close()
 
 	return parseIgnoreFile(fd, file, seen)
 }
 
-func parseIgnoreFile(fd io.Reader, currentFile string, seen map[string]bool) ([]Pattern, error) {
+// parseIgnoreFile parses the patterns in the given file. Lines that fail to
+// parse are skipped and the error recorded for that line; the first such
+// error is returned after the whole file has been processed.
+func parseIgnoreFile(fd io.Reader, currentFile string, seen map[string]bool) ([]Pattern, []Line, error) {
 	var patterns []Pattern
+	var lines []Line
 
 	defaultResult := resultInclude
 	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
 		defaultResult |= resultFoldCase
 	}
 
+	// The line currently being parsed
+	var cur *Line
+
 	addPattern := func(line string) error {
 		pattern := Pattern{
 			pattern: line,
 			result:  defaultResult,
+			file:    cur.File,
+			line:    cur.Line,
 		}
 
 		// Allow prefixes to be specified in any order, but only once.
+		// Predicates may be given more than once, i.e. to specify a range.
 		var seenPrefix [3]bool
+		// The prefixes other than predicates, which are kept in the pattern
+		var prefixes string
 
 		for {
 			if strings.HasPrefix(line, "!") && !seenPrefix[0] {
 				seenPrefix[0] = true
+				prefixes += line[:1]
 				line = line[1:]
 				pattern.result ^= resultInclude
 			} else if strings.HasPrefix(line, "(?i)") && !seenPrefix[1] {
 				seenPrefix[1] = true
 				pattern.result |= resultFoldCase
+				prefixes += line[:4]
 				line = line[4:]
 			} else if strings.HasPrefix(line, "(?d)") && !seenPrefix[2] {
 				seenPrefix[2] = true
 				pattern.result |= resultDeletable
+				prefixes += line[:4]
 				line = line[4:]
+			} else if hasPredicatePrefix(line) {
+				pred, rest, err := parsePredicate(line)
+				if err != nil {
+					return err
+				}
+				pattern.predicates = append(pattern.predicates, pred)
+				line = rest
 			} else {
 				break
 			}
 		}
+		if len(pattern.predicates) > 0 {
+			// The predicates are added back by String().
+			pattern.pattern = prefixes + line
+		}
 
 		if pattern.result.IsCaseFolded() {
 			line = strings.ToLower(line)
@@ -278,14 +515,14 @@ func parseIgnoreFile(fd io.Reader, currentFile string, seen map[string]bool) ([]
 		var err error
 		if strings.HasPrefix(line, "/") {
 			// Pattern is rooted in the current dir only
-			pattern.match, err = glob.Compile(line[1:])
+			err = pattern.compile(line[1:])
 			if err != nil {
 				return fmt.Errorf("invalid pattern %q in ignore file", line)
 			}
 			patterns = append(patterns, pattern)
 		} else if strings.HasPrefix(line, "**/") {
 			// Add the pattern as is, and without **/ so it matches in current dir
-			pattern.match, err = glob.Compile(line)
+			err = pattern.compile(line)
 			if err != nil {
 				return fmt.Errorf("invalid pattern %q in ignore file", line)
 			}
@@ -293,7 +530,7 @@ func parseIgnoreFile(fd io.Reader, currentFile string, seen map[string]bool) ([]
 
 			line = line[3:]
 			pattern.pattern = line
-			pattern.match, err = glob.Compile(line)
+			err = pattern.compile(line)
 			if err != nil {
 				return fmt.Errorf("invalid pattern %q in ignore file", line)
 			}
@@ -301,15 +538,18 @@ func parseIgnoreFile(fd io.Reader, currentFile string, seen map[string]bool) ([]
 		} else if strings.HasPrefix(line, "#include ") {
 			includeRel := line[len("#include "):]
 			includeFile := filepath.Join(filepath.Dir(currentFile), includeRel)
-			includes, err := loadIgnoreFile(includeFile, seen)
+			includes, children, err := loadIgnoreFile(includeFile, seen)
+			// Whatever could be parsed from the included file is used, with
+			// errors reported on the included lines themselves.
+			patterns = append(patterns, includes...)
+			cur.Children = children
 			if err != nil {
 				return fmt.Errorf("include of %q: %v", includeRel, err)
 			}
-			patterns = append(patterns, includes...)
 		} else {
 			// Path name or pattern, add it so it matches files both in
 			// current directory and subdirs.
-			pattern.match, err = glob.Compile(line)
+			err = pattern.compile(line)
 			if err != nil {
 				return fmt.Errorf("invalid pattern %q in ignore file", line)
 			}
@@ -317,7 +557,7 @@ func parseIgnoreFile(fd io.Reader, currentFile string, seen map[string]bool) ([]
 
 			line := "**/" + line
 			pattern.pattern = line
-			pattern.match, err = glob.Compile(line)
+			err = pattern.compile(line)
 			if err != nil {
 				return fmt.Errorf("invalid pattern %q in ignore file", line)
 			}
@@ -327,8 +567,10 @@ func parseIgnoreFile(fd io.Reader, currentFile string, seen map[string]bool) ([]
 	}
 
 	scanner := bufio.NewScanner(fd)
-	var err error
+	var firstErr error
+	lineNo := 0
 	for scanner.Scan() {
+		lineNo++
 		line := strings.TrimSpace(scanner.Text())
 		switch {
 		case line == "":
@@ -337,6 +579,14 @@ func parseIgnoreFile(fd io.Reader, currentFile string, seen map[string]bool) ([]
 			continue
 		}
 
+		cur = &Line{
+			File: currentFile,
+			Line: lineNo,
+			Text: line,
+		}
+		before := len(patterns)
+
+		var err error
 		line = filepath.ToSlash(line)
 		switch {
 		case strings.HasPrefix(line, "#"):
@@ -351,10 +601,23 @@ func parseIgnoreFile(fd io.Reader, currentFile string, seen map[string]bool) ([]
 				err = addPattern(line + "/**")
 			}
 		}
+
 		if err != nil {
-			return nil, err
+			if cur.Children == nil {
+				// Drop any patterns the line resulted in before failing.
+				patterns = patterns[:before]
+			}
+			cur.Error = err.Error()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s:%d: %v", currentFile, lineNo, err)
+			}
+		} else if cur.Children == nil {
+			for _, pat := range patterns[before:] {
+				cur.Patterns = append(cur.Patterns, pat.String())
+			}
 		}
+		lines = append(lines, *cur)
 	}
 
-	return patterns, nil
+	return patterns, lines, firstErr
 }
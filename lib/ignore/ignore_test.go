@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 )
 
 func TestIgnore(t *testing.T) {
@@ -635,3 +636,328 @@ func TestAutomaticCaseInsensitivity(t *testing.T) {
 		}
 	}
 }
+
+func TestLocalOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The shared patterns ignore all logs, the local override unignores
+	// one of them and ignores an additional file.
+
+	file := filepath.Join(dir, ".stignore")
+	if err := ioutil.WriteFile(file, []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pats := New(true)
+	if err := pats.Load(file); err != nil {
+		t.Fatal(err)
+	}
+	hash := pats.Hash()
+
+	if err := ioutil.WriteFile(file+LocalSuffix, []byte("!keep.log\nlocal\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pats.Load(file); err != nil {
+		t.Fatal(err)
+	}
+	if pats.Hash() == hash {
+		t.Error("hash should change when local overrides are added")
+	}
+
+	tests := []struct {
+		f string
+		r bool
+	}{
+		{"other.log", true},
+		{"keep.log", false},
+		{"local", true},
+		{"afile", false},
+	}
+	for _, tc := range tests {
+		if r := pats.Match(tc.f); r.IsIgnored() != tc.r {
+			t.Errorf("Incorrect result for %s; E: %v, A: %v", tc.f, tc.r, r)
+		}
+	}
+
+	// The local overrides apply even without the main file.
+
+	os.Remove(file)
+	if err := pats.Load(file); !os.IsNotExist(err) {
+		t.Fatal("expected not exist error, got", err)
+	}
+	if !pats.Match("local").IsIgnored() {
+		t.Error("local override should still be in effect")
+	}
+}
+
+type fakeInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f fakeInfo) Name() string       { return f.name }
+func (f fakeInfo) Size() int64        { return f.size }
+func (f fakeInfo) Mode() os.FileMode  { return f.mode }
+func (f fakeInfo) ModTime() time.Time { return f.modTime }
+func (f fakeInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f fakeInfo) Sys() interface{}   { return nil }
+
+func TestPredicates(t *testing.T) {
+	stignore := `
+	(?size>2GiB)*.iso
+	(?age>1y)(?size<1k)old*
+	(?size>10MB)/big
+	`
+	pats := New(true)
+	err := pats.Parse(bytes.NewBufferString(stignore), ".stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	year := 365 * 24 * time.Hour
+	tests := []struct {
+		f    string
+		info os.FileInfo
+		r    bool
+	}{
+		{"image.iso", fakeInfo{size: 3 << 30}, true},
+		{"dir/image.iso", fakeInfo{size: 3 << 30}, true},
+		{"image.iso", fakeInfo{size: 1 << 30}, false},
+		{"image.iso", fakeInfo{size: 3 << 30, mode: os.ModeDir}, false},
+		{"image.iso", nil, false},
+		{"oldfile", fakeInfo{size: 100, modTime: now.Add(-2 * year)}, true},
+		{"oldfile", fakeInfo{size: 100, modTime: now.Add(-year / 2)}, false},
+		{"oldfile", fakeInfo{size: 2048, modTime: now.Add(-2 * year)}, false},
+		{"big", fakeInfo{size: 20e6}, true},
+		{"dir/big", fakeInfo{size: 20e6}, false},
+		{"big", fakeInfo{size: 5e6}, false},
+	}
+
+	for _, tc := range tests {
+		if r := pats.MatchInfo(tc.f, tc.info); r.IsIgnored() != tc.r {
+			t.Errorf("Incorrect result for %s (%v); E: %v, A: %v", tc.f, tc.info, tc.r, r)
+		}
+	}
+
+	// Name only matching never considers the predicates.
+	if pats.Match("image.iso").IsIgnored() {
+		t.Error("Match should not consider patterns with predicates")
+	}
+}
+
+func TestBadPredicates(t *testing.T) {
+	var badPatterns = []string{
+		"(?size>)foo",
+		"(?size>2XB)foo",
+		"(?size=2)foo",
+		"(?age>-1d)foo",
+		"(?size>1",
+	}
+
+	for _, pat := range badPatterns {
+		err := New(true).Parse(bytes.NewBufferString(pat), ".stignore")
+		if err == nil {
+			t.Errorf("No error for pattern %q", pat)
+		}
+	}
+}
+
+func TestPredicateHash(t *testing.T) {
+	// Predicates must be part of the hash, while patterns without them must
+	// hash as they always did.
+
+	p1 := New(true)
+	if err := p1.Parse(bytes.NewBufferString("*.iso\n"), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+	p2 := New(true)
+	if err := p2.Parse(bytes.NewBufferString("(?size>2GiB)*.iso\n"), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+	if p1.Hash() == p2.Hash() {
+		t.Error("Predicates should be included in the hash")
+	}
+
+	p3 := New(true)
+	if err := p3.Parse(bytes.NewBufferString("(?size>2GiB)*.iso\n"), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+	if p2.Hash() != p3.Hash() {
+		t.Error("Hash should be stable for identical patterns")
+	}
+
+	// The expansion of a plain pattern, as the hash has always been
+	// calculated from.
+	var patterns []Pattern
+	for _, pat := range []string{"*.iso", "**/*.iso", "*.iso/**", "**/*.iso/**"} {
+		patterns = append(patterns, Pattern{pattern: pat, result: p1.patterns[0].result})
+	}
+	if hash := hashPatterns(patterns); hash != p1.Hash() {
+		t.Errorf("Hash of plain patterns changed; %s != %s", hash, p1.Hash())
+	}
+}
+
+func TestPerLineErrors(t *testing.T) {
+	stignore := `
+	afile
+	[
+	(?size>lots)bfile
+	cfile
+	`
+	pats := New(true)
+	err := pats.Parse(bytes.NewBufferString(stignore), ".stignore")
+	if err == nil {
+		t.Fatal("Expected an error for the bad lines")
+	}
+
+	// The valid lines are still in effect.
+	for _, f := range []string{"afile", "cfile"} {
+		if !pats.Match(f).IsIgnored() {
+			t.Errorf("%s should be ignored", f)
+		}
+	}
+	if pats.Match("bfile").IsIgnored() {
+		t.Error("bfile should not be ignored, as its line is invalid")
+	}
+
+	lines := pats.Lines()
+	if len(lines) != 4 {
+		t.Fatalf("Incorrect number of lines %d != 4", len(lines))
+	}
+	for i, line := range lines {
+		bad := i == 1 || i == 2
+		if bad != (line.Error != "") {
+			t.Errorf("Incorrect error state for line %d %q: %q", line.Line, line.Text, line.Error)
+		}
+		if bad != (len(line.Patterns) == 0) {
+			t.Errorf("Incorrect patterns for line %d %q: %v", line.Line, line.Text, line.Patterns)
+		}
+	}
+	if lines[2].Line != 4 {
+		t.Errorf("Incorrect line number %d != 4", lines[2].Line)
+	}
+}
+
+func TestIncludeLines(t *testing.T) {
+	pats := New(true)
+	if err := pats.Load("testdata/.stignore"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := pats.Lines()
+	if len(lines) == 0 || lines[0].Text != "#include excludes" {
+		t.Fatalf("Unexpected first line %v", lines)
+	}
+	if len(lines[0].Children) == 0 {
+		t.Fatal("The include should have the included lines as children")
+	}
+	if file := filepath.Base(lines[0].Children[0].File); file != "excludes" {
+		t.Errorf("Incorrect file for included line, %q != excludes", file)
+	}
+}
+
+func TestSkipIgnoredDirs(t *testing.T) {
+	pats := New(true)
+	if err := pats.Parse(bytes.NewBufferString("/Reports\n"), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+	if !pats.SkipIgnoredDir("Reports") {
+		t.Error("Ignored directories can be skipped without negated patterns")
+	}
+
+	// Ignore everything in Reports except the documents.
+	stignore := `
+	!/Reports/**.docx
+	/Reports
+	`
+	if err := pats.Parse(bytes.NewBufferString(stignore), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+	if pats.SkipIgnoredDir("Reports") || pats.SkipIgnoredDir("Reports/2016") {
+		t.Error("Ignored directories must be descended into with negated patterns")
+	}
+	if !pats.SkipIgnoredDir("Other") || !pats.SkipIgnoredDir("Reportsx") {
+		t.Error("Negated patterns should only keep matching directories from being skipped")
+	}
+
+	tests := []struct {
+		f string
+		r bool
+	}{
+		{"Reports", true},
+		{"Reports/budget.xlsx", true},
+		{"Reports/2016/summary.docx", false},
+		{"Other/summary.docx", false},
+	}
+	for _, tc := range tests {
+		if r := pats.Match(tc.f); r.IsIgnored() != tc.r {
+			t.Errorf("Incorrect result for %s; E: %v, A: %v", tc.f, tc.r, r)
+		}
+	}
+}
+
+func TestPrefixedPatternsUnchanged(t *testing.T) {
+	// The string form of patterns, and thereby the hash, must not change for
+	// patterns without predicates.
+
+	pats := New(true)
+	if err := pats.Parse(bytes.NewBufferString("!foo\n"), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+	if p := pats.Patterns(); len(p) != 4 || p[0] != "!!foo" || p[1] != "!**/foo" {
+		t.Errorf("Unexpected patterns %v", p)
+	}
+	if h := pats.Hash(); h != "16ebd25c4daadd27ff62fa2cfeb6a32f" {
+		t.Errorf("Unexpected hash %s", h)
+	}
+
+	if err := pats.Parse(bytes.NewBufferString("(?size>1k)!foo\n"), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+	if p := pats.Patterns(); len(p) != 4 || p[0] != "(?size>1k)!!foo" || p[1] != "(?size>1k)!**/foo" {
+		t.Errorf("Unexpected patterns %v", p)
+	}
+}
+
+func TestMatchPatternSource(t *testing.T) {
+	pats := New(true)
+	if err := pats.Load("testdata/.stignore"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		f    string
+		file string
+		line int
+	}{
+		{"bfile", ".stignore", 3},
+		{"dir1/cfile", ".stignore", 4},
+		{"sub/efile", ".stignore", 5},
+		{"dir2/dfile", "excludes", 1},
+	}
+	for _, tc := range tests {
+		pat, ok := pats.MatchPattern(tc.f, nil)
+		if !ok {
+			t.Errorf("No pattern matched %s", tc.f)
+			continue
+		}
+		file, line := pat.Source()
+		if filepath.Base(file) != tc.file || line != tc.line {
+			t.Errorf("Incorrect source for %s; E: %s:%d, A: %s:%d", tc.f, tc.file, tc.line, file, line)
+		}
+		if !pat.Result().IsIgnored() {
+			t.Errorf("Pattern %v for %s should ignore", pat, tc.f)
+		}
+	}
+
+	if pat, ok := pats.MatchPattern("afile", nil); ok {
+		t.Errorf("Unexpected match %v for afile", pat)
+	}
+}
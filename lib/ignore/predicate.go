@@ -0,0 +1,130 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ignore
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A predicate is a condition on the attributes of a file that must hold, in
+// addition to the name matching, for a pattern to apply. Predicates are
+// written as prefixes to the pattern, i.e. "(?size>2GiB)*.iso" or
+// "(?age>1y)**".
+type predicate struct {
+	attr  string // "size" or "age"
+	less  bool   // the comparison is "<" rather than ">"
+	value int64  // bytes for size, seconds for age
+	text  string // the predicate as written, without the parentheses
+}
+
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	// Longer suffixes first, so that "KiB" isn't taken for "B".
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"k", 1 << 10}, {"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+var ageUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"s", 1}, {"m", 60}, {"h", 3600}, {"d", 86400}, {"w", 7 * 86400}, {"y", 365 * 86400},
+}
+
+// hasPredicatePrefix returns true if the line starts with something that
+// looks like a predicate.
+func hasPredicatePrefix(line string) bool {
+	return strings.HasPrefix(line, "(?size") || strings.HasPrefix(line, "(?age")
+}
+
+// parsePredicate parses the predicate at the start of the line and returns
+// it along with the remainder of the line.
+func parsePredicate(line string) (predicate, string, error) {
+	end := strings.Index(line, ")")
+	if end < 0 {
+		return predicate{}, "", fmt.Errorf("unterminated predicate in %q", line)
+	}
+	text := line[2:end]
+	rest := line[end+1:]
+
+	var p predicate
+	p.text = text
+
+	op := strings.IndexAny(text, "<>")
+	if op < 0 {
+		return p, "", fmt.Errorf("predicate %q lacks a comparison", text)
+	}
+	p.attr = text[:op]
+	p.less = text[op] == '<'
+	value := text[op+1:]
+
+	var err error
+	switch p.attr {
+	case "size":
+		p.value, err = parseUnits(value, sizeUnits)
+	case "age":
+		p.value, err = parseUnits(value, ageUnits)
+	default:
+		err = fmt.Errorf("unknown attribute %q", p.attr)
+	}
+	if err != nil {
+		return p, "", fmt.Errorf("predicate %q: %v", text, err)
+	}
+
+	return p, rest, nil
+}
+
+func parseUnits(s string, units []struct {
+	suffix string
+	mult   int64
+}) (int64, error) {
+	mult := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = s[:len(s)-len(unit.suffix)]
+			mult = unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return n * mult, nil
+}
+
+// match returns true if the predicate holds for the given file. Size
+// predicates hold only for regular files.
+func (p predicate) match(info os.FileInfo, now time.Time) bool {
+	var value int64
+	switch p.attr {
+	case "size":
+		if !info.Mode().IsRegular() {
+			return false
+		}
+		value = info.Size()
+	case "age":
+		value = int64(now.Sub(info.ModTime()) / time.Second)
+	}
+
+	if p.less {
+		return value < p.value
+	}
+	return value > p.value
+}
+
+func (p predicate) String() string {
+	return "(?" + p.text + ")"
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/syncthing/syncthing/lib/config"
+)
+
+// ErrNotMember is returned by Authenticate when the user may bind, but is
+// not a member of the required group.
+var ErrNotMember = errors.New("ldap: not a member of the required group")
+
+// Authenticate returns nil if the user may log in according to the directory:
+// binding as the user with the password succeeds and the user is a member of
+// the group, if one is required.
+func Authenticate(cfg config.LDAPConfiguration, username, password string) error {
+	dn := strings.Replace(cfg.BindDN, "%s", EscapeDN(username), -1)
+
+	var conn *Conn
+	var err error
+	if cfg.Transport == config.LDAPTransportTLS {
+		conn, err = DialTLS(cfg.Address, tlsConfig(cfg), cfg.Timeout())
+	} else {
+		conn, err = Dial(cfg.Address, cfg.Timeout())
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if cfg.Transport == config.LDAPTransportStartTLS {
+		if err := conn.StartTLS(tlsConfig(cfg)); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.Bind(dn, password); err != nil {
+		return err
+	}
+
+	if cfg.GroupDN != "" {
+		member, err := conn.Compare(cfg.GroupDN, cfg.GroupAttribute, dn)
+		if err != nil {
+			return err
+		}
+		if !member {
+			return ErrNotMember
+		}
+	}
+	return nil
+}
+
+// IsUnreachable returns true if the error from Authenticate means the server
+// could not be reached or did not answer properly, as opposed to answering
+// that the user may not log in.
+func IsUnreachable(err error) bool {
+	if err == nil || err == ErrNotMember {
+		return false
+	}
+	_, answered := err.(*Error)
+	return !answered
+}
+
+func tlsConfig(cfg config.LDAPConfiguration) *tls.Config {
+	host, _, err := net.SplitHostPort(cfg.Address)
+	if err != nil {
+		host = cfg.Address
+	}
+	return &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ldap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// LDAP messages are encoded with the ASN.1 basic encoding rules. The small
+// subset needed here is implemented directly, as encoding/asn1 only handles
+// DER and not the application specific tags LDAP uses.
+
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+	constructed      = 0x20
+
+	tagInteger     = classUniversal | 0x02
+	tagOctetString = classUniversal | 0x04
+	tagEnumerated  = classUniversal | 0x0a
+	tagSequence    = classUniversal | constructed | 0x10
+)
+
+// maxPacketSize limits what we read from the server, which only ever sends
+// short responses to what we ask.
+const maxPacketSize = 1 << 20
+
+var errMalformed = errors.New("ldap: malformed packet")
+
+// A packet is a BER encoded value. Constructed values have children, while
+// primitive ones have a value.
+type packet struct {
+	tag      byte // identifier octet; class, constructed bit and tag number
+	value    []byte
+	children []*packet
+}
+
+func newSequence(tag byte, children ...*packet) *packet {
+	return &packet{tag: tag | constructed, children: children}
+}
+
+func newString(tag byte, s string) *packet {
+	return &packet{tag: tag, value: []byte(s)}
+}
+
+func newInteger(tag byte, i int64) *packet {
+	// Two's complement, big endian, in as few bytes as possible.
+	var bs []byte
+	for {
+		bs = append([]byte{byte(i)}, bs...)
+		if (i < 0x80 && i >= -0x80) || len(bs) == 8 {
+			break
+		}
+		i >>= 8
+	}
+	return &packet{tag: tag, value: bs}
+}
+
+func (p *packet) isConstructed() bool {
+	return p.tag&constructed != 0
+}
+
+func (p *packet) integer() (int64, error) {
+	if len(p.value) == 0 || len(p.value) > 8 {
+		return 0, errMalformed
+	}
+	i := int64(int8(p.value[0]))
+	for _, b := range p.value[1:] {
+		i = i<<8 | int64(b)
+	}
+	return i, nil
+}
+
+func (p *packet) encode() []byte {
+	value := p.value
+	if p.isConstructed() {
+		value = nil
+		for _, c := range p.children {
+			value = append(value, c.encode()...)
+		}
+	}
+
+	bs := []byte{p.tag}
+	if l := len(value); l < 0x80 {
+		bs = append(bs, byte(l))
+	} else {
+		var lbs []byte
+		for ; l > 0; l >>= 8 {
+			lbs = append([]byte{byte(l)}, lbs...)
+		}
+		bs = append(bs, 0x80|byte(len(lbs)))
+		bs = append(bs, lbs...)
+	}
+	return append(bs, value...)
+}
+
+// readPacket reads one packet, and its children if it's constructed.
+func readPacket(r io.Reader) (*packet, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0]&0x1f == 0x1f {
+		// High tag numbers aren't used by LDAP.
+		return nil, errMalformed
+	}
+
+	l := int(hdr[1])
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 4 {
+			// Indefinite lengths aren't allowed in LDAP.
+			return nil, errMalformed
+		}
+		lbs := make([]byte, n)
+		if _, err := io.ReadFull(r, lbs); err != nil {
+			return nil, err
+		}
+		l = 0
+		for _, b := range lbs {
+			l = l<<8 | int(b)
+		}
+	}
+	if l > maxPacketSize {
+		return nil, errMalformed
+	}
+
+	value := make([]byte, l)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	return parsePacket(hdr[0], value)
+}
+
+func parsePacket(tag byte, value []byte) (*packet, error) {
+	p := &packet{tag: tag}
+	if !p.isConstructed() {
+		p.value = value
+		return p, nil
+	}
+
+	r := bytes.NewReader(value)
+	for r.Len() > 0 {
+		c, err := readPacket(r)
+		if err != nil {
+			return nil, errMalformed
+		}
+		p.children = append(p.children, c)
+	}
+	return p, nil
+}
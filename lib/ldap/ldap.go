@@ -0,0 +1,208 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package ldap implements the parts of an LDAP (RFC 4511) client needed to
+// authenticate users against a directory: simple binds, comparisons for
+// group membership and StartTLS.
+package ldap
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Protocol operations, as application tags.
+const (
+	opBindRequest      = classApplication | 0
+	opBindResponse     = classApplication | 1
+	opUnbindRequest    = classApplication | 2
+	opCompareRequest   = classApplication | 14
+	opCompareResponse  = classApplication | 15
+	opExtendedRequest  = classApplication | 23
+	opExtendedResponse = classApplication | 24
+)
+
+// Result codes
+const (
+	ResultSuccess            = 0
+	ResultCompareFalse       = 5
+	ResultCompareTrue        = 6
+	ResultNoSuchObject       = 32
+	ResultInvalidCredentials = 49
+)
+
+const oidStartTLS = "1.3.6.1.4.1.1466.20037"
+
+// An Error is a result other than success returned by the server.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ldap: result code %d", e.Code)
+	}
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// A Conn is a connection to an LDAP server. Each operation waits for its
+// response, so a Conn must not be used concurrently.
+type Conn struct {
+	conn    net.Conn
+	timeout time.Duration
+	msgID   int64
+}
+
+// Dial connects to the server at addr without TLS. The timeout applies to
+// connecting and to each operation.
+func Dial(addr string, timeout time.Duration) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn, timeout: timeout}, nil
+}
+
+// DialTLS connects to the server at addr using TLS from the start, as for
+// LDAPS.
+func DialTLS(addr string, cfg *tls.Config, timeout time.Duration) (*Conn, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn, timeout: timeout}, nil
+}
+
+// StartTLS upgrades the connection to TLS.
+func (c *Conn) StartTLS(cfg *tls.Config) error {
+	req := newSequence(opExtendedRequest,
+		newString(classContext|0, oidStartTLS),
+	)
+	if _, err := c.request(req, opExtendedResponse); err != nil {
+		return err
+	}
+
+	tc := tls.Client(c.conn, cfg)
+	tc.SetDeadline(time.Now().Add(c.timeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tc
+	return nil
+}
+
+// Bind authenticates as dn with the password. An empty password would be an
+// unauthenticated bind, which servers accept for any DN, so it is refused.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return &Error{Code: ResultInvalidCredentials, Message: "empty password"}
+	}
+	req := newSequence(opBindRequest,
+		newInteger(tagInteger, 3),
+		newString(tagOctetString, dn),
+		newString(classContext|0, password),
+	)
+	_, err := c.request(req, opBindResponse)
+	return err
+}
+
+// Compare returns true if the entry at dn has the attribute with the value.
+func (c *Conn) Compare(dn, attribute, value string) (bool, error) {
+	req := newSequence(opCompareRequest,
+		newString(tagOctetString, dn),
+		newSequence(tagSequence,
+			newString(tagOctetString, attribute),
+			newString(tagOctetString, value),
+		),
+	)
+	code, err := c.request(req, opCompareResponse)
+	switch {
+	case err != nil:
+		return false, err
+	case code == ResultCompareTrue:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	c.msgID++
+	msg := newSequence(tagSequence,
+		newInteger(tagInteger, c.msgID),
+		&packet{tag: opUnbindRequest},
+	)
+	c.conn.Write(msg.encode())
+	return c.conn.Close()
+}
+
+// request sends the operation and waits for the response, returning its
+// result code. Results other than success, or the outcome of a comparison,
+// are returned as an *Error.
+func (c *Conn) request(op *packet, responseTag byte) (int, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	c.msgID++
+	msg := newSequence(tagSequence, newInteger(tagInteger, c.msgID), op)
+	if _, err := c.conn.Write(msg.encode()); err != nil {
+		return 0, err
+	}
+
+	resp, err := readPacket(c.conn)
+	if err != nil {
+		return 0, err
+	}
+	if resp.tag != tagSequence || len(resp.children) < 2 {
+		return 0, errMalformed
+	}
+	if id, err := resp.children[0].integer(); err != nil {
+		return 0, err
+	} else if id != c.msgID {
+		// Either a response to something else, or a notice of
+		// disconnection (with ID zero) that we can't do anything about.
+		return 0, fmt.Errorf("ldap: unexpected response to message %d", id)
+	}
+
+	res := resp.children[1]
+	if res.tag != responseTag|constructed || len(res.children) < 3 || res.children[0].tag != tagEnumerated {
+		return 0, errMalformed
+	}
+	code, err := res.children[0].integer()
+	if err != nil {
+		return 0, err
+	}
+	switch code {
+	case ResultSuccess, ResultCompareTrue, ResultCompareFalse:
+		return int(code), nil
+	default:
+		return int(code), &Error{Code: int(code), Message: string(res.children[2].value)}
+	}
+}
+
+// EscapeDN escapes a value for use in a distinguished name (RFC 4514).
+func EscapeDN(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(s)-1 && c == ' ':
+			b = append(b, '\\', c)
+		case c == 0:
+			b = append(b, `\00`...)
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,280 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ldap
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/tlsutil"
+)
+
+// A fakeServer is a directory with some users and groups, that answers the
+// operations used by the client.
+type fakeServer struct {
+	listener  net.Listener
+	tlsCfg    *tls.Config         // for StartTLS
+	passwords map[string]string   // user DN -> password
+	members   map[string][]string // group DN -> member DNs
+	silent    bool                // accept connections but never answer
+}
+
+func newFakeServer(t *testing.T, tlsCfg *tls.Config, ldaps bool) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldaps {
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+	s := &fakeServer{
+		listener: listener,
+		tlsCfg:   tlsCfg,
+		passwords: map[string]string{
+			"uid=alice,ou=people,dc=example,dc=com": "alicepw",
+			"uid=bob,ou=people,dc=example,dc=com":   "bobpw",
+		},
+		members: map[string][]string{
+			"cn=syncthing,ou=groups,dc=example,dc=com": {"uid=alice,ou=people,dc=example,dc=com"},
+		},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+	}()
+	for {
+		msg, err := readPacket(conn)
+		if err != nil || s.silent {
+			return
+		}
+		id, _ := msg.children[0].integer()
+		op := msg.children[1]
+
+		switch op.tag &^ constructed {
+		case opBindRequest:
+			dn, password := string(op.children[1].value), string(op.children[2].value)
+			if pw, ok := s.passwords[dn]; ok && pw == password {
+				s.respond(conn, id, opBindResponse, ResultSuccess)
+			} else {
+				s.respond(conn, id, opBindResponse, ResultInvalidCredentials)
+			}
+
+		case opCompareRequest:
+			dn := string(op.children[0].value)
+			value := string(op.children[1].children[1].value)
+			members, ok := s.members[dn]
+			code := ResultCompareFalse
+			if !ok {
+				code = ResultNoSuchObject
+			}
+			for _, m := range members {
+				if m == value {
+					code = ResultCompareTrue
+				}
+			}
+			s.respond(conn, id, opCompareResponse, code)
+
+		case opExtendedRequest:
+			s.respond(conn, id, opExtendedResponse, ResultSuccess)
+			tc := tls.Server(conn, s.tlsCfg)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn = tc
+
+		case opUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *fakeServer) respond(conn net.Conn, id int64, tag byte, code int) {
+	msg := newSequence(tagSequence,
+		newInteger(tagInteger, id),
+		newSequence(tag,
+			newInteger(tagEnumerated, int64(code)),
+			newString(tagOctetString, ""),
+			newString(tagOctetString, ""),
+		),
+	)
+	conn.Write(msg.encode())
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, err := tlsutil.NewCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), "ldap.example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tlsCfg := testTLSConfig(t)
+
+	for _, transport := range []config.LDAPTransport{config.LDAPTransportPlain, config.LDAPTransportTLS, config.LDAPTransportStartTLS} {
+		srv := newFakeServer(t, tlsCfg, transport == config.LDAPTransportTLS)
+		cfg := config.LDAPConfiguration{
+			Address:            srv.listener.Addr().String(),
+			Transport:          transport,
+			InsecureSkipVerify: true,
+			BindDN:             "uid=%s,ou=people,dc=example,dc=com",
+			GroupAttribute:     "member",
+			TimeoutS:           1,
+		}
+
+		cases := []struct {
+			username string
+			password string
+			groupDN  string
+			err      error
+		}{
+			{"alice", "alicepw", "", nil},
+			{"bob", "bobpw", "", nil},
+			{"alice", "alicepw", "cn=syncthing,ou=groups,dc=example,dc=com", nil},
+			{"bob", "bobpw", "cn=syncthing,ou=groups,dc=example,dc=com", ErrNotMember},
+			{"bob", "alicepw", "", &Error{Code: ResultInvalidCredentials}},
+			{"bob", "", "", &Error{Code: ResultInvalidCredentials}},
+			{"nobody", "x", "", &Error{Code: ResultInvalidCredentials}},
+			{"alice,ou=people", "alicepw", "", &Error{Code: ResultInvalidCredentials}},
+			{"alice", "alicepw", "cn=nonexistent", &Error{Code: ResultNoSuchObject}},
+		}
+		for _, tc := range cases {
+			cfg.GroupDN = tc.groupDN
+			err := Authenticate(cfg, tc.username, tc.password)
+			if e, ok := err.(*Error); ok {
+				err = &Error{Code: e.Code}
+				if exp, ok := tc.err.(*Error); !ok || exp.Code != e.Code {
+					t.Errorf("%v: unexpected error %v for %q in %q, expected %v", transport, err, tc.username, tc.groupDN, tc.err)
+				}
+			} else if err != tc.err {
+				t.Errorf("%v: unexpected error %v for %q in %q, expected %v", transport, err, tc.username, tc.groupDN, tc.err)
+			}
+			if IsUnreachable(err) {
+				t.Errorf("%v: error %v should not mean unreachable", transport, err)
+			}
+		}
+
+		srv.listener.Close()
+	}
+}
+
+func TestAuthenticateUnreachable(t *testing.T) {
+	tlsCfg := testTLSConfig(t)
+	cfg := config.LDAPConfiguration{
+		BindDN:   "uid=%s,ou=people,dc=example,dc=com",
+		TimeoutS: 1,
+	}
+
+	// Nothing listening
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Address = listener.Addr().String()
+	listener.Close()
+	if err := Authenticate(cfg, "alice", "alicepw"); !IsUnreachable(err) {
+		t.Errorf("Unexpected error %v for closed port", err)
+	}
+
+	// A server that doesn't answer
+
+	srv := newFakeServer(t, tlsCfg, false)
+	defer srv.listener.Close()
+	srv.silent = true
+	cfg.Address = srv.listener.Addr().String()
+	t0 := time.Now()
+	if err := Authenticate(cfg, "alice", "alicepw"); !IsUnreachable(err) {
+		t.Errorf("Unexpected error %v for silent server", err)
+	}
+	if d := time.Since(t0); d > 3*time.Second {
+		t.Errorf("Timeout not respected, took %v", d)
+	}
+
+	// A certificate that can't be verified
+
+	srv = newFakeServer(t, tlsCfg, true)
+	defer srv.listener.Close()
+	cfg.Address = srv.listener.Addr().String()
+	cfg.Transport = config.LDAPTransportTLS
+	if err := Authenticate(cfg, "alice", "alicepw"); !IsUnreachable(err) {
+		t.Errorf("Unexpected error %v for unverified certificate", err)
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	cases := [][2]string{
+		{"alice", "alice"},
+		{"alice,ou=admins", `alice\,ou\=admins`},
+		{" #x ", `\ #x\ `},
+		{"#x", `\#x`},
+		{`a+b"c\d<e>f;g`, `a\+b\"c\\d\<e\>f\;g`},
+		{"a\x00b", `a\00b`},
+	}
+	for _, tc := range cases {
+		if res := EscapeDN(tc[0]); res != tc[1] {
+			t.Errorf("EscapeDN(%q) = %q, expected %q", tc[0], res, tc[1])
+		}
+	}
+}
+
+func TestBERRoundTrip(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	p := newSequence(tagSequence,
+		newInteger(tagInteger, 0),
+		newInteger(tagInteger, 127),
+		newInteger(tagInteger, 128),
+		newInteger(tagInteger, -129),
+		newInteger(tagInteger, 1<<40),
+		newString(tagOctetString, long),
+	)
+	q, err := readPacket(bytes.NewReader(p.encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.children) != 6 {
+		t.Fatalf("Unexpected children %d", len(q.children))
+	}
+	for i, exp := range []int64{0, 127, 128, -129, 1 << 40} {
+		if v, err := q.children[i].integer(); err != nil || v != exp {
+			t.Errorf("Integer %d decoded as %d, %v", exp, v, err)
+		}
+	}
+	if string(q.children[5].value) != long {
+		t.Error("Long string not decoded")
+	}
+
+	if _, err := readPacket(bytes.NewReader([]byte{0x30, 0x84, 0xff, 0xff, 0xff, 0xff})); err == nil {
+		t.Error("Oversized packet should be rejected")
+	}
+}
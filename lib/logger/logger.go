@@ -5,7 +5,9 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -28,13 +30,84 @@ const (
 	NumLevels
 )
 
+// DefaultLevel is the minimum level logged by facilities, unless changed by
+// SetLevel or SetDebug.
+const DefaultLevel = LevelVerbose
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelVerbose:
+		return "verbose"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warning"
+	case LevelFatal:
+		return "fatal"
+	default:
+		return "unknown"
+	}
+}
+
+func (l LogLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *LogLevel) UnmarshalText(bs []byte) error {
+	switch string(bs) {
+	case "debug":
+		*l = LevelDebug
+	case "verbose":
+		*l = LevelVerbose
+	case "info":
+		*l = LevelInfo
+	case "warning":
+		*l = LevelWarn
+	case "fatal":
+		*l = LevelFatal
+	default:
+		return fmt.Errorf("unknown log level %q", bs)
+	}
+	return nil
+}
+
+// A Format is how log lines are written to the output.
+type Format int
+
+const (
+	FormatText Format = iota // default is text; "15:04:05 INFO: message"
+	FormatJSON               // a JSON object per line, as written by NewJSONHandler
+)
+
+// Fields are structured data about a log message, such as the folder or
+// device it concerns. They are given to entry handlers and included in JSON
+// output, but not in text output where the message says it all.
+type Fields map[string]interface{}
+
+// An Entry is a log message with its context.
+type Entry struct {
+	When     time.Time
+	Level    LogLevel
+	Facility string // empty for the default logger
+	Fields   Fields
+	Message  string
+}
+
 // A MessageHandler is called with the log level and message text.
 type MessageHandler func(l LogLevel, msg string)
 
+// An EntryHandler is called with each log entry.
+type EntryHandler func(e Entry)
+
 type Logger interface {
 	AddHandler(level LogLevel, h MessageHandler)
+	AddEntryHandler(level LogLevel, h EntryHandler)
 	SetFlags(flag int)
 	SetPrefix(prefix string)
+	SetFormat(format Format)
+	With(fields Fields) Logger
 	Debugln(vals ...interface{})
 	Debugf(format string, vals ...interface{})
 	Verboseln(vals ...interface{})
@@ -47,17 +120,22 @@ type Logger interface {
 	Fatalf(format string, vals ...interface{})
 	ShouldDebug(facility string) bool
 	SetDebug(facility string, enabled bool)
+	Level(facility string) LogLevel
+	SetLevel(facility string, level LogLevel)
 	Facilities() map[string]string
 	FacilityDebugging() []string
 	NewFacility(facility, description string) Logger
 }
 
 type logger struct {
-	logger     *log.Logger
-	handlers   [NumLevels][]MessageHandler
-	facilities map[string]string // facility name => description
-	debug      map[string]bool   // facility name => debugging enabled
-	mut        sync.Mutex
+	logger        *log.Logger
+	out           io.Writer
+	json          EntryHandler // writes to out, when the format is JSON
+	handlers      [NumLevels][]MessageHandler
+	entryHandlers [NumLevels][]EntryHandler
+	facilities    map[string]string   // facility name => description
+	levels        map[string]LogLevel // facility name => minimum level logged
+	mut           sync.Mutex
 }
 
 // DefaultLogger logs to standard output with a time prefix.
@@ -68,11 +146,13 @@ func New() Logger {
 		// Hack to completely disable logging, for example when running benchmarks.
 		return &logger{
 			logger: log.New(ioutil.Discard, "", 0),
+			out:    ioutil.Discard,
 		}
 	}
 
 	return &logger{
 		logger: log.New(os.Stdout, "", log.Ltime),
+		out:    os.Stdout,
 	}
 }
 
@@ -84,6 +164,14 @@ func (l *logger) AddHandler(level LogLevel, h MessageHandler) {
 	l.handlers[level] = append(l.handlers[level], h)
 }
 
+// AddEntryHandler registers a new EntryHandler to receive entries with the
+// specified log level or above.
+func (l *logger) AddEntryHandler(level LogLevel, h EntryHandler) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.entryHandlers[level] = append(l.entryHandlers[level], h)
+}
+
 // See log.SetFlags
 func (l *logger) SetFlags(flag int) {
 	l.logger.SetFlags(flag)
@@ -94,127 +182,168 @@ func (l *logger) SetPrefix(prefix string) {
 	l.logger.SetPrefix(prefix)
 }
 
-func (l *logger) callHandlers(level LogLevel, s string) {
+// SetFormat sets the format of the lines written to the output. The flags
+// and prefix only apply to text.
+func (l *logger) SetFormat(format Format) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if format == FormatJSON {
+		l.json = NewJSONHandler(l.out)
+	} else {
+		l.json = nil
+	}
+}
+
+// With returns a logger that adds the fields to the messages logged.
+func (l *logger) With(fields Fields) Logger {
+	return &facilityLogger{
+		logger: l,
+		fields: fields,
+	}
+}
+
+// output writes the message and calls the handlers, unless the level is
+// below the minimum for the facility. It must be called directly by the
+// method logging the message, for the file name and line number to be right.
+func (l *logger) output(level LogLevel, facility string, fields Fields, s string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if facility != "" && level != LevelFatal && level < l.levelLocked(facility) {
+		return
+	}
+
+	msg := strings.TrimSpace(s)
+	e := Entry{
+		When:     time.Now(),
+		Level:    level,
+		Facility: facility,
+		Fields:   fields,
+		Message:  msg,
+	}
+
+	if l.json != nil {
+		l.json(e)
+	} else {
+		l.logger.Output(3, levelPrefixes[level]+s)
+	}
+
 	for ll := LevelDebug; ll <= level; ll++ {
 		for _, h := range l.handlers[ll] {
-			h(level, strings.TrimSpace(s))
+			h(level, msg)
+		}
+		for _, h := range l.entryHandlers[ll] {
+			h(e)
 		}
 	}
 }
 
+var levelPrefixes = [NumLevels]string{
+	LevelDebug:   "DEBUG: ",
+	LevelVerbose: "VERBOSE: ",
+	LevelInfo:    "INFO: ",
+	LevelWarn:    "WARNING: ",
+	LevelFatal:   "FATAL: ",
+}
+
 // Debugln logs a line with a DEBUG prefix.
 func (l *logger) Debugln(vals ...interface{}) {
-	l.debugln(3, vals)
-}
-func (l *logger) debugln(level int, vals ...interface{}) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	s := fmt.Sprintln(vals...)
-	l.logger.Output(level, "DEBUG: "+s)
-	l.callHandlers(LevelDebug, s)
+	l.output(LevelDebug, "", nil, fmt.Sprintln(vals...))
 }
 
 // Debugf logs a formatted line with a DEBUG prefix.
 func (l *logger) Debugf(format string, vals ...interface{}) {
-	l.debugf(3, format, vals...)
-}
-func (l *logger) debugf(level int, format string, vals ...interface{}) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	s := fmt.Sprintf(format, vals...)
-	l.logger.Output(level, "DEBUG: "+s)
-	l.callHandlers(LevelDebug, s)
+	l.output(LevelDebug, "", nil, fmt.Sprintf(format, vals...))
 }
 
 // Infoln logs a line with a VERBOSE prefix.
 func (l *logger) Verboseln(vals ...interface{}) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	s := fmt.Sprintln(vals...)
-	l.logger.Output(2, "VERBOSE: "+s)
-	l.callHandlers(LevelVerbose, s)
+	l.output(LevelVerbose, "", nil, fmt.Sprintln(vals...))
 }
 
 // Infof logs a formatted line with a VERBOSE prefix.
 func (l *logger) Verbosef(format string, vals ...interface{}) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	s := fmt.Sprintf(format, vals...)
-	l.logger.Output(2, "VERBOSE: "+s)
-	l.callHandlers(LevelVerbose, s)
+	l.output(LevelVerbose, "", nil, fmt.Sprintf(format, vals...))
 }
 
 // Infoln logs a line with an INFO prefix.
 func (l *logger) Infoln(vals ...interface{}) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	s := fmt.Sprintln(vals...)
-	l.logger.Output(2, "INFO: "+s)
-	l.callHandlers(LevelInfo, s)
+	l.output(LevelInfo, "", nil, fmt.Sprintln(vals...))
 }
 
 // Infof logs a formatted line with an INFO prefix.
 func (l *logger) Infof(format string, vals ...interface{}) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	s := fmt.Sprintf(format, vals...)
-	l.logger.Output(2, "INFO: "+s)
-	l.callHandlers(LevelInfo, s)
+	l.output(LevelInfo, "", nil, fmt.Sprintf(format, vals...))
 }
 
 // Warnln logs a formatted line with a WARNING prefix.
 func (l *logger) Warnln(vals ...interface{}) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	s := fmt.Sprintln(vals...)
-	l.logger.Output(2, "WARNING: "+s)
-	l.callHandlers(LevelWarn, s)
+	l.output(LevelWarn, "", nil, fmt.Sprintln(vals...))
 }
 
 // Warnf logs a formatted line with a WARNING prefix.
 func (l *logger) Warnf(format string, vals ...interface{}) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	s := fmt.Sprintf(format, vals...)
-	l.logger.Output(2, "WARNING: "+s)
-	l.callHandlers(LevelWarn, s)
+	l.output(LevelWarn, "", nil, fmt.Sprintf(format, vals...))
 }
 
 // Fatalln logs a line with a FATAL prefix and exits the process with exit
 // code 1.
 func (l *logger) Fatalln(vals ...interface{}) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	s := fmt.Sprintln(vals...)
-	l.logger.Output(2, "FATAL: "+s)
-	l.callHandlers(LevelFatal, s)
+	l.output(LevelFatal, "", nil, fmt.Sprintln(vals...))
 	os.Exit(1)
 }
 
 // Fatalf logs a formatted line with a FATAL prefix and exits the process with
 // exit code 1.
 func (l *logger) Fatalf(format string, vals ...interface{}) {
-	l.mut.Lock()
-	defer l.mut.Unlock()
-	s := fmt.Sprintf(format, vals...)
-	l.logger.Output(2, "FATAL: "+s)
-	l.callHandlers(LevelFatal, s)
+	l.output(LevelFatal, "", nil, fmt.Sprintf(format, vals...))
 	os.Exit(1)
 }
 
 // ShouldDebug returns true if the given facility has debugging enabled.
 func (l *logger) ShouldDebug(facility string) bool {
-	l.mut.Lock()
-	res := l.debug[facility]
-	l.mut.Unlock()
-	return res
+	return l.Level(facility) == LevelDebug
 }
 
 // SetDebug enabled or disables debugging for the given facility name.
+// Disabling debugging returns the facility to the default level.
 func (l *logger) SetDebug(facility string, enabled bool) {
 	l.mut.Lock()
-	l.debug[facility] = enabled
-	l.mut.Unlock()
+	defer l.mut.Unlock()
+	if enabled {
+		l.setLevelLocked(facility, LevelDebug)
+	} else if l.levelLocked(facility) == LevelDebug {
+		l.setLevelLocked(facility, DefaultLevel)
+	}
+}
+
+// Level returns the minimum level logged for the given facility.
+func (l *logger) Level(facility string) LogLevel {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.levelLocked(facility)
+}
+
+// SetLevel sets the minimum level logged for the given facility. Fatal
+// messages are always logged.
+func (l *logger) SetLevel(facility string, level LogLevel) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.setLevelLocked(facility, level)
+}
+
+func (l *logger) levelLocked(facility string) LogLevel {
+	if level, ok := l.levels[facility]; ok {
+		return level
+	}
+	return DefaultLevel
+}
+
+func (l *logger) setLevelLocked(facility string, level LogLevel) {
+	if l.levels == nil {
+		l.levels = make(map[string]LogLevel)
+	}
+	l.levels[facility] = level
 }
 
 // FacilityDebugging returns the set of facilities that have debugging
@@ -222,8 +351,8 @@ func (l *logger) SetDebug(facility string, enabled bool) {
 func (l *logger) FacilityDebugging() []string {
 	var enabled []string
 	l.mut.Lock()
-	for facility, isEnabled := range l.debug {
-		if isEnabled {
+	for facility, level := range l.levels {
+		if level == LevelDebug {
 			enabled = append(enabled, facility)
 		}
 	}
@@ -252,11 +381,7 @@ func (l *logger) NewFacility(facility, description string) Logger {
 	if description != "" {
 		l.facilities[facility] = description
 	}
-
-	if l.debug == nil {
-		l.debug = make(map[string]bool)
-	}
-	l.debug[facility] = false
+	l.setLevelLocked(facility, DefaultLevel)
 	l.mut.Unlock()
 
 	return &facilityLogger{
@@ -265,28 +390,153 @@ func (l *logger) NewFacility(facility, description string) Logger {
 	}
 }
 
-// A facilityLogger is a regular logger but bound to a facility name. The
-// Debugln and Debugf methods are no-ops unless debugging has been enabled for
-// this facility on the parent logger.
+// A facilityLogger is a regular logger but bound to a facility name, and
+// possibly some fields. Messages below the minimum level for the facility
+// on the parent logger are dropped, so that the Debugln and Debugf methods
+// are no-ops unless debugging has been enabled for this facility.
 type facilityLogger struct {
 	*logger
 	facility string
+	fields   Fields
+}
+
+// With returns a logger that adds the fields to the messages logged, in
+// addition to those already added by this logger.
+func (l *facilityLogger) With(fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &facilityLogger{
+		logger:   l.logger,
+		facility: l.facility,
+		fields:   merged,
+	}
+}
+
+// shouldLog returns whether messages at the given level are logged for the
+// facility. It is checked before formatting, so that disabled messages cost
+// next to nothing and don't read the state of their arguments.
+func (l *facilityLogger) shouldLog(level LogLevel) bool {
+	return level >= l.Level(l.facility)
 }
 
 // Debugln logs a line with a DEBUG prefix.
 func (l *facilityLogger) Debugln(vals ...interface{}) {
-	if !l.ShouldDebug(l.facility) {
+	if !l.shouldLog(LevelDebug) {
 		return
 	}
-	l.logger.debugln(3, vals...)
+	l.output(LevelDebug, l.facility, l.fields, fmt.Sprintln(vals...))
 }
 
 // Debugf logs a formatted line with a DEBUG prefix.
 func (l *facilityLogger) Debugf(format string, vals ...interface{}) {
-	if !l.ShouldDebug(l.facility) {
+	if !l.shouldLog(LevelDebug) {
+		return
+	}
+	l.output(LevelDebug, l.facility, l.fields, fmt.Sprintf(format, vals...))
+}
+
+// Verboseln logs a line with a VERBOSE prefix.
+func (l *facilityLogger) Verboseln(vals ...interface{}) {
+	if !l.shouldLog(LevelVerbose) {
 		return
 	}
-	l.logger.debugf(3, format, vals...)
+	l.output(LevelVerbose, l.facility, l.fields, fmt.Sprintln(vals...))
+}
+
+// Verbosef logs a formatted line with a VERBOSE prefix.
+func (l *facilityLogger) Verbosef(format string, vals ...interface{}) {
+	if !l.shouldLog(LevelVerbose) {
+		return
+	}
+	l.output(LevelVerbose, l.facility, l.fields, fmt.Sprintf(format, vals...))
+}
+
+// Infoln logs a line with an INFO prefix.
+func (l *facilityLogger) Infoln(vals ...interface{}) {
+	if !l.shouldLog(LevelInfo) {
+		return
+	}
+	l.output(LevelInfo, l.facility, l.fields, fmt.Sprintln(vals...))
+}
+
+// Infof logs a formatted line with an INFO prefix.
+func (l *facilityLogger) Infof(format string, vals ...interface{}) {
+	if !l.shouldLog(LevelInfo) {
+		return
+	}
+	l.output(LevelInfo, l.facility, l.fields, fmt.Sprintf(format, vals...))
+}
+
+// Warnln logs a line with a WARNING prefix.
+func (l *facilityLogger) Warnln(vals ...interface{}) {
+	if !l.shouldLog(LevelWarn) {
+		return
+	}
+	l.output(LevelWarn, l.facility, l.fields, fmt.Sprintln(vals...))
+}
+
+// Warnf logs a formatted line with a WARNING prefix.
+func (l *facilityLogger) Warnf(format string, vals ...interface{}) {
+	if !l.shouldLog(LevelWarn) {
+		return
+	}
+	l.output(LevelWarn, l.facility, l.fields, fmt.Sprintf(format, vals...))
+}
+
+// Fatalln logs a line with a FATAL prefix and exits the process with exit
+// code 1.
+func (l *facilityLogger) Fatalln(vals ...interface{}) {
+	l.output(LevelFatal, l.facility, l.fields, fmt.Sprintln(vals...))
+	os.Exit(1)
+}
+
+// Fatalf logs a formatted line with a FATAL prefix and exits the process with
+// exit code 1.
+func (l *facilityLogger) Fatalf(format string, vals ...interface{}) {
+	l.output(LevelFatal, l.facility, l.fields, fmt.Sprintf(format, vals...))
+	os.Exit(1)
+}
+
+// NewJSONHandler returns an EntryHandler that writes each entry to w as a
+// line of JSON, with the time, level, facility, message and fields:
+//
+//	{"time":"2016-10-18T14:02:28.123+02:00","level":"info","facility":"model","message":"Ready to synchronize default (readwrite)","folder":"default"}
+//
+// The fields can't replace the other values.
+func NewJSONHandler(w io.Writer) EntryHandler {
+	return func(e Entry) {
+		bs, err := json.Marshal(jsonObject(e, false))
+		if err != nil {
+			// One of the fields can't be marshalled; use the string
+			// representation of the fields instead.
+			bs, _ = json.Marshal(jsonObject(e, true))
+		}
+		w.Write(append(bs, '\n'))
+	}
+}
+
+func jsonObject(e Entry, stringFields bool) map[string]interface{} {
+	obj := make(map[string]interface{}, len(e.Fields)+4)
+	for k, v := range e.Fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		} else if stringFields {
+			v = fmt.Sprint(v)
+		}
+		obj[k] = v
+	}
+	obj["time"] = e.When.Format(time.RFC3339Nano)
+	obj["level"] = e.Level
+	if e.Facility != "" {
+		obj["facility"] = e.Facility
+	}
+	obj["message"] = e.Message
+	return obj
 }
 
 // A Recorder keeps a size limited record of log events.
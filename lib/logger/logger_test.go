@@ -4,7 +4,11 @@
 package logger
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"strings"
 	"testing"
 	"time"
@@ -131,3 +135,117 @@ func TestRecorder(t *testing.T) {
 	}
 
 }
+
+func TestFacilityLevels(t *testing.T) {
+	l := New()
+	l.SetFlags(0)
+
+	var msgs []string
+	l.AddHandler(LevelDebug, func(l LogLevel, msg string) {
+		msgs = append(msgs, msg)
+	})
+
+	f0 := l.NewFacility("f0", "foo#0")
+	if lvl := l.Level("f0"); lvl != DefaultLevel {
+		t.Errorf("Incorrect default level %v", lvl)
+	}
+
+	l.SetLevel("f0", LevelWarn)
+	f0.Infoln("info")
+	f0.Warnln("warning")
+	l.Infoln("info from the default logger")
+
+	l.SetDebug("f0", true)
+	if !l.ShouldDebug("f0") || l.Level("f0") != LevelDebug {
+		t.Error("Debugging should be enabled")
+	}
+	f0.Debugln("debug")
+
+	// Disabling debugging goes back to the default, not the level before.
+	l.SetDebug("f0", false)
+	f0.Debugln("debug again")
+	f0.Verboseln("verbose")
+
+	expected := []string{"warning", "info from the default logger", "debug", "verbose"}
+	if fmt.Sprint(msgs) != fmt.Sprint(expected) {
+		t.Errorf("Incorrect messages %q != %q", msgs, expected)
+	}
+
+	var lvl LogLevel
+	if err := lvl.UnmarshalText([]byte("warning")); err != nil || lvl != LevelWarn {
+		t.Errorf("Incorrect level %v, %v", lvl, err)
+	}
+	if err := lvl.UnmarshalText([]byte("loud")); err == nil {
+		t.Error("Unknown level should be an error")
+	}
+}
+
+func TestFields(t *testing.T) {
+	l := New()
+	l.SetFlags(0)
+
+	var entries []Entry
+	l.AddEntryHandler(LevelInfo, func(e Entry) {
+		entries = append(entries, e)
+	})
+
+	f0 := l.NewFacility("f0", "foo#0")
+	fl := f0.With(Fields{"folder": "default"}).With(Fields{"device": "ABC"})
+	fl.Infoln("with fields")
+	f0.Infoln("without fields")
+	f0.Debugln("not logged")
+
+	if len(entries) != 2 {
+		t.Fatalf("Incorrect number of entries, %d != 2", len(entries))
+	}
+	e := entries[0]
+	if e.Facility != "f0" || e.Level != LevelInfo || e.Message != "with fields" || e.Fields["folder"] != "default" || e.Fields["device"] != "ABC" {
+		t.Errorf("Incorrect entry %+v", e)
+	}
+	if len(entries[1].Fields) != 0 {
+		t.Errorf("Fields leaked to the facility logger: %v", entries[1].Fields)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := &logger{
+		logger: log.New(buf, "", 0),
+		out:    buf,
+	}
+	f0 := l.NewFacility("f0", "foo#0")
+
+	f0.Infoln("text")
+	if buf.String() != "INFO: text\n" {
+		t.Errorf("Incorrect text output %q", buf.String())
+	}
+	buf.Reset()
+
+	l.SetFormat(FormatJSON)
+	f0.With(Fields{"folder": "default", "err": errors.New("oops"), "message": "not this"}).Warnf("json %d", 1)
+	f0.With(Fields{"fn": func() {}}).Infoln("unmarshallable")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Incorrect number of lines %d: %s", len(lines), buf)
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(lines[0], &obj); err != nil {
+		t.Fatal(err)
+	}
+	if obj["level"] != "warning" || obj["facility"] != "f0" || obj["message"] != "json 1" || obj["folder"] != "default" || obj["err"] != "oops" {
+		t.Errorf("Incorrect JSON %s", lines[0])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, obj["time"].(string)); err != nil {
+		t.Errorf("Incorrect time in %s: %v", lines[0], err)
+	}
+
+	obj = nil
+	if err := json.Unmarshal(lines[1], &obj); err != nil {
+		t.Fatal(err)
+	}
+	if obj["message"] != "unmarshallable" || obj["fn"] == nil {
+		t.Errorf("Incorrect JSON %s", lines[1])
+	}
+}
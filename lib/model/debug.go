@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/syncthing/syncthing/lib/logger"
+	"github.com/syncthing/syncthing/lib/protocol"
 )
 
 var (
@@ -24,3 +25,14 @@ func init() {
 func shouldDebug() bool {
 	return l.ShouldDebug("model")
 }
+
+// folderLogger returns a logger for messages concerning the folder, which
+// are marked as such in structured output.
+func folderLogger(folder string) logger.Logger {
+	return l.With(logger.Fields{"folder": folder})
+}
+
+// deviceLogger returns a logger for messages concerning the device.
+func deviceLogger(device protocol.DeviceID) logger.Logger {
+	return l.With(logger.Fields{"device": device.String()})
+}
@@ -8,6 +8,7 @@ package model
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -19,6 +20,7 @@ import (
 	"reflect"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	stdsync "sync"
 	"time"
@@ -46,6 +48,10 @@ const (
 	indexBatchSize    = 1000       // Either way, don't include more files than this
 )
 
+// The Index/IndexUpdate option marking the end of a round of index updates.
+// Its value is the highest local version the receiver now has complete.
+const indexOptionMaxLocalVersion = "maxLocalVersion"
+
 type service interface {
 	Serve()
 	Stop()
@@ -91,6 +97,8 @@ type Model struct {
 	folderRunners      map[string]service                                     // folder -> puller or scanner
 	folderRunnerTokens map[string][]suture.ServiceToken                       // folder -> tokens for puller or scanner
 	folderStatRefs     map[string]*stats.FolderStatisticsReference            // folder -> statsRef
+	folderFetched      map[string][]string                                    // folder -> one-off fetches not yet pulled
+	history            *stats.History                                         // transfer and scan history
 	fmut               sync.RWMutex                                           // protects the above
 
 	conn              map[protocol.DeviceID]connections.Connection
@@ -98,7 +106,14 @@ type Model struct {
 	deviceClusterConf map[protocol.DeviceID]protocol.ClusterConfigMessage
 	devicePaused      map[protocol.DeviceID]bool
 	deviceDownloads   map[protocol.DeviceID]*deviceDownloadState
-	pmut              sync.RWMutex // protects the above
+	idTransition      []protocol.Option // announced device ID transition, if any
+	pmut              sync.RWMutex      // protects the above
+
+	folderSchedules map[string]config.ParsedSchedule            // folder -> schedule
+	deviceSchedules map[protocol.DeviceID]config.ParsedSchedule // deviceID -> schedule
+	smut            sync.RWMutex                                // protects the above
+
+	scheduleLimiter *scheduleLimiter
 }
 
 type folderFactory func(*Model, config.FolderConfiguration, versioner.Versioner) service
@@ -108,6 +123,11 @@ var (
 	folderFactories = make(map[config.FolderType]folderFactory, 0)
 )
 
+var (
+	errDeviceIDUnknown = errors.New("device ID transition from an unknown device")
+	errDeviceIDInUse   = errors.New("device ID transition to a device ID already in use")
+)
+
 // NewModel creates and starts a new model. The model starts in read-only mode,
 // where it sends index information to connected peers and responds to requests
 // for file data without altering the local folder in any way.
@@ -138,17 +158,24 @@ func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName,
 		folderRunners:      make(map[string]service),
 		folderRunnerTokens: make(map[string][]suture.ServiceToken),
 		folderStatRefs:     make(map[string]*stats.FolderStatisticsReference),
+		folderFetched:      make(map[string][]string),
+		history:            stats.NewHistory(ldb),
 		conn:               make(map[protocol.DeviceID]connections.Connection),
 		helloMessages:      make(map[protocol.DeviceID]protocol.HelloMessage),
 		deviceClusterConf:  make(map[protocol.DeviceID]protocol.ClusterConfigMessage),
 		devicePaused:       make(map[protocol.DeviceID]bool),
 		deviceDownloads:    make(map[protocol.DeviceID]*deviceDownloadState),
+		folderSchedules:    make(map[string]config.ParsedSchedule),
+		scheduleLimiter:    newScheduleLimiter(),
 		fmut:               sync.NewRWMutex(),
 		pmut:               sync.NewRWMutex(),
+		smut:               sync.NewRWMutex(),
 	}
+	m.setDeviceSchedules(cfg.Raw().Devices)
 	if cfg.Options().ProgressUpdateIntervalS > -1 {
 		go m.progressEmitter.Serve()
 	}
+	m.Add(m.history)
 
 	return m
 }
@@ -206,7 +233,7 @@ func (m *Model) StartFolder(folder string) {
 	m.folderRunnerTokens[folder] = append(m.folderRunnerTokens[folder], token)
 	m.fmut.Unlock()
 
-	l.Infoln("Ready to synchronize", folder, fmt.Sprintf("(%s)", cfg.Type))
+	folderLogger(folder).Infoln("Ready to synchronize", folder, fmt.Sprintf("(%s)", cfg.Type))
 }
 
 func (m *Model) warnAboutOverwritingProtectedFiles(folder string) {
@@ -261,6 +288,7 @@ func (m *Model) RemoveFolder(folder string) {
 	delete(m.folderRunners, folder)
 	delete(m.folderRunnerTokens, folder)
 	delete(m.folderStatRefs, folder)
+	delete(m.folderFetched, folder)
 	for dev, folders := range m.deviceFolders {
 		m.deviceFolders[dev] = stringSliceWithout(folders, folder)
 	}
@@ -270,6 +298,10 @@ func (m *Model) RemoveFolder(folder string) {
 
 	m.pmut.Unlock()
 	m.fmut.Unlock()
+
+	m.smut.Lock()
+	delete(m.folderSchedules, folder)
+	m.smut.Unlock()
 }
 
 type ConnectionInfo struct {
@@ -359,6 +391,12 @@ func (m *Model) FolderStatistics() map[string]stats.FolderStatistics {
 	return res
 }
 
+// StatisticsHistory returns the transfer and scan counters between from and
+// to, for the given device and folder or all of them if empty.
+func (m *Model) StatisticsHistory(device, folder string, from, to time.Time) stats.HistoryResult {
+	return m.history.Get(device, folder, from, to)
+}
+
 // Completion returns the completion status, in percent, for the given device
 // and folder.
 func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
@@ -429,7 +467,12 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	if rf, ok := m.folderFiles[folder]; ok {
+		sel := m.folderSelection(folder)
 		rf.WithNeedTruncated(protocol.LocalDeviceID, func(f db.FileIntf) bool {
+			if !sel.isSelected(f.(db.FileInfoTruncated).Name, f.IsDirectory()) {
+				// Remote only, not needed
+				return true
+			}
 			fs, de, by := sizeOfFile(f)
 			nfiles += fs + de
 			bytes += by
@@ -488,8 +531,12 @@ func (m *Model) NeedFolderFiles(folder string, page, perpage int) ([]db.FileInfo
 		}
 	}
 
+	sel := m.folderSelection(folder)
 	rest = make([]db.FileInfoTruncated, 0, perpage)
 	rf.WithNeedTruncated(protocol.LocalDeviceID, func(f db.FileIntf) bool {
+		if !sel.isSelected(f.(db.FileInfoTruncated).Name, f.IsDirectory()) {
+			return true
+		}
 		total++
 		if skip > 0 {
 			skip--
@@ -544,8 +591,10 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 	m.deviceDownloads[deviceID].Update(folder, makeForgetUpdate(fs))
 	m.pmut.RUnlock()
 
-	fs = filterIndex(folder, fs, cfg.IgnoreDelete, ignores)
+	fs = filterIndex(folder, fs, cfg.IgnoreDelete, cfg.SharedIgnores, ignores)
 	files.Replace(deviceID, fs)
+	maxLocalVer, _ := maxLocalVersionOption(options)
+	files.SetMaxLocalVersion(deviceID, maxLocalVer)
 
 	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
 		"device":  deviceID.String(),
@@ -585,8 +634,11 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 	m.deviceDownloads[deviceID].Update(folder, makeForgetUpdate(fs))
 	m.pmut.RUnlock()
 
-	fs = filterIndex(folder, fs, cfg.IgnoreDelete, ignores)
+	fs = filterIndex(folder, fs, cfg.IgnoreDelete, cfg.SharedIgnores, ignores)
 	files.Update(deviceID, fs)
+	if maxLocalVer, ok := maxLocalVersionOption(options); ok {
+		files.SetMaxLocalVersion(deviceID, maxLocalVer)
+	}
 
 	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
 		"device":  deviceID.String(),
@@ -621,6 +673,18 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 
 	tempIndexFolders := make([]string, 0, len(cm.Folders))
 
+	// The index senders and the temporary index subscription last for the
+	// whole connection, so they are only set up on the first cluster config
+	// we receive on it.
+	m.pmut.Lock()
+	conn, ok := m.conn[deviceID]
+	_, seen := m.deviceClusterConf[deviceID]
+	if ok {
+		m.deviceClusterConf[deviceID] = cm
+	}
+	m.pmut.Unlock()
+	startSenders := ok && !seen
+
 	m.fmut.Lock()
 nextFolder:
 	for _, folder := range cm.Folders {
@@ -649,20 +713,20 @@ nextFolder:
 		if folder.Flags&protocol.FlagFolderDisabledTempIndexes == 0 {
 			tempIndexFolders = append(tempIndexFolders, folder.ID)
 		}
-	}
-	m.fmut.Unlock()
 
-	// This breaks if we send multiple CM messages during the same connection.
-	if len(tempIndexFolders) > 0 {
-		m.pmut.RLock()
-		conn, ok := m.conn[deviceID]
-		m.pmut.RUnlock()
+		fs := m.folderFiles[folder.ID]
+		startLocalVer, fullIndex := m.checkIndexIDs(deviceID, folder, fs)
 		// In case we've got ClusterConfig, and the connection disappeared
 		// from infront of our nose.
-		if ok {
-			m.progressEmitter.temporaryIndexSubscribe(conn, tempIndexFolders)
+		if startSenders {
+			go sendIndexes(conn, folder.ID, fs, m.folderIgnores[folder.ID], startLocalVer, fullIndex)
 		}
 	}
+	m.fmut.Unlock()
+
+	if len(tempIndexFolders) > 0 && startSenders {
+		m.progressEmitter.temporaryIndexSubscribe(conn, tempIndexFolders)
+	}
 
 	var changed bool
 
@@ -680,6 +744,11 @@ nextFolder:
 				var id protocol.DeviceID
 				copy(id[:], device.ID)
 
+				if m.cfg.RevokedDevice(id) {
+					// Revoked devices are never added back.
+					continue nextDevice
+				}
+
 				if _, ok := m.cfg.Devices()[id]; !ok {
 					// The device is currently unknown. Add it to the config.
 
@@ -698,6 +767,8 @@ nextFolder:
 						Addresses:   addresses,
 						CertName:    device.CertName,
 					}
+					introducer := deviceID
+					newDeviceCfg.IntroducedBy = &introducer
 
 					// The introducers' introducers are also our introducers.
 					if device.Flags&protocol.FlagIntroducer != 0 {
@@ -725,38 +796,238 @@ nextFolder:
 				m.deviceFolders[id] = append(m.deviceFolders[id], folder.ID)
 				m.folderDevices[folder.ID] = append(m.folderDevices[folder.ID], id)
 
+				introducer := deviceID
 				folderCfg := m.cfg.Folders()[folder.ID]
 				folderCfg.Devices = append(folderCfg.Devices, config.FolderDeviceConfiguration{
-					DeviceID: id,
+					DeviceID:     id,
+					IntroducedBy: &introducer,
 				})
 				m.cfg.SetFolder(folderCfg)
 
 				changed = true
 			}
 		}
+
+		// Propagate what the introducer has removed or revoked.
+		if m.handleIntroducerRemovals(deviceID, cm) {
+			changed = true
+		}
+		if m.handleRevocations(deviceID, cm) {
+			changed = true
+		}
 	}
 
 	if changed {
 		m.cfg.Save()
 	}
+
+	if t, ok, err := protocol.DeviceIDTransitionFromOptions(cm); err != nil {
+		deviceLogger(deviceID).Infof("Device %v announced an invalid device ID transition: %v", deviceID, err)
+	} else if ok {
+		m.handleDeviceIDTransition(deviceID, t)
+	}
+}
+
+// handleIntroducerRemovals stops sharing folders with the devices that the
+// introducer added to them, but no longer shares them with. Devices that it
+// added and that are thereby left without folders are removed entirely.
+// Folders that the introducer doesn't announce are left alone, as we can't
+// tell who it shares them with.
+func (m *Model) handleIntroducerRemovals(introducer protocol.DeviceID, cm protocol.ClusterConfigMessage) bool {
+	announced := make(map[string]map[protocol.DeviceID]struct{}, len(cm.Folders))
+	for _, folder := range cm.Folders {
+		devices := make(map[protocol.DeviceID]struct{}, len(folder.Devices))
+		for _, device := range folder.Devices {
+			var id protocol.DeviceID
+			copy(id[:], device.ID)
+			devices[id] = struct{}{}
+		}
+		announced[folder.ID] = devices
+	}
+
+	cfg := m.cfg.Raw().Copy()
+	removed := make(map[protocol.DeviceID]struct{})
+	shared := make(map[protocol.DeviceID]struct{})
+	for i, folder := range cfg.Folders {
+		devices, ok := announced[folder.ID]
+		kept := folder.Devices[:0]
+		for _, device := range folder.Devices {
+			if _, stillShared := devices[device.DeviceID]; ok && !stillShared && device.IsIntroducedBy(introducer) {
+				l.Infof("Removing device %v from share %q (removed by introducer %v)", device.DeviceID, folder.ID, introducer)
+				removed[device.DeviceID] = struct{}{}
+				continue
+			}
+			shared[device.DeviceID] = struct{}{}
+			kept = append(kept, device)
+		}
+		cfg.Folders[i].Devices = kept
+	}
+	if len(removed) == 0 {
+		return false
+	}
+
+	devices := cfg.Devices[:0]
+	for _, device := range cfg.Devices {
+		_, wasRemoved := removed[device.DeviceID]
+		_, isShared := shared[device.DeviceID]
+		if wasRemoved && !isShared && device.IsIntroducedBy(introducer) {
+			l.Infof("Removing device %v from config (removed by introducer %v)", device.DeviceID, introducer)
+			continue
+		}
+		devices = append(devices, device)
+	}
+	cfg.Devices = devices
+
+	m.cfg.Replace(cfg)
+	return true
+}
+
+// handleRevocations revokes the devices that the introducer announces as
+// revoked.
+func (m *Model) handleRevocations(introducer protocol.DeviceID, cm protocol.ClusterConfigMessage) bool {
+	changed := false
+	for _, id := range cm.RevokedDevices() {
+		if id == m.id || id == introducer || m.cfg.RevokedDevice(id) {
+			continue
+		}
+		l.Infof("Revoking device %v (revoked by introducer %v)", id, introducer)
+		m.cfg.RevokeDevice(id)
+		changed = true
+	}
+	return changed
+}
+
+// handleDeviceIDTransition verifies a device ID transition announced by the
+// peer, and moves the configuration of the old device ID to the new one if
+// it is valid. The transition is announced both before the peer restarts
+// with its new certificate and after, so it may come from either device ID.
+// It must not take over our own device ID, nor another configured device,
+// unless it is that device itself announcing it.
+func (m *Model) handleDeviceIDTransition(deviceID protocol.DeviceID, t protocol.DeviceIDTransition) {
+	dl := deviceLogger(deviceID)
+
+	if t.From != deviceID && t.To != deviceID {
+		dl.Infof("Device %v announced a device ID transition for another device (%v)", deviceID, t.From)
+		return
+	}
+	if t.From == t.To {
+		return
+	}
+	if err := t.Verify(); err != nil {
+		dl.Infof("Device %v announced a device ID transition that failed verification: %v", deviceID, err)
+		return
+	}
+
+	if err := m.applyDeviceIDTransition(deviceID, t.From, t.To); err == errDeviceIDInUse {
+		dl.Infof("Device %v announced a device ID transition to %v, which is already in use; ignoring", deviceID, t.To)
+	}
+}
+
+// ApplyDeviceIDTransition moves the configuration of the device from one
+// device ID to another, on behalf of a connection from the new device ID
+// whose certificate has been certified by the key of the old one. The caller
+// is responsible for having verified that. The new device ID must not be
+// configured already.
+func (m *Model) ApplyDeviceIDTransition(from, to protocol.DeviceID) error {
+	if _, ok := m.cfg.Devices()[to]; ok {
+		return errDeviceIDInUse
+	}
+	return m.applyDeviceIDTransition(to, from, to)
+}
+
+// applyDeviceIDTransition applies a verified device ID transition learned
+// from deviceID, which must be one of from and to.
+func (m *Model) applyDeviceIDTransition(deviceID, from, to protocol.DeviceID) error {
+	devices := m.cfg.Devices()
+	if _, ok := devices[from]; !ok {
+		// Unknown, or the transition has already been done.
+		return errDeviceIDUnknown
+	}
+	_, toConfigured := devices[to]
+	if to == m.id || (toConfigured && to != deviceID) || m.cfg.RevokedDevice(to) {
+		return errDeviceIDInUse
+	}
+
+	if _, ok := m.cfg.ReplaceDeviceID(from, to); !ok {
+		return errDeviceIDUnknown
+	}
+	if err := m.cfg.Save(); err != nil {
+		deviceLogger(deviceID).Warnln("Saving config:", err)
+	}
+
+	deviceLogger(deviceID).Infof("Device %v has changed its device ID to %v", from, to)
+	events.Default.Log(events.DeviceIDChanged, map[string]string{
+		"from": from.String(),
+		"to":   to.String(),
+	})
+	return nil
+}
+
+// AnnounceDeviceIDTransition makes us announce the transition from our
+// current device ID to a new one to all peers. As the announcement is part
+// of the cluster config sent when a connection is established, existing
+// connections are closed so that the peers reconnect and receive it.
+func (m *Model) AnnounceDeviceIDTransition(t protocol.DeviceIDTransition) {
+	m.pmut.Lock()
+	m.idTransition = t.Options()
+	devices := make([]protocol.DeviceID, 0, len(m.conn))
+	for device := range m.conn {
+		devices = append(devices, device)
+	}
+	m.pmut.Unlock()
+
+	for _, device := range devices {
+		m.Close(device, errors.New("announcing device ID transition"))
+	}
+}
+
+// checkIndexIDs compares the index IDs announced by the peer device for the
+// folder with the ones we know. It returns the local version from which our
+// index should be sent to the peer, and whether it must be sent as a full
+// index because the peer doesn't know our current index. If the peer's own
+// index has been reset, we forget what we had from it and expect a full
+// index in return.
+func (m *Model) checkIndexIDs(deviceID protocol.DeviceID, folder protocol.Folder, fs *db.FileSet) (int64, bool) {
+	startLocalVer, fullIndex := int64(0), true
+
+	for _, dev := range folder.Devices {
+		switch {
+		case bytes.Equal(dev.ID, m.id[:]):
+			// This is the peer's view of our index. If it has seen our
+			// current index, we only need to send what is newer.
+			if myIndexID := fs.IndexID(protocol.LocalDeviceID); dev.IndexID() == myIndexID {
+				l.Debugf("Device %v folder %q has our index ID %v at local version %d", deviceID, folder.ID, myIndexID, dev.MaxLocalVersion)
+				startLocalVer, fullIndex = dev.MaxLocalVersion, false
+			} else if dev.IndexID() != 0 {
+				l.Infof("Device %v folder %q has mismatching index ID for us (%v != %v)", deviceID, folder.ID, dev.IndexID(), myIndexID)
+			}
+
+		case bytes.Equal(dev.ID, deviceID[:]):
+			// This is the peer's own index. If it's not the one we have
+			// stored, what we have is stale.
+			if theirIndexID := dev.IndexID(); theirIndexID != 0 && theirIndexID != fs.IndexID(deviceID) {
+				l.Debugf("Device %v folder %q has a new index ID %v", deviceID, folder.ID, theirIndexID)
+				fs.Replace(deviceID, nil)
+				fs.SetIndexID(deviceID, theirIndexID)
+			}
+		}
+	}
+
+	return startLocalVer, fullIndex
 }
 
 // Close removes the peer from the model and closes the underlying connection if possible.
 // Implements the protocol.Model interface.
 func (m *Model) Close(device protocol.DeviceID, err error) {
-	l.Infof("Connection to %s closed: %v", device, err)
+	deviceLogger(device).Infof("Connection to %s closed: %v", device, err)
 	events.Default.Log(events.DeviceDisconnected, map[string]string{
 		"id":    device.String(),
 		"error": err.Error(),
 	})
 
+	// The index of the device is kept, so that it only needs to send us
+	// what changed after what we announce on the next connection.
 	m.pmut.Lock()
-	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[device] {
-		m.folderFiles[folder].Replace(device, nil)
-	}
-	m.fmut.RUnlock()
-
 	conn, ok := m.conn[device]
 	if ok {
 		m.progressEmitter.temporaryIndexUnsubscribe(conn)
@@ -786,6 +1057,16 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		return fmt.Errorf("protocol error: unknown flags 0x%x in Request message", flags)
 	}
 
+	if deviceID != protocol.LocalDeviceID {
+		folderState := m.folderScheduleState(folder)
+		deviceState := m.deviceScheduleState(deviceID)
+		if !folderState.Serve || !deviceState.Serve {
+			l.Debugf("%v REQ(in) outside of schedule: %s: %q / %q o=%d s=%d", m, deviceID, folder, name, offset, len(buf))
+			return protocol.ErrGeneric
+		}
+		m.limitSend(folder, deviceID, len(buf))
+	}
+
 	if deviceID != protocol.LocalDeviceID {
 		l.Debugf("%v REQ(in): %s: %q / %q o=%d s=%d f=%d", m, deviceID, folder, name, offset, len(buf), flags)
 	}
@@ -842,6 +1123,7 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 			l.Debugln("symlink.Reader.ReadAt", err)
 			return protocol.ErrGeneric
 		}
+		m.history.Sent(deviceID, folder, len(buf))
 		return nil
 	}
 
@@ -850,6 +1132,7 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 	if flags&protocol.FlagFromTemporary != 0 && !folderCfg.DisableTempIndexes {
 		tempFn := filepath.Join(folderPath, defTempNamer.TempName(name))
 		if err := readOffsetIntoBuf(tempFn, offset, buf); err == nil {
+			m.history.Sent(deviceID, folder, len(buf))
 			return nil
 		}
 		// Fall through to reading from a non-temp file, just incase the temp
@@ -862,6 +1145,7 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 	} else if err != nil {
 		return protocol.ErrGeneric
 	}
+	m.history.Sent(deviceID, folder, len(buf))
 	return nil
 }
 
@@ -944,6 +1228,196 @@ func (m *Model) GetIgnores(folder string) ([]string, []string, error) {
 	return lines, patterns, nil
 }
 
+// IgnoreLines returns the lines of the folder's ignore files as parsed,
+// including any per-line errors.
+func (m *Model) IgnoreLines(folder string) ([]ignore.Line, error) {
+	m.fmut.RLock()
+	_, ok := m.folderCfgs[folder]
+	ignores := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Folder %s does not exist", folder)
+	}
+
+	return ignores.Lines(), nil
+}
+
+// FetchFile pulls the given file or directory from remote devices once, in
+// a folder using selective sync. Unlike selecting the path, this does not
+// change the configuration; the fetch is forgotten once the file has been
+// pulled, and later changes to it are not pulled unless it's selected.
+func (m *Model) FetchFile(folder, file string) error {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+	cfg, ok := m.folderCfgs[folder]
+	fs := m.folderFiles[folder]
+	runner := m.folderRunners[folder]
+	if !ok {
+		return fmt.Errorf("Folder %s does not exist", folder)
+	}
+	if !cfg.SelectiveSync {
+		return fmt.Errorf("Folder %s does not use selective sync", folder)
+	}
+
+	file = filepath.Clean(osutil.NativeFilename(file))
+	gf, ok := fs.GetGlobal(file)
+	if !ok || gf.IsDeleted() {
+		return fmt.Errorf("%s: no such file in folder %s", file, folder)
+	}
+	if m.folderSelection(folder).isSelected(gf.Name, gf.IsDirectory()) {
+		// Nothing to do
+		return nil
+	}
+
+	m.folderFetched[folder] = append(m.folderFetched[folder], gf.Name)
+	if runner != nil {
+		runner.IndexUpdated()
+	}
+	return nil
+}
+
+// folderSelection returns the selection of the folder, including the one-off
+// fetches not yet pulled. The caller must hold fmut.
+func (m *Model) folderSelection(folder string) *selection {
+	return newSelection(m.folderCfgs[folder]).with(m.folderFetched[folder])
+}
+
+// forgetFetched forgets the one-off fetches in the folder that have nothing
+// left to pull.
+func (m *Model) forgetFetched(folder string) {
+	m.fmut.RLock()
+	fetched := m.folderFetched[folder]
+	fs := m.folderFiles[folder]
+	ignores := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+	if len(fetched) == 0 || fs == nil {
+		return
+	}
+
+	sep := string(filepath.Separator)
+	pending := make(map[string]bool)
+	fs.WithNeedTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if ignores.Match(f.Name).IsIgnored() {
+			// Never pulled, so not waited for either
+			return true
+		}
+		for _, path := range fetched {
+			if f.Name == path || strings.HasPrefix(f.Name, path+sep) {
+				pending[path] = true
+			}
+		}
+		return len(pending) < len(fetched)
+	})
+
+	done := make(map[string]bool)
+	for _, path := range fetched {
+		if !pending[path] {
+			done[path] = true
+		}
+	}
+
+	m.fmut.Lock()
+	var kept []string
+	for _, path := range m.folderFetched[folder] {
+		if !done[path] {
+			kept = append(kept, path)
+		}
+	}
+	if len(kept) == 0 {
+		delete(m.folderFetched, folder)
+	} else {
+		m.folderFetched[folder] = kept
+	}
+	m.fmut.Unlock()
+}
+
+// An IgnoreExplanation describes which ignore pattern, if any, decides
+// whether a file is ignored.
+type IgnoreExplanation struct {
+	File      string `json:"file"`
+	Ignored   bool   `json:"ignored"`
+	Deletable bool   `json:"deletable"`
+	Pattern   string `json:"pattern,omitempty"`
+	Source    string `json:"source,omitempty"` // the ignore file, relative to the folder
+	Line      int    `json:"line,omitempty"`
+}
+
+// ExplainIgnore returns which ignore pattern, if any, decides whether the
+// given file in the folder is ignored. Size and age rules are evaluated
+// against the file on disk or, if it's not present, the global version.
+func (m *Model) ExplainIgnore(folder, file string) (IgnoreExplanation, error) {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	fs := m.folderFiles[folder]
+	ignores := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return IgnoreExplanation{}, fmt.Errorf("Folder %s does not exist", folder)
+	}
+
+	file = filepath.Clean(file)
+	info, err := osutil.Lstat(filepath.Join(cfg.Path(), file))
+	if err != nil {
+		info = nil
+		if gf, ok := fs.GetGlobal(osutil.NormalizedFilename(file)); ok {
+			info = lastFileInfoOf(fs, gf)
+		}
+	}
+
+	exp := IgnoreExplanation{
+		File: file,
+	}
+	pattern, ok := ignores.MatchPattern(file, info)
+	if !ok {
+		return exp, nil
+	}
+
+	exp.Ignored = pattern.Result().IsIgnored()
+	exp.Deletable = pattern.Result().IsDeletable()
+	exp.Pattern = pattern.String()
+	source, line := pattern.Source()
+	if rel, err := filepath.Rel(cfg.Path(), source); err == nil {
+		source = rel
+	}
+	exp.Source = source
+	exp.Line = line
+
+	return exp, nil
+}
+
+// IgnoreDryRun returns the currently synced files in the folder that would
+// become ignored if the given ignore file content was applied, together with
+// the parsed lines of the content. Lines that fail to parse are reported and
+// otherwise disregarded.
+func (m *Model) IgnoreDryRun(folder string, content []string) ([]string, []ignore.Line, error) {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	fs := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("Folder %s does not exist", folder)
+	}
+
+	ignores := ignore.New(false)
+	ignores.ParseWithLocal(strings.NewReader(strings.Join(content, "\n")), filepath.Join(cfg.Path(), ".stignore"))
+
+	files := make([]string, 0)
+	fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if f.IsDeleted() || f.IsInvalid() {
+			// Not synced, either way
+			return true
+		}
+		if ignores.MatchInfo(f.Name, fileInfoOf(f.FileInfo)).IsIgnored() {
+			files = append(files, f.Name)
+		}
+		return true
+	})
+
+	return files, ignores.Lines(), nil
+}
+
 func (m *Model) SetIgnores(folder string, content []string) error {
 	cfg, ok := m.folderCfgs[folder]
 	if !ok {
@@ -1002,9 +1476,10 @@ func (m *Model) GetHello(protocol.DeviceID) protocol.HelloMessage {
 	}
 }
 
-// AddConnection adds a new peer connection to the model. An initial index will
-// be sent to the connected peer, thereafter index updates whenever the local
-// folder changes.
+// AddConnection adds a new peer connection to the model. Once the peer's
+// cluster config has been received, our index (or the part of it that the
+// peer hasn't seen yet) will be sent, thereafter index updates whenever the
+// local folder changes.
 func (m *Model) AddConnection(conn connections.Connection, hello protocol.HelloMessage) {
 	deviceID := conn.ID()
 
@@ -1032,19 +1507,13 @@ func (m *Model) AddConnection(conn connections.Connection, hello protocol.HelloM
 
 	events.Default.Log(events.DeviceConnected, event)
 
-	l.Infof(`Device %s client is "%s %s" named "%s"`, deviceID, hello.ClientName, hello.ClientVersion, hello.DeviceName)
+	deviceLogger(deviceID).Infof(`Device %s client is "%s %s" named "%s"`, deviceID, hello.ClientName, hello.ClientVersion, hello.DeviceName)
 
 	conn.Start()
 
 	cm := m.generateClusterConfig(deviceID)
+	cm.Options = append(cm.Options, m.idTransition...)
 	conn.ClusterConfig(cm)
-
-	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[deviceID] {
-		fs := m.folderFiles[folder]
-		go sendIndexes(conn, folder, fs, m.folderIgnores[folder])
-	}
-	m.fmut.RUnlock()
 	m.pmut.Unlock()
 
 	device, ok := m.cfg.Devices()[deviceID]
@@ -1129,19 +1598,26 @@ func (m *Model) folderStatRef(folder string) *stats.FolderStatisticsReference {
 	return sr
 }
 
-func (m *Model) receivedFile(folder string, file protocol.FileInfo) {
+// receivedFiles records that a number of files were pulled to the folder,
+// the last of which was file.
+func (m *Model) receivedFiles(folder string, file protocol.FileInfo, files int) {
 	m.folderStatRef(folder).ReceivedFile(file.Name, file.IsDeleted())
+	m.history.Pulled(folder, files)
 }
 
-func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher) {
+// sendIndexes sends the index for the folder to the peer, starting with the
+// files newer than startLocalVer, and then keeps it updated as the local
+// index changes. If fullIndex is set the initial batch is sent as an Index
+// message, replacing whatever the peer had from us.
+func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher, startLocalVer int64, fullIndex bool) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	var err error
 
-	l.Debugf("sendIndexes for %s-%s/%q starting", deviceID, name, folder)
+	l.Debugf("sendIndexes for %s-%s/%q starting (from local version %d, full index %v)", deviceID, name, folder, startLocalVer, fullIndex)
 	defer l.Debugf("sendIndexes for %s-%s/%q exiting: %v", deviceID, name, folder, err)
 
-	minLocalVer, err := sendIndexTo(true, 0, conn, folder, fs, ignores)
+	minLocalVer, err := sendIndexTo(fullIndex, startLocalVer, conn, folder, fs, ignores)
 
 	// Subscribe to LocalIndexUpdated (we have new information to send) and
 	// DeviceDisconnected (it might be us who disconnected, so we should
@@ -1178,7 +1654,7 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 	name := conn.Name()
 	batch := make([]protocol.FileInfo, 0, indexBatchSize)
 	currentBatchSize := 0
-	maxLocalVer := int64(0)
+	maxLocalVer := minLocalVer
 	var err error
 
 	fs.WithHave(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
@@ -1219,13 +1695,17 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 		return true
 	})
 
+	// The last message tells the peer that it now has everything up to
+	// maxLocalVer, which it announces back to us on reconnect.
+	options := []protocol.Option{{Key: indexOptionMaxLocalVersion, Value: strconv.FormatInt(maxLocalVer, 10)}}
+
 	if initial && err == nil {
-		err = conn.Index(folder, batch, 0, nil)
+		err = conn.Index(folder, batch, 0, options)
 		if err == nil {
 			l.Debugf("sendIndexes for %s-%s/%q: %d files (small initial index)", deviceID, name, folder, len(batch))
 		}
 	} else if len(batch) > 0 && err == nil {
-		err = conn.IndexUpdate(folder, batch, 0, nil)
+		err = conn.IndexUpdate(folder, batch, 0, options)
 		if err == nil {
 			l.Debugf("sendIndexes for %s-%s/%q: %d files (last batch)", deviceID, name, folder, len(batch))
 		}
@@ -1234,6 +1714,18 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 	return maxLocalVer, err
 }
 
+// maxLocalVersionOption returns the local version marked as complete in the
+// options of an index message, if any.
+func maxLocalVersionOption(options []protocol.Option) (int64, bool) {
+	for _, option := range options {
+		if option.Key == indexOptionMaxLocalVersion {
+			ver, err := strconv.ParseInt(option.Value, 10, 64)
+			return ver, err == nil
+		}
+	}
+	return 0, false
+}
+
 func (m *Model) updateLocals(folder string, fs []protocol.FileInfo) {
 	m.fmut.RLock()
 	files := m.folderFiles[folder]
@@ -1293,6 +1785,8 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 	m.folderIgnores[cfg.ID] = ignores
 
 	m.fmut.Unlock()
+
+	m.setFolderSchedule(cfg.ID, cfg.Schedule)
 }
 
 func (m *Model) ScanFolders() map[string]error {
@@ -1352,7 +1846,7 @@ func (m *Model) ScanFolderSubs(folder string, subs []string) error {
 	return runner.Scan(subs)
 }
 
-func (m *Model) internalScanFolderSubdirs(folder string, subs []string) error {
+func (m *Model) internalScanFolderSubdirs(folder string, subs []string) (err error) {
 	for i, sub := range subs {
 		sub = osutil.NativeFilename(sub)
 		if p := filepath.Clean(filepath.Join(folder, sub)); !strings.HasPrefix(p, folder) {
@@ -1375,6 +1869,11 @@ func (m *Model) internalScanFolderSubdirs(folder string, subs []string) error {
 		return errors.New("no such folder")
 	}
 
+	start := time.Now()
+	defer func() {
+		m.history.Scanned(folder, time.Since(start), err)
+	}()
+
 	if err := m.CheckFolderHealth(folder); err != nil {
 		runner.setError(err)
 		l.Infof("Stopping folder %s due to error: %s", folder, err)
@@ -1413,6 +1912,7 @@ func (m *Model) internalScanFolderSubdirs(folder string, subs []string) error {
 		MtimeRepo:             db.NewVirtualMtimeRepo(m.db, folderCfg.ID),
 		IgnorePerms:           folderCfg.IgnorePerms,
 		AutoNormalize:         folderCfg.AutoNormalize,
+		SharedIgnores:         folderCfg.SharedIgnores,
 		Hashers:               m.numHashers(folder),
 		ShortID:               m.shortID,
 		ProgressTickIntervalS: folderCfg.ScanProgressIntervalS,
@@ -1483,7 +1983,12 @@ func (m *Model) internalScanFolderSubdirs(folder string, subs []string) error {
 					batch = batch[:0]
 				}
 
-				if ignores.Match(f.Name).IsIgnored() || symlinkInvalid(folder, f) {
+				info, lstatErr := osutil.Lstat(filepath.Join(folderCfg.Path(), f.Name))
+				if lstatErr != nil {
+					info = nil
+				}
+
+				if ignores.MatchInfo(f.Name, info).IsIgnored() || symlinkInvalid(folder, f) {
 					// File has been ignored or an unsupported symlink. Set invalid bit.
 					l.Debugln("setting invalid bit on ignored", f)
 					nf := protocol.FileInfo{
@@ -1493,7 +1998,7 @@ func (m *Model) internalScanFolderSubdirs(folder string, subs []string) error {
 						Version:  f.Version, // The file is still the same, so don't bump version
 					}
 					batch = append(batch, nf)
-				} else if _, err := osutil.Lstat(filepath.Join(folderCfg.Path(), f.Name)); err != nil {
+				} else if lstatErr != nil {
 					// File has been deleted.
 
 					// We don't specifically verify that the error is
@@ -1579,12 +2084,13 @@ func (m *Model) numHashers(folder string) int {
 
 // generateClusterConfig returns a ClusterConfigMessage that is correct for
 // the given peer device
-func (m *Model) generateClusterConfig(device protocol.DeviceID) protocol.ClusterConfigMessage {
+func (m *Model) generateClusterConfig(peer protocol.DeviceID) protocol.ClusterConfigMessage {
 	var message protocol.ClusterConfigMessage
 
 	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[device] {
+	for _, folder := range m.deviceFolders[peer] {
 		folderCfg := m.cfg.Folders()[folder]
+		fs := m.folderFiles[folder]
 		protocolFolder := protocol.Folder{
 			ID:    folder,
 			Label: folderCfg.Label,
@@ -1622,12 +2128,34 @@ func (m *Model) generateClusterConfig(device protocol.DeviceID) protocol.Cluster
 			if deviceCfg.Introducer {
 				protocolDevice.Flags |= protocol.FlagIntroducer
 			}
+
+			// Announce our index and what we have of the peer's index, so
+			// that only the changes since need to be exchanged.
+			switch device {
+			case m.id:
+				protocolDevice.SetIndexID(fs.IndexID(protocol.LocalDeviceID))
+				protocolDevice.MaxLocalVersion = fs.LocalVersion(protocol.LocalDeviceID)
+			case peer:
+				if id := fs.IndexID(peer); id != 0 {
+					protocolDevice.SetIndexID(id)
+					protocolDevice.MaxLocalVersion = fs.MaxLocalVersion(peer)
+				}
+			}
+
 			protocolFolder.Devices = append(protocolFolder.Devices, protocolDevice)
 		}
 		message.Folders = append(message.Folders, protocolFolder)
 	}
 	m.fmut.RUnlock()
 
+	// Announce the devices we have revoked, so that the peer may revoke
+	// them as well if we are its introducer.
+	for _, id := range m.cfg.Raw().RevokedDevices {
+		if !message.AddRevokedDevice(id) {
+			break
+		}
+	}
+
 	return message
 }
 
@@ -1684,6 +2212,31 @@ func (m *Model) Override(folder string) {
 	runner.setState(FolderIdle)
 }
 
+// CheckDatabase verifies the database for the given folder, repairing any
+// inconsistencies found.
+func (m *Model) CheckDatabase(folder string) (db.CheckResult, error) {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	runner := m.folderRunners[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return db.CheckResult{}, fmt.Errorf("Folder %s does not exist", folder)
+	}
+
+	l.Infof("Checking database for folder %q", folder)
+	res := fs.Check()
+	if n := res.Problems(); n > 0 {
+		l.Infof("Repaired %d database inconsistencies for folder %q (%+v)", n, folder, res)
+		if runner != nil {
+			// What we need may have changed.
+			runner.IndexUpdated()
+		}
+	} else {
+		l.Infof("Database for folder %q is consistent (checked %d files in %v)", folder, res.Files, res.Duration)
+	}
+	return res, nil
+}
+
 // CurrentLocalVersion returns the change version for the given folder.
 // This is guaranteed to increment if the contents of the local folder has
 // changed.
@@ -1725,6 +2278,7 @@ func (m *Model) RemoteLocalVersion(folder string) (int64, bool) {
 func (m *Model) GlobalDirectoryTree(folder, prefix string, levels int, dirsonly bool) map[string]interface{} {
 	m.fmut.RLock()
 	files, ok := m.folderFiles[folder]
+	sel := m.folderSelection(folder)
 	m.fmut.RUnlock()
 	if !ok {
 		return nil
@@ -1745,6 +2299,15 @@ func (m *Model) GlobalDirectoryTree(folder, prefix string, levels int, dirsonly
 			return true
 		}
 
+		// Files outside the selection are "remote only", unless we happen
+		// to have them anyway. Such files are flagged by a third element in
+		// their entry.
+		remoteOnly := false
+		if !sel.isSelected(f.Name, f.IsDirectory()) {
+			lf, ok := files.Get(protocol.LocalDeviceID, f.Name)
+			remoteOnly = !ok || lf.IsDeleted()
+		}
+
 		f.Name = strings.Replace(f.Name, prefix, "", 1)
 
 		var dir, base string
@@ -1774,9 +2337,13 @@ func (m *Model) GlobalDirectoryTree(folder, prefix string, levels int, dirsonly
 		}
 
 		if !dirsonly && base != "" {
-			last[base] = []interface{}{
+			entry := []interface{}{
 				time.Unix(f.Modified, 0), f.Size(),
 			}
+			if remoteOnly {
+				entry = append(entry, true)
+			}
+			last[base] = entry
 		}
 
 		return true
@@ -1893,15 +2460,15 @@ func (m *Model) CheckFolderHealth(id string) error {
 
 	if err != nil {
 		if oldErr != nil && oldErr.Error() != err.Error() {
-			l.Infof("Folder %q error changed: %q -> %q", folder.ID, oldErr, err)
+			folderLogger(folder.ID).Infof("Folder %q error changed: %q -> %q", folder.ID, oldErr, err)
 		} else if oldErr == nil {
-			l.Warnf("Stopping folder %q - %v", folder.ID, err)
+			folderLogger(folder.ID).Warnf("Stopping folder %q - %v", folder.ID, err)
 		}
 		if runnerExists {
 			runner.setError(err)
 		}
 	} else if oldErr != nil {
-		l.Infof("Folder %q error is cleared, restarting", folder.ID)
+		folderLogger(folder.ID).Infof("Folder %q error is cleared, restarting", folder.ID)
 		if runnerExists {
 			runner.clearError()
 		}
@@ -1911,7 +2478,7 @@ func (m *Model) CheckFolderHealth(id string) error {
 }
 
 func (m *Model) ResetFolder(folder string) {
-	l.Infof("Cleaning data for folder %q", folder)
+	folderLogger(folder).Infof("Cleaning data for folder %q", folder)
 	db.DropFolder(m.db, folder)
 }
 
@@ -1926,6 +2493,10 @@ func (m *Model) VerifyConfiguration(from, to config.Configuration) error {
 func (m *Model) CommitConfiguration(from, to config.Configuration) bool {
 	// TODO: This should not use reflect, and should take more care to try to handle stuff without restart.
 
+	// Device schedules are looked up whenever they are needed, so they only
+	// need to be updated.
+	m.setDeviceSchedules(to.Devices)
+
 	// Go through the folder configs and figure out if we need to restart or not.
 
 	fromFolders := mapFolders(from.Folders)
@@ -1964,9 +2535,42 @@ func (m *Model) CommitConfiguration(from, to config.Configuration) bool {
 		toDevs := mapDevices(toCfg.DeviceIDs())
 		for dev := range fromDevs {
 			if _, ok := toDevs[dev]; !ok {
-				// A device was removed. Requires restart.
-				l.Debugln(m, "requires restart, removing device", dev, "from folder", folderID)
-				return false
+				// A device was removed. Stop sharing the folder with it and
+				// forget its index. The connection is closed so that the
+				// device gets our new cluster config, if it is still
+				// allowed to connect.
+
+				m.fmut.Lock()
+				m.pmut.Lock()
+
+				m.folderCfgs[folderID] = toCfg
+				devices := m.folderDevices[folderID][:0]
+				for _, id := range m.folderDevices[folderID] {
+					if id != dev {
+						devices = append(devices, id)
+					}
+				}
+				m.folderDevices[folderID] = devices
+				folders := m.deviceFolders[dev][:0]
+				for _, id := range m.deviceFolders[dev] {
+					if id != folderID {
+						folders = append(folders, id)
+					}
+				}
+				m.deviceFolders[dev] = folders
+				if fs, ok := m.folderFiles[folderID]; ok {
+					// Forget the index ID too, so that we don't announce
+					// having an index we no longer have, should the folder
+					// be shared again.
+					fs.Replace(dev, nil)
+					fs.SetIndexID(dev, 0)
+				}
+				if conn, ok := m.conn[dev]; ok {
+					closeRawConn(conn)
+				}
+
+				m.pmut.Unlock()
+				m.fmut.Unlock()
 			}
 		}
 
@@ -1994,17 +2598,65 @@ func (m *Model) CommitConfiguration(from, to config.Configuration) bool {
 			}
 		}
 
-		// Check if anything else differs, apart from the device list and label.
+		// The selection of paths to pull is handled without restart; the
+		// puller uses the new selection on its next iteration.
+		if fromCfg.SelectiveSync != toCfg.SelectiveSync || !reflect.DeepEqual(fromCfg.SelectedPaths, toCfg.SelectedPaths) {
+			m.fmut.Lock()
+			cfg := m.folderCfgs[folderID]
+			cfg.SelectiveSync = toCfg.SelectiveSync
+			cfg.SelectedPaths = toCfg.SelectedPaths
+			m.folderCfgs[folderID] = cfg
+			runner, ok := m.folderRunners[folderID]
+			m.fmut.Unlock()
+			if ok {
+				runner.IndexUpdated()
+			}
+		}
+
+		// The schedule is looked up whenever it is needed, so it only needs
+		// to be updated.
+		if !reflect.DeepEqual(fromCfg.Schedule, toCfg.Schedule) {
+			m.fmut.Lock()
+			cfg := m.folderCfgs[folderID]
+			cfg.Schedule = toCfg.Schedule
+			m.folderCfgs[folderID] = cfg
+			m.fmut.Unlock()
+			m.setFolderSchedule(folderID, toCfg.Schedule)
+		}
+
+		// Check if anything else differs, apart from the device list, label,
+		// selection and schedule.
 		fromCfg.Devices = nil
 		toCfg.Devices = nil
 		fromCfg.Label = ""
 		toCfg.Label = ""
+		fromCfg.SelectiveSync, fromCfg.SelectedPaths = false, nil
+		toCfg.SelectiveSync, toCfg.SelectedPaths = false, nil
+		fromCfg.Schedule = config.ScheduleConfiguration{}
+		toCfg.Schedule = config.ScheduleConfiguration{}
 		if !reflect.DeepEqual(fromCfg, toCfg) {
 			l.Debugln(m, "requires restart, folder", folderID, "configuration differs")
 			return false
 		}
 	}
 
+	// Newly revoked devices are disconnected, if they weren't already as
+	// part of being removed from the folders.
+	fromRevoked := mapDevices(from.RevokedDevices)
+	for _, dev := range to.RevokedDevices {
+		if _, ok := fromRevoked[dev]; ok {
+			continue
+		}
+		events.Default.Log(events.DeviceRevoked, map[string]string{
+			"device": dev.String(),
+		})
+		m.pmut.Lock()
+		if conn, ok := m.conn[dev]; ok {
+			closeRawConn(conn)
+		}
+		m.pmut.Unlock()
+	}
+
 	// Removing a device requires restart
 	toDevs := mapDeviceCfgs(from.Devices)
 	for _, dev := range from.Devices {
@@ -2018,6 +2670,9 @@ func (m *Model) CommitConfiguration(from, to config.Configuration) bool {
 	// by themselves.
 	from.Options.URAccepted = to.Options.URAccepted
 	from.Options.URUniqueID = to.Options.URUniqueID
+	from.Options.MaxSendKbps = to.Options.MaxSendKbps
+	from.Options.MaxRecvKbps = to.Options.MaxRecvKbps
+	from.Options.BandwidthSchedule = to.Options.BandwidthSchedule
 	// All of the other generic options require restart. Or at least they may;
 	// removing this check requires going through those options carefully and
 	// making sure there are individual services that handle them correctly.
@@ -2062,12 +2717,16 @@ func mapDeviceCfgs(devices []config.DeviceConfiguration) map[protocol.DeviceID]s
 	return m
 }
 
-func filterIndex(folder string, fs []protocol.FileInfo, dropDeletes bool, ignores *ignore.Matcher) []protocol.FileInfo {
+func filterIndex(folder string, fs []protocol.FileInfo, dropDeletes, sharedIgnores bool, ignores *ignore.Matcher) []protocol.FileInfo {
 	for i := 0; i < len(fs); {
 		if fs[i].Flags&^protocol.FlagsAll != 0 {
 			l.Debugln("dropping update for file with unknown bits set", fs[i])
 			fs[i] = fs[len(fs)-1]
 			fs = fs[:len(fs)-1]
+		} else if isLocalIgnoreFile(fs[i].Name, sharedIgnores) {
+			l.Debugln("dropping update for device local ignore file", fs[i])
+			fs[i] = fs[len(fs)-1]
+			fs = fs[:len(fs)-1]
 		} else if fs[i].IsDeleted() && dropDeletes {
 			l.Debugln("dropping update for undesired delete", fs[i])
 			fs[i] = fs[len(fs)-1]
@@ -2087,6 +2746,20 @@ func filterIndex(folder string, fs []protocol.FileInfo, dropDeletes bool, ignore
 	return fs
 }
 
+// isLocalIgnoreFile returns true if the named file holds ignore patterns
+// that must not be overwritten by other devices. That is the local override
+// file, and the .stignore file itself unless the folder shares its ignores.
+func isLocalIgnoreFile(name string, sharedIgnores bool) bool {
+	switch name {
+	case ".stignore":
+		return !sharedIgnores
+	case ".stignore" + ignore.LocalSuffix:
+		return true
+	default:
+		return false
+	}
+}
+
 func symlinkInvalid(folder string, fi db.FileIntf) bool {
 	if !symlinks.Supported && fi.IsSymlink() && !fi.IsInvalid() && !fi.IsDeleted() {
 		symlinkWarning.Do(func() {
@@ -17,7 +17,9 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	stdsync "sync"
 	"testing"
 	"time"
 
@@ -25,7 +27,9 @@ import (
 	"github.com/syncthing/syncthing/lib/config"
 	"github.com/syncthing/syncthing/lib/connections"
 	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/events"
 	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/tlsutil"
 )
 
 var device1, device2 protocol.DeviceID
@@ -135,6 +139,108 @@ func TestRequest(t *testing.T) {
 	}
 }
 
+func TestRequestSchedule(t *testing.T) {
+	// A window without any allowed operations, covering all of the time.
+	blocked := config.ScheduleConfiguration{
+		Windows: []config.ScheduleWindow{{Days: "*"}},
+	}
+
+	fcfg := defaultFolderConfig.Copy()
+	dcfg := config.NewDeviceConfiguration(device1, "device1")
+	w := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{dcfg},
+	})
+
+	m := NewModel(w, protocol.LocalDeviceID, "device", "syncthing", "dev", db.OpenMemory(), nil)
+	m.AddFolder(fcfg)
+	m.ServeBackground()
+	w.Subscribe(m)
+
+	bs := make([]byte, 6)
+	if err := m.Request(device1, "default", "foo", 0, nil, 0, nil, bs); err != nil {
+		t.Error("Unexpected error without schedule:", err)
+	}
+
+	// The folder may not be served.
+
+	fcfg.Schedule = blocked
+	w.SetFolder(fcfg)
+	if err := m.Request(device1, "default", "foo", 0, nil, 0, nil, bs); err != protocol.ErrGeneric {
+		t.Error("Expected request outside of folder schedule to fail, got", err)
+	}
+
+	// Neither may the device.
+
+	fcfg.Schedule = config.ScheduleConfiguration{}
+	w.SetFolder(fcfg)
+	dcfg.Schedule = blocked
+	w.SetDevice(dcfg)
+	if err := m.Request(device1, "default", "foo", 0, nil, 0, nil, bs); err != protocol.ErrGeneric {
+		t.Error("Expected request outside of device schedule to fail, got", err)
+	}
+	if avail := m.filterScheduledAvailability([]Availability{{ID: device1}}); len(avail) != 0 {
+		t.Error("Device outside of schedule should not be pulled from")
+	}
+
+	// Serving with a bandwidth cap is allowed.
+
+	dcfg.Schedule.Windows[0].Allow = "serve"
+	dcfg.Schedule.Windows[0].MaxSendKbps = 1000
+	w.SetDevice(dcfg)
+	if err := m.Request(device1, "default", "foo", 0, nil, 0, nil, bs); err != nil {
+		t.Error("Unexpected error with capped schedule:", err)
+	}
+}
+
+func TestScheduleLimitDirections(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.Schedule = config.ScheduleConfiguration{
+		Windows: []config.ScheduleWindow{{Days: "*", Allow: "serve,pull", MaxSendKbps: 100, MaxRecvKbps: 200}},
+	}
+	dcfg := config.NewDeviceConfiguration(device1, "device1")
+	dcfg.Schedule = config.ScheduleConfiguration{
+		Windows: []config.ScheduleWindow{{Days: "*", Allow: "serve,pull", MaxSendKbps: 300, MaxRecvKbps: 400}},
+	}
+	w := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{dcfg},
+	})
+
+	m := NewModel(w, protocol.LocalDeviceID, "device", "syncthing", "dev", db.OpenMemory(), nil)
+	m.AddFolder(fcfg)
+
+	// Sending and receiving each keep their own buckets at their own caps,
+	// rather than replacing each other's.
+
+	m.limitSend("default", device1, 1)
+	m.limitRecv("default", device1, 1)
+	buckets := make(map[string]interface{})
+	for key, bucket := range m.scheduleLimiter.buckets {
+		buckets[key] = bucket
+	}
+	m.limitSend("default", device1, 1)
+	m.limitRecv("default", device1, 1)
+
+	expected := map[string]int{
+		"send:folder:default":             100,
+		"recv:folder:default":             200,
+		"send:device:" + device1.String(): 300,
+		"recv:device:" + device1.String(): 400,
+	}
+	if len(m.scheduleLimiter.rates) != len(expected) {
+		t.Errorf("Unexpected buckets %v", m.scheduleLimiter.rates)
+	}
+	for key, rate := range expected {
+		if r := m.scheduleLimiter.rates[key]; r != rate {
+			t.Errorf("Incorrect rate %d != %d for %s", r, rate, key)
+		}
+		if buckets[key] != interface{}(m.scheduleLimiter.buckets[key]) {
+			t.Errorf("Bucket for %s was recreated", key)
+		}
+	}
+}
+
 func genFiles(n int) []protocol.FileInfo {
 	files := make([]protocol.FileInfo, n)
 	t := time.Now().Unix()
@@ -479,6 +585,182 @@ func TestClusterConfig(t *testing.T) {
 	}
 }
 
+// indexRecordingConnection records the index messages sent to it.
+type indexRecordingConnection struct {
+	*FakeConnection
+	mut     stdsync.Mutex
+	indexes [][]protocol.FileInfo
+	updates [][]protocol.FileInfo
+	options []protocol.Option
+}
+
+func (c *indexRecordingConnection) Index(folder string, fs []protocol.FileInfo, flags uint32, options []protocol.Option) error {
+	c.mut.Lock()
+	c.indexes = append(c.indexes, fs)
+	c.options = options
+	c.mut.Unlock()
+	return nil
+}
+
+func (c *indexRecordingConnection) IndexUpdate(folder string, fs []protocol.FileInfo, flags uint32, options []protocol.Option) error {
+	c.mut.Lock()
+	c.updates = append(c.updates, fs)
+	c.options = options
+	c.mut.Unlock()
+	return nil
+}
+
+func (c *indexRecordingConnection) received() (indexes, updates [][]protocol.FileInfo, options []protocol.Option) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.indexes, c.updates, c.options
+}
+
+func TestDeltaIndexExchange(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.Devices = append(fcfg.Devices, config.FolderDeviceConfiguration{DeviceID: protocol.LocalDeviceID})
+
+	db := db.OpenMemory()
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db, nil)
+	m.AddFolder(fcfg)
+	m.ServeBackground()
+	m.StartFolder("default")
+	m.ScanFolder("default")
+
+	fs := m.folderFiles["default"]
+	myIndexID := fs.IndexID(protocol.LocalDeviceID)
+	if myIndexID == 0 {
+		t.Fatal("Local index ID should be set")
+	}
+	if fs.IndexID(protocol.LocalDeviceID) != myIndexID {
+		t.Fatal("Local index ID should be stable")
+	}
+	myLocalVer := fs.LocalVersion(protocol.LocalDeviceID)
+
+	connect := func(myAnnouncedID protocol.IndexID, maxLocalVer int64) *indexRecordingConnection {
+		rc := &indexRecordingConnection{FakeConnection: &FakeConnection{id: device1}}
+		m.AddConnection(connections.Connection{
+			IntermediateConnection: connections.IntermediateConnection{
+				Conn: tls.Client(&fakeConn{}, nil),
+			},
+			Connection: rc,
+		}, protocol.HelloMessage{})
+
+		me := protocol.Device{ID: protocol.LocalDeviceID[:], MaxLocalVersion: maxLocalVer}
+		me.SetIndexID(myAnnouncedID)
+		peer := protocol.Device{ID: device1[:]}
+		peer.SetIndexID(42)
+		m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+			Folders: []protocol.Folder{{ID: "default", Devices: []protocol.Device{me, peer}}},
+		})
+		return rc
+	}
+
+	// An unknown index ID gets the full index.
+
+	rc := connect(12345, myLocalVer)
+	for i := 0; i < 100; i++ {
+		if indexes, _, _ := rc.received(); len(indexes) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	indexes, updates, options := rc.received()
+	if len(indexes) != 1 || len(updates) != 0 || len(indexes[0]) == 0 {
+		t.Fatalf("Expected one full index, got %d indexes and %d updates", len(indexes), len(updates))
+	}
+	if ver, ok := maxLocalVersionOption(options); !ok || ver != myLocalVer {
+		t.Errorf("Incorrect max local version option %v, expected %d", options, myLocalVer)
+	}
+
+	// The peer's index ID was recorded, and the full index is acknowledged
+	// once received.
+
+	if id := fs.IndexID(device1); id != 42 {
+		t.Errorf("Incorrect peer index ID %v != 42", id)
+	}
+	m.Index(device1, "default", []protocol.FileInfo{{Name: "remote", LocalVersion: 7, Version: protocol.Vector{{ID: 42, Value: 1}}}}, 0, []protocol.Option{{Key: indexOptionMaxLocalVersion, Value: "7"}})
+	cm := m.generateClusterConfig(device1)
+	for _, dev := range cm.Folders[0].Devices {
+		if bytes.Equal(dev.ID, device1[:]) && (dev.IndexID() != 42 || dev.MaxLocalVersion != 7) {
+			t.Errorf("Incorrect announcement of the peer's index: %v, %d", dev.IndexID(), dev.MaxLocalVersion)
+		}
+		if bytes.Equal(dev.ID, protocol.LocalDeviceID[:]) && (dev.IndexID() != myIndexID || dev.MaxLocalVersion != myLocalVer) {
+			t.Errorf("Incorrect announcement of our index: %v, %d", dev.IndexID(), dev.MaxLocalVersion)
+		}
+	}
+	m.Close(device1, protocol.ErrTimeout)
+
+	// The peer's index is kept while it's disconnected, as it will only send
+	// us what changed after what we announce.
+
+	if _, ok := fs.Get(device1, "remote"); !ok {
+		t.Error("The peer's index should be kept on disconnect")
+	}
+	cm = m.generateClusterConfig(device1)
+	for _, dev := range cm.Folders[0].Devices {
+		if bytes.Equal(dev.ID, device1[:]) && (dev.IndexID() != 42 || dev.MaxLocalVersion != 7) {
+			t.Errorf("Incorrect announcement of the peer's index after disconnect: %v, %d", dev.IndexID(), dev.MaxLocalVersion)
+		}
+	}
+
+	// Reconnecting with our index ID and local version gets nothing but the
+	// changes made after.
+
+	rc = connect(myIndexID, myLocalVer)
+	m.updateLocals("default", []protocol.FileInfo{{Name: "newfile", Version: protocol.Vector{{ID: 1, Value: 1}}}})
+	for i := 0; i < 100; i++ {
+		if _, updates, _ := rc.received(); len(updates) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	indexes, updates, _ = rc.received()
+	if len(indexes) != 0 || len(updates) != 1 || len(updates[0]) != 1 || updates[0][0].Name != "newfile" {
+		t.Errorf("Expected only the new file in an update, got %d indexes and updates %v", len(indexes), updates)
+	}
+
+	// The peer likewise sends only its changes; together with what we kept
+	// its index is complete.
+
+	m.IndexUpdate(device1, "default", []protocol.FileInfo{{Name: "remote2", LocalVersion: 8, Version: protocol.Vector{{ID: 42, Value: 2}}}}, 0, []protocol.Option{{Key: indexOptionMaxLocalVersion, Value: "8"}})
+	for _, name := range []string{"remote", "remote2"} {
+		if _, ok := fs.Get(device1, name); !ok {
+			t.Errorf("The peer's index lacks %q after reconnect", name)
+		}
+	}
+	m.Close(device1, protocol.ErrTimeout)
+}
+
+func TestUnshareForgetsIndexID(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	w := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{config.NewDeviceConfiguration(device1, "device1")},
+	})
+
+	m := NewModel(w, protocol.LocalDeviceID, "device", "syncthing", "dev", db.OpenMemory(), nil)
+	m.AddFolder(fcfg)
+	m.ServeBackground()
+	w.Subscribe(m)
+
+	fs := m.folderFiles["default"]
+	fs.SetIndexID(device1, 42)
+	m.Index(device1, "default", []protocol.FileInfo{{Name: "remote", LocalVersion: 7, Version: protocol.Vector{{ID: 42, Value: 1}}}}, 0, []protocol.Option{{Key: indexOptionMaxLocalVersion, Value: "7"}})
+
+	// The dropped index must not be announced as if we still had it, when
+	// the folder is shared again.
+
+	fcfg.Devices = nil
+	w.SetFolder(fcfg)
+	if _, ok := fs.Get(device1, "remote"); ok {
+		t.Error("The index of the unshared device should be dropped")
+	}
+	if id, ver := fs.IndexID(device1), fs.MaxLocalVersion(device1); id != 0 || ver != 0 {
+		t.Errorf("Index ID %v and max local version %d should be forgotten", id, ver)
+	}
+}
+
 func TestIgnores(t *testing.T) {
 	arrEqual := func(a, b []string) bool {
 		if len(a) != len(b) {
@@ -569,6 +851,52 @@ func TestIgnores(t *testing.T) {
 	}
 }
 
+func TestIgnoreDryRunAndExplain(t *testing.T) {
+	ioutil.WriteFile("testdata/.stfolder", nil, 0644)
+	ioutil.WriteFile("testdata/.stignore", []byte(".*\nquux\n"), 0644)
+
+	db := db.OpenMemory()
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db, nil)
+	m.AddFolder(defaultFolderConfig)
+	m.StartFolder("default")
+	m.ServeBackground()
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, lines, err := m.IgnoreDryRun("default", []string{"ba*", "["})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if len(files) != 2 || files[0] != "bar" || files[1] != "baz" {
+		t.Errorf("Incorrect files to become ignored: %v", files)
+	}
+	if len(lines) != 2 || lines[1].Error == "" {
+		t.Errorf("Expected an error for the second line: %v", lines)
+	}
+
+	exp, err := m.ExplainIgnore("default", ".hidden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exp.Ignored || exp.Source != ".stignore" || exp.Line != 1 {
+		t.Errorf("Incorrect explanation for .hidden: %+v", exp)
+	}
+
+	exp, err = m.ExplainIgnore("default", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp.Ignored || exp.Pattern != "" {
+		t.Errorf("Incorrect explanation for foo: %+v", exp)
+	}
+
+	if _, err := m.ExplainIgnore("doesnotexist", "foo"); err == nil {
+		t.Error("No error")
+	}
+}
+
 func TestRefuseUnknownBits(t *testing.T) {
 	db := db.OpenMemory()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db, nil)
@@ -1256,6 +1584,31 @@ func TestIgnoreDelete(t *testing.T) {
 	}
 }
 
+func TestSharedIgnoresIndex(t *testing.T) {
+	files := []protocol.FileInfo{
+		{Name: ".stignore"},
+		{Name: ".stignore.local"},
+		{Name: "foo"},
+	}
+
+	// Without shared ignores neither ignore file is accepted from others.
+	fs := filterIndex("default", append([]protocol.FileInfo(nil), files...), false, false, nil)
+	if len(fs) != 1 || fs[0].Name != "foo" {
+		t.Errorf("unexpected filtered index %v", fs)
+	}
+
+	// With shared ignores the .stignore file is accepted, but never the
+	// local override.
+	fs = filterIndex("default", append([]protocol.FileInfo(nil), files...), false, true, nil)
+	names := make(map[string]bool)
+	for _, f := range fs {
+		names[f.Name] = true
+	}
+	if len(fs) != 2 || !names[".stignore"] || !names["foo"] {
+		t.Errorf("unexpected filtered index %v", fs)
+	}
+}
+
 func TestUnifySubs(t *testing.T) {
 	cases := []struct {
 		in     []string // input to unifySubs
@@ -1403,3 +1756,176 @@ func (fakeConn) SetReadDeadline(time.Time) error {
 func (fakeConn) SetWriteDeadline(time.Time) error {
 	return nil
 }
+
+func TestIntroducerRemovalsAndRevocations(t *testing.T) {
+	device3 := protocol.NewDeviceID([]byte("introduced device"))
+
+	cfg := config.New(device1)
+	cfg.Devices = []config.DeviceConfiguration{
+		{DeviceID: device1},
+		{DeviceID: device2, Introducer: true},
+	}
+	cfg.Folders = []config.FolderConfiguration{
+		{
+			ID:      "folder1",
+			RawPath: "testdata",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+				{DeviceID: device2},
+			},
+		},
+	}
+	wcfg := config.Wrap("/tmp/test", cfg)
+
+	db := db.OpenMemory()
+	m := NewModel(wcfg, device1, "device", "syncthing", "dev", db, nil)
+	m.AddFolder(cfg.Folders[0])
+	m.ServeBackground()
+	wcfg.Subscribe(m)
+
+	announce := func(devices ...protocol.DeviceID) protocol.ClusterConfigMessage {
+		folder := protocol.Folder{ID: "folder1"}
+		for _, dev := range devices {
+			dev := dev
+			folder.Devices = append(folder.Devices, protocol.Device{ID: dev[:]})
+		}
+		return protocol.ClusterConfigMessage{Folders: []protocol.Folder{folder}}
+	}
+	sharedWith := func(dev protocol.DeviceID) bool {
+		for _, fdev := range wcfg.Folders()["folder1"].Devices {
+			if fdev.DeviceID == dev {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The introducer adds a device, which is marked as introduced by it.
+
+	m.ClusterConfig(device2, announce(device1, device2, device3))
+	if dev, ok := wcfg.Devices()[device3]; !ok || !dev.IsIntroducedBy(device2) {
+		t.Fatalf("Device should have been introduced, got %+v", dev)
+	}
+	if !sharedWith(device3) {
+		t.Fatal("Folder should be shared with the introduced device")
+	}
+
+	// When the introducer stops sharing the folder with it, so do we.
+
+	m.ClusterConfig(device2, announce(device1, device2))
+	if _, ok := wcfg.Devices()[device3]; ok {
+		t.Error("Device should have been removed")
+	}
+	if sharedWith(device3) {
+		t.Error("Folder should no longer be shared with the removed device")
+	}
+	if m.folderSharedWith("folder1", device3) {
+		t.Error("Model should no longer share the folder with the removed device")
+	}
+
+	// A revocation removes the device and keeps it from being introduced
+	// again.
+
+	sub := events.Default.Subscribe(events.DeviceRevoked)
+	defer events.Default.Unsubscribe(sub)
+
+	m.ClusterConfig(device2, announce(device1, device2, device3))
+	cm := announce(device1, device2, device3)
+	cm.AddRevokedDevice(device3)
+	m.ClusterConfig(device2, cm)
+
+	if !wcfg.RevokedDevice(device3) {
+		t.Error("Device should have been revoked")
+	}
+	if _, ok := wcfg.Devices()[device3]; ok {
+		t.Error("Revoked device should have been removed")
+	}
+	if sharedWith(device3) {
+		t.Error("Folder should no longer be shared with the revoked device")
+	}
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal("No DeviceRevoked event:", err)
+	}
+	if dev := ev.Data.(map[string]string)["device"]; dev != device3.String() {
+		t.Errorf("Incorrect revoked device %s", dev)
+	}
+
+	// Our revocations are announced in turn, and revoked devices are not
+	// introduced again.
+
+	cm = m.generateClusterConfig(device2)
+	if ids := cm.RevokedDevices(); len(ids) != 1 || ids[0] != device3 {
+		t.Errorf("Incorrect announced revocations %v", ids)
+	}
+	m.ClusterConfig(device2, announce(device1, device2, device3))
+	if _, ok := wcfg.Devices()[device3]; ok {
+		t.Error("Revoked device should not be introduced again")
+	}
+}
+
+func TestDeviceIDTransition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certs := make([]tls.Certificate, 4)
+	ids := make([]protocol.DeviceID, len(certs))
+	for i := range certs {
+		certFile := filepath.Join(dir, fmt.Sprintf("cert%d.pem", i))
+		keyFile := filepath.Join(dir, fmt.Sprintf("key%d.pem", i))
+		certs[i], err = tlsutil.NewCertificateWithKeyType(certFile, keyFile, "syncthing", tlsutil.KeyTypeEd25519)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = protocol.NewDeviceID(certs[i].Certificate[0])
+	}
+	me, peer, other, next := ids[0], ids[1], ids[2], ids[3]
+
+	cfg := config.New(me)
+	cfg.Devices = []config.DeviceConfiguration{
+		{DeviceID: me},
+		{DeviceID: peer, Name: "peer"},
+		{DeviceID: other, Name: "other"},
+	}
+	wcfg := config.Wrap(filepath.Join(dir, "config.xml"), cfg)
+	m := NewModel(wcfg, me, "device", "syncthing", "dev", db.OpenMemory(), nil)
+
+	announce := func(from protocol.DeviceID, to int) {
+		tr, err := protocol.NewDeviceIDTransition(certs[1], certs[to])
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.ClusterConfig(from, protocol.ClusterConfigMessage{Options: tr.Options()})
+	}
+
+	// The peer may not take over our own device ID, nor that of another
+	// configured device.
+
+	announce(peer, 0)
+	announce(peer, 2)
+	if err := m.ApplyDeviceIDTransition(peer, other); err != errDeviceIDInUse {
+		t.Errorf("Unexpected error for a transition to a device ID in use: %v", err)
+	}
+	devs := wcfg.Devices()
+	if devs[peer].Name != "peer" || devs[other].Name != "other" || devs[me].Name == "peer" {
+		t.Fatalf("Transition to a device ID in use was applied: %v", devs)
+	}
+
+	// A transition to a new device ID is applied, also when announced from
+	// the new device ID after the peer has restarted.
+
+	announce(next, 3)
+	devs = wcfg.Devices()
+	if _, ok := devs[peer]; ok {
+		t.Error("Old device ID should be gone")
+	}
+	if devs[next].Name != "peer" {
+		t.Errorf("Configuration not moved to the new device ID: %v", devs)
+	}
+	if err := m.ApplyDeviceIDTransition(peer, next); err == nil {
+		t.Error("Unexpected success for a transition already done")
+	}
+}
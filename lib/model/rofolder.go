@@ -57,8 +57,14 @@ func (f *roFolder) Serve() {
 			return
 
 		case <-f.scan.timer.C:
+			if !f.model.folderScheduleState(f.folderID).Scan {
+				l.Debugln(f, "skip scan (schedule)")
+				f.scan.timer.Reset(scheduleRecheckInterval)
+				continue
+			}
+
 			if err := f.model.CheckFolderHealth(f.folderID); err != nil {
-				l.Infoln("Skipping folder", f.folderID, "scan due to folder error:", err)
+				folderLogger(f.folderID).Infoln("Skipping folder", f.folderID, "scan due to folder error:", err)
 				f.scan.reschedule()
 				continue
 			}
@@ -76,7 +82,7 @@ func (f *roFolder) Serve() {
 			}
 
 			if !initialScanCompleted {
-				l.Infoln("Completed initial scan (ro) of folder", f.folderID)
+				folderLogger(f.folderID).Infoln("Completed initial scan (ro) of folder", f.folderID)
 				initialScanCompleted = true
 			}
 
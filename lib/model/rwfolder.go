@@ -7,6 +7,9 @@
 package model
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -53,8 +56,9 @@ type copyBlocksState struct {
 const retainBits = os.ModeSetgid | os.ModeSetuid | os.ModeSticky
 
 var (
-	activity    = newDeviceActivity()
-	errNoDevice = errors.New("peers who had this file went away, or the file has changed while syncing. will retry later")
+	activity          = newDeviceActivity()
+	errNoDevice       = errors.New("peers who had this file went away, or the file has changed while syncing. will retry later")
+	errNoTempProgress = errors.New("no usable temp file progress")
 )
 
 const (
@@ -81,6 +85,7 @@ type rwFolder struct {
 	folder
 
 	virtualMtimeRepo *db.VirtualMtimeRepo
+	tempProgress     *db.TempProgressRepo
 	dir              string
 	versioner        versioner.Versioner
 	ignorePerms      bool
@@ -92,6 +97,7 @@ type rwFolder struct {
 	pause            time.Duration
 	allowSparse      bool
 	checkFreeSpace   bool
+	sharedIgnores    bool
 
 	queue       *jobQueue
 	dbUpdates   chan dbUpdateJob
@@ -120,6 +126,7 @@ func newRWFolder(model *Model, cfg config.FolderConfiguration, ver versioner.Ver
 		},
 
 		virtualMtimeRepo: db.NewVirtualMtimeRepo(model.db, cfg.ID),
+		tempProgress:     db.NewTempProgressRepo(model.db, cfg.ID),
 		dir:              cfg.Path(),
 		ignorePerms:      cfg.IgnorePerms,
 		copiers:          cfg.Copiers,
@@ -128,6 +135,7 @@ func newRWFolder(model *Model, cfg config.FolderConfiguration, ver versioner.Ver
 		maxConflicts:     cfg.MaxConflicts,
 		allowSparse:      !cfg.DisableSparseFiles,
 		checkFreeSpace:   cfg.MinDiskFreePct != 0,
+		sharedIgnores:    cfg.SharedIgnores,
 		versioner:        ver,
 
 		queue:       newJobQueue(),
@@ -206,6 +214,12 @@ func (f *rwFolder) Serve() {
 				continue
 			}
 
+			if !f.model.folderScheduleState(f.folderID).Pull {
+				l.Debugln(f, "skip (schedule)")
+				f.pullTimer.Reset(scheduleRecheckInterval)
+				continue
+			}
+
 			f.model.fmut.RLock()
 			curIgnores := f.model.folderIgnores[f.folderID]
 			f.model.fmut.RUnlock()
@@ -227,7 +241,7 @@ func (f *rwFolder) Serve() {
 			}
 
 			if err := f.model.CheckFolderHealth(f.folderID); err != nil {
-				l.Infoln("Skipping folder", f.folderID, "pull due to folder error:", err)
+				folderLogger(f.folderID).Infoln("Skipping folder", f.folderID, "pull due to folder error:", err)
 				f.pullTimer.Reset(f.sleep)
 				continue
 			}
@@ -241,6 +255,14 @@ func (f *rwFolder) Serve() {
 			for {
 				tries++
 
+				if tries > 1 && !f.model.folderScheduleState(f.folderID).Pull {
+					// The schedule window changed during the pull. Leave
+					// prevVer as is, so that we pick up where we left off.
+					l.Debugln(f, "stopping pull (schedule)")
+					f.pullTimer.Reset(scheduleRecheckInterval)
+					break
+				}
+
 				changed := f.pullerIteration(curIgnores)
 				l.Debugln(f, "changed", changed)
 
@@ -249,6 +271,8 @@ func (f *rwFolder) Serve() {
 					// sync. Remember the local version number and
 					// schedule a resync a little bit into the future.
 
+					f.model.forgetFetched(f.folderID)
+
 					if lv, ok := f.model.RemoteLocalVersion(f.folderID); ok && lv < curVer {
 						// There's a corner case where the device we needed
 						// files from disconnected during the puller
@@ -272,7 +296,7 @@ func (f *rwFolder) Serve() {
 					// we're not making it. Probably there are write
 					// errors preventing us. Flag this with a warning and
 					// wait a bit longer before retrying.
-					l.Infof("Folder %q isn't making progress. Pausing puller for %v.", f.folderID, f.pause)
+					folderLogger(f.folderID).Infof("Folder %q isn't making progress. Pausing puller for %v.", f.folderID, f.pause)
 					l.Debugln(f, "next pull in", f.pause)
 
 					if folderErrors := f.currentErrors(); len(folderErrors) > 0 {
@@ -292,13 +316,19 @@ func (f *rwFolder) Serve() {
 		// this is the easiest way to make sure we are not doing both at the
 		// same time.
 		case <-f.scan.timer.C:
+			if !f.model.folderScheduleState(f.folderID).Scan {
+				l.Debugln(f, "skip scan (schedule)")
+				f.scan.timer.Reset(scheduleRecheckInterval)
+				continue
+			}
+
 			err := f.scanSubdirsIfHealthy(nil)
 			f.scan.reschedule()
 			if err != nil {
 				continue
 			}
 			if !initialScanCompleted {
-				l.Infoln("Completed initial scan (rw) of folder", f.folderID)
+				folderLogger(f.folderID).Infoln("Completed initial scan (rw) of folder", f.folderID)
 				initialScanCompleted = true
 			}
 
@@ -377,6 +407,7 @@ func (f *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 
 	f.model.fmut.RLock()
 	folderFiles := f.model.folderFiles[f.folderID]
+	sel := f.model.folderSelection(f.folderID)
 	f.model.fmut.RUnlock()
 
 	// !!!
@@ -427,11 +458,17 @@ func (f *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 
 		file := intf.(protocol.FileInfo)
 
-		if ignores.Match(file.Name).IsIgnored() {
+		if ignores.MatchInfo(file.Name, lastFileInfoOf(folderFiles, file)).IsIgnored() {
 			// This is an ignored file. Skip it, continue iteration.
 			return true
 		}
 
+		if !sel.isSelected(file.Name, file.IsDirectory()) {
+			// Outside the selection of a selectively synced folder; remote
+			// only. Skip it, continue iteration.
+			return true
+		}
+
 		l.Debugln(f, "handling", file.Name)
 
 		if !handleFile(file) {
@@ -929,29 +966,25 @@ func (f *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 
 	var blocks []protocol.BlockInfo
 	var blocksSize int64
-	var reused []int32
 
 	// Check for an old temporary file which might have some blocks we could
-	// reuse.
-	tempBlocks, err := scanner.HashFile(tempName, protocol.BlockSize, 0, nil)
+	// reuse. If we recorded the progress of an earlier pull into it we trust
+	// that, otherwise the whole file is rehashed.
+	blocksHash := blockListHash(file.Blocks)
+	reused, err := f.resumeTempFile(file, tempName, blocksHash)
+	if err != nil {
+		reused, err = hashTempFile(file, tempName)
+	}
 	if err == nil {
-		// Check for any reusable blocks in the temp file
-		tempCopyBlocks, _ := scanner.BlockDiff(tempBlocks, file.Blocks)
-
-		// block.String() returns a string unique to the block
-		existingBlocks := make(map[string]struct{}, len(tempCopyBlocks))
-		for _, block := range tempCopyBlocks {
-			existingBlocks[block.String()] = struct{}{}
-		}
-
 		// Since the blocks are already there, we don't need to get them.
+		isReused := make(map[int32]struct{}, len(reused))
+		for _, idx := range reused {
+			isReused[idx] = struct{}{}
+		}
 		for i, block := range file.Blocks {
-			_, ok := existingBlocks[block.String()]
-			if !ok {
+			if _, ok := isReused[int32(i)]; !ok {
 				blocks = append(blocks, block)
 				blocksSize += int64(block.Size)
-			} else {
-				reused = append(reused, int32(i))
 			}
 		}
 
@@ -962,6 +995,7 @@ func (f *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 			// sharedpuller not to panic when it fails to exclusively create a
 			// file which already exists
 			osutil.InWritableDir(osutil.Remove, tempName)
+			f.tempProgress.Delete(file.Name)
 		}
 	} else {
 		// Copy the blocks, as we don't want to shuffle them on the FileInfo
@@ -971,7 +1005,7 @@ func (f *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 
 	if f.checkFreeSpace {
 		if free, err := osutil.DiskFreeBytes(f.dir); err == nil && free < blocksSize {
-			l.Warnf(`Folder "%s": insufficient disk space in %s for %s: have %.2f MiB, need %.2f MiB`, f.folderID, f.dir, file.Name, float64(free)/1024/1024, float64(blocksSize)/1024/1024)
+			folderLogger(f.folderID).Warnf(`Folder "%s": insufficient disk space in %s for %s: have %.2f MiB, need %.2f MiB`, f.folderID, f.dir, file.Name, float64(free)/1024/1024, float64(blocksSize)/1024/1024)
 			f.newError(file.Name, errors.New("insufficient space"))
 			return
 		}
@@ -1005,6 +1039,9 @@ func (f *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		version:          curFile.Version,
 		mut:              sync.NewRWMutex(),
 		sparse:           f.allowSparse,
+		progress:         f.tempProgress,
+		blocksHash:       blocksHash,
+		progressLen:      len(reused),
 	}
 
 	l.Debugf("%v need file %s; copy %d, reused %v", f, file.Name, len(blocks), reused)
@@ -1016,6 +1053,99 @@ func (f *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 	copyChan <- cs
 }
 
+// resumeTempFile returns the indexes of the blocks in the temporary file
+// that can be reused according to the recorded progress of an earlier pull.
+// The record is only trusted if the temporary file has the same size and
+// modification time as when it was recorded, i.e. it has not been written to
+// since; otherwise the file is hashed as usual. As the file is synced before
+// each record, the recorded blocks are on disk even after a crash. The blocks
+// recorded last are verified anyway, as a cheap check that the file is still
+// the one we recorded.
+func (f *rwFolder) resumeTempFile(file protocol.FileInfo, tempName string, blocksHash []byte) ([]int32, error) {
+	progress, ok := f.tempProgress.Get(file.Name)
+	if !ok {
+		return nil, errNoTempProgress
+	}
+
+	info, err := os.Stat(tempName)
+	if err != nil || !bytes.Equal(progress.BlocksHash, blocksHash) || info.Size() != progress.Size || info.ModTime().UnixNano() != progress.Modified {
+		l.Debugln(f, "temp progress for", file.Name, "is outdated")
+		f.tempProgress.Delete(file.Name)
+		return nil, errNoTempProgress
+	}
+
+	fd, err := os.Open(tempName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	tail := make(map[int32]struct{}, len(progress.Tail))
+	for _, idx := range progress.Tail {
+		tail[idx] = struct{}{}
+	}
+
+	var reused []int32
+	buf := make([]byte, protocol.BlockSize)
+	for i, block := range file.Blocks {
+		if !progress.IsVerified(i) {
+			continue
+		}
+		if _, ok := tail[int32(i)]; ok {
+			buf = buf[:block.Size]
+			if _, err := fd.ReadAt(buf, block.Offset); err != nil {
+				continue
+			}
+			if _, err := scanner.VerifyBuffer(buf, block); err != nil {
+				continue
+			}
+		}
+		reused = append(reused, int32(i))
+	}
+
+	l.Debugf("%v resuming %s; reused %d blocks, verified %d", f, file.Name, len(reused), len(progress.Tail))
+	return reused, nil
+}
+
+// hashTempFile returns the indexes of the blocks in the temporary file that
+// can be reused, by hashing all of it.
+func hashTempFile(file protocol.FileInfo, tempName string) ([]int32, error) {
+	tempBlocks, err := scanner.HashFile(tempName, protocol.BlockSize, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for any reusable blocks in the temp file
+	tempCopyBlocks, _ := scanner.BlockDiff(tempBlocks, file.Blocks)
+
+	// block.String() returns a string unique to the block
+	existingBlocks := make(map[string]struct{}, len(tempCopyBlocks))
+	for _, block := range tempCopyBlocks {
+		existingBlocks[block.String()] = struct{}{}
+	}
+
+	var reused []int32
+	for i, block := range file.Blocks {
+		if _, ok := existingBlocks[block.String()]; ok {
+			reused = append(reused, int32(i))
+		}
+	}
+	return reused, nil
+}
+
+// blockListHash returns a hash identifying the list of blocks, used to tell
+// whether recorded progress concerns the same version of a file.
+func blockListHash(blocks []protocol.BlockInfo) []byte {
+	h := sha256.New()
+	var size [4]byte
+	for _, block := range blocks {
+		binary.BigEndian.PutUint32(size[:], uint32(block.Size))
+		h.Write(size[:])
+		h.Write(block.Hash)
+	}
+	return h.Sum(nil)
+}
+
 // shortcutFile sets file mode and modification time, when that's the only
 // thing that has changed.
 func (f *rwFolder) shortcutFile(file protocol.FileInfo) error {
@@ -1185,6 +1315,7 @@ func (f *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 
 		var lastError error
 		candidates := f.model.Availability(f.folderID, state.file.Name, state.file.Version, state.block)
+		candidates = f.model.filterScheduledAvailability(candidates)
 		for {
 			// Select the least busy device to pull the block from. If we found no
 			// feasible device at all, fail the block (and in the long run, the
@@ -1203,6 +1334,7 @@ func (f *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 
 			// Fetch the block, while marking the selected device as in use so that
 			// leastBusy can select another device when someone else asks.
+			f.model.limitRecv(f.folderID, selected.ID, int(state.block.Size))
 			activity.using(selected)
 			buf, lastError := f.model.requestGlobal(selected.ID, f.folderID, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash, selected.FromTemporary)
 			activity.done(selected)
@@ -1218,6 +1350,7 @@ func (f *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 				l.Debugln("request:", f.folderID, state.file.Name, state.block.Offset, state.block.Size, "hash mismatch")
 				continue
 			}
+			f.model.history.Received(selected.ID, f.folderID, len(buf))
 
 			// Save the block data we got from the cluster
 			_, err = fd.WriteAt(buf, state.block.Offset)
@@ -1375,11 +1508,15 @@ func (f *rwFolder) dbUpdaterRoutine() {
 	defer tick.Stop()
 
 	handleBatch := func() {
-		found := false
+		pulled := 0
+		ignoresChanged := false
 		var lastFile protocol.FileInfo
 
 		for _, job := range batch {
 			files = append(files, job.file)
+			if f.sharedIgnores && job.file.Name == ".stignore" {
+				ignoresChanged = true
+			}
 			if job.file.IsInvalid() || (job.file.IsDirectory() && !job.file.IsSymlink()) {
 				continue
 			}
@@ -1388,14 +1525,18 @@ func (f *rwFolder) dbUpdaterRoutine() {
 				continue
 			}
 
-			found = true
+			pulled++
 			lastFile = job.file
 		}
 
 		f.model.updateLocals(f.folderID, files)
 
-		if found {
-			f.model.receivedFile(f.folderID, lastFile)
+		if pulled > 0 {
+			f.model.receivedFiles(f.folderID, lastFile, pulled)
+		}
+
+		if ignoresChanged {
+			f.reloadSharedIgnores()
 		}
 
 		batch = batch[:0]
@@ -1429,6 +1570,25 @@ loop:
 	}
 }
 
+// reloadSharedIgnores loads the ignore patterns after a new version of the
+// shared .stignore file has been pulled from another device.
+func (f *rwFolder) reloadSharedIgnores() {
+	f.model.fmut.RLock()
+	ignores := f.model.folderIgnores[f.folderID]
+	f.model.fmut.RUnlock()
+
+	if err := ignores.Load(filepath.Join(f.dir, ".stignore")); err != nil && !os.IsNotExist(err) {
+		folderLogger(f.folderID).Infof("Folder %q: loading shared ignores: %v", f.folderID, err)
+		return
+	}
+
+	folderLogger(f.folderID).Infof("Folder %q: ignore patterns updated by remote device", f.folderID)
+	events.Default.Log(events.FolderIgnoresChanged, map[string]interface{}{
+		"folder":   f.folderID,
+		"patterns": ignores.Patterns(),
+	})
+}
+
 func (f *rwFolder) inConflict(current, replacement protocol.Vector) bool {
 	if current.Concurrent(replacement) {
 		// Obvious case
@@ -1511,6 +1671,7 @@ func (f *rwFolder) newError(path string, err error) {
 	}
 
 	f.errors[path] = err.Error()
+	f.model.history.Failed(f.folderID)
 }
 
 func (f *rwFolder) clearErrors() {
@@ -1549,3 +1710,48 @@ func (l fileErrorList) Less(a, b int) bool {
 func (l fileErrorList) Swap(a, b int) {
 	l[a], l[b] = l[b], l[a]
 }
+
+// fileInfo presents the attributes of a file in the index as an
+// os.FileInfo, for evaluating ignore patterns with attribute predicates.
+type fileInfo struct {
+	file protocol.FileInfo
+}
+
+// fileInfoOf returns the os.FileInfo for the file in the index, or nil if it
+// is deleted and thus lacks attributes.
+func fileInfoOf(file protocol.FileInfo) os.FileInfo {
+	if file.IsDeleted() {
+		return nil
+	}
+	return fileInfo{file}
+}
+
+// lastFileInfoOf is like fileInfoOf, but for a deleted file it returns the
+// os.FileInfo of our own last version of it, so that attribute predicates
+// can protect the file from being deleted.
+func lastFileInfoOf(fs *db.FileSet, file protocol.FileInfo) os.FileInfo {
+	if !file.IsDeleted() {
+		return fileInfo{file}
+	}
+	if cur, ok := fs.Get(protocol.LocalDeviceID, file.Name); ok {
+		return fileInfoOf(cur)
+	}
+	return nil
+}
+
+func (i fileInfo) Name() string       { return filepath.Base(i.file.Name) }
+func (i fileInfo) Size() int64        { return i.file.Size() }
+func (i fileInfo) ModTime() time.Time { return time.Unix(i.file.Modified, 0) }
+func (i fileInfo) IsDir() bool        { return i.file.IsDirectory() }
+func (i fileInfo) Sys() interface{}   { return nil }
+
+func (i fileInfo) Mode() os.FileMode {
+	mode := os.FileMode(i.file.Flags & 0777)
+	switch {
+	case i.file.IsDirectory():
+		mode |= os.ModeDir
+	case i.file.IsSymlink():
+		mode |= os.ModeSymlink
+	}
+	return mode
+}
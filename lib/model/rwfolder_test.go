@@ -7,12 +7,16 @@
 package model
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/ignore"
 	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syncthing/syncthing/lib/scanner"
 	"github.com/syncthing/syncthing/lib/sync"
@@ -74,10 +78,11 @@ func setUpRwFolder(model *Model) rwFolder {
 			},
 			model: model,
 		},
-		dir:       "testdata",
-		queue:     newJobQueue(),
-		errors:    make(map[string]string),
-		errorsMut: sync.NewMutex(),
+		dir:          "testdata",
+		queue:        newJobQueue(),
+		errors:       make(map[string]string),
+		errorsMut:    sync.NewMutex(),
+		tempProgress: db.NewTempProgressRepo(model.db, "default"),
 	}
 }
 
@@ -165,6 +170,191 @@ func TestHandleFileWithTemp(t *testing.T) {
 	}
 }
 
+func TestHandleFileWithTempProgress(t *testing.T) {
+	// The temp file has the required blocks 2, 3, 4 and 7, at indexes 1, 2,
+	// 3 and 6. The recorded progress claims indexes 1, 2 and 5, of which 2
+	// and 5 are in the tail and verified. Block 6 is not at index 5, so we
+	// should reuse only indexes 1 and 2, and not look any further:
+	// Copy: 1, 4, 5, 6, 7, 8
+
+	existingBlocks := []int{0, 2, 0, 0, 5, 0, 0, 8}
+	existingFile := setUpFile("file", existingBlocks)
+	requiredFile := existingFile
+	requiredFile.Blocks = blocks[1:]
+
+	m := setUpModel(existingFile)
+	f := setUpRwFolder(m)
+
+	info, err := os.Stat(filepath.Join("testdata", defTempNamer.TempName("file")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := db.TempProgress{
+		BlocksHash: blockListHash(requiredFile.Blocks),
+		Size:       info.Size(),
+		Modified:   info.ModTime().UnixNano(),
+		Tail:       []int32{2, 5},
+	}
+	for _, idx := range []int{1, 2, 5} {
+		progress.SetVerified(idx)
+	}
+	f.tempProgress.Put("file", progress)
+
+	copyChan := make(chan copyBlocksState, 1)
+	f.handleFile(requiredFile, copyChan, nil)
+	toCopy := <-copyChan
+
+	if len(toCopy.blocks) != 6 {
+		t.Errorf("Unexpected count of copy blocks: %d != 6", len(toCopy.blocks))
+	}
+	for _, toCopyBlock := range toCopy.blocks {
+		if string(toCopyBlock.Hash) == string(blocks[2].Hash) || string(toCopyBlock.Hash) == string(blocks[3].Hash) {
+			t.Errorf("Block %s should have been reused", toCopyBlock.String())
+		}
+	}
+
+	// If the temp file has been touched since, the record is not trusted
+	// and the temp file is hashed as usual.
+
+	progress.Modified--
+	f.tempProgress.Put("file", progress)
+
+	f.handleFile(requiredFile, copyChan, nil)
+	toCopy = <-copyChan
+
+	if len(toCopy.blocks) != 4 {
+		t.Errorf("Unexpected count of copy blocks: %d != 4", len(toCopy.blocks))
+	}
+	if _, ok := f.tempProgress.Get("file"); ok {
+		t.Error("Outdated progress should have been removed")
+	}
+}
+
+func TestResumeAfterUnrecordedWrites(t *testing.T) {
+	// The temp file has the required blocks at indexes 1, 2, 3 and 6. The
+	// pull records index 1, then writes index 2 without recording it
+	// before "crashing". As the file was written to after the record,
+	// resuming should not trust it.
+
+	requiredFile := setUpFile("resume", []int{1, 2, 3, 4, 5, 6, 7, 8})
+	tempName := filepath.Join("testdata", defTempNamer.TempName("resume"))
+	bs, err := ioutil.ReadFile(filepath.Join("testdata", defTempNamer.TempName("file")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tempName, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempName)
+
+	m := setUpModel(requiredFile)
+	f := setUpRwFolder(m)
+
+	newState := func() *sharedPullerState {
+		return &sharedPullerState{
+			file:       requiredFile,
+			folder:     "default",
+			tempName:   tempName,
+			reused:     4,
+			progress:   f.tempProgress,
+			blocksHash: blockListHash(requiredFile.Blocks),
+			pullNeeded: 3,
+			mut:        sync.NewRWMutex(),
+		}
+	}
+	// pull writes the given blocks to the temp file, as the puller would.
+	// Only the first one is recorded, as the others come within the
+	// recording interval.
+	pull := func(s *sharedPullerState, idxs ...int) {
+		fd, err := s.tempFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range idxs {
+			block := requiredFile.Blocks[idx]
+			if _, err := fd.WriteAt(bs[block.Offset:block.Offset+int64(block.Size)], block.Offset); err != nil {
+				t.Fatal(err)
+			}
+			s.pullDone(block)
+		}
+	}
+
+	s := newState()
+	pull(s, 1, 2)
+
+	// Crash, without closing the state properly. The modification time is
+	// moved on explicitly, as the second write may well have happened
+	// within the timestamp granularity of the filesystem.
+	s.fd.Close()
+	p, _ := f.tempProgress.Get("resume")
+	mtime := time.Unix(0, p.Modified).Add(time.Second)
+	if err := os.Chtimes(tempName, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.resumeTempFile(requiredFile, tempName, s.blocksHash); err != errNoTempProgress {
+		t.Fatal("Unexpected error resuming a touched temp file:", err)
+	}
+	if _, ok := f.tempProgress.Get("resume"); ok {
+		t.Error("Outdated progress should have been removed")
+	}
+
+	// A failed pull that is closed properly records the blocks written
+	// since, along with the new modification time, and can be resumed.
+
+	s = newState()
+	pull(s, 1, 2)
+	s.fail("test", errors.New("failed"))
+	if _, err := s.finalClose(); err == nil {
+		t.Fatal("Unexpected nil error from a failed pull")
+	}
+
+	reused, err := f.resumeTempFile(requiredFile, tempName, s.blocksHash)
+	if err != nil {
+		t.Fatal("Unexpected error resuming:", err)
+	}
+	if len(reused) != 2 || reused[0] != 1 || reused[1] != 2 {
+		t.Errorf("Unexpected reused blocks %v != [1 2]", reused)
+	}
+}
+
+func TestIgnoredDeletionPredicates(t *testing.T) {
+	// A file of 1 MiB that we have, and that is deleted remotely
+	file := setUpFile("bigfile", []int{1, 2, 3, 4, 5, 6, 7, 8})
+	file.Version = file.Version.Update(protocol.LocalDeviceID.Short())
+	m := setUpModel(file)
+	m.Index(device1, "default", []protocol.FileInfo{{
+		Name:    "bigfile",
+		Flags:   protocol.FlagDeleted,
+		Version: file.Version.Update(device1.Short()),
+	}}, 0, nil)
+
+	ignores := ignore.New(false)
+	if err := ignores.Parse(bytes.NewBufferString("(?size>512k)bigfile\n"), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deletion has no size of its own, so the predicate is evaluated
+	// against our version of the file, which it protects.
+
+	fs := m.folderFiles["default"]
+	needed := 0
+	fs.WithNeed(protocol.LocalDeviceID, func(intf db.FileIntf) bool {
+		f := intf.(protocol.FileInfo)
+		needed++
+		if !f.IsDeleted() {
+			t.Errorf("Unexpected needed file %v", f)
+		}
+		if !ignores.MatchInfo(f.Name, lastFileInfoOf(fs, f)).IsIgnored() {
+			t.Error("Deletion of a file matching the predicate should be ignored")
+		}
+		return true
+	})
+	if needed != 1 {
+		t.Errorf("Expected one needed file, got %d", needed)
+	}
+}
+
 func TestCopierFinder(t *testing.T) {
 	// After diff between required and existing we should:
 	// Copy: 1, 2, 3, 4, 6, 7, 8
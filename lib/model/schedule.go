@@ -0,0 +1,121 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// How long to wait before checking the schedule again, when an operation is
+// not currently allowed. Schedule windows have minute granularity.
+const scheduleRecheckInterval = time.Minute
+
+// folderScheduleState returns what the schedule of the folder currently
+// allows.
+func (m *Model) folderScheduleState(folder string) config.ScheduleState {
+	m.smut.RLock()
+	sched := m.folderSchedules[folder]
+	m.smut.RUnlock()
+	return sched.StateAt(time.Now())
+}
+
+// deviceScheduleState returns what the schedule of the device currently
+// allows.
+func (m *Model) deviceScheduleState(device protocol.DeviceID) config.ScheduleState {
+	m.smut.RLock()
+	sched := m.deviceSchedules[device]
+	m.smut.RUnlock()
+	return sched.StateAt(time.Now())
+}
+
+// setFolderSchedule parses the schedule of the folder, so that it's not
+// parsed again on every lookup.
+func (m *Model) setFolderSchedule(folder string, sched config.ScheduleConfiguration) {
+	parsed := sched.Parse()
+	m.smut.Lock()
+	m.folderSchedules[folder] = parsed
+	m.smut.Unlock()
+}
+
+// setDeviceSchedules parses the schedules of the given devices, replacing
+// those of all devices.
+func (m *Model) setDeviceSchedules(devices []config.DeviceConfiguration) {
+	parsed := make(map[protocol.DeviceID]config.ParsedSchedule, len(devices))
+	for _, dev := range devices {
+		parsed[dev.DeviceID] = dev.Schedule.Parse()
+	}
+	m.smut.Lock()
+	m.deviceSchedules = parsed
+	m.smut.Unlock()
+}
+
+// filterScheduledAvailability removes the devices that we are not allowed
+// to pull from at the moment.
+func (m *Model) filterScheduledAvailability(availabilities []Availability) []Availability {
+	filtered := availabilities[:0]
+	for _, av := range availabilities {
+		if m.deviceScheduleState(av.ID).Pull {
+			filtered = append(filtered, av)
+		}
+	}
+	return filtered
+}
+
+// limitSend blocks until the schedules of the folder and device allow
+// sending the given number of bytes to the device.
+func (m *Model) limitSend(folder string, device protocol.DeviceID, bytes int) {
+	m.scheduleLimiter.wait("send:folder:"+folder, m.folderScheduleState(folder).MaxSendKbps, bytes)
+	m.scheduleLimiter.wait("send:device:"+device.String(), m.deviceScheduleState(device).MaxSendKbps, bytes)
+}
+
+// limitRecv blocks until the schedules of the folder and device allow
+// receiving the given number of bytes from the device. The caps are
+// separate from those for sending, so they use buckets of their own.
+func (m *Model) limitRecv(folder string, device protocol.DeviceID, bytes int) {
+	m.scheduleLimiter.wait("recv:folder:"+folder, m.folderScheduleState(folder).MaxRecvKbps, bytes)
+	m.scheduleLimiter.wait("recv:device:"+device.String(), m.deviceScheduleState(device).MaxRecvKbps, bytes)
+}
+
+// A scheduleLimiter enforces the bandwidth caps of schedule windows. There
+// is one bucket per key, which is recreated when the cap changes.
+type scheduleLimiter struct {
+	buckets map[string]*ratelimit.Bucket
+	rates   map[string]int
+	mut     sync.Mutex
+}
+
+func newScheduleLimiter() *scheduleLimiter {
+	return &scheduleLimiter{
+		buckets: make(map[string]*ratelimit.Bucket),
+		rates:   make(map[string]int),
+		mut:     sync.NewMutex(),
+	}
+}
+
+// wait blocks until the given number of bytes may be transferred under a
+// cap of kbps KiB/s. A cap of zero means no limit.
+func (l *scheduleLimiter) wait(key string, kbps, bytes int) {
+	if kbps <= 0 {
+		return
+	}
+
+	l.mut.Lock()
+	bucket, ok := l.buckets[key]
+	if !ok || l.rates[key] != kbps {
+		bucket = ratelimit.NewBucketWithRate(float64(1024*kbps), int64(5*1024*kbps))
+		l.buckets[key] = bucket
+		l.rates[key] = kbps
+	}
+	l.mut.Unlock()
+
+	bucket.Wait(int64(bytes))
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/osutil"
+)
+
+// A selection is the set of paths that are pulled in a folder using
+// selective sync. Everything else in the global tree is "remote only". Files
+// already present locally are scanned and synced as usual regardless of the
+// selection, so deselecting a directory does not remove anything.
+type selection struct {
+	paths []string
+}
+
+// newSelection returns the selection for the folder, or nil if the folder
+// does not use selective sync. A nil selection selects everything.
+func newSelection(cfg config.FolderConfiguration) *selection {
+	if !cfg.SelectiveSync {
+		return nil
+	}
+
+	s := &selection{}
+	for _, path := range cfg.SelectedPaths {
+		// Paths are relative to the folder root, with or without a leading
+		// slash.
+		path = strings.Trim(filepath.Clean(osutil.NativeFilename(path)), string(filepath.Separator))
+		if path == "." || path == "" {
+			// The folder root is selected, which is everything.
+			return nil
+		}
+		s.paths = append(s.paths, path)
+	}
+	return s
+}
+
+// with returns the selection extended with the given paths, as named in the
+// index. The receiver is not modified.
+func (s *selection) with(paths []string) *selection {
+	if s == nil || len(paths) == 0 {
+		return s
+	}
+	return &selection{paths: append(append([]string(nil), s.paths...), paths...)}
+}
+
+// isSelected returns true if the given file, as named in the index, should
+// be pulled. Files in the folder root are always selected, as are the
+// parent directories of the selected paths.
+func (s *selection) isSelected(name string, isDir bool) bool {
+	if s == nil {
+		return true
+	}
+
+	sep := string(filepath.Separator)
+	if !isDir && !strings.Contains(name, sep) {
+		return true
+	}
+
+	for _, path := range s.paths {
+		if name == path || strings.HasPrefix(name, path+sep) {
+			// The selected path or something within it
+			return true
+		}
+		if isDir && strings.HasPrefix(path, name+sep) {
+			// A parent of the selected path
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+func TestSelection(t *testing.T) {
+	cfg := config.FolderConfiguration{
+		SelectiveSync: true,
+		SelectedPaths: []string{"photos/2016", "docs/"},
+	}
+	sel := newSelection(cfg)
+
+	cases := []struct {
+		name     string
+		dir      bool
+		selected bool
+	}{
+		{"rootfile", false, true},
+		{"photos", true, true},
+		{"photos/2016", true, true},
+		{"photos/2016/img.jpg", false, true},
+		{"photos/2015", true, false},
+		{"photos/2015/img.jpg", false, false},
+		{"photos/20160", true, false},
+		{"docs", true, true},
+		{"docs/a/b.txt", false, true},
+		{"music", true, false},
+		{"music/song.mp3", false, false},
+	}
+
+	for _, tc := range cases {
+		name := filepath.FromSlash(tc.name)
+		if sel.isSelected(name, tc.dir) != tc.selected {
+			t.Errorf("Incorrect selection for %s; E: %v", tc.name, tc.selected)
+		}
+	}
+
+	// Without selective sync, or with the root selected, everything is
+	// selected.
+
+	cfg.SelectiveSync = false
+	if sel := newSelection(cfg); !sel.isSelected(filepath.FromSlash("music/song.mp3"), false) {
+		t.Error("Everything should be selected without selective sync")
+	}
+	cfg.SelectiveSync = true
+	cfg.SelectedPaths = []string{"/"}
+	if sel := newSelection(cfg); !sel.isSelected(filepath.FromSlash("music/song.mp3"), false) {
+		t.Error("Everything should be selected with the root selected")
+	}
+}
+
+func TestSelectionNeed(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.SelectiveSync = true
+	fcfg.SelectedPaths = []string{"selected"}
+
+	db := db.OpenMemory()
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db, nil)
+	m.AddFolder(fcfg)
+	m.ServeBackground()
+	m.ScanFolder("default")
+
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "selected", Flags: protocol.FlagDirectory, Version: protocol.Vector{{ID: 42, Value: 1}}},
+		{Name: filepath.Join("selected", "file"), Version: protocol.Vector{{ID: 42, Value: 1}}},
+		{Name: "other", Flags: protocol.FlagDirectory, Version: protocol.Vector{{ID: 42, Value: 1}}},
+		{Name: filepath.Join("other", "file"), Version: protocol.Vector{{ID: 42, Value: 1}}},
+	}, 0, nil)
+
+	if files, _ := m.NeedSize("default"); files != 2 {
+		t.Errorf("Incorrect need size %d != 2", files)
+	}
+	_, _, rest, total := m.NeedFolderFiles("default", 1, 10)
+	if total != 2 || len(rest) != 2 {
+		t.Errorf("Incorrect needed files %v", rest)
+	}
+	for _, f := range rest {
+		if f.Name != "selected" && f.Name != filepath.Join("selected", "file") {
+			t.Errorf("Unexpected needed file %s", f.Name)
+		}
+	}
+
+	tree := m.GlobalDirectoryTree("default", "other", -1, false)
+	if entry, ok := tree["file"].([]interface{}); !ok || len(entry) != 3 || entry[2] != true {
+		t.Errorf("Unselected file should be remote only: %v", tree)
+	}
+	tree = m.GlobalDirectoryTree("default", "selected", -1, false)
+	if entry, ok := tree["file"].([]interface{}); !ok || len(entry) != 2 {
+		t.Errorf("Selected file should not be remote only: %v", tree)
+	}
+}
+
+func TestSelectionFetch(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.SelectiveSync = true
+	fcfg.SelectedPaths = []string{"selected"}
+
+	db := db.OpenMemory()
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db, nil)
+	m.AddFolder(fcfg)
+	m.ServeBackground()
+	m.ScanFolder("default")
+
+	other := []protocol.FileInfo{
+		{Name: "other", Flags: protocol.FlagDirectory, Version: protocol.Vector{{ID: 42, Value: 1}}},
+		{Name: filepath.Join("other", "file"), Version: protocol.Vector{{ID: 42, Value: 1}}},
+	}
+	m.Index(device1, "default", append([]protocol.FileInfo{
+		{Name: "selected", Flags: protocol.FlagDirectory, Version: protocol.Vector{{ID: 42, Value: 1}}},
+	}, other...), 0, nil)
+
+	if err := m.FetchFile("default", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := m.NeedSize("default"); files != 3 {
+		t.Errorf("Incorrect need size %d != 3 after fetch", files)
+	}
+	if paths := m.folderCfgs["default"].SelectedPaths; len(paths) != 1 {
+		t.Errorf("Fetching should not change the selection: %v", paths)
+	}
+
+	// The fetch is remembered until there is nothing left to pull.
+
+	m.forgetFetched("default")
+	if files, _ := m.NeedSize("default"); files != 3 {
+		t.Errorf("Incorrect need size %d != 3 before pulling", files)
+	}
+
+	m.updateLocals("default", other)
+	m.forgetFetched("default")
+	if fetched := m.folderFetched["default"]; len(fetched) != 0 {
+		t.Errorf("Pulled fetch should be forgotten: %v", fetched)
+	}
+	if files, _ := m.NeedSize("default"); files != 1 {
+		t.Errorf("Incorrect need size %d != 1 after pulling", files)
+	}
+}
@@ -29,6 +29,8 @@ type sharedPullerState struct {
 	ignorePerms bool
 	version     protocol.Vector // The current (old) version
 	sparse      bool
+	progress    *db.TempProgressRepo // Where the progress is recorded, if anywhere
+	blocksHash  []byte               // Identifies the block list in the recorded progress
 
 	// Mutable, must be locked for access
 	err              error        // The first error we hit
@@ -42,9 +44,15 @@ type sharedPullerState struct {
 	closed           bool         // True if the file has been finalClosed.
 	available        []int32      // Indexes of the blocks that are available in the temporary file
 	availableUpdated time.Time    // Time when list of available blocks was last updated
+	progressLen      int          // Number of available blocks when the progress was last recorded
+	progressSaved    time.Time    // Time when the progress was last recorded
 	mut              sync.RWMutex // Protects the above
 }
 
+// The progress of a pull is recorded at most this often, so that it can be
+// resumed after a restart.
+const tempProgressInterval = 5 * time.Second
+
 // A momentary state representing the progress of the puller
 type pullerProgress struct {
 	Total               int   `json:"total"`
@@ -214,6 +222,7 @@ func (s *sharedPullerState) copyDone(block protocol.BlockInfo) {
 	s.updated = time.Now()
 	s.available = append(s.available, int32(block.Offset/protocol.BlockSize))
 	s.availableUpdated = time.Now()
+	s.saveProgressLocked(false)
 	l.Debugln("sharedPullerState", s.folder, s.file.Name, "copyNeeded ->", s.copyNeeded)
 	s.mut.Unlock()
 }
@@ -242,6 +251,7 @@ func (s *sharedPullerState) pullDone(block protocol.BlockInfo) {
 	s.updated = time.Now()
 	s.available = append(s.available, int32(block.Offset/protocol.BlockSize))
 	s.availableUpdated = time.Now()
+	s.saveProgressLocked(false)
 	l.Debugln("sharedPullerState", s.folder, s.file.Name, "pullNeeded done ->", s.pullNeeded)
 	s.mut.Unlock()
 }
@@ -265,6 +275,12 @@ func (s *sharedPullerState) finalClose() (bool, error) {
 		return false, nil
 	}
 
+	// A failed pull may be resumed from where we got. The record is saved
+	// while the temporary file is still open, so that it can be synced.
+	if s.err != nil {
+		s.saveProgressLocked(true)
+	}
+
 	if s.fd != nil {
 		if closeErr := s.fd.Close(); closeErr != nil && s.err == nil {
 			// This is our error if we weren't errored before. Otherwise we
@@ -276,9 +292,62 @@ func (s *sharedPullerState) finalClose() (bool, error) {
 
 	s.closed = true
 
+	// The record of a successful pull is no longer needed.
+	if s.err == nil && s.progress != nil {
+		s.progress.Delete(s.file.Name)
+	}
+
 	return true, s.err
 }
 
+// saveProgressLocked records which blocks are available in the temporary
+// file, unless it was recently done and force is false. The file is synced
+// first, so that the recorded blocks are on disk should we crash, and its
+// modification time recorded after that. A forced record is saved even when
+// no blocks were added, to keep the modification time current. The
+// temporary file must not be written to concurrently, which holding the lock
+// ensures.
+func (s *sharedPullerState) saveProgressLocked(force bool) {
+	if s.progress == nil || len(s.available) == 0 {
+		return
+	}
+	if !force && len(s.available) == s.progressLen {
+		return
+	}
+	if !force && time.Since(s.progressSaved) < tempProgressInterval {
+		return
+	}
+
+	var info os.FileInfo
+	var err error
+	if s.fd != nil {
+		if err = s.fd.Sync(); err == nil {
+			info, err = s.fd.Stat()
+		}
+	} else {
+		info, err = os.Stat(s.tempName)
+	}
+	if err != nil {
+		l.Debugln("sharedPullerState", s.folder, s.file.Name, "saving progress:", err)
+		return
+	}
+
+	p := db.TempProgress{
+		BlocksHash: s.blocksHash,
+		Size:       info.Size(),
+		Modified:   info.ModTime().UnixNano(),
+		Verified:   make([]byte, 0, (len(s.file.Blocks)+7)/8),
+		Tail:       s.available[s.progressLen:],
+	}
+	for _, idx := range s.available {
+		p.SetVerified(int(idx))
+	}
+	s.progress.Put(s.file.Name, p)
+
+	s.progressLen = len(s.available)
+	s.progressSaved = time.Now()
+}
+
 // Progress returns the momentarily progress for the puller
 func (s *sharedPullerState) Progress() *pullerProgress {
 	s.mut.RLock()
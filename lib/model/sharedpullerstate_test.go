@@ -7,9 +7,12 @@
 package model
 
 import (
+	"errors"
 	"os"
+	"reflect"
 	"testing"
 
+	"github.com/syncthing/syncthing/lib/db"
 	"github.com/syncthing/syncthing/lib/sync"
 )
 
@@ -85,3 +88,53 @@ func TestReadOnlyDir(t *testing.T) {
 	s.fail("Test done", nil)
 	s.finalClose()
 }
+
+func TestSaveProgress(t *testing.T) {
+	repo := db.NewTempProgressRepo(db.OpenMemory(), "default")
+	file := setUpFile("file", []int{1, 2, 3})
+
+	s := sharedPullerState{
+		file:       file,
+		tempName:   "testdata/" + defTempNamer.TempName("file"),
+		progress:   repo,
+		blocksHash: blockListHash(file.Blocks),
+		pullNeeded: 2,
+		mut:        sync.NewRWMutex(),
+	}
+
+	// The first completed block is recorded right away, the second one
+	// only when the pull fails.
+
+	s.pullDone(blocks[2])
+	s.pullDone(blocks[1])
+	if p, ok := repo.Get("file"); !ok {
+		t.Fatal("Progress should have been recorded")
+	} else if !p.IsVerified(1) || p.IsVerified(0) || !reflect.DeepEqual(p.Tail, []int32{1}) {
+		t.Errorf("Incorrect progress %+v", p)
+	}
+
+	s.fail("test", errors.New("test"))
+	if done, _ := s.finalClose(); !done {
+		t.Fatal("Should be closed")
+	}
+	if p, ok := repo.Get("file"); !ok {
+		t.Fatal("Progress should have been recorded")
+	} else if !p.IsVerified(0) || !p.IsVerified(1) || !reflect.DeepEqual(p.Tail, []int32{0}) {
+		t.Errorf("Incorrect progress %+v", p)
+	}
+
+	// The record of a successful pull is removed.
+
+	s = sharedPullerState{
+		file:     file,
+		tempName: s.tempName,
+		progress: repo,
+		mut:      sync.NewRWMutex(),
+	}
+	if done, err := s.finalClose(); !done || err != nil {
+		t.Fatal("Should be closed without error", err)
+	}
+	if _, ok := repo.Get("file"); ok {
+		t.Error("Progress should have been removed")
+	}
+}
@@ -102,3 +102,11 @@ func (w *AtomicWriter) Close() error {
 
 	return nil
 }
+
+// Discard closes and removes the temporary file, leaving the final path
+// untouched. It is invalid to call Write() or Close() after Discard().
+func (w *AtomicWriter) Discard() {
+	w.next.Close()
+	os.Remove(w.next.Name())
+	w.err = ErrClosed
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2016 The Protocol Authors.
+
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// The Device option used to announce an index ID in ClusterConfig messages.
+const optionIndexID = "indexID"
+
+// An IndexID identifies one incarnation of a device's index for a folder. It
+// is chosen at random when the index is created and changes whenever the
+// index is reset, so that a peer can tell whether the local versions it
+// remembers still refer to the same sequence of changes. The zero value
+// means "unknown".
+type IndexID uint64
+
+// NewIndexID returns a new, random, nonzero index ID.
+func NewIndexID() IndexID {
+	var bs [8]byte
+	for {
+		if _, err := io.ReadFull(rand.Reader, bs[:]); err != nil {
+			panic("randomness failure: " + err.Error())
+		}
+		if id := IndexID(binary.BigEndian.Uint64(bs[:])); id != 0 {
+			return id
+		}
+	}
+}
+
+func (i IndexID) String() string {
+	return fmt.Sprintf("0x%016X", uint64(i))
+}
+
+// IndexID returns the index ID announced for the device, or zero if there
+// is none.
+func (d Device) IndexID() IndexID {
+	for _, option := range d.Options {
+		if option.Key == optionIndexID {
+			id, err := strconv.ParseUint(option.Value, 16, 64)
+			if err != nil {
+				return 0
+			}
+			return IndexID(id)
+		}
+	}
+	return 0
+}
+
+// SetIndexID sets the index ID announced for the device.
+func (d *Device) SetIndexID(id IndexID) {
+	value := strconv.FormatUint(uint64(id), 16)
+	for i, option := range d.Options {
+		if option.Key == optionIndexID {
+			d.Options[i].Value = value
+			return
+		}
+	}
+	d.Options = append(d.Options, Option{Key: optionIndexID, Value: value})
+}
@@ -0,0 +1,30 @@
+// Copyright (C) 2016 The Protocol Authors.
+
+package protocol
+
+import "testing"
+
+func TestDeviceIndexID(t *testing.T) {
+	var d Device
+	if id := d.IndexID(); id != 0 {
+		t.Errorf("Unset index ID should be zero, not %v", id)
+	}
+
+	id := NewIndexID()
+	if id == 0 {
+		t.Fatal("New index ID should not be zero")
+	}
+	d.SetIndexID(id)
+	d.SetIndexID(id)
+	if len(d.Options) != 1 {
+		t.Errorf("Index ID should be set once, got options %v", d.Options)
+	}
+	if got := d.IndexID(); got != id {
+		t.Errorf("Incorrect index ID %v != %v", got, id)
+	}
+
+	d.Options[0].Value = "garbage"
+	if got := d.IndexID(); got != 0 {
+		t.Errorf("Invalid index ID should be zero, not %v", got)
+	}
+}
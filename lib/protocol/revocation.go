@@ -0,0 +1,37 @@
+// Copyright (C) 2016 The Protocol Authors.
+
+package protocol
+
+// The ClusterConfig option used to announce a revoked device. The option is
+// given once for each revoked device.
+const OptionRevokedDevice = "revokedDevice"
+
+// The maximum number of options in a ClusterConfig message.
+const maxClusterConfigOptions = 64
+
+// RevokedDevices returns the devices announced as revoked in the message.
+// Invalid device IDs are skipped.
+func (o *ClusterConfigMessage) RevokedDevices() []DeviceID {
+	var ids []DeviceID
+	for _, option := range o.Options {
+		if option.Key != OptionRevokedDevice {
+			continue
+		}
+		id, err := DeviceIDFromString(option.Value)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// AddRevokedDevice announces the device as revoked in the message. It
+// returns false if there is no room left for more options.
+func (o *ClusterConfigMessage) AddRevokedDevice(id DeviceID) bool {
+	if len(o.Options) >= maxClusterConfigOptions {
+		return false
+	}
+	o.Options = append(o.Options, Option{Key: OptionRevokedDevice, Value: id.String()})
+	return true
+}
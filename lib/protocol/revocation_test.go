@@ -0,0 +1,28 @@
+// Copyright (C) 2016 The Protocol Authors.
+
+package protocol
+
+import "testing"
+
+func TestRevokedDevices(t *testing.T) {
+	var cm ClusterConfigMessage
+	if ids := cm.RevokedDevices(); len(ids) != 0 {
+		t.Errorf("Unexpected revoked devices %v", ids)
+	}
+
+	id := NewDeviceID([]byte("stolen laptop"))
+	cm.Options = append(cm.Options, Option{Key: "other", Value: "value"}, Option{Key: OptionRevokedDevice, Value: "garbage"})
+	if !cm.AddRevokedDevice(id) {
+		t.Fatal("Unexpected failure to add revoked device")
+	}
+	if ids := cm.RevokedDevices(); len(ids) != 1 || ids[0] != id {
+		t.Errorf("Incorrect revoked devices %v", ids)
+	}
+
+	// The message must remain possible to marshal.
+	for cm.AddRevokedDevice(id) {
+	}
+	if _, err := cm.MarshalXDR(); err != nil {
+		t.Error("Full message does not marshal:", err)
+	}
+}
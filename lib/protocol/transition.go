@@ -0,0 +1,281 @@
+// Copyright (C) 2016 The Protocol Authors.
+
+package protocol
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The ClusterConfig option used to announce a device ID transition.
+const OptionDeviceIDTransition = "deviceIDTransition"
+
+// OIDDeviceIDTransition identifies the certificate extension with which a
+// new certificate carries the old one, and its signature over the new public
+// key. It is in a private arc, meaningful to Syncthing only.
+var OIDDeviceIDTransition = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 59821, 1, 1}
+
+var (
+	ErrTransitionWrongDevice = errors.New("transition is not from the certificate's device ID")
+	ErrTransitionUnsupported = errors.New("unsupported key type")
+)
+
+// A DeviceIDTransition announces that a device has replaced its certificate,
+// and thereby its device ID. It carries the old certificate and is signed
+// with its private key, so that peers can verify that the new device ID
+// belongs to the same device without having seen the old certificate on a
+// connection.
+type DeviceIDTransition struct {
+	From        DeviceID
+	To          DeviceID
+	Issued      time.Time
+	Certificate []byte // The old certificate, DER encoded
+	Signature   []byte
+}
+
+// NewDeviceIDTransition returns a transition from the device ID of oldCert to
+// the one of newCert, signed with the private key of oldCert.
+func NewDeviceIDTransition(oldCert, newCert tls.Certificate) (DeviceIDTransition, error) {
+	if len(oldCert.Certificate) == 0 || len(newCert.Certificate) == 0 {
+		return DeviceIDTransition{}, errors.New("missing certificate")
+	}
+	signer, ok := oldCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return DeviceIDTransition{}, ErrTransitionUnsupported
+	}
+
+	t := DeviceIDTransition{
+		From:        NewDeviceID(oldCert.Certificate[0]),
+		To:          NewDeviceID(newCert.Certificate[0]),
+		Issued:      time.Now().Truncate(time.Second),
+		Certificate: oldCert.Certificate[0],
+	}
+
+	sig, err := sign(signer, t.signedBytes())
+	if err != nil {
+		return DeviceIDTransition{}, err
+	}
+	t.Signature = sig
+	return t, nil
+}
+
+// certificateTransition is the value of the OIDDeviceIDTransition extension.
+type certificateTransition struct {
+	Certificate []byte // The old certificate, DER encoded
+	Issued      int64
+	Signature   []byte // Over the public key of the new certificate
+}
+
+// CertificateTransitionExtension returns the extension to put in a new
+// certificate with the public key pub, certifying that key with the private
+// key of oldCert. A peer that only knows the old device ID can then accept
+// connections using the new certificate straight away; see
+// CertificateTransitionFrom.
+func CertificateTransitionExtension(oldCert tls.Certificate, pub crypto.PublicKey) (pkix.Extension, error) {
+	if len(oldCert.Certificate) == 0 {
+		return pkix.Extension{}, errors.New("missing certificate")
+	}
+	signer, ok := oldCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return pkix.Extension{}, ErrTransitionUnsupported
+	}
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+
+	ct := certificateTransition{
+		Certificate: oldCert.Certificate[0],
+		Issued:      time.Now().Unix(),
+	}
+	ct.Signature, err = sign(signer, keySignedBytes(NewDeviceID(ct.Certificate), spki, ct.Issued))
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+
+	val, err := asn1.Marshal(ct)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: OIDDeviceIDTransition, Value: val}, nil
+}
+
+// CertificateTransitionFrom returns the device ID whose key has certified
+// the key of the given certificate, as made by
+// CertificateTransitionExtension. The returned bool is false if the
+// certificate carries no such extension. As the peer has proven to hold the
+// key of the certificate on connecting, the transition from the returned
+// device ID to the one of the certificate is as good as verified.
+func CertificateTransitionFrom(cert *x509.Certificate) (DeviceID, bool, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(OIDDeviceIDTransition) {
+			continue
+		}
+
+		var ct certificateTransition
+		if rest, err := asn1.Unmarshal(ext.Value, &ct); err != nil {
+			return DeviceID{}, true, err
+		} else if len(rest) > 0 {
+			return DeviceID{}, true, errors.New("trailing data after transition")
+		}
+
+		from := NewDeviceID(ct.Certificate)
+		if err := checkSignature(ct.Certificate, keySignedBytes(from, cert.RawSubjectPublicKeyInfo, ct.Issued), ct.Signature); err != nil {
+			return DeviceID{}, true, err
+		}
+		return from, true, nil
+	}
+	return DeviceID{}, false, nil
+}
+
+// ParseDeviceIDTransition parses the string form of a transition, as returned
+// by String.
+func ParseDeviceIDTransition(s string) (DeviceIDTransition, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 5 {
+		return DeviceIDTransition{}, fmt.Errorf("invalid transition %q", s)
+	}
+
+	var t DeviceIDTransition
+	var err error
+	if t.From, err = DeviceIDFromString(fields[0]); err != nil {
+		return DeviceIDTransition{}, err
+	}
+	if t.To, err = DeviceIDFromString(fields[1]); err != nil {
+		return DeviceIDTransition{}, err
+	}
+	issued, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return DeviceIDTransition{}, err
+	}
+	t.Issued = time.Unix(issued, 0)
+	if t.Certificate, err = base64.StdEncoding.DecodeString(fields[3]); err != nil {
+		return DeviceIDTransition{}, err
+	}
+	if t.Signature, err = base64.StdEncoding.DecodeString(fields[4]); err != nil {
+		return DeviceIDTransition{}, err
+	}
+	return t, nil
+}
+
+// Options returns the transition as cluster config options. The string form
+// is usually longer than an option value may be, so it is split over the
+// option OptionDeviceIDTransition and as many numbered ones after it as
+// needed.
+func (t DeviceIDTransition) Options() []Option {
+	s := t.String()
+	var opts []Option
+	for i := 0; len(s) > 0; i++ {
+		n := len(s)
+		if n > maxOptionValueLen {
+			n = maxOptionValueLen
+		}
+		opts = append(opts, Option{
+			Key:   transitionOptionKey(i),
+			Value: s[:n],
+		})
+		s = s[n:]
+	}
+	return opts
+}
+
+// DeviceIDTransitionFromOptions reassembles and parses a transition
+// announced in the cluster config. The returned bool is false if there is no
+// transition.
+func DeviceIDTransitionFromOptions(cm ClusterConfigMessage) (DeviceIDTransition, bool, error) {
+	var parts []string
+	for i := 0; i < maxTransitionOptions; i++ {
+		part := cm.GetOption(transitionOptionKey(i))
+		if part == "" {
+			break
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return DeviceIDTransition{}, false, nil
+	}
+	t, err := ParseDeviceIDTransition(strings.Join(parts, ""))
+	return t, true, err
+}
+
+const (
+	maxOptionValueLen    = 1024
+	maxTransitionOptions = 8
+)
+
+func transitionOptionKey(i int) string {
+	if i == 0 {
+		return OptionDeviceIDTransition
+	}
+	return fmt.Sprintf("%s.%d", OptionDeviceIDTransition, i)
+}
+
+// String returns the transition in a compact form suitable for use as an
+// option value.
+func (t DeviceIDTransition) String() string {
+	return fmt.Sprintf("%s,%s,%d,%s,%s", t.From, t.To, t.Issued.Unix(), base64.StdEncoding.EncodeToString(t.Certificate), base64.StdEncoding.EncodeToString(t.Signature))
+}
+
+// Verify returns nil if the certificate in the transition is the one of the
+// device ID it is from, and the transition is signed with its key.
+func (t DeviceIDTransition) Verify() error {
+	if NewDeviceID(t.Certificate) != t.From {
+		return ErrTransitionWrongDevice
+	}
+	return checkSignature(t.Certificate, t.signedBytes(), t.Signature)
+}
+
+func (t DeviceIDTransition) signedBytes() []byte {
+	return []byte(fmt.Sprintf("syncthing device ID transition\n%s\n%s\n%d\n", t.From, t.To, t.Issued.Unix()))
+}
+
+func keySignedBytes(from DeviceID, spki []byte, issued int64) []byte {
+	return []byte(fmt.Sprintf("syncthing device ID transition key\n%s\n%x\n%d\n", from, sha256.Sum256(spki), issued))
+}
+
+// sign signs the message with the key, hashing it with SHA-256 first unless
+// it's an Ed25519 key.
+func sign(signer crypto.Signer, msg []byte) ([]byte, error) {
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		// Ed25519 signs the message itself, not a hash of it.
+		return signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	hash := sha256.Sum256(msg)
+	return signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+}
+
+// checkSignature returns nil if the signature of the message was made with
+// the key of the DER encoded certificate.
+func checkSignature(certDER, msg, sig []byte) error {
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return err
+	}
+
+	var algo x509.SignatureAlgorithm
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		algo = x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		algo = x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		algo = x509.PureEd25519
+	default:
+		return ErrTransitionUnsupported
+	}
+	return cert.CheckSignature(algo, msg, sig)
+}
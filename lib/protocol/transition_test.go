@@ -0,0 +1,165 @@
+// Copyright (C) 2016 The Protocol Authors.
+
+package protocol
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T, keyType string) (tls.Certificate, *x509.Certificate) {
+	return testCertificateWithExtensions(t, keyType, nil)
+}
+
+func testCertificateWithExtensions(t *testing.T, keyType string, extensions func(pub crypto.PublicKey) []pkix.Extension) (tls.Certificate, *x509.Certificate) {
+	var priv interface{}
+	var pub interface{}
+	switch keyType {
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, pub = key, &key.PublicKey
+	case "ecdsa":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, pub = key, &key.PublicKey
+	case "ed25519":
+		edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, pub = edPriv, edPub
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "syncthing"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if extensions != nil {
+		template.ExtraExtensions = extensions(pub)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, cert
+}
+
+func TestDeviceIDTransition(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ecdsa", "ed25519"} {
+		oldCert, oldX509 := testCertificate(t, keyType)
+		newCert, newX509 := testCertificate(t, keyType)
+
+		tr, err := NewDeviceIDTransition(oldCert, newCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.From != NewDeviceID(oldX509.Raw) || tr.To != NewDeviceID(newX509.Raw) {
+			t.Errorf("Incorrect transition %v", tr)
+		}
+
+		// The transition survives a round trip through its string form,
+		// and through cluster config options.
+
+		parsed, err := ParseDeviceIDTransition(tr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := parsed.Verify(); err != nil {
+			t.Errorf("Verify failed for %s: %v", keyType, err)
+		}
+
+		opts := tr.Options()
+		for _, opt := range opts {
+			if len(opt.Value) > 1024 {
+				t.Errorf("Option %s too long: %d bytes", opt.Key, len(opt.Value))
+			}
+		}
+		fromOpts, ok, err := DeviceIDTransitionFromOptions(ClusterConfigMessage{Options: opts})
+		if !ok || err != nil {
+			t.Fatal("Transition not found in options:", ok, err)
+		}
+		if fromOpts.String() != tr.String() {
+			t.Errorf("Transition changed by options round trip")
+		}
+
+		// It is not valid with any other certificate, nor when changed.
+
+		wrongCert := parsed
+		wrongCert.Certificate = newX509.Raw
+		if err := wrongCert.Verify(); err != ErrTransitionWrongDevice {
+			t.Errorf("Unexpected error for the wrong certificate: %v", err)
+		}
+		forged := parsed
+		forged.To = forged.From
+		if err := forged.Verify(); err == nil {
+			t.Error("Unexpected success for a forged transition")
+		}
+	}
+
+	if _, ok, _ := DeviceIDTransitionFromOptions(ClusterConfigMessage{}); ok {
+		t.Error("Unexpected transition without options")
+	}
+}
+
+func TestParseDeviceIDTransitionInvalid(t *testing.T) {
+	for _, s := range []string{"", "a,b,c", "a,b,c,d", "a,b,c,d,e", "a,b,c,d,e,f"} {
+		if _, err := ParseDeviceIDTransition(s); err == nil {
+			t.Errorf("Unexpected nil error for %q", s)
+		}
+	}
+}
+
+func TestCertificateTransition(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ecdsa", "ed25519"} {
+		oldCert, oldX509 := testCertificate(t, keyType)
+		_, newX509 := testCertificateWithExtensions(t, keyType, func(pub crypto.PublicKey) []pkix.Extension {
+			ext, err := CertificateTransitionExtension(oldCert, pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return []pkix.Extension{ext}
+		})
+
+		from, ok, err := CertificateTransitionFrom(newX509)
+		if !ok || err != nil {
+			t.Fatalf("Transition not found for %s: %v %v", keyType, ok, err)
+		}
+		if from != NewDeviceID(oldX509.Raw) {
+			t.Errorf("Incorrect transition from %v for %s", from, keyType)
+		}
+
+		// The extension certifies only the key it was made for.
+
+		_, otherX509 := testCertificateWithExtensions(t, keyType, func(crypto.PublicKey) []pkix.Extension {
+			return newX509.Extensions
+		})
+		if _, ok, err := CertificateTransitionFrom(otherX509); !ok || err == nil {
+			t.Errorf("Unexpected success for a copied extension with %s: %v %v", keyType, ok, err)
+		}
+
+		if _, ok, _ := CertificateTransitionFrom(oldX509); ok {
+			t.Error("Unexpected transition without extension")
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package client
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/tlsutil"
+)
+
+func TestConfigForCertsKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, keyType := range []string{tlsutil.KeyTypeECDSAP384, tlsutil.KeyTypeECDSAP256, tlsutil.KeyTypeEd25519} {
+		cert, err := tlsutil.NewCertificateWithKeyType(filepath.Join(dir, keyType+"-cert.pem"), filepath.Join(dir, keyType+"-key.pem"), "syncthing", keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := protocol.NewDeviceID(cert.Certificate[0])
+
+		// Relays may not speak anything newer than TLS 1.2, where the
+		// cipher suites we allow must still work with the key.
+		for _, maxVersion := range []uint16{tls.VersionTLS12, 0} {
+			c0, c1 := net.Pipe()
+			client := tls.Client(c0, configForCerts([]tls.Certificate{cert}))
+			serverCfg := configForCerts([]tls.Certificate{cert})
+			serverCfg.MaxVersion = maxVersion
+			server := tls.Server(c1, serverCfg)
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- server.Handshake()
+			}()
+			if err := client.Handshake(); err != nil {
+				t.Fatalf("%s: %v", keyType, err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatalf("%s: %v", keyType, err)
+			}
+
+			if remote := protocol.NewDeviceID(server.ConnectionState().PeerCertificates[0].Raw); remote != id {
+				t.Errorf("%s: incorrect device ID %v != %v", keyType, remote, id)
+			}
+
+			c0.Close()
+			c1.Close()
+		}
+	}
+}
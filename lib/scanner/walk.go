@@ -67,6 +67,9 @@ type Walker struct {
 	// When AutoNormalize is set, file names that are in UTF8 but incorrect
 	// normalization form will be corrected.
 	AutoNormalize bool
+	// If SharedIgnores is true, the .stignore file in the root of the folder
+	// is scanned like any other file so that it's synced to other devices.
+	SharedIgnores bool
 	// Number of routines to use for hashing
 	Hashers int
 	// Our vector clock id
@@ -236,13 +239,24 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 			return nil
 		}
 
-		if sn := filepath.Base(relPath); sn == ".stignore" || sn == ".stfolder" ||
-			strings.HasPrefix(relPath, ".stversions") || (w.Matcher != nil && w.Matcher.Match(relPath).IsIgnored()) {
+		if sn := filepath.Base(relPath); (sn == ".stignore" && !(w.SharedIgnores && relPath == sn)) ||
+			sn == ".stignore"+ignore.LocalSuffix || sn == ".stfolder" ||
+			strings.HasPrefix(relPath, ".stversions") {
 			// An ignored file
 			l.Debugln("ignored:", relPath)
 			return skip
 		}
 
+		if w.Matcher != nil && w.Matcher.MatchInfo(relPath, info).IsIgnored() {
+			l.Debugln("ignored:", relPath)
+			if info.IsDir() && !w.Matcher.SkipIgnoredDir(relPath) {
+				// Negated patterns may match files within the directory,
+				// so we need to look inside it.
+				return nil
+			}
+			return skip
+		}
+
 		if !utf8.ValidString(relPath) {
 			l.Warnf("File name %q is not in UTF8 encoding; skipping.", relPath)
 			return skip
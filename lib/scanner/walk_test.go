@@ -121,6 +121,40 @@ func TestWalk(t *testing.T) {
 	}
 }
 
+func TestWalkNegatedIgnoredDir(t *testing.T) {
+	ignores := ignore.New(false)
+	err := ignores.Parse(bytes.NewBufferString("!dir3/dfile\ndir3\n"), ".stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{
+		Dir:       "testdata",
+		Subs:      []string{"dir3"},
+		BlockSize: 128 * 1024,
+		Matcher:   ignores,
+		Hashers:   2,
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []protocol.FileInfo
+	for f := range fchan {
+		files = append(files, f)
+	}
+
+	// The directory itself is ignored, but the walk must descend into it
+	// to find the unignored file.
+
+	if len(files) != 1 {
+		t.Fatalf("Incorrect length %d != 1", len(files))
+	}
+	if files[0].Name != filepath.Join("dir3", "dfile") {
+		t.Errorf("Incorrect file %v != dir3/dfile", files[0])
+	}
+}
+
 func TestWalkError(t *testing.T) {
 	w := Walker{
 		Dir:       "testdata-missing",
@@ -10,6 +10,7 @@ package signature
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
@@ -58,6 +59,38 @@ func GenerateKeys() (privKey []byte, pubKey []byte, err error) {
 	return
 }
 
+// GenerateEd25519Keys returns a new Ed25519 key pair, with the private and
+// public key encoded in PEM format.
+func GenerateEd25519Keys() (privKey []byte, pubKey []byte, err error) {
+	// Generate a new key pair
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Marshal and encode the private key
+	bs, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	privKey = pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: bs,
+	})
+
+	// Marshal and encode the public key
+	bs, err = x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubKey = pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: bs,
+	})
+
+	return
+}
+
 // Sign computes the hash of data and signs it with the private key, returning
 // a signature in PEM format.
 func Sign(privKeyPEM []byte, data io.Reader) ([]byte, error) {
@@ -74,15 +107,22 @@ func Sign(privKeyPEM []byte, data io.Reader) ([]byte, error) {
 	}
 
 	// Sign the hash
-	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
-	if err != nil {
-		return nil, err
-	}
+	var sig []byte
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+		if err != nil {
+			return nil, err
+		}
 
-	// Marshal the signature using ASN.1
-	sig, err := marshalSignature(r, s)
-	if err != nil {
-		return nil, err
+		// Marshal the signature using ASN.1
+		sig, err = marshalSignature(r, s)
+		if err != nil {
+			return nil, err
+		}
+
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, hash)
 	}
 
 	// Encode it in a PEM block
@@ -109,11 +149,6 @@ func Verify(pubKeyPEM []byte, signature []byte, data io.Reader) error {
 		return errors.New("unsupported signature format")
 	}
 
-	r, s, err := unmarshalSignature(block.Bytes)
-	if err != nil {
-		return err
-	}
-
 	// Compute the hash of the data
 	hash, err := hashReader(data)
 	if err != nil {
@@ -121,8 +156,20 @@ func Verify(pubKeyPEM []byte, signature []byte, data io.Reader) error {
 	}
 
 	// Verify the signature
-	if !ecdsa.Verify(key, hash, r, s) {
-		return errors.New("incorrect signature")
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		r, s, err := unmarshalSignature(block.Bytes)
+		if err != nil {
+			return err
+		}
+		if !ecdsa.Verify(key, hash, r, s) {
+			return errors.New("incorrect signature")
+		}
+
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, hash, block.Bytes) {
+			return errors.New("incorrect signature")
+		}
 	}
 
 	return nil
@@ -138,16 +185,31 @@ func hashReader(r io.Reader) ([]byte, error) {
 	return hash, nil
 }
 
-// loadPrivateKey returns the ECDSA private key structure for the given PEM
+// loadPrivateKey returns the ECDSA or Ed25519 private key for the given PEM
 // data.
-func loadPrivateKey(bs []byte) (*ecdsa.PrivateKey, error) {
+func loadPrivateKey(bs []byte) (interface{}, error) {
 	block, _ := pem.Decode(bs)
-	return x509.ParseECPrivateKey(block.Bytes)
+	if block == nil || block.Bytes == nil {
+		return nil, errors.New("unsupported private key format")
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	intf, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pk, ok := intf.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("unsupported private key format")
+	}
+	return pk, nil
 }
 
-// loadPublicKey returns the ECDSA public key structure for the given PEM
+// loadPublicKey returns the ECDSA or Ed25519 public key for the given PEM
 // data.
-func loadPublicKey(bs []byte) (*ecdsa.PublicKey, error) {
+func loadPublicKey(bs []byte) (interface{}, error) {
 	// Decode and parse the public key PEM block
 	block, _ := pem.Decode(bs)
 	if block == nil || block.Bytes == nil {
@@ -158,13 +220,13 @@ func loadPublicKey(bs []byte) (*ecdsa.PublicKey, error) {
 		return nil, err
 	}
 
-	// It should be an ECDSA public key
-	pk, ok := intf.(*ecdsa.PublicKey)
-	if !ok {
+	// It should be an ECDSA or Ed25519 public key
+	switch pk := intf.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return pk, nil
+	default:
 		return nil, errors.New("unsupported public key format")
 	}
-
-	return pk, nil
 }
 
 // A wrapper around the signature integers so that we can marshal and
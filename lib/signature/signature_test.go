@@ -79,3 +79,31 @@ func TestVerify(t *testing.T) {
 		t.Fatal("signature should not match")
 	}
 }
+
+func TestEd25519SignVerify(t *testing.T) {
+	priv, pub, err := signature.GenerateEd25519Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := signature.Sign(priv, bytes.NewReader([]byte("this is a string to sign")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = signature.Verify(pub, s, bytes.NewReader([]byte("this is a string to sign")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = signature.Verify(pub, s, bytes.NewReader([]byte("thus is a string to sign")))
+	if err == nil {
+		t.Fatal("signature should not match")
+	}
+
+	// An ECDSA signature does not verify with an Ed25519 key.
+	err = signature.Verify(pub, exampleSig, bytes.NewReader([]byte("this is a string to sign")))
+	if err == nil {
+		t.Fatal("signature should not match")
+	}
+}
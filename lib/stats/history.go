@@ -0,0 +1,366 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package stats
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const (
+	historyHours         = 31 * 24 // Number of hourly entries kept
+	historyDays          = 3 * 366 // Number of daily entries kept
+	historyFlushInterval = time.Minute
+	historyEntryLen      = 7 * 8
+)
+
+// A HistoryEntry holds the counters of a device and folder, or the sum of
+// several, for an hour or a day.
+type HistoryEntry struct {
+	Start         time.Time     `json:"start"`
+	BytesSent     int64         `json:"bytesSent"`
+	BytesReceived int64         `json:"bytesReceived"`
+	FilesPulled   int64         `json:"filesPulled"`
+	Scans         int64         `json:"scans"`
+	ScanDuration  time.Duration `json:"scanDuration"`
+	Errors        int64         `json:"errors"`
+}
+
+func (e *HistoryEntry) add(other HistoryEntry) {
+	e.BytesSent += other.BytesSent
+	e.BytesReceived += other.BytesReceived
+	e.FilesPulled += other.FilesPulled
+	e.Scans += other.Scans
+	e.ScanDuration += other.ScanDuration
+	e.Errors += other.Errors
+}
+
+func (e HistoryEntry) marshal() []byte {
+	bs := make([]byte, historyEntryLen)
+	for i, v := range []int64{e.Start.Unix(), e.BytesSent, e.BytesReceived, e.FilesPulled, e.Scans, int64(e.ScanDuration), e.Errors} {
+		binary.BigEndian.PutUint64(bs[i*8:], uint64(v))
+	}
+	return bs
+}
+
+func (e *HistoryEntry) unmarshal(bs []byte) error {
+	if len(bs) != historyEntryLen {
+		return errors.New("incorrect history entry length")
+	}
+	v := func(i int) int64 {
+		return int64(binary.BigEndian.Uint64(bs[i*8:]))
+	}
+	e.Start = time.Unix(v(0), 0).UTC()
+	e.BytesSent = v(1)
+	e.BytesReceived = v(2)
+	e.FilesPulled = v(3)
+	e.Scans = v(4)
+	e.ScanDuration = time.Duration(v(5))
+	e.Errors = v(6)
+	return nil
+}
+
+// A HistoryResult is the answer to a history query.
+type HistoryResult struct {
+	Period  string         `json:"period"` // "hour" or "day"
+	Entries []HistoryEntry `json:"entries"`
+	Total   HistoryEntry   `json:"total"`
+}
+
+// A historyPeriod is the length of the entries in a ring buffer, and the
+// number of entries in it. Days start at midnight UTC.
+type historyPeriod struct {
+	name   string
+	prefix string
+	length time.Duration
+	slots  int64
+}
+
+var (
+	historyHour = historyPeriod{"hour", "h", time.Hour, historyHours}
+	historyDay  = historyPeriod{"day", "d", 24 * time.Hour, historyDays}
+)
+
+// key returns the key of the ring buffer slot for the period starting at the
+// given time.
+func (p historyPeriod) key(start time.Time) string {
+	return fmt.Sprintf("%s%d", p.prefix, start.Unix()/int64(p.length/time.Second)%p.slots)
+}
+
+// oldest returns the start of the oldest period still in the ring buffer.
+func (p historyPeriod) oldest(now time.Time) time.Time {
+	return now.Truncate(p.length).Add(-time.Duration(p.slots-1) * p.length)
+}
+
+// A historySeries is a device and folder that counters are kept for. The
+// counters that don't concern a specific device, such as scans, have an empty
+// device.
+type historySeries struct {
+	Device string `json:"device"`
+	Folder string `json:"folder"`
+}
+
+type historyKey struct {
+	historySeries
+	hour int64
+}
+
+// History records transfer and scan counters per device and folder over
+// time. The counters are collected in memory and flushed to the database once
+// a minute, into a ring buffer of hourly entries and one of daily entries for
+// each device and folder.
+type History struct {
+	db    *db.Instance
+	index *db.NamespacedKV
+	stop  chan struct{}
+	now   func() time.Time
+
+	mut     sync.Mutex
+	pending map[historyKey]*HistoryEntry
+
+	fmut   sync.Mutex // serializes flushes and protects series
+	series map[historySeries]struct{}
+}
+
+func NewHistory(ldb *db.Instance) *History {
+	h := &History{
+		db:      ldb,
+		index:   db.NewNamespacedKV(ldb, string([]byte{db.KeyTypeStatsHistory})+"index"),
+		stop:    make(chan struct{}),
+		now:     time.Now,
+		mut:     sync.NewMutex(),
+		pending: make(map[historyKey]*HistoryEntry),
+		fmut:    sync.NewMutex(),
+		series:  make(map[historySeries]struct{}),
+	}
+
+	if bs, ok := h.index.Bytes("series"); ok {
+		var series []historySeries
+		if err := json.Unmarshal(bs, &series); err != nil {
+			l.Infoln("Loading statistics history:", err)
+		}
+		for _, s := range series {
+			h.series[s] = struct{}{}
+		}
+	}
+
+	return h
+}
+
+func (h *History) Serve() {
+	t := time.NewTicker(historyFlushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			h.Flush()
+		case <-h.stop:
+			h.Flush()
+			return
+		}
+	}
+}
+
+func (h *History) Stop() {
+	close(h.stop)
+}
+
+func (h *History) String() string {
+	return "stats.History"
+}
+
+// Sent records data sent to the device for the folder.
+func (h *History) Sent(device protocol.DeviceID, folder string, bytes int) {
+	h.record(device.String(), folder, func(e *HistoryEntry) {
+		e.BytesSent += int64(bytes)
+	})
+}
+
+// Received records data received from the device for the folder.
+func (h *History) Received(device protocol.DeviceID, folder string, bytes int) {
+	h.record(device.String(), folder, func(e *HistoryEntry) {
+		e.BytesReceived += int64(bytes)
+	})
+}
+
+// Pulled records files pulled to the folder.
+func (h *History) Pulled(folder string, files int) {
+	h.record("", folder, func(e *HistoryEntry) {
+		e.FilesPulled += int64(files)
+	})
+}
+
+// Scanned records a scan of the folder, and whether it failed.
+func (h *History) Scanned(folder string, duration time.Duration, err error) {
+	h.record("", folder, func(e *HistoryEntry) {
+		e.Scans++
+		e.ScanDuration += duration
+		if err != nil {
+			e.Errors++
+		}
+	})
+}
+
+// Failed records a file that couldn't be synced in the folder.
+func (h *History) Failed(folder string) {
+	h.record("", folder, func(e *HistoryEntry) {
+		e.Errors++
+	})
+}
+
+func (h *History) record(device, folder string, fn func(e *HistoryEntry)) {
+	hour := h.now().Unix() / int64(time.Hour/time.Second)
+	key := historyKey{historySeries{device, folder}, hour}
+
+	h.mut.Lock()
+	e, ok := h.pending[key]
+	if !ok {
+		e = &HistoryEntry{Start: time.Unix(hour*int64(time.Hour/time.Second), 0).UTC()}
+		h.pending[key] = e
+	}
+	fn(e)
+	h.mut.Unlock()
+}
+
+// Flush writes the pending counters to the database.
+func (h *History) Flush() {
+	h.mut.Lock()
+	pending := h.pending
+	h.pending = make(map[historyKey]*HistoryEntry)
+	h.mut.Unlock()
+
+	h.fmut.Lock()
+	defer h.fmut.Unlock()
+
+	newSeries := false
+	for key, e := range pending {
+		if _, ok := h.series[key.historySeries]; !ok {
+			h.series[key.historySeries] = struct{}{}
+			newSeries = true
+		}
+
+		ns := h.seriesKV(key.historySeries)
+		addHistoryEntry(ns, historyHour, *e)
+		day := *e
+		day.Start = e.Start.Truncate(historyDay.length)
+		addHistoryEntry(ns, historyDay, day)
+	}
+
+	if newSeries {
+		series := make([]historySeries, 0, len(h.series))
+		for s := range h.series {
+			series = append(series, s)
+		}
+		sort.Sort(historySeriesList(series))
+		bs, _ := json.Marshal(series)
+		h.index.PutBytes("series", bs)
+	}
+}
+
+// Get returns the counters between from and to, summed over the devices and
+// folders matching the given ones, where an empty string matches all. The
+// entries are hourly if those reach back to from, otherwise daily. Periods
+// without activity are included, as zero entries.
+func (h *History) Get(device, folder string, from, to time.Time) HistoryResult {
+	h.Flush()
+
+	now := h.now()
+	if to.IsZero() || to.After(now) {
+		to = now
+	}
+	p := historyHour
+	if from.Before(p.oldest(now)) {
+		p = historyDay
+	}
+	if oldest := p.oldest(now); from.Before(oldest) {
+		from = oldest
+	}
+
+	res := HistoryResult{
+		Period:  p.name,
+		Entries: make([]HistoryEntry, 0),
+	}
+	for t := from.Truncate(p.length); !t.After(to); t = t.Add(p.length) {
+		res.Entries = append(res.Entries, HistoryEntry{Start: t.UTC()})
+	}
+
+	h.fmut.Lock()
+	for s := range h.series {
+		if device != "" && s.Device != device || folder != "" && s.Folder != folder {
+			continue
+		}
+		ns := h.seriesKV(s)
+		for i := range res.Entries {
+			if e, ok := getHistoryEntry(ns, p, res.Entries[i].Start); ok {
+				res.Entries[i].add(e)
+			}
+		}
+	}
+	h.fmut.Unlock()
+
+	for _, e := range res.Entries {
+		res.Total.add(e)
+	}
+	if len(res.Entries) > 0 {
+		res.Total.Start = res.Entries[0].Start
+	}
+	return res
+}
+
+func (h *History) seriesKV(s historySeries) *db.NamespacedKV {
+	return db.NewNamespacedKV(h.db, string([]byte{db.KeyTypeStatsHistory})+"series"+s.Device+"\x00"+s.Folder+"\x00")
+}
+
+// getHistoryEntry returns the entry for the period starting at the given
+// time, if it's still in the ring buffer.
+func getHistoryEntry(ns *db.NamespacedKV, p historyPeriod, start time.Time) (HistoryEntry, bool) {
+	var e HistoryEntry
+	bs, ok := ns.Bytes(p.key(start))
+	if !ok {
+		return e, false
+	}
+	if err := e.unmarshal(bs); err != nil {
+		l.Debugln("stats.History:", err)
+		return e, false
+	}
+	return e, e.Start.Equal(start)
+}
+
+// addHistoryEntry adds the counters to the entry for the same period in the
+// ring buffer, replacing the entry for an older period if necessary.
+func addHistoryEntry(ns *db.NamespacedKV, p historyPeriod, e HistoryEntry) {
+	if old, ok := getHistoryEntry(ns, p, e.Start); ok {
+		e.add(old)
+	}
+	ns.PutBytes(p.key(e.Start), e.marshal())
+}
+
+type historySeriesList []historySeries
+
+func (l historySeriesList) Len() int {
+	return len(l)
+}
+
+func (l historySeriesList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+func (l historySeriesList) Less(a, b int) bool {
+	if l[a].Device != l[b].Device {
+		return l[a].Device < l[b].Device
+	}
+	return l[a].Folder < l[b].Folder
+}
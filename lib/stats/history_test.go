@@ -0,0 +1,91 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package stats
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+func TestHistory(t *testing.T) {
+	ldb := db.OpenMemory()
+	h := NewHistory(ldb)
+
+	now := time.Date(2016, 6, 15, 12, 30, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+
+	dev1 := protocol.DeviceID{1}
+	dev2 := protocol.DeviceID{2}
+
+	h.Sent(dev1, "f1", 100)
+	h.Sent(dev1, "f2", 10)
+	h.Received(dev2, "f1", 1000)
+	h.Pulled("f1", 3)
+	h.Scanned("f1", time.Second, nil)
+	h.Scanned("f1", time.Second, errors.New("failed"))
+	h.Failed("f1")
+
+	// An hour later, flushed in between.
+	h.Flush()
+	now = now.Add(time.Hour)
+	h.Sent(dev1, "f1", 200)
+
+	from := now.Add(-3 * time.Hour)
+	res := h.Get("", "", from, time.Time{})
+	if res.Period != "hour" || len(res.Entries) != 4 {
+		t.Fatalf("Incorrect result %+v", res)
+	}
+	e := res.Entries[2]
+	if !e.Start.Equal(time.Date(2016, 6, 15, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Incorrect start %v", e.Start)
+	}
+	if e.BytesSent != 110 || e.BytesReceived != 1000 || e.FilesPulled != 3 || e.Scans != 2 || e.ScanDuration != 2*time.Second || e.Errors != 2 {
+		t.Errorf("Incorrect entry %+v", e)
+	}
+	if res.Entries[3].BytesSent != 200 || res.Total.BytesSent != 310 {
+		t.Errorf("Incorrect sent bytes %+v", res)
+	}
+
+	// Filtering on device and folder.
+	if res := h.Get(dev1.String(), "", from, now); res.Total.BytesSent != 310 || res.Total.BytesReceived != 0 || res.Total.Scans != 0 {
+		t.Errorf("Incorrect total for device %+v", res.Total)
+	}
+	if res := h.Get(dev1.String(), "f1", from, now); res.Total.BytesSent != 300 {
+		t.Errorf("Incorrect total for device and folder %+v", res.Total)
+	}
+	if res := h.Get("", "f2", from, now); res.Total.BytesSent != 10 || res.Total.Scans != 0 {
+		t.Errorf("Incorrect total for folder %+v", res.Total)
+	}
+
+	// Further back than the hourly entries, the daily ones are used.
+	res = h.Get("", "", now.Add(-60*24*time.Hour), now)
+	if res.Period != "day" || len(res.Entries) != 61 {
+		t.Fatalf("Incorrect result %v %d", res.Period, len(res.Entries))
+	}
+	if e := res.Entries[60]; e.BytesSent != 310 || !e.Start.Equal(time.Date(2016, 6, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Incorrect daily entry %+v", e)
+	}
+
+	// The history survives a restart.
+	h = NewHistory(ldb)
+	h.now = func() time.Time { return now }
+	if res := h.Get(dev1.String(), "", from, now); res.Total.BytesSent != 310 {
+		t.Errorf("Incorrect total after restart %+v", res.Total)
+	}
+
+	// When the ring buffer wraps around, the old entries are replaced.
+	now = now.Add(historyHours * time.Hour)
+	h.Sent(dev1, "f1", 1)
+	res = h.Get(dev1.String(), "", now.Add(-time.Hour), now)
+	if res.Total.BytesSent != 1 {
+		t.Errorf("Incorrect total after wrap around %+v", res.Total)
+	}
+}
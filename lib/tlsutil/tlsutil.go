@@ -8,7 +8,9 @@ package tlsutil
 
 import (
 	"bufio"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
@@ -29,11 +31,25 @@ var (
 	ErrIdentificationFailed = fmt.Errorf("failed to identify socket type")
 )
 
+// The key types that may be used for new certificates.
+const (
+	KeyTypeECDSAP384 = "ecdsa-p384"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeEd25519   = "ed25519"
+	KeyTypeRSA       = "rsa"
+)
+
+// KeyTypes lists the supported key types.
+var KeyTypes = []string{KeyTypeECDSAP384, KeyTypeECDSAP256, KeyTypeEd25519, KeyTypeRSA}
+
+// The number of bits in RSA keys generated for KeyTypeRSA.
+const rsaKeyBits = 3072
+
 // NewCertificate generates and returns a new TLS certificate. If tlsRSABits
 // is greater than zero we generate an RSA certificate with the specified
 // number of bits. Otherwise we create a 384 bit ECDSA certificate.
 func NewCertificate(certFile, keyFile, tlsDefaultCommonName string, tlsRSABits int) (tls.Certificate, error) {
-	var priv interface{}
+	var priv crypto.Signer
 	var err error
 	if tlsRSABits > 0 {
 		priv, err = rsa.GenerateKey(rand.Reader, tlsRSABits)
@@ -44,6 +60,72 @@ func NewCertificate(certFile, keyFile, tlsDefaultCommonName string, tlsRSABits i
 		return tls.Certificate{}, fmt.Errorf("generate key: %s", err)
 	}
 
+	return newCertificate(certFile, keyFile, tlsDefaultCommonName, priv, nil)
+}
+
+// NewCertificateWithKeyType generates and returns a new TLS certificate with
+// a key of the given type, which is one of KeyTypes.
+func NewCertificateWithKeyType(certFile, keyFile, tlsDefaultCommonName, keyType string) (tls.Certificate, error) {
+	priv, err := generateKey(keyType)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate key: %s", err)
+	}
+
+	return newCertificate(certFile, keyFile, tlsDefaultCommonName, priv, nil)
+}
+
+// NewCertificateWithExtensions is like NewCertificateWithKeyType, but adds
+// the extensions returned by the given function for the public key of the
+// new certificate.
+func NewCertificateWithExtensions(certFile, keyFile, tlsDefaultCommonName, keyType string, extensions func(pub crypto.PublicKey) ([]pkix.Extension, error)) (tls.Certificate, error) {
+	priv, err := generateKey(keyType)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate key: %s", err)
+	}
+	extra, err := extensions(priv.Public())
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("extensions: %s", err)
+	}
+
+	return newCertificate(certFile, keyFile, tlsDefaultCommonName, priv, extra)
+}
+
+// KeyType returns the key type of the private key, or the empty string if it
+// is of an unsupported type.
+func KeyType(priv crypto.PrivateKey) string {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return KeyTypeRSA
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P384():
+			return KeyTypeECDSAP384
+		case elliptic.P256():
+			return KeyTypeECDSAP256
+		}
+	case ed25519.PrivateKey:
+		return KeyTypeEd25519
+	}
+	return ""
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+}
+
+func newCertificate(certFile, keyFile, tlsDefaultCommonName string, priv crypto.Signer, extra []pkix.Extension) (tls.Certificate, error) {
 	notBefore := time.Now()
 	notAfter := time.Date(2049, 12, 31, 23, 59, 59, 0, time.UTC)
 
@@ -55,12 +137,13 @@ func NewCertificate(certFile, keyFile, tlsDefaultCommonName string, tlsRSABits i
 		NotBefore: notBefore,
 		NotAfter:  notAfter,
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              keyUsage(priv),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
+		ExtraExtensions:       extra,
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("create cert: %s", err)
 	}
@@ -153,18 +236,16 @@ func (c *UnionedConnection) Read(b []byte) (n int, err error) {
 	return c.Reader.Read(b)
 }
 
-func publicKey(priv interface{}) interface{} {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &k.PublicKey
-	case *ecdsa.PrivateKey:
-		return &k.PublicKey
-	default:
-		return nil
+// keyUsage returns the key usage for a certificate with the key. Key
+// encipherment is only meaningful for RSA keys.
+func keyUsage(priv crypto.Signer) x509.KeyUsage {
+	if _, ok := priv.(*rsa.PrivateKey); ok {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
 	}
+	return x509.KeyUsageDigitalSignature
 }
 
-func pemBlockForKey(priv interface{}) (*pem.Block, error) {
+func pemBlockForKey(priv crypto.Signer) (*pem.Block, error) {
 	switch k := priv.(type) {
 	case *rsa.PrivateKey:
 		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
@@ -174,6 +255,12 @@ func pemBlockForKey(priv interface{}) (*pem.Block, error) {
 			return nil, err
 		}
 		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
+	case ed25519.PrivateKey:
+		b, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: b}, nil
 	default:
 		return nil, fmt.Errorf("unknown key type")
 	}
@@ -0,0 +1,144 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+func TestNewCertificateKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// RSA keys are slow to generate and covered by the benchmarks.
+	for _, keyType := range []string{KeyTypeECDSAP384, KeyTypeECDSAP256, KeyTypeEd25519} {
+		certFile := filepath.Join(dir, keyType+"-cert.pem")
+		keyFile := filepath.Join(dir, keyType+"-key.pem")
+		cert, err := NewCertificateWithKeyType(certFile, keyFile, "syncthing", keyType)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if kt := KeyType(cert.PrivateKey); kt != keyType {
+			t.Errorf("%s: unexpected key type %q", keyType, kt)
+		}
+
+		// The certificate loads back from disk and the device ID is
+		// derived from it as usual.
+
+		loaded, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if protocol.NewDeviceID(loaded.Certificate[0]) != protocol.NewDeviceID(cert.Certificate[0]) {
+			t.Errorf("%s: device ID changed on load", keyType)
+		}
+
+		// Both sides of a handshake see the device ID of the other.
+
+		client, server, err := handshake(cert, cert)
+		if err != nil {
+			t.Fatalf("%s: handshake: %v", keyType, err)
+		}
+		for _, state := range []tls.ConnectionState{client, server} {
+			certs := state.PeerCertificates
+			if len(certs) == 0 || protocol.NewDeviceID(certs[0].Raw) != protocol.NewDeviceID(cert.Certificate[0]) {
+				t.Errorf("%s: incorrect peer certificate", keyType)
+			}
+		}
+	}
+
+	if _, err := NewCertificateWithKeyType(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), "syncthing", "dsa"); err == nil {
+		t.Error("Unexpected nil error for unknown key type")
+	}
+}
+
+func BenchmarkHandshakeECDSAP384(b *testing.B) {
+	benchmarkHandshake(b, KeyTypeECDSAP384)
+}
+
+func BenchmarkHandshakeECDSAP256(b *testing.B) {
+	benchmarkHandshake(b, KeyTypeECDSAP256)
+}
+
+func BenchmarkHandshakeEd25519(b *testing.B) {
+	benchmarkHandshake(b, KeyTypeEd25519)
+}
+
+func BenchmarkHandshakeRSA(b *testing.B) {
+	benchmarkHandshake(b, KeyTypeRSA)
+}
+
+func benchmarkHandshake(b *testing.B, keyType string) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, err := NewCertificateWithKeyType(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), "syncthing", keyType)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := handshake(cert, cert); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// handshake performs a TLS handshake over an in memory connection, with
+// settings like the ones used for device connections, and returns the
+// connection state of the client and server.
+func handshake(clientCert, serverCert tls.Certificate) (tls.ConnectionState, tls.ConnectionState, error) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	client := tls.Client(c0, testConfig(clientCert))
+	server := tls.Server(c1, testConfig(serverCert))
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Handshake()
+	}()
+	if err := client.Handshake(); err != nil {
+		return tls.ConnectionState{}, tls.ConnectionState{}, err
+	}
+	if err := <-errs; err != nil {
+		return tls.ConnectionState{}, tls.ConnectionState{}, err
+	}
+	return client.ConnectionState(), server.ConnectionState(), nil
+}
+
+func testConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		ClientAuth:             tls.RequestClientCert,
+		SessionTicketsDisabled: true,
+		InsecureSkipVerify:     true,
+		MinVersion:             tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		},
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package totp implements time based one time passwords as described in RFC
+// 6238, with the parameters that authenticator apps expect: HMAC-SHA1, six
+// digits and a period of 30 seconds.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	period = 30 * time.Second
+	digits = 6
+	modulo = 1000000 // 10^digits
+
+	// The number of periods before and after the current one that codes
+	// are also accepted for, to allow for clock skew and slow typing.
+	skew = 1
+)
+
+// GenerateSecret returns a new random secret, base32 encoded.
+func GenerateSecret() (string, error) {
+	bs := make([]byte, 20)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(bs), nil
+}
+
+// Code returns the code for the given secret at the given time.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, counter(t)), nil
+}
+
+// Validate returns true if the code is valid for the secret at the given
+// time.
+func Validate(secret, candidate string, t time.Time) bool {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return false
+	}
+	candidate = strings.Replace(candidate, " ", "", -1)
+	if len(candidate) != digits {
+		return false
+	}
+
+	c := counter(t)
+	for i := -skew; i <= skew; i++ {
+		if subtle.ConstantTimeCompare([]byte(code(key, c+uint64(i))), []byte(candidate)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// URI returns the otpauth URI for the secret, as understood by authenticator
+// apps when encoded in a QR code.
+func URI(secret, issuer, account string) string {
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + account,
+	}
+	q := url.Values{}
+	q.Set("secret", strings.TrimRight(secret, "="))
+	q.Set("issuer", issuer)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	if pad := len(secret) % 8; pad != 0 {
+		secret += strings.Repeat("=", 8-pad)
+	}
+	return base32.StdEncoding.DecodeString(secret)
+}
+
+func counter(t time.Time) uint64 {
+	return uint64(t.Unix() / int64(period/time.Second))
+}
+
+// code is the HOTP value (RFC 4226) for the key and counter.
+func code(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	bin := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, bin%modulo)
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors from RFC 6238, appendix B. The codes there have
+// eight digits; ours are the last six of those.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	for _, tc := range rfcVectors {
+		code, err := Code(rfcSecret, time.Unix(tc.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tc.code {
+			t.Errorf("Incorrect code at %d, %s != %s", tc.unix, code, tc.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	if !Validate(rfcSecret, "050471", now) {
+		t.Error("Current code should be valid")
+	}
+	if !Validate(rfcSecret, "050 471", now) {
+		t.Error("Spaces should be ignored")
+	}
+	if !Validate(rfcSecret, "050471", now.Add(30*time.Second)) || !Validate(rfcSecret, "050471", now.Add(-30*time.Second)) {
+		t.Error("Code should be valid in the adjacent periods")
+	}
+	if Validate(rfcSecret, "050471", now.Add(90*time.Second)) {
+		t.Error("Code should not be valid later")
+	}
+	if Validate(rfcSecret, "050472", now) || Validate(rfcSecret, "", now) || Validate("not base32!", "050471", now) {
+		t.Error("Incorrect code should not be valid")
+	}
+
+	// Secrets are accepted without padding and in lower case, as often
+	// entered by hand.
+	if !Validate(strings.ToLower(strings.TrimRight(rfcSecret, "=")), "050471", now) {
+		t.Error("Unpadded lower case secret should work")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	s1, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, _ := GenerateSecret()
+	if s1 == s2 || len(s1) != 32 {
+		t.Errorf("Unexpected secrets %q, %q", s1, s2)
+	}
+
+	code, err := Code(s1, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Validate(s1, code, time.Now()) {
+		t.Error("Generated code should be valid")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI(rfcSecret, "Syncthing", "jb@host")
+	exp := "otpauth://totp/Syncthing:jb@host?issuer=Syncthing&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	if uri != exp {
+		t.Errorf("Incorrect URI %q != %q", uri, exp)
+	}
+}
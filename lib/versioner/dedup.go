@@ -0,0 +1,566 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/osutil"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+func init() {
+	// Register the constructor for this type of versioner
+	Factories["dedup"] = NewDedup
+}
+
+const (
+	dedupBlocksDir   = ".blocks"
+	dedupManifestExt = ".manifest"
+)
+
+var errHashMismatch = errors.New("block hash mismatch")
+
+// Dedup stores versions as lists of blocks referencing a shared, content
+// addressed block store under .stversions/.blocks. A version of a large file
+// that changed only in a few places thus costs only the changed blocks. Each
+// block is reference counted by the manifests that use it and is removed
+// when the last referencing version expires.
+type Dedup struct {
+	folderPath   string
+	versionsPath string
+	keep         int
+	cleanoutDays int
+	stop         chan struct{}
+
+	mut      sync.Mutex
+	refs     map[string]int      // block hash (hex) -> number of referencing manifests; nil until loaded
+	released map[string]struct{} // blocks whose reference count dropped to zero
+}
+
+// A dedupManifest describes one archived version of a file.
+type dedupManifest struct {
+	Name        string               `json:"name"`
+	Size        int64                `json:"size"`
+	Modified    time.Time            `json:"modified"`
+	Permissions uint32               `json:"permissions"`
+	Blocks      []protocol.BlockInfo `json:"blocks"`
+}
+
+func NewDedup(folderID, folderPath string, params map[string]string) Versioner {
+	keep, err := strconv.Atoi(params["keep"])
+	if err != nil {
+		keep = 5 // A reasonable default
+	}
+	cleanoutDays, _ := strconv.Atoi(params["cleanoutDays"])
+	// On error we default to 0, "do not clean out old versions by age"
+
+	// Use custom path if set, otherwise .stversions in folderPath
+	versionsDir := params["versionsPath"]
+	if versionsDir == "" {
+		versionsDir = filepath.Join(folderPath, ".stversions")
+	}
+
+	d := &Dedup{
+		folderPath:   folderPath,
+		versionsPath: versionsDir,
+		keep:         keep,
+		cleanoutDays: cleanoutDays,
+		stop:         make(chan struct{}),
+		mut:          sync.NewMutex(),
+		released:     make(map[string]struct{}),
+	}
+
+	l.Debugf("instantiated %#v", d)
+	return d
+}
+
+// Archive splits the named file into blocks, stores the blocks not already
+// present in the block store and records a manifest for the version. If
+// this function returns nil, the named file does not exist any more (has
+// been archived).
+func (d *Dedup) Archive(filePath string) error {
+	info, err := osutil.Lstat(filePath)
+	if os.IsNotExist(err) {
+		l.Debugln("not archiving nonexistent file", filePath)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	relativePath, err := filepath.Rel(d.folderPath, filePath)
+	if err != nil {
+		return err
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if err := d.loadRefs(); err != nil {
+		return err
+	}
+	defer d.removeReleasedBlocks()
+
+	l.Debugln("archiving", filePath)
+
+	manifestPath := d.manifestPath(relativePath, info.ModTime().Format(TimeFormat))
+	if err := osutil.MkdirAll(filepath.Dir(manifestPath), 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		// Symlinks and other oddities have no content worth deduplicating;
+		// keep them as they are next to the manifests.
+		l.Debugln("moving non regular file to", manifestPath)
+		return osutil.Rename(filePath, strings.TrimSuffix(manifestPath, dedupManifestExt))
+	}
+
+	// The same version (by modification time) may have been archived
+	// before. Its blocks are released once the new manifest has replaced
+	// it, so that the reference counts stay exact and a failure on the way
+	// leaves the old version intact.
+	old, oldErr := readDedupManifest(manifestPath)
+
+	blocks, err := d.storeBlocks(filePath)
+	if err != nil {
+		return err
+	}
+
+	m := dedupManifest{
+		Name:        relativePath,
+		Size:        info.Size(),
+		Modified:    info.ModTime(),
+		Permissions: uint32(info.Mode().Perm()),
+		Blocks:      blocks,
+	}
+	if err := writeDedupManifest(manifestPath, m); err != nil {
+		d.release(m)
+		return err
+	}
+	if oldErr == nil {
+		d.release(old)
+	}
+
+	if err := osutil.Remove(filePath); err != nil {
+		return err
+	}
+
+	d.expireVersions(relativePath)
+	return nil
+}
+
+// Restore reassembles the version of the named file (relative to the folder
+// root) with the given tag and writes it to dst, overwriting any existing
+// file.
+func (d *Dedup) Restore(name, tag, dst string) error {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	m, err := readDedupManifest(d.manifestPath(name, tag))
+	if err != nil {
+		return err
+	}
+
+	w, err := osutil.CreateAtomic(dst, os.FileMode(m.Permissions))
+	if err != nil {
+		return err
+	}
+
+	// Any failure before the final Close must leave the existing file at
+	// dst alone, so the temporary file is discarded rather than committed.
+	for _, block := range m.Blocks {
+		bs, err := ioutil.ReadFile(d.blockPath(hex.EncodeToString(block.Hash)))
+		if err != nil {
+			w.Discard()
+			return err
+		}
+		if hash := sha256.Sum256(bs); !bytes.Equal(hash[:], block.Hash) {
+			w.Discard()
+			return fmt.Errorf("%s: %x: %v", name, block.Hash, errHashMismatch)
+		}
+		if _, err := w.Write(bs); err != nil {
+			w.Discard()
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, m.Modified, m.Modified)
+}
+
+// Versions returns the tags of the archived versions of the named file
+// (relative to the folder root), oldest first.
+func (d *Dedup) Versions(name string) ([]string, error) {
+	manifests, err := d.manifests(name)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, len(manifests))
+	for i, path := range manifests {
+		tags[i] = filenameTag(strings.TrimSuffix(path, dedupManifestExt))
+	}
+	return tags, nil
+}
+
+func (d *Dedup) Serve() {
+	l.Debugln(d, "starting")
+	defer l.Debugln(d, "stopping")
+
+	// Do the first cleanup one minute after startup.
+	timer := time.NewTimer(time.Minute)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+
+		case <-timer.C:
+			if err := d.clean(); err != nil {
+				l.Infoln("Cleaning versions:", err)
+			}
+
+			// Cleanups once a day should be enough.
+			timer.Reset(24 * time.Hour)
+		}
+	}
+}
+
+func (d *Dedup) Stop() {
+	close(d.stop)
+}
+
+func (d *Dedup) String() string {
+	return fmt.Sprintf("dedup@%p", d)
+}
+
+// clean removes versions older than the configured number of days and any
+// blocks that are no longer referenced by a manifest.
+func (d *Dedup) clean() error {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if err := d.loadRefs(); err != nil {
+		return err
+	}
+
+	if d.cleanoutDays > 0 {
+		cutoff := time.Now().Add(time.Duration(-24*d.cleanoutDays) * time.Hour)
+		err := d.walkVersions(func(path string, info os.FileInfo) error {
+			if info.ModTime().After(cutoff) {
+				return nil
+			}
+			d.removeVersion(path)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.removeUnreferencedBlocks()
+}
+
+// storeBlocks reads the given file and makes sure every block of it exists
+// in the block store. The reference count of each block is increased.
+func (d *Dedup) storeBlocks(filePath string) ([]protocol.BlockInfo, error) {
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var blocks []protocol.BlockInfo
+	var offset int64
+	buf := make([]byte, protocol.BlockSize)
+	for {
+		n, err := io.ReadFull(fd, buf)
+		if n > 0 {
+			hash := sha256.Sum256(buf[:n])
+			if err := d.storeBlock(hash[:], buf[:n]); err != nil {
+				d.release(dedupManifest{Blocks: blocks})
+				return nil, err
+			}
+			blocks = append(blocks, protocol.BlockInfo{
+				Offset: offset,
+				Size:   int32(n),
+				Hash:   hash[:],
+			})
+			d.refs[hex.EncodeToString(hash[:])]++
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			d.release(dedupManifest{Blocks: blocks})
+			return nil, err
+		}
+	}
+
+	return blocks, nil
+}
+
+func (d *Dedup) storeBlock(hash, data []byte) error {
+	path := d.blockPath(hex.EncodeToString(hash))
+	if _, err := os.Lstat(path); err == nil {
+		// Already in the store
+		return nil
+	}
+
+	if err := osutil.MkdirAll(filepath.Dir(path), 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	w, err := osutil.CreateAtomic(path, 0644)
+	if err != nil {
+		return err
+	}
+	w.Write(data)
+	return w.Close()
+}
+
+// expireVersions removes the oldest versions of the named file until at
+// most keep versions remain.
+func (d *Dedup) expireVersions(name string) {
+	versions, err := d.versions(name)
+	if err != nil {
+		l.Warnln("globbing:", err, "for", name)
+		return
+	}
+
+	if len(versions) > d.keep {
+		for _, toRemove := range versions[:len(versions)-d.keep] {
+			l.Debugln("cleaning out", toRemove)
+			d.removeVersion(toRemove)
+		}
+	}
+}
+
+// removeVersion removes the given version, which is either a manifest or a
+// non regular file kept as it is.
+func (d *Dedup) removeVersion(path string) {
+	if filepath.Ext(path) == dedupManifestExt {
+		d.removeManifest(path)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		l.Warnln("removing old version:", err)
+	}
+}
+
+// removeManifest removes the given manifest and releases the blocks it
+// references.
+func (d *Dedup) removeManifest(path string) {
+	m, err := readDedupManifest(path)
+	if err != nil {
+		l.Warnln("reading version manifest:", err)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		l.Warnln("removing old version:", err)
+		return
+	}
+	d.release(m)
+}
+
+// release decreases the reference count of every block in the manifest.
+// Blocks are not removed from disk until removeReleasedBlocks is called, as
+// they may be referenced again in the meantime.
+func (d *Dedup) release(m dedupManifest) {
+	for _, block := range m.Blocks {
+		key := hex.EncodeToString(block.Hash)
+		if d.refs[key] <= 1 {
+			d.refs[key] = 0
+			d.released[key] = struct{}{}
+		} else {
+			d.refs[key]--
+		}
+	}
+}
+
+// removeReleasedBlocks removes the blocks that have been released and are
+// still unreferenced.
+func (d *Dedup) removeReleasedBlocks() {
+	for key := range d.released {
+		delete(d.released, key)
+		if d.refs[key] > 0 {
+			continue
+		}
+		delete(d.refs, key)
+		l.Debugln("removing unreferenced block", key)
+		if err := os.Remove(d.blockPath(key)); err != nil && !os.IsNotExist(err) {
+			l.Infoln("Removing unreferenced version block:", err)
+		}
+	}
+}
+
+// removeUnreferencedBlocks walks the whole block store and removes any block
+// not referenced by a manifest, such as those left behind by an interrupted
+// archive operation.
+func (d *Dedup) removeUnreferencedBlocks() error {
+	d.released = make(map[string]struct{})
+
+	blocksDir := filepath.Join(d.versionsPath, dedupBlocksDir)
+	if _, err := os.Lstat(blocksDir); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.Walk(blocksDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		key := filepath.Base(path)
+		if d.refs[key] > 0 {
+			return nil
+		}
+		l.Debugln("removing unreferenced block", key)
+		delete(d.refs, key)
+		if err := os.Remove(path); err != nil {
+			l.Infoln("Removing unreferenced version block:", err)
+		}
+		return nil
+	})
+}
+
+// loadRefs builds the block reference counts from the manifests on disk,
+// unless that has already been done.
+func (d *Dedup) loadRefs() error {
+	if d.refs != nil {
+		return nil
+	}
+
+	refs := make(map[string]int)
+	err := d.walkManifests(func(path string, _ os.FileInfo) error {
+		m, err := readDedupManifest(path)
+		if err != nil {
+			l.Infoln("Reading version manifest:", err)
+			return nil
+		}
+		for _, block := range m.Blocks {
+			refs[hex.EncodeToString(block.Hash)]++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.refs = refs
+	return nil
+}
+
+func (d *Dedup) walkManifests(fn func(path string, info os.FileInfo) error) error {
+	return d.walkVersions(func(path string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return fn(path, info)
+	})
+}
+
+// walkVersions calls fn for every archived version, that is every manifest
+// and every non regular file kept next to them.
+func (d *Dedup) walkVersions(fn func(path string, info os.FileInfo) error) error {
+	if _, err := os.Lstat(d.versionsPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	blocksDir := filepath.Join(d.versionsPath, dedupBlocksDir)
+	return filepath.Walk(d.versionsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == blocksDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && filepath.Ext(path) != dedupManifestExt {
+			return nil
+		}
+		return fn(path, info)
+	})
+}
+
+// manifests returns the paths of the manifests for the named file, oldest
+// first.
+func (d *Dedup) manifests(name string) ([]string, error) {
+	pattern := d.manifestPath(name, TimeGlob)
+	matches, err := osutil.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return uniqueSortedStrings(matches), nil
+}
+
+// versions returns the paths of all archived versions of the named file,
+// oldest first: the manifests as well as any non regular files.
+func (d *Dedup) versions(name string) ([]string, error) {
+	versions, err := d.manifests(name)
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := filepath.Join(d.versionsPath, taggedFilename(name, TimeGlob))
+	matches, err := osutil.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range matches {
+		if info, err := osutil.Lstat(path); err == nil && !info.Mode().IsRegular() {
+			versions = append(versions, path)
+		}
+	}
+
+	// Sorting by path sorts by tag, as the part before the tag is the same.
+	return uniqueSortedStrings(versions), nil
+}
+
+func (d *Dedup) manifestPath(name, tag string) string {
+	return filepath.Join(d.versionsPath, taggedFilename(name, tag)+dedupManifestExt)
+}
+
+func (d *Dedup) blockPath(key string) string {
+	return filepath.Join(d.versionsPath, dedupBlocksDir, key[:2], key)
+}
+
+func readDedupManifest(path string) (dedupManifest, error) {
+	var m dedupManifest
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(bs, &m)
+	return m, err
+}
+
+func writeDedupManifest(path string, m dedupManifest) error {
+	w, err := osutil.CreateAtomic(path, 0644)
+	if err != nil {
+		return err
+	}
+	json.NewEncoder(w).Encode(m)
+	return w.Close()
+}
@@ -0,0 +1,271 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+func countBlocks(t *testing.T, dir string) int {
+	n := 0
+	err := filepath.Walk(filepath.Join(dir, ".stversions", dedupBlocksDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDedupArchiveRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewDedup("", dir, map[string]string{"keep": "2"}).(*Dedup)
+	path := filepath.Join(dir, "test.dat")
+
+	// Three blocks, of which the last one changes between versions.
+	data := make([]byte, 3*protocol.BlockSize)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	var versions [][]byte
+	for i := 0; i < 3; i++ {
+		data[len(data)-1] = byte(i)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.Archive(path); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Fatal("archived file should not exist")
+		}
+		versions = append(versions, append([]byte(nil), data...))
+	}
+
+	tags, err := v.Versions("test.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 {
+		t.Fatalf("expected two versions to be kept, got %d", len(tags))
+	}
+
+	// Two shared blocks plus one distinct last block per kept version.
+	if n := countBlocks(t, dir); n != 4 {
+		t.Errorf("expected 4 stored blocks, got %d", n)
+	}
+
+	for i, tag := range tags {
+		if err := v.Restore("test.dat", tag, path); err != nil {
+			t.Fatal(err)
+		}
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs, versions[i+1]) {
+			t.Errorf("restored version %s differs from the archived data", tag)
+		}
+	}
+}
+
+func TestDedupCleanUnreferenced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewDedup("", dir, nil).(*Dedup)
+	path := filepath.Join(dir, "test.dat")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Archive(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A block not referenced by any manifest, as left by a crash.
+	orphan := filepath.Join(dir, ".stversions", dedupBlocksDir, "00", "00orphan")
+	os.MkdirAll(filepath.Dir(orphan), 0755)
+	if err := ioutil.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.clean(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(orphan); !os.IsNotExist(err) {
+		t.Error("unreferenced block should have been removed")
+	}
+	if n := countBlocks(t, dir); n != 1 {
+		t.Errorf("expected the referenced block to remain, got %d blocks", n)
+	}
+}
+
+func TestDedupRestoreMissingBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewDedup("", dir, nil).(*Dedup)
+	path := filepath.Join(dir, "test.dat")
+	if err := ioutil.WriteFile(path, []byte("old data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Archive(path); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := v.Versions("test.dat")
+	if err != nil || len(tags) != 1 {
+		t.Fatal("expected one version, got", tags, err)
+	}
+
+	blocks := filepath.Join(dir, ".stversions", dedupBlocksDir)
+	if err := os.RemoveAll(blocks); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("current data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Restore("test.dat", tags[0], path); err == nil {
+		t.Fatal("unexpected nil error restoring a version with missing blocks")
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "current data" {
+		t.Errorf("failed restore changed the existing file to %q", bs)
+	}
+}
+
+func TestDedupExpireNonRegular(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires symlinks")
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewDedup("", dir, map[string]string{"keep": "2"}).(*Dedup)
+
+	// Two older versions of test.dat that were symlinks when archived.
+	versionsDir := filepath.Join(dir, ".stversions")
+	if err := os.MkdirAll(versionsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldest := filepath.Join(versionsDir, "test~20160101-000000.dat")
+	older := filepath.Join(versionsDir, "test~20160102-000000.dat")
+	for _, link := range []string{oldest, older} {
+		if err := os.Symlink("target", link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "test.dat")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Archive(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(oldest); !os.IsNotExist(err) {
+		t.Error("oldest symlink version should have been expired")
+	}
+	if _, err := os.Lstat(older); err != nil {
+		t.Error("newer symlink version should have been kept:", err)
+	}
+}
+
+func TestDedupArchiveFailureKeepsVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewDedup("", dir, nil).(*Dedup)
+	path := filepath.Join(dir, "test.dat")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("old data")
+	if err := v.Archive(path); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := v.Versions("test.dat")
+	if err != nil || len(tags) != 1 {
+		t.Fatal("expected one version, got", tags, err)
+	}
+
+	// The same version is archived again with other contents, but the
+	// block can't be stored as its directory in the store is in the way.
+	newHash := sha256.Sum256([]byte("new data"))
+	blockDir := filepath.Dir(v.blockPath(hex.EncodeToString(newHash[:])))
+	if err := ioutil.WriteFile(blockDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	write("new data")
+	if err := v.Archive(path); err == nil {
+		t.Fatal("unexpected nil error archiving with the block store in the way")
+	}
+
+	// The existing version is intact.
+	if err := v.Restore("test.dat", tags[0], path); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "old data" {
+		t.Errorf("restored %q instead of the archived version", bs)
+	}
+}
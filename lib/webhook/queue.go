@@ -0,0 +1,102 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package webhook
+
+import (
+	"fmt"
+
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// The maximum number of undelivered batches kept per webhook. When the
+// queue is full the oldest batch is dropped.
+const maxQueueLen = 1000
+
+// A queue is a persistent FIFO of event batches awaiting delivery, kept in
+// the database so that nothing is lost over a restart.
+type queue struct {
+	ns  *db.NamespacedKV
+	mut sync.Mutex
+}
+
+func newQueue(ldb *db.Instance, id string) *queue {
+	prefix := string([]byte{db.KeyTypeWebhookQueue}) + id + "/"
+	return &queue{
+		ns:  db.NewNamespacedKV(ldb, prefix),
+		mut: sync.NewMutex(),
+	}
+}
+
+// push adds a batch at the end of the queue.
+func (q *queue) push(batch []byte) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	head, tail := q.bounds()
+	q.ns.PutBytes(itemKey(tail), batch)
+	tail++
+	q.ns.PutInt64("tail", tail)
+
+	if tail-head > maxQueueLen {
+		l.Infof("Webhook queue full; dropping the oldest batch of events")
+		q.ns.Delete(itemKey(head))
+		q.ns.PutInt64("head", head+1)
+	}
+}
+
+// peek returns the batch at the front of the queue, if there is one.
+func (q *queue) peek() ([]byte, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	head, tail := q.bounds()
+	if head == tail {
+		return nil, false
+	}
+	return q.ns.Bytes(itemKey(head))
+}
+
+// pop removes the batch at the front of the queue.
+func (q *queue) pop() {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	head, tail := q.bounds()
+	if head == tail {
+		return
+	}
+	q.ns.Delete(itemKey(head))
+	q.ns.PutInt64("head", head+1)
+}
+
+// len returns the number of batches in the queue.
+func (q *queue) len() int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	head, tail := q.bounds()
+	return int(tail - head)
+}
+
+// reset removes everything from the queue.
+func (q *queue) reset() {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	q.ns.Reset()
+}
+
+func (q *queue) bounds() (head, tail int64) {
+	head, _ = q.ns.Int64("head")
+	tail, _ = q.ns.Int64("tail")
+	return head, tail
+}
+
+func itemKey(n int64) string {
+	return fmt.Sprintf("item-%020d", n)
+}
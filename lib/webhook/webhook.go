@@ -0,0 +1,505 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package webhook posts selected events to configured URLs.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/events"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const (
+	batchInterval  = 5 * time.Second
+	maxBatchEvents = 100
+	minRetryDelay  = time.Second
+	maxRetryDelay  = 5 * time.Minute
+	requestTimeout = 30 * time.Second
+)
+
+// SignatureHeader is the request header carrying the HMAC-SHA256 signature
+// of the request body, as "sha256=<hex>", for webhooks with a secret.
+const SignatureHeader = "X-Syncthing-Signature"
+
+// The Service subscribes to events and posts batches of those selected by
+// each configured webhook to its URL. Batches awaiting delivery are queued
+// in the database and retried with exponential backoff.
+type Service struct {
+	cfg     *config.Wrapper
+	db      *db.Instance
+	client  *http.Client
+	changed chan struct{}
+	stop    chan struct{}
+
+	mut     sync.Mutex
+	hooks   map[string]*hook
+	running bool // senders are started
+}
+
+func NewService(cfg *config.Wrapper, ldb *db.Instance) *Service {
+	s := &Service{
+		cfg:     cfg,
+		db:      ldb,
+		client:  &http.Client{Timeout: requestTimeout},
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		mut:     sync.NewMutex(),
+		hooks:   make(map[string]*hook),
+	}
+	s.setHooks(cfg.Raw().Webhooks)
+	return s
+}
+
+// Serve runs the service, until Stop is called.
+func (s *Service) Serve() {
+	var sub *events.Subscription
+	defer func() {
+		if sub != nil {
+			events.Default.Unsubscribe(sub)
+		}
+		s.mut.Lock()
+		for _, h := range s.hooks {
+			h.stopSender()
+		}
+		s.running = false
+		s.mut.Unlock()
+	}()
+
+	subscribe := func() {
+		if sub != nil {
+			events.Default.Unsubscribe(sub)
+		}
+		sub = events.Default.Subscribe(s.mask())
+	}
+	subscribe()
+
+	s.mut.Lock()
+	for _, h := range s.hooks {
+		h.startSender(s.client)
+	}
+	s.running = true
+	s.mut.Unlock()
+
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev := <-sub.C():
+			data := eventData(ev)
+			s.mut.Lock()
+			for _, h := range s.hooks {
+				h.handle(ev, data)
+			}
+			s.mut.Unlock()
+
+		case <-ticker.C:
+			s.mut.Lock()
+			for _, h := range s.hooks {
+				h.flush(time.Now())
+			}
+			s.mut.Unlock()
+
+		case <-s.changed:
+			subscribe()
+
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Service) Stop() {
+	close(s.stop)
+}
+
+func (s *Service) String() string {
+	return "webhook.Service"
+}
+
+// Test posts a synthetic event directly to the given webhook, bypassing its
+// event filters and the queue, and returns the result.
+func (s *Service) Test(id string) error {
+	s.mut.Lock()
+	h, ok := s.hooks[id]
+	s.mut.Unlock()
+	if !ok {
+		return fmt.Errorf("no such webhook %q", id)
+	}
+
+	ev := events.Event{
+		Time: time.Now(),
+		Type: events.Ping,
+		Data: map[string]interface{}{
+			"webhook": id,
+			"test":    true,
+		},
+	}
+	bs, err := marshalBatch([]events.Event{ev})
+	if err != nil {
+		return err
+	}
+	return h.post(s.client, bs, nil)
+}
+
+func (s *Service) VerifyConfiguration(from, to config.Configuration) error {
+	for _, hook := range to.Webhooks {
+		if hook.URL == "" {
+			return fmt.Errorf("webhook %q lacks a URL", hook.ID)
+		}
+		if _, err := eventMask(hook.Events); err != nil {
+			return fmt.Errorf("webhook %q: %v", hook.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Service) CommitConfiguration(from, to config.Configuration) bool {
+	s.setHooks(to.Webhooks)
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// setHooks replaces the set of webhooks. Unchanged webhooks keep their
+// state, and changed ones keep their queue and the events not yet queued.
+// The queues of removed webhooks are discarded.
+func (s *Service) setHooks(cfgs []config.WebhookConfiguration) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	seen := make(map[string]bool, len(cfgs))
+	for _, cfg := range cfgs {
+		seen[cfg.ID] = true
+		old, ok := s.hooks[cfg.ID]
+		if ok {
+			if configEqual(old.cfg, cfg) {
+				continue
+			}
+			// The new hook shares the queue in the database, so the old
+			// sender must be gone before the new one starts using it.
+			old.stopSender()
+		}
+
+		h, err := newHook(cfg, newQueue(s.db, cfg.ID))
+		if err != nil {
+			l.Warnf("Webhook %q: %v", cfg.ID, err)
+			delete(s.hooks, cfg.ID)
+			continue
+		}
+		if ok {
+			h.batch = old.batch
+			h.delayed = old.delayed
+		}
+		s.hooks[cfg.ID] = h
+		if s.running {
+			h.startSender(s.client)
+		}
+	}
+
+	for id, h := range s.hooks {
+		if !seen[id] {
+			h.stopSender()
+			h.queue.reset()
+			delete(s.hooks, id)
+		}
+	}
+}
+
+// mask returns the events we need to subscribe to for the current webhooks.
+func (s *Service) mask() events.EventType {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var mask events.EventType
+	for _, h := range s.hooks {
+		mask |= h.mask
+		if h.cfg.DisconnectedDelayS > 0 {
+			// Needed to cancel delayed disconnect events
+			mask |= events.DeviceConnected
+		}
+	}
+	return mask
+}
+
+// A hook is the runtime state of a configured webhook.
+type hook struct {
+	cfg     config.WebhookConfiguration
+	mask    events.EventType
+	folders map[string]bool
+	devices map[string]bool
+	queue   *queue
+
+	batch   []events.Event
+	delayed []delayedEvent
+
+	kick       chan struct{}
+	senderStop chan struct{}
+	senderDone chan struct{}
+}
+
+type delayedEvent struct {
+	event  events.Event
+	device string
+	due    time.Time
+}
+
+func newHook(cfg config.WebhookConfiguration, q *queue) (*hook, error) {
+	mask, err := eventMask(cfg.Events)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &hook{
+		cfg:   cfg,
+		mask:  mask,
+		queue: q,
+		kick:  make(chan struct{}, 1),
+	}
+	if len(cfg.Folders) > 0 {
+		h.folders = make(map[string]bool, len(cfg.Folders))
+		for _, folder := range cfg.Folders {
+			h.folders[folder] = true
+		}
+	}
+	if len(cfg.Devices) > 0 {
+		h.devices = make(map[string]bool, len(cfg.Devices))
+		for _, dev := range cfg.Devices {
+			h.devices[dev.String()] = true
+		}
+	}
+	return h, nil
+}
+
+// handle adds the event to the current batch, if it's selected.
+func (h *hook) handle(ev events.Event, data dataMap) {
+	device := data.device()
+
+	if ev.Type == events.DeviceConnected && h.cfg.DisconnectedDelayS > 0 {
+		// The device came back before the delay; forget the disconnect.
+		delayed := h.delayed[:0]
+		for _, d := range h.delayed {
+			if d.device != device {
+				delayed = append(delayed, d)
+			}
+		}
+		h.delayed = delayed
+	}
+
+	if ev.Type&h.mask == 0 {
+		return
+	}
+	if h.folders != nil {
+		if folder, ok := data["folder"].(string); ok && !h.folders[folder] {
+			return
+		}
+	}
+	if h.devices != nil && device != "" && !h.devices[device] {
+		return
+	}
+	if ev.Type == events.FolderCompletion && h.cfg.CompletedOnly {
+		if completion, ok := data["completion"].(float64); !ok || completion < 100 {
+			return
+		}
+	}
+
+	if ev.Type == events.DeviceDisconnected && h.cfg.DisconnectedDelayS > 0 {
+		h.delayed = append(h.delayed, delayedEvent{
+			event:  ev,
+			device: device,
+			due:    ev.Time.Add(time.Duration(h.cfg.DisconnectedDelayS) * time.Second),
+		})
+		return
+	}
+
+	h.batch = append(h.batch, ev)
+	if len(h.batch) >= maxBatchEvents {
+		h.flush(time.Now())
+	}
+}
+
+// flush moves any delayed events that are due into the batch, and queues
+// the batch for delivery.
+func (h *hook) flush(now time.Time) {
+	delayed := h.delayed[:0]
+	for _, d := range h.delayed {
+		if now.After(d.due) {
+			h.batch = append(h.batch, d.event)
+		} else {
+			delayed = append(delayed, d)
+		}
+	}
+	h.delayed = delayed
+
+	if len(h.batch) == 0 {
+		return
+	}
+
+	bs, err := marshalBatch(h.batch)
+	h.batch = nil
+	if err != nil {
+		l.Warnf("Webhook %q: %v", h.cfg.ID, err)
+		return
+	}
+	h.queue.push(bs)
+
+	select {
+	case h.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (h *hook) startSender(client *http.Client) {
+	h.senderStop = make(chan struct{})
+	h.senderDone = make(chan struct{})
+	go h.sender(client, h.senderStop, h.senderDone)
+}
+
+// stopSender stops the sender and waits for it to exit. A delivery in
+// progress is cancelled.
+func (h *hook) stopSender() {
+	if h.senderStop != nil {
+		close(h.senderStop)
+		<-h.senderDone
+		h.senderStop = nil
+		h.senderDone = nil
+	}
+}
+
+// sender delivers the queued batches in order, retrying failed deliveries
+// with exponential backoff.
+func (h *hook) sender(client *http.Client, stop, done chan struct{}) {
+	defer close(done)
+
+	delay := minRetryDelay
+	for {
+		bs, ok := h.queue.peek()
+		if !ok {
+			select {
+			case <-h.kick:
+				continue
+			case <-stop:
+				return
+			}
+		}
+
+		if err := h.post(client, bs, stop); err != nil {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			l.Infof("Webhook %q: delivery failed, retrying in %v: %v", h.cfg.ID, delay, err)
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			continue
+		}
+
+		l.Debugf("Webhook %q: delivered batch of %d bytes", h.cfg.ID, len(bs))
+		h.queue.pop()
+		delay = minRetryDelay
+	}
+}
+
+// post delivers the body to the webhook URL. The request is cancelled when
+// the cancel channel, if any, is closed.
+func (h *hook) post(client *http.Client, body []byte, cancel <-chan struct{}) error {
+	req, err := http.NewRequest("POST", h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Cancel = cancel
+	req.Header.Set("Content-Type", "application/json")
+	if h.cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Signature([]byte(h.cfg.Secret), body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// Signature returns the hex encoded HMAC-SHA256 of the body, as sent in the
+// SignatureHeader.
+func Signature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func marshalBatch(evs []events.Event) ([]byte, error) {
+	return json.Marshal(map[string][]events.Event{
+		"events": evs,
+	})
+}
+
+// eventMask returns the mask for the given event type names.
+func eventMask(names []string) (events.EventType, error) {
+	var mask events.EventType
+	for _, name := range names {
+		t := events.UnmarshalEventType(name)
+		if t == 0 {
+			return 0, fmt.Errorf("unknown event type %q", name)
+		}
+		mask |= t
+	}
+	return mask, nil
+}
+
+type dataMap map[string]interface{}
+
+// eventData returns the event data in generic form, for filtering.
+func eventData(ev events.Event) dataMap {
+	var data dataMap
+	if bs, err := json.Marshal(ev.Data); err == nil {
+		json.Unmarshal(bs, &data)
+	}
+	return data
+}
+
+// device returns the device the event concerns, if any. Device events call
+// it "id".
+func (d dataMap) device() string {
+	if dev, ok := d["device"].(string); ok {
+		return dev
+	}
+	if dev, ok := d["id"].(string); ok {
+		return dev
+	}
+	return ""
+}
+
+func configEqual(a, b config.WebhookConfiguration) bool {
+	as, _ := json.Marshal(a)
+	bs, _ := json.Marshal(b)
+	return bytes.Equal(as, bs)
+}
@@ -0,0 +1,233 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/events"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+func testHook(t *testing.T, cfg config.WebhookConfiguration) *hook {
+	h, err := newHook(cfg, newQueue(db.OpenMemory(), cfg.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func handle(h *hook, t events.EventType, data interface{}) {
+	ev := events.Event{Time: time.Now(), Type: t, Data: data}
+	h.handle(ev, eventData(ev))
+}
+
+func TestHookFilters(t *testing.T) {
+	h := testHook(t, config.WebhookConfiguration{
+		ID:            "test",
+		Events:        []string{"FolderCompletion", "FolderErrors"},
+		Folders:       []string{"default"},
+		CompletedOnly: true,
+	})
+
+	handle(h, events.FolderErrors, map[string]interface{}{"folder": "default"})
+	handle(h, events.FolderErrors, map[string]interface{}{"folder": "other"})
+	handle(h, events.StateChanged, map[string]interface{}{"folder": "default"})
+	handle(h, events.FolderCompletion, map[string]interface{}{"folder": "default", "completion": 50.0})
+	handle(h, events.FolderCompletion, map[string]interface{}{"folder": "default", "completion": 100.0})
+
+	if len(h.batch) != 2 {
+		t.Fatalf("Incorrect batch length %d != 2", len(h.batch))
+	}
+	if h.batch[0].Type != events.FolderErrors || h.batch[1].Type != events.FolderCompletion {
+		t.Errorf("Unexpected batch %v", h.batch)
+	}
+}
+
+func TestDeviceFilter(t *testing.T) {
+	h := testHook(t, config.WebhookConfiguration{
+		ID:      "test",
+		Events:  []string{"DeviceConnected"},
+		Devices: []protocol.DeviceID{protocol.LocalDeviceID},
+	})
+
+	handle(h, events.DeviceConnected, map[string]string{"id": protocol.LocalDeviceID.String()})
+	handle(h, events.DeviceConnected, map[string]string{"id": "other"})
+
+	if len(h.batch) != 1 {
+		t.Fatalf("Incorrect batch length %d != 1", len(h.batch))
+	}
+}
+
+func TestDisconnectedDelay(t *testing.T) {
+	h := testHook(t, config.WebhookConfiguration{
+		ID:                 "test",
+		Events:             []string{"DeviceDisconnected"},
+		DisconnectedDelayS: 60,
+	})
+
+	// One device reconnects within the delay, the other does not.
+	handle(h, events.DeviceDisconnected, map[string]string{"id": "a"})
+	handle(h, events.DeviceDisconnected, map[string]string{"id": "b"})
+	handle(h, events.DeviceConnected, map[string]string{"id": "a"})
+
+	h.flush(time.Now())
+	if h.queue.len() != 0 {
+		t.Fatal("Nothing should be sent before the delay")
+	}
+
+	h.flush(time.Now().Add(2 * time.Minute))
+	bs, ok := h.queue.peek()
+	if !ok {
+		t.Fatal("Expected a queued batch after the delay")
+	}
+	var batch struct {
+		Events []struct {
+			Data map[string]string
+		}
+	}
+	if err := json.Unmarshal(bs, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Events) != 1 || batch.Events[0].Data["id"] != "b" {
+		t.Errorf("Unexpected batch %s", bs)
+	}
+}
+
+func TestQueuePersistence(t *testing.T) {
+	ldb := db.OpenMemory()
+	q := newQueue(ldb, "test")
+	q.push([]byte("one"))
+	q.push([]byte("two"))
+	q.pop()
+
+	q = newQueue(ldb, "test")
+	if q.len() != 1 {
+		t.Fatalf("Incorrect queue length %d != 1", q.len())
+	}
+	if bs, ok := q.peek(); !ok || string(bs) != "two" {
+		t.Errorf("Incorrect queue head %q", bs)
+	}
+
+	// Queues for other webhooks are separate.
+	if n := newQueue(ldb, "test2").len(); n != 0 {
+		t.Errorf("Unexpected queue length %d for other webhook", n)
+	}
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	secret := "s3cr3t"
+	received := make(chan []byte, 1)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			// Fail the first attempt
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		bs, _ := ioutil.ReadAll(r.Body)
+		if sig := r.Header.Get(SignatureHeader); sig != "sha256="+Signature([]byte(secret), bs) {
+			t.Errorf("Incorrect signature %q", sig)
+		}
+		received <- bs
+	}))
+	defer srv.Close()
+
+	h := testHook(t, config.WebhookConfiguration{
+		ID:     "test",
+		URL:    srv.URL,
+		Events: []string{"Ping"},
+		Secret: secret,
+	})
+	handle(h, events.Ping, nil)
+	h.flush(time.Now())
+
+	h.startSender(http.DefaultClient)
+	defer h.stopSender()
+
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Batch was not delivered")
+	}
+	if attempts != 2 {
+		t.Errorf("Incorrect number of attempts %d != 2", attempts)
+	}
+
+	// The delivered batch is removed from the queue.
+	for i := 0; i < 100 && h.queue.len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := h.queue.len(); n != 0 {
+		t.Errorf("Incorrect queue length %d after delivery", n)
+	}
+}
+
+func TestChangedHook(t *testing.T) {
+	requests := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		// Hang until the test is done.
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	cfg := config.WebhookConfiguration{
+		ID:     "test",
+		URL:    srv.URL,
+		Events: []string{"Ping"},
+	}
+	s := NewService(config.Wrap("/tmp/test", config.Configuration{
+		Webhooks: []config.WebhookConfiguration{cfg},
+	}), db.OpenMemory())
+
+	s.mut.Lock()
+	h := s.hooks["test"]
+	handle(h, events.Ping, nil)
+	h.flush(time.Now())
+	handle(h, events.Ping, nil)
+	h.startSender(http.DefaultClient)
+	s.running = true
+	s.mut.Unlock()
+
+	select {
+	case <-requests:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Batch was not posted")
+	}
+
+	// Changing the webhook waits for the delivery in progress to be
+	// cancelled, keeps the queued batch and the event not yet queued.
+
+	cfg.Secret = "changed"
+	s.setHooks([]config.WebhookConfiguration{cfg})
+
+	s.mut.Lock()
+	h2 := s.hooks["test"]
+	h2.stopSender()
+	s.mut.Unlock()
+
+	if h2 == h {
+		t.Fatal("The changed webhook should have been replaced")
+	}
+	if n := h2.queue.len(); n != 1 {
+		t.Errorf("Incorrect queue length %d != 1", n)
+	}
+	if len(h2.batch) != 1 {
+		t.Errorf("Incorrect batch length %d != 1", len(h2.batch))
+	}
+}